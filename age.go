@@ -0,0 +1,77 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"time"
+)
+
+// WarnGenerationAge warns when the log hasn't rotated for longer than max, which happens to
+// idle logs whose size never reaches the limit and leaves their replay depending on ever
+// older files. Unlike WithRotationInterval the age is checked by a timer, so it applies to
+// logs that output nothing: once the current generation is older than max a warning is
+// logged and HealthCheck returns an error until the log rotates, and with force a rotation
+// is started as well, which replaces the old files with a fresh snapshot. Stats reports the
+// age of the current generation as GenerationAge, in seconds. A zero max, the default,
+// disables the check.
+func WarnGenerationAge(max time.Duration, force bool) LogOption {
+	return runtimeOption(func(pl *pLog) { pl.maxAge, pl.forceAge = max, force })
+}
+
+// ageError returns the error of a generation older than its maximum age, nil if it isn't,
+// must be called while holding the lock
+func (pl *pLog) ageError() error {
+	age := pl.now().Sub(pl.genStart)
+	if pl.maxAge <= 0 || !pl.opened || age < pl.maxAge {
+		return nil
+	}
+	return fmt.Errorf("log generation %d is %s old, it has not rotated for more than %s",
+		pl.gen, age, pl.maxAge)
+}
+
+// armAgeCheck starts the timer that checks the age of the current generation, see
+// WarnGenerationAge, must be called while holding the lock or before NewLog returns
+func (pl *pLog) armAgeCheck() {
+	if pl.ageTimer != nil {
+		pl.ageTimer.Stop()
+		pl.ageTimer = nil
+	}
+	if pl.maxAge <= 0 || !pl.opened {
+		return
+	}
+	wait := pl.maxAge - pl.now().Sub(pl.genStart)
+	if wait < 0 {
+		wait = 0
+	}
+	pl.startAgeTimer(wait)
+}
+
+// startAgeTimer starts the timer of an age check, a check that runs after the timer was
+// stopped or replaced does nothing, must be called while holding the lock
+func (pl *pLog) startAgeTimer(wait time.Duration) {
+	pl.ageChecks++
+	n := pl.ageChecks
+	pl.ageTimer = time.AfterFunc(wait, func() { pl.checkAge(n) })
+}
+
+// checkAge warns about the current generation once it's older than its maximum age and
+// forces a rotation if requested, it checks again one maximum age later in case the log
+// still doesn't rotate
+func (pl *pLog) checkAge(n uint64) {
+	pl.Lock()
+	defer pl.Unlock()
+	if pl.ageTimer == nil || pl.ageChecks != n || pl.errState != nil {
+		return // re-armed by a rotation, or closed
+	}
+	err := pl.ageError()
+	if err == nil {
+		pl.armAgeCheck()
+		return
+	}
+	pl.log.Warn("Log has not rotated", "gen", pl.gen, "max_age", pl.maxAge, "err", err)
+	if pl.forceAge && pl.priCaps.CanRotate {
+		pl.rotate()
+	}
+	pl.startAgeTimer(pl.maxAge)
+}
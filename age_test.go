@@ -0,0 +1,65 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("Generation age", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	open := func(rc *recordingClient, opts ...LogOption) Log {
+		fd, err := NewFileDest(PT+"/age", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, rc, log15.Root(), opts...)
+		Ω(err).ShouldNot(HaveOccurred())
+		return pl
+	}
+
+	It("warns about an idle log that doesn't rotate", func() {
+		pl := open(&recordingClient{}, WarnGenerationAge(50*time.Millisecond, false))
+		defer pl.(*pLog).Close()
+		Ω(pl.HealthCheck()).ShouldNot(HaveOccurred())
+
+		Eventually(pl.HealthCheck).Should(MatchError(ContainSubstring("has not rotated")))
+		Ω(pl.Stats()["Generation"]).Should(Equal(1.0))
+		Ω(pl.Stats()["GenerationAge"]).Should(BeNumerically(">=", 0.05))
+	})
+
+	It("forces a rotation", func() {
+		rc := &recordingClient{events: []interface{}{&logEv1{S: "a"}, &logEv2{A: 1}}}
+		pl := open(rc, WarnGenerationAge(50*time.Millisecond, true))
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).
+			Should(BeNumerically(">=", 2))
+		pl.(*pLog).Close()
+
+		rc2 := &recordingClient{}
+		pl = open(rc2)
+		pl.(*pLog).Close()
+		Ω(rc2.events).Should(Equal(rc.events))
+	})
+
+	It("checks the age set by Reconfigure", func() {
+		t := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+		pl := open(&recordingClient{}, WithClock(func() time.Time { return t }))
+		defer pl.(*pLog).Close()
+		t = t.Add(2 * time.Hour)
+		Ω(pl.HealthCheck()).ShouldNot(HaveOccurred())
+
+		Ω(Reconfigure(pl, WarnGenerationAge(time.Hour, false))).ShouldNot(HaveOccurred())
+		Ω(pl.HealthCheck()).Should(MatchError(ContainSubstring("more than 1h0m0s")))
+		Ω(Reconfigure(pl, WarnGenerationAge(0, false))).ShouldNot(HaveOccurred())
+		Ω(pl.HealthCheck()).ShouldNot(HaveOccurred())
+	})
+})
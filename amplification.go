@@ -0,0 +1,49 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+// amplification counts the bytes persist writes to all destinations, including snapshots,
+// metadata, and secondary mirrors, and the bytes of the events the application outputs,
+// whose ratio is the write amplification
+type amplification struct {
+	written uint64 // bytes written to all destinations
+	events  uint64 // encoded bytes of the events output by the application
+}
+
+func (a amplification) ratio() float64 {
+	if a.events == 0 {
+		return 0
+	}
+	return float64(a.written) / float64(a.events)
+}
+
+// ampCounters tracks the write amplification since the log was created and per generation
+type ampCounters struct {
+	total amplification
+	gen   amplification // current generation
+	last  amplification // previous generation, from its rotation to the current one
+}
+
+func (ac *ampCounters) wrote(n int) {
+	ac.total.written += uint64(n)
+	ac.gen.written += uint64(n)
+}
+
+func (ac *ampCounters) event(n int) {
+	ac.total.events += uint64(n)
+	ac.gen.events += uint64(n)
+}
+
+// rotated starts counting a new generation
+func (ac *ampCounters) rotated() {
+	ac.last, ac.gen = ac.gen, amplification{}
+}
+
+// stats adds the write amplification to a Stats map
+func (ac *ampCounters) stats(stats map[string]float64) {
+	stats["BytesWritten"] = float64(ac.total.written)
+	stats["EventBytes"] = float64(ac.total.events)
+	stats["WriteAmplification"] = ac.total.ratio()
+	stats["WriteAmplificationGeneration"] = ac.gen.ratio()
+	stats["WriteAmplificationLastGeneration"] = ac.last.ratio()
+}
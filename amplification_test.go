@@ -0,0 +1,65 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("Write amplification", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	It("counts the bytes of each generation", func() {
+		var ac ampCounters
+		ac.wrote(300)
+		ac.event(100)
+		Ω(ac.gen.ratio()).Should(Equal(3.0))
+		ac.rotated()
+		ac.wrote(50)
+		ac.event(50)
+		stats := make(map[string]float64)
+		ac.stats(stats)
+		Ω(stats).Should(Equal(map[string]float64{"BytesWritten": 350, "EventBytes": 150,
+			"WriteAmplification": 350.0 / 150, "WriteAmplificationGeneration": 1,
+			"WriteAmplificationLastGeneration": 3}))
+	})
+
+	It("includes snapshots and secondary mirrors", func() {
+		fd, err := NewFileDest(PT+"/amp", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{events: []interface{}{&logEv1{S: "snapshot"}}}
+		pl, err := NewLog(fd, rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()["EventBytes"]).Should(BeZero())
+		Ω(pl.Stats()["BytesWritten"]).Should(BeNumerically(">", 0))
+
+		Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		primary := pl.Stats()
+		Ω(primary["EventBytes"]).Should(BeNumerically(">", 0))
+		Ω(primary["WriteAmplification"]).Should(BeNumerically(">", 1))
+
+		By("mirroring to a secondary")
+		sd, err := NewFileDest(PT+"/amp2", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.SetSecondaryDestination(sd)).ShouldNot(HaveOccurred())
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(2.0))
+		pl.(*pLog).Close()
+		pl.(*pLog).Lock()
+		defer pl.(*pLog).Unlock()
+		Ω(pl.(*pLog).amp.last.events).Should(Equal(uint64(primary["EventBytes"])))
+		Ω(pl.(*pLog).amp.gen.events).Should(BeZero())
+		// the secondary receives the same bytes as the primary
+		size := uint64(pl.(*pLog).size + pl.(*pLog).sizeReplay)
+		Ω(size).Should(BeNumerically(">", 0))
+		Ω(pl.(*pLog).amp.gen.written).Should(Equal(2 * size))
+	})
+})
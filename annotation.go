@@ -0,0 +1,69 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import "fmt"
+
+// maxAnnotationSize is the maximum total size of the keys and values of an event's
+// annotations, see Annotate
+const maxAnnotationSize = 1024
+
+// Annotate outputs an event along with annotations, small string key/value pairs such as
+// the subsystem the event originates from, which tooling can filter on, see the -ann option
+// of plog grep, without changing the event's type. The annotations are stored in the
+// event's envelope, see NamespacedEvent, and a namespaced event keeps its namespace. Their
+// keys and values may total at most 1KB. Replay drops the annotations unless the log is
+// opened with ReplayAnnotations. Like Output, it may be called from PersistAll. Older
+// versions of persist cannot replay logs that contain annotated events.
+func Annotate(log Log, annotations map[string]string, logEvent interface{}) error {
+	size := 0
+	for k, v := range annotations {
+		size += len(k) + len(v)
+	}
+	if size > maxAnnotationSize {
+		return fmt.Errorf("annotations of %T total %d bytes, the maximum is %d", logEvent,
+			size, maxAnnotationSize)
+	}
+	if len(annotations) == 0 {
+		return log.Output(logEvent)
+	}
+	ne := &NamespacedEvent{Event: logEvent}
+	if inner, ok := logEvent.(*NamespacedEvent); ok {
+		ne.NS, ne.Event = inner.NS, inner.Event
+	}
+	ne.Annotations = annotations
+	return log.Output(ne)
+}
+
+// Annotations returns the annotations of a replayed event, nil if it has none, see
+// Annotate
+func Annotations(logEvent interface{}) map[string]string {
+	if ne, ok := logEvent.(*NamespacedEvent); ok {
+		return ne.Annotations
+	}
+	return nil
+}
+
+// ReplayAnnotations makes the log replay the annotations of the events, see Annotate. The
+// client then receives each annotated event in its envelope, a NamespacedEvent, and
+// unwraps it using Namespace.
+func ReplayAnnotations() LogOption {
+	return func(pl *pLog) { pl.replayAnn = true }
+}
+
+// annotationDecoder drops the annotations of the events replayed, unwrapping the events
+// whose envelope only holds annotations
+type annotationDecoder struct {
+	Decoder
+}
+
+func (ad annotationDecoder) Decode() (interface{}, error) {
+	ev, err := ad.Decoder.Decode()
+	if ne, ok := ev.(*NamespacedEvent); ok && err == nil && ne.Annotations != nil {
+		if ne.NS == "" {
+			return ne.Event, nil
+		}
+		return &NamespacedEvent{NS: ne.NS, Event: ne.Event}, nil
+	}
+	return ev, err
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("Annotations", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	billing := map[string]string{"subsystem": "billing"}
+
+	// reopen replays the log at basepath using the options
+	reopen := func(opts ...LogOption) []interface{} {
+		fd, err := NewFileDest(PT+"/ann", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{}
+		pl, err := NewLog(fd, rc, log15.Root(), opts...)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+		return rc.events
+	}
+
+	It("stores annotations that replay drops unless requested", func() {
+		fd, err := NewFileDest(PT+"/ann", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(Annotate(pl, billing, &logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		Ω(Annotate(pl, billing, &NamespacedEvent{NS: "t1", Event: &logEv2{A: 1}})).
+			ShouldNot(HaveOccurred())
+		Ω(Annotate(pl, nil, &logEv1{S: "b"})).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		events := reopen(ReplayAnnotations())
+		Ω(events).Should(Equal([]interface{}{
+			&NamespacedEvent{Event: &logEv1{S: "a"}, Annotations: billing},
+			&NamespacedEvent{NS: "t1", Event: &logEv2{A: 1}, Annotations: billing},
+			&logEv1{S: "b"}}))
+		Ω(Annotations(events[1])).Should(Equal(billing))
+		Ω(Annotations(events[2])).Should(BeNil())
+
+		// the snapshot written by the first reopen keeps the annotations
+		Ω(reopen()).Should(Equal([]interface{}{&logEv1{S: "a"},
+			&NamespacedEvent{NS: "t1", Event: &logEv2{A: 1}}, &logEv1{S: "b"}}))
+	})
+
+	It("stores annotations in the header of logs using a type registry", func() {
+		reg := NewTypeRegistry()
+		Ω(reg.Register("ev1", &logEv1{})).ShouldNot(HaveOccurred())
+		var buf bytes.Buffer
+		pl, err := NewLog(NewWriterDest(&buf, nil), &recordingClient{}, log15.Root(),
+			WithTypeRegistry(reg))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(Annotate(pl, billing, &logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		rc := &recordingClient{}
+		_, err = ReplayFrom(&buf, GobCodecWithRegistry(reg), rc)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(Equal([]interface{}{
+			&NamespacedEvent{Event: &logEv1{S: "a"}, Annotations: billing}}))
+	})
+
+	It("limits the size of annotations", func() {
+		pl, err := NewLog(NewWriterDest(&bytes.Buffer{}, nil), &recordingClient{},
+			log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		big := map[string]string{"note": strings.Repeat("x", maxAnnotationSize)}
+		Ω(Annotate(pl, big, &logEv1{S: "a"})).Should(MatchError(ContainSubstring(
+			"the maximum is 1024")))
+	})
+})
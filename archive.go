@@ -0,0 +1,224 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// archiveManifest is the name of the manifest in an archive bundle
+const archiveManifest = "manifest.json"
+
+// ArchiveManifest describes the content of an archive bundle, it's the last entry of the
+// bundle so the files can be streamed without reading them twice
+type ArchiveManifest struct {
+	Basename string        // base name of the archived log set, e.g., "mylog"
+	Created  time.Time     // time the archive was created
+	Files    []ArchiveFile // log files in the archive, in LogFiles order
+}
+
+// ArchiveFile describes one log file in an archive bundle
+type ArchiveFile struct {
+	Name   string // base name of the log file
+	Size   int64
+	SHA256 string // hex-encoded checksum of the content
+}
+
+// Archive writes all the log files of the log set at basepath to out as a single bundle: a
+// gzip-compressed tar file holding the log files followed by a manifest with their sizes
+// and checksums, see Unarchive. The application should not have the log set open, else the
+// bundle may end in the middle of an event.
+func Archive(basepath string, out io.Writer) error {
+	files, err := LogFiles(basepath)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no log files found at %s", basepath)
+	}
+	zw := gzip.NewWriter(out)
+	tw := tar.NewWriter(zw)
+	man := ArchiveManifest{Basename: filepath.Base(basepath), Created: time.Now()}
+	for _, f := range files {
+		af, err := archiveFile(tw, f)
+		if err != nil {
+			return fmt.Errorf("cannot archive %s: %s", f, err.Error())
+		}
+		man.Files = append(man.Files, af)
+	}
+	buf, err := json.MarshalIndent(&man, "", "  ")
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: archiveManifest, Mode: 0660, Size: int64(len(buf)),
+		ModTime: man.Created}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(buf); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// archiveFile adds a log file to the tar stream and returns its manifest entry
+func archiveFile(tw *tar.Writer, name string) (ArchiveFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return ArchiveFile{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return ArchiveFile{}, err
+	}
+	af := ArchiveFile{Name: filepath.Base(name), Size: fi.Size()}
+	hdr := &tar.Header{Name: af.Name, Mode: 0660, Size: af.Size, ModTime: fi.ModTime()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return af, err
+	}
+	h := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(tw, h), f, af.Size); err != nil {
+		return af, err
+	}
+	af.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return af, nil
+}
+
+// Unarchive restores a bundle produced by Archive as the log set at basepath, which may
+// differ from the archived one, and returns the names of the restored log files. Each
+// file is extracted to a temporary name and the files are only renamed to their final
+// names once the manifest has been read and all the checksums match, thus either the
+// whole log set appears or nothing does. No log set may exist at basepath.
+func Unarchive(r io.Reader, basepath string) ([]string, error) {
+	if existing, err := LogFiles(basepath); err != nil {
+		return nil, err
+	} else if len(existing) > 0 {
+		return nil, fmt.Errorf("log files already exist at %s", basepath)
+	}
+	if err := os.MkdirAll(filepath.Dir(basepath), 0777); err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not an archive bundle: %s", err.Error())
+	}
+
+	// extract the log files to temporary names
+	sums := map[string]string{} // checksum of each extracted file by name
+	var temps []string
+	cleanup := func() {
+		for _, t := range temps {
+			os.Remove(t)
+		}
+	}
+	var man *ArchiveManifest
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("cannot read archive bundle: %s", err.Error())
+		}
+		if hdr.Name == archiveManifest {
+			man = &ArchiveManifest{}
+			if err := json.NewDecoder(tr).Decode(man); err != nil {
+				cleanup()
+				return nil, fmt.Errorf("invalid manifest: %s", err.Error())
+			}
+			continue
+		}
+		if !strings.HasSuffix(hdr.Name, ".plog") || filepath.Base(hdr.Name) != hdr.Name {
+			cleanup()
+			return nil, fmt.Errorf("unexpected file %q in archive bundle", hdr.Name)
+		}
+		temp := filepath.Join(filepath.Dir(basepath), hdr.Name+".tmp")
+		temps = append(temps, temp)
+		sum, err := extractFile(tr, temp)
+		if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("cannot extract %s: %s", hdr.Name, err.Error())
+		}
+		sums[hdr.Name] = sum
+	}
+	if err := checkManifest(man, sums); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	// switch over to the final names, this is where the log set appears
+	var finals []string
+	for _, af := range man.Files {
+		temp := filepath.Join(filepath.Dir(basepath), af.Name+".tmp")
+		final := basepath + strings.TrimPrefix(af.Name, man.Basename)
+		if err := os.Rename(temp, final); err != nil {
+			for _, f := range finals {
+				os.Remove(f)
+			}
+			cleanup()
+			return nil, err
+		}
+		finals = append(finals, final)
+	}
+	syncDir(filepath.Dir(basepath))
+	return finals, nil
+}
+
+// extractFile writes the content of the current tar entry to a new file, syncs it to disk
+// and returns its hex-encoded checksum
+func extractFile(r io.Reader, name string) (string, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return hex.EncodeToString(h.Sum(nil)), err
+}
+
+// checkManifest verifies that the files extracted from a bundle are exactly the ones listed
+// in its manifest and have the recorded checksums
+func checkManifest(man *ArchiveManifest, sums map[string]string) error {
+	if man == nil {
+		return fmt.Errorf("archive bundle has no manifest, it may be truncated")
+	}
+	if len(man.Files) != len(sums) {
+		return fmt.Errorf("archive bundle holds %d log files, manifest lists %d",
+			len(sums), len(man.Files))
+	}
+	for _, af := range man.Files {
+		sum, ok := sums[af.Name]
+		if !ok {
+			return fmt.Errorf("%s is missing from the archive bundle", af.Name)
+		}
+		if !strings.HasPrefix(af.Name, man.Basename+"-") {
+			return fmt.Errorf("%s does not belong to log set %s", af.Name, man.Basename)
+		}
+		if sum != af.SHA256 {
+			return fmt.Errorf("%s: checksum mismatch, expected %s got %s", af.Name,
+				af.SHA256, sum)
+		}
+	}
+	return nil
+}
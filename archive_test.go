@@ -0,0 +1,87 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("Archive", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	// archive writes a log set with two generations and returns its bundle
+	archive := func() []byte {
+		fd, err := NewFileDest(PT+"/orig", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+		fd, err = NewFileDest(PT+"/orig", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err = NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "b"})).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		var buf bytes.Buffer
+		Ω(Archive(PT+"/orig", &buf)).ShouldNot(HaveOccurred())
+		return buf.Bytes()
+	}
+
+	It("restores a log set under a new name", func() {
+		bundle := archive()
+		orig, _ := LogFiles(PT + "/orig")
+		restored, err := Unarchive(bytes.NewReader(bundle), PT+"/restored/copy")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(restored).Should(HaveLen(len(orig)))
+		for i, f := range restored {
+			Ω(f).Should(Equal(PT + "/restored/copy" + strings.TrimPrefix(orig[i], PT+"/orig")))
+			sum, err := fileChecksum(orig[i])
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(fileChecksum(f)).Should(Equal(sum))
+		}
+
+		fd, err := NewFileDest(PT+"/restored/copy", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{}
+		pl, err := NewLog(fd, rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(Equal([]interface{}{&logEv1{S: "a"}, &logEv1{S: "b"}}))
+		pl.(*pLog).Close()
+	})
+
+	It("refuses to overwrite a log set", func() {
+		bundle := archive()
+		_, err := Unarchive(bytes.NewReader(bundle), PT+"/orig")
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("already exist"))
+	})
+
+	It("restores nothing from a truncated bundle", func() {
+		bundle := archive()
+		_, err := Unarchive(bytes.NewReader(bundle[:len(bundle)/2]), PT+"/copy")
+		Ω(err).Should(HaveOccurred())
+		files, _ := LogFiles(PT + "/copy")
+		Ω(files).Should(BeEmpty())
+		tmps, _ := filepath.Glob(PT + "/*.tmp")
+		Ω(tmps).Should(BeEmpty())
+	})
+
+	It("rejects an empty log set", func() {
+		var buf bytes.Buffer
+		Ω(Archive(PT+"/none", &buf)).Should(MatchError(ContainSubstring("no log files")))
+	})
+})
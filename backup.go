@@ -0,0 +1,194 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// An Uploader copies a complete log file to an off-host location. The name is the base
+// name of the log file (without directory) and the reader produces exactly size bytes.
+// Upload may be called repeatedly for the same file if a previous attempt failed.
+type Uploader interface {
+	Upload(name string, r io.Reader, size int64) error
+}
+
+// BackupTo causes the file destination to push a copy of each fresh -curr log file to the
+// uploader every time a rotation completes, i.e., each time there is a new complete snapshot.
+// Uploads happen in the background and failed uploads are retried with exponential backoff
+// until they succeed or are superseded by the upload of a more recent snapshot.
+func BackupTo(u Uploader) FileDestOption {
+	return func(fd *fileDest) { fd.backup = newBackupPusher(u, fd.log) }
+}
+
+// backupJob is a snapshot waiting to be uploaded
+type backupJob struct {
+	name string   // base name of the log file
+	file *os.File // private read handle, the log file may be renamed while we upload
+	size int64    // size of the log file when the snapshot completed
+}
+
+// backupPusher uploads backup jobs one at a time in a background goroutine, a new job
+// replaces any job that is still pending or being retried
+type backupPusher struct {
+	uploader   Uploader
+	jobs       chan *backupJob
+	done       chan struct{}
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	log        log15.Logger
+}
+
+func newBackupPusher(u Uploader, log log15.Logger) *backupPusher {
+	bp := &backupPusher{
+		uploader:   u,
+		jobs:       make(chan *backupJob, 1),
+		done:       make(chan struct{}),
+		minBackoff: time.Second,
+		maxBackoff: time.Minute,
+		log:        log,
+	}
+	go bp.run()
+	return bp
+}
+
+// push queues the first size bytes of the named file for upload, replacing any queued job
+func (bp *backupPusher) push(filename string, size int64) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("cannot open %s for backup: %s", filename, err.Error())
+	}
+	job := &backupJob{name: filepath.Base(filename), file: f, size: size}
+	for {
+		select {
+		case bp.jobs <- job:
+			return nil
+		case old := <-bp.jobs:
+			bp.log.Info("Backup superseded before upload", "file", old.name)
+			old.file.Close()
+		}
+	}
+}
+
+// close stops the background goroutine, pending uploads are abandoned
+func (bp *backupPusher) close() {
+	close(bp.done)
+}
+
+func (bp *backupPusher) run() {
+	var job *backupJob
+	var retry <-chan time.Time
+	var backoff time.Duration
+	for {
+		select {
+		case <-bp.done:
+			if job != nil {
+				job.file.Close()
+			}
+			return
+		case j := <-bp.jobs:
+			if job != nil {
+				bp.log.Info("Backup superseded while retrying", "file", job.name)
+				job.file.Close()
+			}
+			job = j
+			backoff = bp.minBackoff
+		case <-retry:
+		}
+		retry = nil
+		if job == nil {
+			continue
+		}
+
+		err := bp.uploader.Upload(job.name, io.NewSectionReader(job.file, 0, job.size),
+			job.size)
+		if err == nil {
+			bp.log.Info("Backup uploaded", "file", job.name, "size", job.size)
+			job.file.Close()
+			job = nil
+			continue
+		}
+		bp.log.Warn("Backup upload failed, will retry", "file", job.name,
+			"retry_in", backoff, "err", err)
+		retry = time.After(backoff)
+		backoff *= 2
+		if backoff > bp.maxBackoff {
+			backoff = bp.maxBackoff
+		}
+	}
+}
+
+//===== HTTP uploader
+
+type httpUploader struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTPUploader returns an uploader that performs an HTTP PUT of each log file to
+// baseURL + "/" + name. A nil client uses http.DefaultClient.
+func NewHTTPUploader(baseURL string, client *http.Client) Uploader {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &httpUploader{baseURL: strings.TrimSuffix(baseURL, "/"), client: client}
+}
+
+func (hu *httpUploader) Upload(name string, r io.Reader, size int64) error {
+	req, err := http.NewRequest("PUT", hu.baseURL+"/"+name, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := hu.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("PUT %s: %s", req.URL, resp.Status)
+	}
+	return nil
+}
+
+//===== Command uploader
+
+type cmdUploader struct {
+	name string
+	args []string
+}
+
+// NewCommandUploader returns an uploader that runs an external command for each log file
+// and feeds the file contents to its stdin. Any occurrence of "{name}" in the arguments is
+// replaced by the log file's base name. This is the simplest way to push backups over SSH,
+// e.g. NewCommandUploader("ssh", "backup@host", "cat > /backups/{name}").
+func NewCommandUploader(name string, args ...string) Uploader {
+	return &cmdUploader{name: name, args: args}
+}
+
+func (cu *cmdUploader) Upload(name string, r io.Reader, size int64) error {
+	args := make([]string, len(cu.args))
+	for i, a := range cu.args {
+		args[i] = strings.Replace(a, "{name}", name, -1)
+	}
+	cmd := exec.Command(cu.name, args...)
+	cmd.Stdin = r
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s: %s", cu.name, err.Error(),
+			strings.TrimSpace(out.String()))
+	}
+	return nil
+}
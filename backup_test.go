@@ -0,0 +1,95 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// uploader used for testing, fails the first failures uploads
+type testUploader struct {
+	failures int
+	uploads  chan string // name:content of each successful upload
+}
+
+func (tu *testUploader) Upload(name string, r io.Reader, size int64) error {
+	if tu.failures > 0 {
+		tu.failures--
+		return fmt.Errorf("simulated failure")
+	}
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(buf)) != size {
+		return fmt.Errorf("size mismatch: got %d expected %d", len(buf), size)
+	}
+	tu.uploads <- name + ":" + string(buf)
+	return nil
+}
+
+var _ = Describe("BackupTo", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	It("uploads the snapshot at the end of each rotation", func() {
+		tu := &testUploader{uploads: make(chan string, 10)}
+		fd, err := NewFileDest(PT+"/backup", true, nil, BackupTo(tu))
+		Ω(err).ShouldNot(HaveOccurred())
+		defer fd.Close()
+
+		fd.Write([]byte("snapshot 1"))
+		Ω(fd.EndRotate()).ShouldNot(HaveOccurred())
+		fd.Write([]byte(" and more"))
+		var up string
+		Eventually(tu.uploads).Should(Receive(&up))
+		Ω(up).Should(HaveSuffix("-curr.plog:snapshot 1"))
+
+		Ω(fd.StartRotate()).ShouldNot(HaveOccurred())
+		fd.Write([]byte("snapshot 2"))
+		Ω(fd.EndRotate()).ShouldNot(HaveOccurred())
+		Eventually(tu.uploads).Should(Receive(&up))
+		Ω(up).Should(HaveSuffix("-curr.plog:snapshot 2"))
+	})
+
+	It("retries failed uploads", func() {
+		tu := &testUploader{failures: 2, uploads: make(chan string, 10)}
+		fd, err := NewFileDest(PT+"/backup", true, nil, BackupTo(tu))
+		Ω(err).ShouldNot(HaveOccurred())
+		defer fd.Close()
+		fd.(*fileDest).backup.minBackoff = time.Millisecond
+
+		fd.Write([]byte("snapshot"))
+		Ω(fd.EndRotate()).ShouldNot(HaveOccurred())
+		var up string
+		Eventually(tu.uploads).Should(Receive(&up))
+		Ω(up).Should(HaveSuffix("-curr.plog:snapshot"))
+	})
+
+	It("uploads using HTTP PUT", func() {
+		puts := make(chan string, 10)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			buf, _ := ioutil.ReadAll(r.Body)
+			puts <- r.Method + " " + r.URL.Path + " " + string(buf)
+		}))
+		defer srv.Close()
+
+		hu := NewHTTPUploader(srv.URL+"/backups/", nil)
+		Ω(hu.Upload("x-curr.plog", strings.NewReader("hello"), 5)).ShouldNot(HaveOccurred())
+		Ω(puts).Should(Receive(Equal("PUT /backups/x-curr.plog hello")))
+	})
+})
@@ -0,0 +1,233 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+// blobChunkSize is the size of the chunks a blob is written in
+const blobChunkSize = 64 * 1024
+
+// BlobStart starts a blob written to a snapshot by PersistBlob, it's followed by the blob's
+// BlobChunk records and a BlobEnd
+type BlobStart struct {
+	Name string
+}
+
+// BlobChunk holds the next bytes of a blob
+type BlobChunk struct {
+	Data []byte
+}
+
+// BlobEnd ends a blob, Err is set if the blob could not be read completely while written
+type BlobEnd struct {
+	Size int64  // number of bytes of the blob
+	Sum  uint32 // CRC-32C of the blob's bytes
+	Err  string
+}
+
+func init() {
+	Register(&BlobStart{})
+	Register(&BlobChunk{})
+	Register(&BlobEnd{})
+}
+
+// A BlobClient is a LogClient that replays the blobs written by PersistBlob
+type BlobClient interface {
+	LogClient
+	// ReplayBlob is called with the bytes of a blob, which r returns as they are decoded
+	// from the log, r returns an error if the blob is corrupt when it reaches its end
+	ReplayBlob(name string, r io.Reader) error
+}
+
+// PersistBlob streams a large opaque section of the snapshot, such as a serialized index,
+// from r into the log in chunks followed by a checksum, which avoids holding the whole blob
+// in memory as a single event. It must be called by PersistAll with the Log it received.
+// Replay passes the blob to the client's ReplayBlob in the order it was written relative
+// to the events, and fails if the client doesn't implement BlobClient. The other outputs
+// wait while the blob is written, so PersistAll must not call it while holding a lock that
+// the application needs to output events. Blobs are written in full by delta snapshots,
+// see WithDeltaSnapshots, hence the replay of a delta chain may pass several blobs of the
+// same name, the last one being the latest. If r fails the blob is recorded as incomplete
+// and PersistBlob returns the error, its reader returns the error at replay as well, and
+// the replay fails unless ReplayBlob returns nil regardless. Logs with blobs cannot be
+// replayed by versions of persist that predate them.
+func PersistBlob(log Log, name string, r io.Reader) error {
+	var pl *pLog
+	var snapshot, catchUp bool
+	switch l := log.(type) {
+	case snapshotLog:
+		pl, snapshot = l.pLog, true
+	case catchUpLog:
+		pl, catchUp = l.pLog, true
+	case *pLog:
+		if !l.opened {
+			pl = l // the initial snapshot written by NewLog
+		}
+	}
+	if pl == nil {
+		return fmt.Errorf("PersistBlob must be called by PersistAll with the Log it received")
+	}
+	pl.Lock()
+	err := pl.writeBlob(name, r, catchUp)
+	pl.Unlock()
+	if snapshot {
+		pl.throttleSnapshot()
+	}
+	return err
+}
+
+// writeBlob writes the records of a blob, to the secondary's stream only when catching it
+// up, must be called while holding the pl.Lock()
+func (pl *pLog) writeBlob(name string, r io.Reader, catchUp bool) error {
+	if err := pl.checkState(); err != nil {
+		return err
+	}
+	if catchUp && !pl.secSynced {
+		return nil // the secondary failed again, the next catch-up starts over
+	}
+	if err := pl.flushShards(); err != nil {
+		return err
+	}
+	if err := pl.useFormat(formatBlobs); err != nil {
+		return err
+	}
+	if err := pl.encodeBlob(&BlobStart{Name: name}, catchUp); err != nil {
+		return err
+	}
+	sum := crc32.New(blockCRC)
+	end := &BlobEnd{}
+	buf := make([]byte, blobChunkSize)
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			sum.Write(buf[:n])
+			end.Size += int64(n)
+			if err := pl.encodeBlob(&BlobChunk{Data: buf[:n]}, catchUp); err != nil {
+				return err
+			}
+			if !catchUp && pl.opened {
+				pl.snapBytes += n
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		} else if rerr != nil {
+			end.Err = rerr.Error()
+			if err := pl.encodeBlob(end, catchUp); err != nil {
+				return err
+			}
+			return fmt.Errorf("cannot read blob %q: %s", name, rerr.Error())
+		}
+	}
+	end.Sum = sum.Sum32()
+	return pl.encodeBlob(end, catchUp)
+}
+
+// encodeBlob encodes a record of a blob into the primary's stream, unless catching up the
+// secondary, and into the secondary's own stream, must be called while holding the
+// pl.Lock()
+func (pl *pLog) encodeBlob(rec interface{}, catchUp bool) error {
+	if !catchUp {
+		if err := pl.encoder.Encode(rec); err != nil {
+			return pl.fail("encode", err)
+		}
+	}
+	if pl.secEnc != nil && pl.secSynced {
+		if err := pl.secEnc.Encode(rec); err != nil {
+			pl.secondaryError("Write", err)
+		}
+	}
+	return nil
+}
+
+// replayBlob passes the blob that start begins to the client, then reads what the client
+// left of it so the checksum is verified and the replay continues after the blob
+func replayBlob(dec Decoder, client LogClient, start *BlobStart) (err error) {
+	br := &blobReader{dec: dec, name: start.Name, sum: crc32.New(blockCRC)}
+	bc, err := blobClient(client, start.Name)
+	if err != nil {
+		return err
+	}
+	perr := callSafely("ReplayBlob", func() { err = bc.ReplayBlob(start.Name, br) })
+	if perr != nil {
+		return perr
+	} else if err != nil {
+		return err
+	}
+	if _, err = io.Copy(ioutil.Discard, br); br.incomplete {
+		return nil // the client accepted the part that was written
+	}
+	return err
+}
+
+// blobClient returns the client as a BlobClient, or an error if it can't replay blobs
+func blobClient(client LogClient, name string) (BlobClient, error) {
+	bc, ok := client.(BlobClient)
+	if !ok {
+		return nil, fmt.Errorf("cannot replay blob %q, the client doesn't implement "+
+			"ReplayBlob", name)
+	}
+	return bc, nil
+}
+
+// blobReader reads the chunks of a blob from the decoder of a replayed stream
+type blobReader struct {
+	dec  Decoder
+	name string
+	sum  hash.Hash32
+	size int64
+	data []byte // rest of the current chunk
+	err  error  // returned once the data is read, io.EOF at the end of the blob
+	// incomplete is set if the blob could not be read completely when it was written
+	incomplete bool
+}
+
+func (br *blobReader) Read(p []byte) (int, error) {
+	for len(br.data) == 0 && br.err == nil {
+		br.next()
+	}
+	if len(br.data) == 0 {
+		return 0, br.err
+	}
+	n := copy(p, br.data)
+	br.data = br.data[n:]
+	return n, nil
+}
+
+// next decodes the next record of the blob
+func (br *blobReader) next() {
+	ev, err := br.dec.Decode()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		br.err = fmt.Errorf("cannot decode blob %q: %s", br.name, err.Error())
+		return
+	}
+	switch e := ev.(type) {
+	case *BlobChunk:
+		br.data = e.Data
+		br.sum.Write(e.Data)
+		br.size += int64(len(e.Data))
+	case *BlobEnd:
+		switch {
+		case e.Err != "":
+			br.incomplete = true
+			br.err = fmt.Errorf("blob %q was not written completely: %s", br.name, e.Err)
+		case e.Size != br.size || e.Sum != br.sum.Sum32():
+			br.err = fmt.Errorf("blob %q is corrupt: read %d bytes with checksum %08x, "+
+				"expected %d bytes with checksum %08x", br.name, br.size, br.sum.Sum32(),
+				e.Size, e.Sum)
+		default:
+			br.err = io.EOF
+		}
+	default:
+		br.err = fmt.Errorf("blob %q is interrupted by a %T record", br.name, ev)
+	}
+}
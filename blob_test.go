@@ -0,0 +1,132 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// blobTestClient persists its events followed by a blob and records the blobs it replays
+type blobTestClient struct {
+	recordingClient
+	blob    []byte
+	readErr error  // returned by the blob's reader after the blob, if set
+	after   int    // events replayed before the blob
+	replay  error  // error passed to ReplayBlob's reader
+	name    string // name of the blob replayed
+}
+
+func (bc *blobTestClient) PersistAll(pl Log) {
+	bc.recordingClient.PersistAll(pl)
+	if bc.blob == nil {
+		return
+	}
+	var r io.Reader = bytes.NewReader(bc.blob)
+	if bc.readErr != nil {
+		r = io.MultiReader(r, &failingReader{err: bc.readErr})
+		Ω(PersistBlob(pl, "index", r)).Should(MatchError(ContainSubstring("disk on fire")))
+		return
+	}
+	Ω(PersistBlob(pl, "index", r)).ShouldNot(HaveOccurred())
+}
+
+func (bc *blobTestClient) ReplayBlob(name string, r io.Reader) error {
+	bc.name, bc.after = name, len(bc.events)
+	bc.blob, bc.replay = ioutil.ReadAll(r)
+	return nil
+}
+
+type failingReader struct{ err error }
+
+func (fr *failingReader) Read(p []byte) (int, error) { return 0, fr.err }
+
+var _ = Describe("Blobs", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	blob := make([]byte, 3*blobChunkSize+100)
+	for i := range blob {
+		blob[i] = byte(i * 7)
+	}
+	events := []interface{}{&logEv1{S: "a"}, &logEv2{A: 1}}
+
+	open := func(client LogClient) (Log, error) {
+		fd, err := NewFileDest(PT+"/blob", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		return NewLog(fd, client, log15.Root())
+	}
+
+	It("replays a blob written by each snapshot", func() {
+		bc := &blobTestClient{recordingClient: recordingClient{events: events}, blob: blob}
+		pl, err := open(bc)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.(*pLog).Lock()
+		pl.(*pLog).rotate()
+		pl.(*pLog).Unlock()
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(2.0))
+		pl.(*pLog).Close()
+
+		bc2 := &blobTestClient{}
+		pl, err = open(bc2)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+		Ω(bc2.events).Should(Equal(events))
+		Ω(bc2.name).Should(Equal("index"))
+		Ω(bc2.after).Should(Equal(2))
+		Ω(bc2.replay).ShouldNot(HaveOccurred())
+		Ω(bc2.blob).Should(Equal(blob))
+	})
+
+	It("fails the replay of a corrupt blob", func() {
+		pl, err := open(&blobTestClient{blob: blob})
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+		names, err := LogFiles(PT + "/blob")
+		Ω(err).ShouldNot(HaveOccurred())
+		data, err := ioutil.ReadFile(names[0])
+		Ω(err).ShouldNot(HaveOccurred())
+		i := bytes.Index(data, blob[blobChunkSize:blobChunkSize+64])
+		Ω(i).Should(BeNumerically(">", 0))
+		data[i+10]++
+		Ω(ioutil.WriteFile(names[0], data, 0666)).ShouldNot(HaveOccurred())
+
+		_, err = open(&blobTestClient{})
+		Ω(err).Should(MatchError(ContainSubstring(`blob "index" is corrupt`)))
+	})
+
+	It("passes the error of an incomplete blob to the client", func() {
+		bc := &blobTestClient{blob: blob[:100], readErr: fmt.Errorf("disk on fire")}
+		pl, err := open(bc)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		bc2 := &blobTestClient{}
+		pl, err = open(bc2)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+		Ω(bc2.blob).Should(Equal(blob[:100]))
+		Ω(bc2.replay).Should(MatchError(ContainSubstring("not written completely")))
+	})
+
+	It("requires a client that replays blobs", func() {
+		pl, err := open(&blobTestClient{blob: blob})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(PersistBlob(pl, "late", bytes.NewReader(blob))).Should(HaveOccurred())
+		pl.(*pLog).Close()
+
+		_, err = open(&recordingClient{})
+		Ω(err).Should(MatchError(ContainSubstring("doesn't implement ReplayBlob")))
+	})
+})
@@ -0,0 +1,288 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	blockMagic  = "PBK1"
+	blockHeader = 16       // magic, sequence number, payload length, CRC-32C
+	blockSize   = 64 << 10 // size of a full block
+	blockPage   = 4 << 10  // blocks start at a multiple of the page size
+)
+
+var blockCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// NewBlockDest wraps a destination such that the records written to it are coalesced into
+// blocks of up to 64KB, which suits local disks as well as object stores better than many
+// small writes and checksums the data at block granularity. Each segment, i.e., each stream
+// started by a rotation, is a sequence of blocks that start at a multiple of 4KB, each with
+// a header holding a magic number, the block's sequence number in the segment, the length
+// of its data, and a CRC-32C, a partially filled block being padded to the next 4KB. A block
+// is written once it's full, once flushInterval has passed since data was added to it, and
+// at each rotation and on Close. The data of the last flushInterval is thus lost if the
+// process crashes, which a short interval, e.g. 10ms, bounds while still coalescing the
+// records of busy logs, and a zero interval writes a block for each write. Replay verifies
+// the checksums and fails on corrupted blocks, tools need BlockReader to read the segments.
+func NewBlockDest(dest LogDestination, flushInterval time.Duration) LogDestination {
+	return &blockDest{dest: dest, interval: flushInterval}
+}
+
+type blockDest struct {
+	mu       sync.Mutex
+	dest     LogDestination
+	interval time.Duration
+	data     []byte      // data of the block being filled
+	seq      uint32      // sequence number of the next block of the segment
+	timer    *time.Timer // flushes the block being filled, nil if it's empty
+	err      error       // error of a flush by the timer, returned by the next call
+	replay   []io.ReadCloser
+	wrapped  bool // replay readers have been wrapped
+}
+
+func (bd *blockDest) Write(p []byte) (int, error) {
+	bd.mu.Lock()
+	defer bd.mu.Unlock()
+	if err := bd.takeErr(); err != nil {
+		return 0, err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		room := blockSize - blockHeader - len(bd.data)
+		if room > len(p) {
+			room = len(p)
+		}
+		bd.data = append(bd.data, p[:room]...)
+		p = p[room:]
+		if len(bd.data) == blockSize-blockHeader || bd.interval <= 0 {
+			if err := bd.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if len(bd.data) > 0 && bd.timer == nil {
+		bd.timer = time.AfterFunc(bd.interval, bd.flushTimer)
+	}
+	return n, nil
+}
+
+// flush writes the block being filled, must be called while holding the lock
+func (bd *blockDest) flush() error {
+	if bd.timer != nil {
+		bd.timer.Stop()
+		bd.timer = nil
+	}
+	if len(bd.data) == 0 {
+		return nil
+	}
+	size := (blockHeader + len(bd.data) + blockPage - 1) / blockPage * blockPage
+	block := make([]byte, size)
+	copy(block, blockMagic)
+	binary.BigEndian.PutUint32(block[4:], bd.seq)
+	binary.BigEndian.PutUint32(block[8:], uint32(len(bd.data)))
+	copy(block[blockHeader:], bd.data)
+	crc := crc32.Update(crc32.Checksum(block[:12], blockCRC), blockCRC,
+		block[blockHeader:blockHeader+len(bd.data)])
+	binary.BigEndian.PutUint32(block[12:], crc)
+	n, err := bd.dest.Write(block)
+	if err == nil && n != len(block) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		return err
+	}
+	bd.seq++
+	bd.data = bd.data[:0]
+	return nil
+}
+
+// flushTimer flushes the block being filled once the interval has passed
+func (bd *blockDest) flushTimer() {
+	bd.mu.Lock()
+	defer bd.mu.Unlock()
+	if bd.timer == nil {
+		return // flushed meanwhile
+	}
+	bd.timer = nil
+	if err := bd.flush(); err != nil && bd.err == nil {
+		bd.err = err
+	}
+}
+
+// takeErr returns and clears the error of a flush by the timer
+func (bd *blockDest) takeErr() error {
+	err := bd.err
+	bd.err = nil
+	return err
+}
+
+func (bd *blockDest) Capabilities() Capabilities { return DestCapabilities(bd.dest) }
+
+func (bd *blockDest) ReplayReaders() []io.ReadCloser {
+	if !bd.wrapped {
+		for _, rr := range bd.dest.ReplayReaders() {
+			bd.replay = append(bd.replay, blockReadCloser{BlockReader(rr, false), rr})
+		}
+		bd.wrapped = true
+	}
+	return bd.replay
+}
+
+// StartRotate completes the segment and starts a new one
+func (bd *blockDest) StartRotate() error {
+	bd.mu.Lock()
+	defer bd.mu.Unlock()
+	if err := bd.takeErr(); err != nil {
+		return err
+	}
+	if err := bd.flush(); err != nil {
+		return err
+	}
+	if err := bd.dest.StartRotate(); err != nil {
+		return err
+	}
+	bd.seq = 0
+	return nil
+}
+
+// EndRotate writes the end of the snapshot before the destination relies on it
+func (bd *blockDest) EndRotate() error {
+	bd.mu.Lock()
+	defer bd.mu.Unlock()
+	if err := bd.takeErr(); err != nil {
+		return err
+	}
+	if err := bd.flush(); err != nil {
+		return err
+	}
+	return bd.dest.EndRotate()
+}
+
+func (bd *blockDest) Close() {
+	bd.mu.Lock()
+	defer bd.mu.Unlock()
+	bd.flush()
+	bd.dest.Close()
+}
+
+// BlockReader returns a reader that verifies a segment written by a destination created
+// with NewBlockDest and produces the data written to it. Read fails on a corrupted block
+// unless resync is true, in which case the reader skips to the next valid block, losing
+// the data of the corrupted one, which suits tools salvaging what they can of a damaged log.
+// A block cut short by the end of the segment is reported as io.ErrUnexpectedEOF.
+func BlockReader(r io.Reader, resync bool) io.Reader {
+	return &blockReader{r: r, resync: resync}
+}
+
+type blockReader struct {
+	r       io.Reader
+	resync  bool
+	seq     uint32 // sequence number of the next block
+	data    []byte // verified data not yet returned
+	off     int64  // offset in the segment
+	pending []byte // bytes read past the start of a corrupted block, to read again
+	cur     []byte // bytes of the block being read, if resyncing
+	err     error
+}
+
+func (br *blockReader) Read(p []byte) (int, error) {
+	for len(br.data) == 0 {
+		if br.err != nil {
+			return 0, br.err
+		}
+		br.err = br.next()
+	}
+	n := copy(p, br.data)
+	br.data = br.data[n:]
+	return n, nil
+}
+
+// next reads and verifies the next block, skipping corrupted ones if resyncing
+func (br *blockReader) next() error {
+	for {
+		br.cur = br.cur[:0]
+		err := br.readBlock()
+		if err == nil || err == io.EOF || !br.resync {
+			return err
+		}
+		// look for the next valid block at the following page boundary, reading the
+		// bytes consumed past it again
+		if len(br.cur) > blockPage {
+			br.pending = append(append([]byte(nil), br.cur[blockPage:]...), br.pending...)
+			br.off -= int64(len(br.cur) - blockPage)
+		} else if err := br.skip(blockPage - len(br.cur)); err != nil {
+			return io.EOF // the segment ends within the corrupted block
+		}
+		br.seq = 0
+	}
+}
+
+// readBlock reads the block at the current offset
+func (br *blockReader) readBlock() error {
+	start := br.off
+	var hdr [blockHeader]byte
+	if err := br.read(hdr[:]); err != nil {
+		return err // io.EOF at the end of the segment
+	}
+	if string(hdr[:4]) != blockMagic {
+		return fmt.Errorf("no block at offset %d", start)
+	}
+	seq := binary.BigEndian.Uint32(hdr[4:])
+	l := int(binary.BigEndian.Uint32(hdr[8:]))
+	if l > blockSize-blockHeader {
+		return fmt.Errorf("block at offset %d has a bad length", start)
+	}
+	data := make([]byte, l)
+	if err := br.read(data); err != nil {
+		return eofInRecord(err)
+	}
+	crc := crc32.Update(crc32.Checksum(hdr[:12], blockCRC), blockCRC, data)
+	if crc != binary.BigEndian.Uint32(hdr[12:]) {
+		return fmt.Errorf("block at offset %d fails its checksum", start)
+	}
+	if seq != br.seq && !br.resync {
+		return fmt.Errorf("block at offset %d is out of sequence: expected %d, found %d",
+			start, br.seq, seq)
+	}
+	br.seq = seq + 1
+	br.data = data
+	// the padding may be missing at the end of the segment
+	br.skip(int((blockPage - br.off%blockPage) % blockPage))
+	return nil
+}
+
+// read reads len(p) bytes, it returns io.EOF if none could be read
+func (br *blockReader) read(p []byte) error {
+	n := copy(p, br.pending)
+	br.pending = br.pending[n:]
+	m, err := io.ReadFull(br.r, p[n:])
+	if err == io.EOF && n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if br.resync {
+		br.cur = append(br.cur, p[:n+m]...)
+	}
+	br.off += int64(n + m)
+	return err
+}
+
+// skip discards n bytes
+func (br *blockReader) skip(n int) error {
+	if n <= 0 {
+		return nil
+	}
+	return br.read(make([]byte, n))
+}
+
+// blockReadCloser verifies what it reads and closes the underlying replay reader
+type blockReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("BlockDest", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	open := func(create bool, interval time.Duration, rc *recordingClient) (Log, error) {
+		fd, err := NewFileDest(PT+"/block", create, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(NewBlockDest(fd, interval), rc, log15.Root())
+		if err != nil {
+			fd.Close()
+		}
+		return pl, err
+	}
+
+	currSize := func() int64 {
+		files, err := LogFiles(PT + "/block")
+		Ω(err).ShouldNot(HaveOccurred())
+		return fileSize(files[len(files)-1])
+	}
+
+	It("coalesces the records into page-aligned blocks", func() {
+		rc := &recordingClient{events: []interface{}{&logEv1{S: "a"}, &logEv2{A: 1}}}
+		pl, err := open(true, time.Hour, rc)
+		Ω(err).ShouldNot(HaveOccurred())
+		// the snapshot is flushed at the end of the rotation
+		Ω(currSize()).Should(Equal(int64(blockPage)))
+		Ω(pl.Output(&logEv1{S: "b"})).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "c"})).ShouldNot(HaveOccurred())
+		Ω(currSize()).Should(Equal(int64(blockPage)))
+		pl.(*pLog).Close()
+		Ω(currSize()).Should(Equal(int64(2 * blockPage)))
+
+		rc = &recordingClient{}
+		pl, err = open(false, time.Hour, rc)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(Equal([]interface{}{&logEv1{S: "a"}, &logEv2{A: 1},
+			&logEv1{S: "b"}, &logEv1{S: "c"}}))
+		pl.(*pLog).Close()
+	})
+
+	It("flushes a block once the interval has passed", func() {
+		pl, err := open(true, 10*time.Millisecond, &recordingClient{})
+		Ω(err).ShouldNot(HaveOccurred())
+		size := currSize()
+		Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		Eventually(currSize).Should(Equal(size + blockPage))
+		pl.(*pLog).Close()
+	})
+
+	It("fails the replay of a corrupted block", func() {
+		pl, err := open(true, time.Hour, &recordingClient{events: []interface{}{
+			&logEv1{S: "a"}}})
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+		files, _ := LogFiles(PT + "/block")
+		data, _ := ioutil.ReadFile(files[0])
+		data[blockHeader+5] ^= 0xff
+		Ω(ioutil.WriteFile(files[0], data, 0666)).ShouldNot(HaveOccurred())
+		_, err = open(false, time.Hour, &recordingClient{})
+		Ω(err).Should(MatchError(ContainSubstring("block at offset 0 fails its checksum")))
+	})
+
+	It("resyncs past corrupted blocks", func() {
+		var buf bytes.Buffer
+		bd := NewBlockDest(NewWriterDest(&buf, nil), 0)
+		big := bytes.Repeat([]byte("x"), blockSize)
+		for _, p := range [][]byte{[]byte("first"), big, []byte("last")} {
+			Ω(bd.Write(p)).Should(Equal(len(p)))
+		}
+		// first, 2 blocks for big, and last
+		Ω(buf.Len()).Should(Equal(blockPage + blockSize + blockPage + blockPage))
+		data := buf.Bytes()
+		data[blockPage+blockHeader] ^= 0xff
+
+		strict, err := ioutil.ReadAll(BlockReader(bytes.NewReader(data), false))
+		Ω(err).Should(MatchError(ContainSubstring("fails its checksum")))
+		Ω(string(strict)).Should(Equal("first"))
+
+		salvaged, err := ioutil.ReadAll(BlockReader(bytes.NewReader(data), true))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(salvaged)).Should(Equal("first" + "xxxxxxxxxxxxxxxx" + "last"))
+
+		By("reporting a truncated block")
+		_, err = ioutil.ReadAll(BlockReader(bytes.NewReader(buf.Bytes()[:20]), false))
+		Ω(err).Should(HaveOccurred())
+	})
+})
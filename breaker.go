@@ -0,0 +1,146 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// circuit breaker states, see NewBreakerDest
+const (
+	circuitClosed   = 0
+	circuitHalfOpen = 1
+	circuitOpen     = 2
+)
+
+// NewBreakerDest wraps a destination in a circuit breaker, such that persist stops calling a
+// destination that keeps failing, e.g. a remote server that is down, instead of waiting for
+// each call to time out. The breaker opens after threshold consecutive failures of Write,
+// StartRotate, or EndRotate, the calls then fail right away for the cooldown period. The
+// first call after the cooldown is let through as a probe: the breaker closes again if it
+// succeeds and reopens for another cooldown if it fails, the other calls made while probing
+// fail. The log's Stats report the state as PrimaryCircuitState or SecondaryCircuitState,
+// 0 when closed, 1 when probing, and 2 when open. The breaker suits secondary destinations
+// best, whose failures the log tolerates and whose catch-ups are probes.
+func NewBreakerDest(dest LogDestination, threshold int, cooldown time.Duration) LogDestination {
+	if threshold < 1 {
+		threshold = 1
+	}
+	cb := &breakerDest{dest: dest, threshold: threshold, cooldown: cooldown}
+	if _, ok := dest.(ContextWriter); ok {
+		return &ctxBreakerDest{cb}
+	}
+	return cb
+}
+
+// circuitBreaker is implemented by destinations wrapped in a circuit breaker
+type circuitBreaker interface {
+	circuitState() int
+}
+
+type breakerDest struct {
+	dest      LogDestination
+	threshold int
+	cooldown  time.Duration
+	mu        sync.Mutex
+	state     int       // circuitClosed, circuitHalfOpen, or circuitOpen
+	failures  int       // consecutive failures
+	lastErr   error     // error of the last failure
+	opened    time.Time // time at which the breaker last opened
+}
+
+// allow returns an error if the call must fail right away, when it returns nil the caller
+// must call done with the result of the call
+func (cb *breakerDest) allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case circuitOpen:
+		if time.Since(cb.opened) < cb.cooldown {
+			return cb.openError()
+		}
+		cb.state = circuitHalfOpen
+	case circuitHalfOpen:
+		return cb.openError()
+	}
+	return nil
+}
+
+// done records the result of a call let through by allow
+func (cb *breakerDest) done(err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if err == nil {
+		cb.state = circuitClosed
+		cb.failures = 0
+		return
+	}
+	cb.failures++
+	cb.lastErr = err
+	if cb.state == circuitHalfOpen || cb.failures >= cb.threshold {
+		cb.state = circuitOpen
+		cb.opened = time.Now()
+	}
+}
+
+func (cb *breakerDest) openError() error {
+	return fmt.Errorf("circuit breaker open after %d consecutive failures, last: %s",
+		cb.failures, cb.lastErr.Error())
+}
+
+// call performs an operation on the destination through the breaker
+func (cb *breakerDest) call(f func() error) error {
+	if err := cb.allow(); err != nil {
+		return err
+	}
+	err := f()
+	cb.done(err)
+	return err
+}
+
+// write performs a write through the breaker, short writes count as failures
+func (cb *breakerDest) write(w func([]byte) (int, error), p []byte) (int, error) {
+	var n int
+	err := cb.call(func() error {
+		var err error
+		n, err = w(p)
+		if err == nil && n != len(p) {
+			err = io.ErrShortWrite
+		}
+		return err
+	})
+	return n, err
+}
+
+func (cb *breakerDest) Write(p []byte) (int, error) { return cb.write(cb.dest.Write, p) }
+
+func (cb *breakerDest) Capabilities() Capabilities { return DestCapabilities(cb.dest) }
+
+func (cb *breakerDest) ReplayReaders() []io.ReadCloser { return cb.dest.ReplayReaders() }
+
+func (cb *breakerDest) StartRotate() error { return cb.call(cb.dest.StartRotate) }
+
+func (cb *breakerDest) EndRotate() error { return cb.call(cb.dest.EndRotate) }
+
+func (cb *breakerDest) Close() { cb.dest.Close() }
+
+// circuitState returns the state of the breaker, for stats
+func (cb *breakerDest) circuitState() int {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// ctxBreakerDest is a breakerDest around a ContextWriter, it's a ContextWriter as well
+type ctxBreakerDest struct {
+	*breakerDest
+}
+
+func (cb *ctxBreakerDest) WriteContext(ctx context.Context, p []byte) (int, error) {
+	cw := cb.dest.(ContextWriter)
+	return cb.write(func(p []byte) (int, error) { return cw.WriteContext(ctx, p) }, p)
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// destination that counts the writes that reach it
+type callCountingDest struct {
+	LogDestination
+	writes int
+}
+
+func (cd *callCountingDest) Write(p []byte) (int, error) {
+	cd.writes++
+	return cd.LogDestination.Write(p)
+}
+
+var _ = Describe("BreakerDest", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	It("stops calling a failing destination until a probe succeeds", func() {
+		var buf bytes.Buffer
+		fd := &flakyDest{LogDestination: NewWriterDest(&buf, nil)}
+		cd := &callCountingDest{LogDestination: fd}
+		cb := NewBreakerDest(cd, 2, 20*time.Millisecond)
+		state := func() int { return cb.(circuitBreaker).circuitState() }
+
+		fd.setDown(true)
+		for i := 0; i < 2; i++ {
+			_, err := cb.Write([]byte("x"))
+			Ω(err).Should(MatchError("destination is down"))
+		}
+		Ω(state()).Should(Equal(circuitOpen))
+		_, err := cb.Write([]byte("x"))
+		Ω(err).Should(MatchError(ContainSubstring("circuit breaker open after 2 consecutive " +
+			"failures, last: destination is down")))
+		Ω(cd.writes).Should(Equal(2))
+
+		By("reopening when the probe fails")
+		time.Sleep(30 * time.Millisecond)
+		_, err = cb.Write([]byte("x"))
+		Ω(err).Should(MatchError("destination is down"))
+		Ω(cd.writes).Should(Equal(3))
+		Ω(state()).Should(Equal(circuitOpen))
+
+		By("closing when the probe succeeds")
+		fd.setDown(false)
+		time.Sleep(30 * time.Millisecond)
+		Ω(cb.Write([]byte("y"))).Should(Equal(1))
+		Ω(state()).Should(Equal(circuitClosed))
+		Ω(cb.Write([]byte("z"))).Should(Equal(1))
+		Ω(buf.String()).Should(Equal("yz"))
+	})
+
+	It("reports the state of a secondary's breaker in the stats", func() {
+		pd, err := NewFileDest(PT+"/primary", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(pd, &recordingClient{}, log15.Root(), WithSecondaryRetry(0))
+		Ω(err).ShouldNot(HaveOccurred())
+		var buf bytes.Buffer
+		fd := &flakyDest{LogDestination: NewWriterDest(&buf, nil)}
+		Ω(pl.SetSecondaryDestination(NewBreakerDest(fd, 1, time.Hour))).
+			ShouldNot(HaveOccurred())
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(2.0))
+		Ω(pl.Stats()).Should(HaveKeyWithValue("SecondaryCircuitState", 0.0))
+		Ω(pl.Stats()).ShouldNot(HaveKey("PrimaryCircuitState"))
+
+		fd.setDown(true)
+		Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()).Should(HaveKeyWithValue("SecondaryCircuitState", 2.0))
+		pl.(*pLog).Close()
+	})
+
+	It("keeps context-aware writes", func() {
+		var buf bytes.Buffer
+		_, ok := NewBreakerDest(&stallDest{LogDestination: NewWriterDest(&buf, nil)}, 1,
+			time.Hour).(ContextWriter)
+		Ω(ok).Should(BeTrue())
+		_, ok = NewBreakerDest(NewWriterDest(&buf, nil), 1, time.Hour).(ContextWriter)
+		Ω(ok).Should(BeFalse())
+	})
+})
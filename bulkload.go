@@ -0,0 +1,73 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"io"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// An EventSource returns the events of a bulk load one after the other, and io.EOF once
+// there are no more, see BulkLoad
+type EventSource func() (interface{}, error)
+
+// BulkLoad writes the events returned by source to an empty destination as the snapshot of
+// a first generation, such that a new node can be seeded from authoritative data, e.g., a
+// database export, rather than start from an empty state, without an application state to
+// replay into. The events are written the way NewLog writes its initial snapshot, using the
+// codec, GobCodec if nil, and the options, which should match those the application passes
+// to NewLog, e.g., RecordSequenceNumbers or SnapshotOrder. BulkLoad fails if the
+// destination has events to replay. It closes the destination and returns the number of
+// events written. If source fails the generation is left incomplete and the destination
+// must be discarded.
+func BulkLoad(dest LogDestination, codec Codec, source EventSource,
+	opts ...LogOption) (int, error) {
+
+	if codec != nil {
+		opts = append([]LogOption{WithCodec(codec)}, opts...)
+	}
+	bl := &bulkLoader{source: source}
+	log, err := NewLog(dest, bl, log15.Root().New("bulk_load", true), opts...)
+	if err != nil {
+		dest.Close()
+		return bl.count, err
+	}
+	log.(*pLog).Close()
+	return bl.count, nil
+}
+
+// bulkLoader is the client of the log written by BulkLoad
+type bulkLoader struct {
+	source EventSource
+	count  int
+}
+
+func (bl *bulkLoader) Replay(logEvent interface{}) error {
+	return fmt.Errorf("bulk load requires an empty destination, found a %T event",
+		logEvent)
+}
+
+func (bl *bulkLoader) PersistAll(log Log) {
+	for {
+		ev, err := bl.source()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			err = fmt.Errorf("bulk load source failed after %d events: %s", bl.count,
+				err.Error())
+		} else if err = log.Output(ev); err == nil {
+			bl.count++
+			continue
+		}
+		// fail the snapshot so the generation isn't ended by the destination
+		pl := log.(*pLog)
+		pl.Lock()
+		if pl.errState == nil {
+			pl.fail("snapshot", err)
+		}
+		pl.Unlock()
+		return
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("BulkLoad", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	events := []interface{}{&logEv1{S: "a"}, &logEv2{A: 1}, &logEv1{S: "b"}}
+
+	// source returns the events, followed by err if not nil
+	source := func(err error) EventSource {
+		i := 0
+		return func() (interface{}, error) {
+			if i == len(events) {
+				if err != nil {
+					return nil, err
+				}
+				return nil, io.EOF
+			}
+			i++
+			return events[i-1], nil
+		}
+	}
+
+	It("seeds a log that the application replays", func() {
+		fd, err := NewFileDest(PT+"/bulk", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		n, err := BulkLoad(fd, nil, source(nil), RecordSequenceNumbers())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(n).Should(Equal(3))
+
+		fd, err = NewFileDest(PT+"/bulk", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{}
+		pl, err := NewLog(fd, rc, log15.Root(), RecordSequenceNumbers())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()["Generation"]).Should(Equal(2.0))
+		pl.(*pLog).Close()
+		Ω(rc.events).Should(Equal(events))
+	})
+
+	It("fails when the source fails", func() {
+		fd, err := NewFileDest(PT+"/bulk", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		n, err := BulkLoad(fd, nil, source(fmt.Errorf("export truncated")))
+		Ω(err).Should(MatchError(ContainSubstring("source failed after 3 events: " +
+			"export truncated")))
+		Ω(n).Should(Equal(3))
+	})
+
+	It("requires an empty destination", func() {
+		fd, err := NewFileDest(PT+"/bulk", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{events: events}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		fd, err = NewFileDest(PT+"/bulk", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = BulkLoad(fd, GobCodec, source(nil))
+		Ω(err).Should(MatchError(ContainSubstring("requires an empty destination")))
+	})
+})
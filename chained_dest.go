@@ -0,0 +1,186 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ChainedEvent is the event a chained destination outputs to the downstream log for each
+// event of the upstream log. Each upstream rotation starts a new generation with a full
+// snapshot of the upstream state and, once that snapshot is complete, a ChainedEvent with
+// SnapshotDone set and a nil Event is output. This allows the downstream client to discard
+// any upstream resource that has not been re-created in the latest complete generation.
+type ChainedEvent struct {
+	Source       string // name of the upstream log
+	Gen          uint64 // upstream generation, incremented at each upstream rotation
+	SnapshotDone bool   // marks the completion of the upstream generation's snapshot
+	Event        interface{}
+}
+
+func init() {
+	Register(&ChainedEvent{})
+}
+
+type chainedDest struct {
+	downstream Log
+	source     string
+	codec      Codec
+	gen        uint64
+	feed       *feedReader // feeds the upstream data to the decoder goroutine
+}
+
+// NewChainedDest returns a destination that decodes the events written by an upstream log
+// and outputs them into a downstream log, wrapped in a ChainedEvent carrying the source
+// name. This allows an aggregator process to consolidate many upstream logs into one
+// durable log with its own destinations and rotation policy: the downstream client
+// receives the ChainedEvents on Replay and must re-output its consolidated state in
+// PersistAll. The codec must be the one the upstream log writes with, a nil codec defaults
+// to GobCodec, and all the upstream event types must be registered in the aggregator. The
+// upstream stream is decoded as a replay decodes it: its own records are dropped, and the
+// events of a transaction are only chained once it commits. Blobs are not chained, the
+// destination fails when the upstream log writes one. A chained destination cannot be
+// replayed from, it must be a secondary destination.
+func NewChainedDest(downstream Log, source string, codec Codec) LogDestination {
+	if codec == nil {
+		codec = GobCodec
+	}
+	cd := &chainedDest{downstream: downstream, source: source, codec: codec}
+	cd.start()
+	return cd
+}
+
+// start launches a goroutine to decode a fresh upstream stream
+func (cd *chainedDest) start() {
+	feed := newFeedReader()
+	cd.feed = feed
+	client := &chainClient{cd: cd, gen: cd.gen}
+	go func() {
+		dec := annotationDecoder{Decoder: withSequence(cd.codec.NewDecoder(feed))}
+		_, err := replayStream(dec, client, nil)
+		if err == nil {
+			err = io.EOF
+		} else if client.err == nil {
+			err = fmt.Errorf("chained destination cannot decode: %s", err.Error())
+		} else {
+			err = client.err
+		}
+		feed.finish(err)
+	}()
+}
+
+// chainClient receives the events decoded from the upstream stream of a generation and
+// outputs them to the downstream log
+type chainClient struct {
+	cd  *chainedDest
+	gen uint64
+	err error // error of the downstream log
+}
+
+func (cc *chainClient) Replay(ev interface{}) error {
+	cc.err = cc.cd.downstream.Output(&ChainedEvent{Source: cc.cd.source, Gen: cc.gen,
+		Event: ev})
+	return cc.err
+}
+
+func (cc *chainClient) PersistAll(pl Log) {}
+
+// Write passes the upstream data to the decoder and waits until all complete events have
+// been output to the downstream log
+func (cd *chainedDest) Write(p []byte) (int, error) {
+	if err := cd.feed.write(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (cd *chainedDest) Capabilities() Capabilities {
+	return Capabilities{CanRotate: true, WriteOnly: true}
+}
+
+func (cd *chainedDest) ReplayReaders() []io.ReadCloser { return nil }
+
+// StartRotate is called by persist when the upstream log starts a fresh stream
+func (cd *chainedDest) StartRotate() error {
+	cd.feed.close()
+	cd.gen++
+	cd.start()
+	return nil
+}
+
+// EndRotate is called by persist when the upstream snapshot is complete
+func (cd *chainedDest) EndRotate() error {
+	return cd.downstream.Output(&ChainedEvent{Source: cd.source, Gen: cd.gen,
+		SnapshotDone: true})
+}
+
+func (cd *chainedDest) Close() {
+	cd.feed.close()
+}
+
+// feedReader is a reader that hands data to a decoder running in a separate goroutine such
+// that the writer can wait until the decoder has consumed everything it has been given
+type feedReader struct {
+	buf     bytes.Buffer
+	waiting bool  // reader is blocked waiting for more data
+	closed  bool  // no more data will be written
+	err     error // set when the reader is done, io.EOF if it consumed everything
+	cond    *sync.Cond
+	sync.Mutex
+}
+
+func newFeedReader() *feedReader {
+	fr := &feedReader{}
+	fr.cond = sync.NewCond(&fr.Mutex)
+	return fr
+}
+
+func (fr *feedReader) Read(p []byte) (int, error) {
+	fr.Lock()
+	defer fr.Unlock()
+	for fr.buf.Len() == 0 && !fr.closed {
+		fr.waiting = true
+		fr.cond.Broadcast()
+		fr.cond.Wait()
+	}
+	fr.waiting = false
+	if fr.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return fr.buf.Read(p)
+}
+
+// write adds data and waits for the reader to consume it all and ask for more
+func (fr *feedReader) write(p []byte) error {
+	fr.Lock()
+	defer fr.Unlock()
+	fr.buf.Write(p)
+	fr.waiting = false
+	fr.cond.Broadcast()
+	for fr.err == nil && !(fr.waiting && fr.buf.Len() == 0) {
+		fr.cond.Wait()
+	}
+	return fr.err
+}
+
+// finish is called by the reader when it's done
+func (fr *feedReader) finish(err error) {
+	fr.Lock()
+	defer fr.Unlock()
+	fr.err = err
+	fr.cond.Broadcast()
+}
+
+// close signals the end of the data and waits for the reader to finish
+func (fr *feedReader) close() {
+	fr.Lock()
+	defer fr.Unlock()
+	fr.closed = true
+	fr.cond.Broadcast()
+	for fr.err == nil {
+		fr.cond.Wait()
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// aggregator client used for testing, it keeps all the upstream events
+type testAggregator struct {
+	events []*ChainedEvent
+}
+
+func (ta *testAggregator) Replay(ev interface{}) error {
+	ta.events = append(ta.events, ev.(*ChainedEvent))
+	return nil
+}
+
+func (ta *testAggregator) PersistAll(pl Log) {
+	for _, ev := range ta.events {
+		pl.Output(ev)
+	}
+}
+
+var _ = Describe("ChainedDest", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	It("consolidates an upstream log into a downstream log", func() {
+		var buf bytes.Buffer
+		agg := &testAggregator{}
+		down, err := NewLog(NewWriterDest(&buf, nil), agg, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		fd, err := NewFileDest(PT+"/up", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		up, err := NewLog(fd, &testLogClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(up.SetSecondaryDestination(NewChainedDest(down, "up1", nil))).ShouldNot(HaveOccurred())
+		Eventually(func() bool {
+			up.(*pLog).Lock()
+			defer up.(*pLog).Unlock()
+			return up.(*pLog).rotating
+		}).Should(BeFalse())
+		Ω(up.Output(&logEv1{S: "delta"})).ShouldNot(HaveOccurred())
+		up.(*pLog).Close()
+		down.(*pLog).Close()
+
+		By("replaying the downstream log")
+		replayed := &testAggregator{}
+		_, err = NewLog(NewWriterDest(ioutil.Discard,
+			[]io.ReadCloser{ioutil.NopCloser(&buf)}), replayed, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(replayed.events).Should(HaveLen(5))
+		Ω(replayed.events[0]).Should(Equal(&ChainedEvent{Source: "up1",
+			Event: &logEv1{S: "hello world #1!"}}))
+		Ω(replayed.events[3]).Should(Equal(&ChainedEvent{Source: "up1",
+			SnapshotDone: true}))
+		Ω(replayed.events[4].Event).Should(Equal(&logEv1{S: "delta"}))
+	})
+
+	It("decodes the upstream records with the upstream codec", func() {
+		reg := NewTypeRegistry()
+		Ω(reg.Register("test.ev1", &logEv1{})).ShouldNot(HaveOccurred())
+		codec := JSONCodec(reg)
+		var buf bytes.Buffer
+		down, err := NewLog(NewWriterDest(&buf, nil), &testAggregator{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		fd, err := NewFileDest(PT+"/up", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		up, err := NewLog(fd, &recordingClient{}, log15.Root(), WithCodec(codec),
+			RecordSequenceNumbers())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(up.SetSecondaryDestination(NewChainedDest(down, "up1", codec))).
+			ShouldNot(HaveOccurred())
+		Eventually(func() bool {
+			up.(*pLog).Lock()
+			defer up.(*pLog).Unlock()
+			return up.(*pLog).rotating
+		}).Should(BeFalse())
+		Ω(up.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		Ω(Txn(up, func(w TxnWriter) error {
+			w.Output(&logEv1{S: "b"})
+			return w.Output(&logEv1{S: "c"})
+		})).ShouldNot(HaveOccurred())
+		up.(*pLog).Close()
+		down.(*pLog).Close()
+
+		replayed := &testAggregator{}
+		_, err = NewLog(NewWriterDest(ioutil.Discard,
+			[]io.ReadCloser{ioutil.NopCloser(&buf)}), replayed, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		var events []interface{}
+		for _, ev := range replayed.events {
+			events = append(events, ev.Event)
+		}
+		Ω(events).Should(Equal([]interface{}{nil, &logEv1{S: "a"}, &logEv1{S: "b"},
+			&logEv1{S: "c"}}))
+	})
+})
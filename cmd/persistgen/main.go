@@ -0,0 +1,181 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+// Command persistgen generates the MarshalPersist and UnmarshalPersist methods of event
+// types, which the gob codec uses instead of reflection, see persist.FastEvent. It's meant
+// for go:generate, next to the event types:
+//
+//	//go:generate persistgen -type StartedEvent,StoppedEvent
+//
+// The exported fields of the types must be of type bool, string, []byte, time.Time, or
+// a sized or unsized integer or float type, unexported fields are skipped as gob does.
+// Types with other fields are better left to gob, persistgen rejects them. Once logs have
+// been written, fields may only be added at the end of a type. The types are registered
+// using persist.RegisterFast under <package>.<type>, see -prefix.
+//
+// Usage: persistgen -type T1,T2 [-output file] [-prefix name] [files...]
+//
+// Without files, the non-test Go files of the current directory are parsed.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fieldKinds maps the supported field types to the persist functions that encode and
+// decode them and the type the decoded value is converted from
+var fieldKinds = map[string]struct{ append, read, conv string }{
+	"bool":      {"AppendBool", "ReadBool", ""},
+	"string":    {"AppendString", "ReadString", ""},
+	"[]byte":    {"AppendBytes", "ReadBytes", ""},
+	"[]uint8":   {"AppendBytes", "ReadBytes", ""},
+	"time.Time": {"AppendTime", "ReadTime", ""},
+	"int":       {"AppendInt", "ReadInt", "int64"},
+	"int8":      {"AppendInt", "ReadInt", "int64"},
+	"int16":     {"AppendInt", "ReadInt", "int64"},
+	"int32":     {"AppendInt", "ReadInt", "int64"},
+	"int64":     {"AppendInt", "ReadInt", "int64"},
+	"uint":      {"AppendUint", "ReadUint", "uint64"},
+	"uint8":     {"AppendUint", "ReadUint", "uint64"},
+	"uint16":    {"AppendUint", "ReadUint", "uint64"},
+	"uint32":    {"AppendUint", "ReadUint", "uint64"},
+	"uint64":    {"AppendUint", "ReadUint", "uint64"},
+	"float32":   {"AppendFloat", "ReadFloat", "float64"},
+	"float64":   {"AppendFloat", "ReadFloat", "float64"},
+}
+
+func main() {
+	typeList := flag.String("type", "", "comma-separated list of the event types")
+	output := flag.String("output", "", "output file, <package>_persist.go by default")
+	prefix := flag.String("prefix", "", "prefix of the registered names, the package name "+
+		"by default")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: persistgen -type T1,T2 [-output file] "+
+			"[-prefix name] [files...]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *typeList == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := generate(strings.Split(*typeList, ","), flag.Args(), *output,
+		*prefix); err != nil {
+		fmt.Fprintf(os.Stderr, "persistgen: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// generate writes the methods of the types declared in the files to output
+func generate(names, files []string, output, prefix string) error {
+	explicit := len(files) > 0
+	if !explicit {
+		var err error
+		if files, err = filepath.Glob("*.go"); err != nil {
+			return err
+		}
+	}
+	fset := token.NewFileSet()
+	decls := map[string]*ast.StructType{}
+	pkg := ""
+	for _, f := range files {
+		if !explicit && (strings.HasSuffix(f, "_test.go") || f == output) {
+			continue
+		}
+		file, err := parser.ParseFile(fset, f, nil, 0)
+		if err != nil {
+			return err
+		}
+		pkg = file.Name.Name
+		ast.Inspect(file, func(n ast.Node) bool {
+			if ts, ok := n.(*ast.TypeSpec); ok {
+				if st, ok := ts.Type.(*ast.StructType); ok {
+					decls[ts.Name.Name] = st
+				}
+			}
+			return true
+		})
+	}
+	if output == "" {
+		output = pkg + "_persist.go"
+	}
+	if prefix == "" {
+		prefix = pkg
+	}
+	qual := "persist."
+	if pkg == "persist" {
+		qual = ""
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by persistgen; DO NOT EDIT.\n\npackage %s\n\n", pkg)
+	if qual != "" {
+		fmt.Fprintf(&buf, "import %q\n\n", "github.com/rightscale/persist")
+	}
+	fmt.Fprintf(&buf, "func init() {\n")
+	for _, t := range names {
+		fmt.Fprintf(&buf, "%sRegisterFast(%q, (*%s)(nil))\n", qual, prefix+"."+t, t)
+	}
+	fmt.Fprintf(&buf, "}\n")
+	for _, t := range names {
+		st, ok := decls[t]
+		if !ok {
+			return fmt.Errorf("struct type %s not found in %s", t, strings.Join(files, ", "))
+		}
+		if err := generateType(&buf, t, st, qual); err != nil {
+			return err
+		}
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("cannot format the generated code: %s", err.Error())
+	}
+	return ioutil.WriteFile(output, src, 0666)
+}
+
+// generateType writes the methods of one type
+func generateType(buf *bytes.Buffer, name string, st *ast.StructType, qual string) error {
+	var enc, dec bytes.Buffer
+	for _, field := range st.Fields.List {
+		typ := types.ExprString(field.Type)
+		if len(field.Names) == 0 {
+			return fmt.Errorf("%s embeds %s, leave it to gob", name, typ)
+		}
+		for _, n := range field.Names {
+			if !n.IsExported() {
+				continue
+			}
+			kind, ok := fieldKinds[typ]
+			if !ok {
+				return fmt.Errorf("field %s of %s has unsupported type %s, leave %s to gob",
+					n.Name, name, typ, name)
+			}
+			if kind.conv == "" {
+				fmt.Fprintf(&enc, "b = %s%s(b, ev.%s)\n", qual, kind.append, n.Name)
+				fmt.Fprintf(&dec, "ev.%s = r.%s()\n", n.Name, kind.read)
+			} else {
+				fmt.Fprintf(&enc, "b = %s%s(b, %s(ev.%s))\n", qual, kind.append, kind.conv,
+					n.Name)
+				fmt.Fprintf(&dec, "ev.%s = %s(r.%s())\n", n.Name, typ, kind.read)
+			}
+		}
+	}
+	fmt.Fprintf(buf, "\n// MarshalPersist appends the encoded event to b, see %sFastEvent\n",
+		qual)
+	fmt.Fprintf(buf, "func (ev *%s) MarshalPersist(b []byte) []byte {\n%sreturn b\n}\n",
+		name, enc.String())
+	fmt.Fprintf(buf, "\n// UnmarshalPersist decodes the event, see %sFastEvent\n", qual)
+	fmt.Fprintf(buf, "func (ev *%s) UnmarshalPersist(data []byte) error {\n"+
+		"r := %sNewFastReader(data)\n%sreturn r.Err()\n}\n", name, qual, dec.String())
+	return nil
+}
@@ -0,0 +1,331 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+// Command persistsoak is a soak test of persist's crash recovery. It runs a writer process
+// that applies a random but reproducible sequence of operations to a key-value store
+// persisted in a log set using a file destination, with a size limit such that the log
+// rotates continuously. The harness kills the writer at random points, now and then stops
+// it cleanly instead, reopens the log set, and checks that the replayed state has the
+// fingerprint of the state after the operations the writer acknowledged, which it
+// simulates. There is no fault-injection filesystem, crashes are SIGKILLs of the writer.
+// Log sets a crash leaves in a state that cannot be opened are fixed using
+// persist.PlanRepair, as plogrepair would, records the kill left partially written are
+// truncated, and both are counted. It runs until the duration has passed or a check
+// fails, in which case it exits with an error and leaves the log set in place for
+// inspection.
+//
+// Usage: persistsoak [-duration 1m] [-dir dir] [-seed n] [-keys n] [-size-limit bytes]
+//
+// It's meant to run locally while working on recovery and for a longer duration in
+// nightly CI, e.g. make soak.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rightscale/persist"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	duration  = flag.Duration("duration", time.Minute, "how long to run")
+	dir       = flag.String("dir", "", "directory of the log set, a temporary one by default")
+	seed      = flag.Int64("seed", 0, "seed of the operations and crashes, random by default")
+	keys      = flag.Int("keys", 1000, "number of keys of the store")
+	sizeLimit = flag.Int("size-limit", 1<<20, "log size that triggers a rotation")
+	writer    = flag.Bool("writer", false, "run as the writer process (internal)")
+)
+
+func main() {
+	flag.Parse()
+	log15.Root().SetHandler(log15.DiscardHandler())
+	persist.Strict(true)
+	if *writer {
+		os.Exit(runWriter())
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	if *dir == "" {
+		d, err := ioutil.TempDir("", "persistsoak")
+		if err != nil {
+			fail("%s", err.Error())
+		}
+		*dir = d
+	}
+	h := &harness{basepath: filepath.Join(*dir, "soak"), rnd: rand.New(rand.NewSource(*seed)),
+		sim: newStore()}
+	fmt.Printf("persistsoak: seed %d, log set %s\n", *seed, h.basepath)
+	if err := h.run(time.Now().Add(*duration)); err != nil {
+		fail("%s\nseed %d, log set left in %s", err.Error(), *seed, *dir)
+	}
+	fmt.Printf("persistsoak: ok, %d cycles, %d crashes, %d operations, %d repairs, "+
+		"%d torn records\n", h.cycles, h.crashes, h.sim.ops, h.repairs, h.torn)
+	os.RemoveAll(*dir)
+}
+
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "persistsoak: "+format+"\n", args...)
+	os.Exit(1)
+}
+
+// openedLog is a log and its destination
+type openedLog struct {
+	persist.Log
+	dest persist.LogDestination
+	done uint64 // last complete generation
+}
+
+// openLog opens the log set and replays it into c
+func openLog(basepath string, create bool, c *client) (*openedLog, error) {
+	dest, err := persist.NewFileDest(basepath, create, nil)
+	if err != nil {
+		return nil, err
+	}
+	ol := &openedLog{dest: dest}
+	pl, err := persist.NewLog(dest, c, log15.Root(),
+		persist.OnRotate(func(gen uint64) { atomic.StoreUint64(&ol.done, gen) }))
+	if err != nil {
+		dest.Close()
+		return nil, err
+	}
+	pl.SetSizeLimit(*sizeLimit)
+	ol.Log = pl
+	return ol, nil
+}
+
+// close waits for the rotations to complete and closes the destination. A rotation may be
+// about to start when the last one completes, hence the generations must remain complete
+// for a while.
+func (ol *openedLog) close() {
+	var idle time.Time
+	for {
+		if float64(atomic.LoadUint64(&ol.done)) < ol.Stats()["Generation"] {
+			idle = time.Time{}
+		} else if idle.IsZero() {
+			idle = time.Now()
+		} else if time.Since(idle) > 20*time.Millisecond {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ol.dest.Close()
+}
+
+// runWriter is the writer process: it continues the sequence of operations where the
+// replayed state left off and reports each operation whose output returned on stdout,
+// until it's killed or receives SIGTERM
+func runWriter() int {
+	c := &client{s: newStore()}
+	basepath := filepath.Join(*dir, "soak")
+	files, _ := persist.LogFiles(basepath)
+	ol, err := openLog(basepath, len(files) == 0, c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM)
+	out := bufio.NewWriter(os.Stdout)
+	fmt.Fprintf(out, "start %d\n", c.s.ops)
+	for {
+		select {
+		case <-stop:
+			ol.close()
+			out.Flush()
+			return 0
+		default:
+		}
+		if err := c.do(ol, *seed, *keys); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		// the report must not lag behind by more than the operation in flight
+		fmt.Fprintf(out, "ack %d\n", c.s.ops)
+		out.Flush()
+	}
+}
+
+// harness runs the writer through cycles of writes and crashes
+type harness struct {
+	basepath string
+	rnd      *rand.Rand
+	sim      *store // simulated state after the operations verified so far
+	cycles   int
+	crashes  int
+	repairs  int // log sets repaired using PlanRepair
+	torn     int // partially written records truncated
+}
+
+func (h *harness) run(deadline time.Time) error {
+	for time.Now().Before(deadline) {
+		crash := h.rnd.Intn(5) != 0
+		start, acked, err := h.cycle(crash, time.Duration(20+h.rnd.Intn(480))*time.Millisecond)
+		if err != nil {
+			return err
+		}
+		if start != h.sim.ops {
+			return fmt.Errorf("writer replayed %d operations, %d were verified", start,
+				h.sim.ops)
+		}
+		if err := h.verify(acked, crash); err != nil {
+			return err
+		}
+		h.throttle()
+		h.cycles++
+		if crash {
+			h.crashes++
+		}
+		if h.cycles%50 == 0 {
+			fmt.Printf("persistsoak: %d cycles, %d operations\n", h.cycles, h.sim.ops)
+		}
+	}
+	return nil
+}
+
+// cycle runs the writer for a while and kills it or stops it cleanly, it returns the
+// number of operations the writer replayed and the number it acknowledged
+func (h *harness) cycle(crash bool, d time.Duration) (int, int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, 0, err
+	}
+	cmd := exec.Command(exe, "-writer", "-dir", filepath.Dir(h.basepath),
+		"-seed", strconv.FormatInt(*seed, 10), "-keys", strconv.Itoa(*keys),
+		"-size-limit", strconv.Itoa(*sizeLimit))
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, 0, err
+	}
+	reports := make(chan struct{})
+	var startV, ackedV int64 = -1, -1
+	go func() {
+		s := bufio.NewScanner(stdout)
+		for s.Scan() {
+			f := strings.Fields(s.Text())
+			if len(f) != 2 {
+				continue
+			}
+			n, _ := strconv.ParseInt(f[1], 10, 64)
+			if f[0] == "start" {
+				atomic.StoreInt64(&startV, n)
+			}
+			atomic.StoreInt64(&ackedV, n)
+		}
+		close(reports)
+	}()
+	time.Sleep(d)
+	if crash {
+		cmd.Process.Kill()
+	} else {
+		cmd.Process.Signal(syscall.SIGTERM)
+	}
+	<-reports
+	err = cmd.Wait()
+	start, acked := int(atomic.LoadInt64(&startV)), int(atomic.LoadInt64(&ackedV))
+	if start < 0 || !crash && err != nil {
+		return 0, 0, fmt.Errorf("writer failed: %v: %s", err, stderr.String())
+	}
+	return start, acked, nil
+}
+
+// verify reopens the log set and checks that the replayed state is the simulated state
+// after the operations acknowledged by the writer, or after one more if it crashed
+func (h *harness) verify(acked int, crash bool) error {
+	var c *client
+	var ol *openedLog
+	for {
+		c = &client{s: newStore()}
+		var err error
+		if ol, err = openLog(h.basepath, false, c); err == nil {
+			break
+		}
+		if err = h.repair(err); err != nil {
+			return err
+		}
+	}
+	ol.close()
+	max := acked
+	if crash {
+		max++
+	}
+	if c.s.ops < acked || c.s.ops > max {
+		return fmt.Errorf("replayed %d operations, the writer acknowledged %d", c.s.ops,
+			acked)
+	}
+	for h.sim.ops < c.s.ops {
+		h.sim.apply(operation(*seed, h.sim.ops, *keys))
+	}
+	if c.s.fingerprint() != h.sim.fingerprint() {
+		return fmt.Errorf("the state replayed after %d operations has the wrong fingerprint",
+			c.s.ops)
+	}
+	return h.cleanup()
+}
+
+// repair fixes a log set that cannot be opened, either its files or the end of the latest
+// log file
+func (h *harness) repair(openErr error) error {
+	actions, err := persist.PlanRepair(h.basepath)
+	if err == nil && len(actions) > 0 {
+		err = persist.Repair(actions)
+		h.repairs++
+	} else if err == nil {
+		var torn bool
+		if torn, err = truncateTorn(h.basepath); err == nil && !torn {
+			err = openErr
+		} else if torn {
+			h.torn++
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("cannot open the log set: %s", err.Error())
+	}
+	return nil
+}
+
+// cleanup removes the files that are no longer needed such that long runs don't fill the
+// disk
+func (h *harness) cleanup() error {
+	names, err := filepath.Glob(h.basepath + "-*")
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if strings.HasSuffix(n, "-old.plog") || strings.HasSuffix(n, ".aside") {
+			os.Remove(n)
+		}
+	}
+	return nil
+}
+
+// throttle waits for the next second if the log set rotated a lot in this one: log file
+// names have a timestamp to the second and a one-letter suffix, hence a log set cannot
+// rotate more than 27 times a second
+func (h *harness) throttle() {
+	now := time.Now().UTC()
+	names, _ := filepath.Glob(h.basepath + now.Format("-20060102-150405") + "*")
+	for _, n := range names {
+		if n[len(h.basepath)+16] >= 'k' {
+			time.Sleep(now.Truncate(time.Second).Add(time.Second).Sub(now))
+			return
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rightscale/persist"
+)
+
+// the events of the key-value store the soak test persists: live puts and deletes carry
+// the number of the operation, snapshot puts don't and are followed by a mark
+type (
+	putEvent struct {
+		Key, Value string
+		Op         int // -1 in snapshots
+	}
+	delEvent struct {
+		Key string
+		Op  int
+	}
+	markEvent struct {
+		Ops int // number of operations applied to the snapshot's state
+	}
+)
+
+func init() {
+	persist.Register(&putEvent{})
+	persist.Register(&delEvent{})
+	persist.Register(&markEvent{})
+}
+
+// store is the state of the soak test, a key-value map and the number of operations
+// applied to it
+type store struct {
+	data map[string]string
+	ops  int
+}
+
+func newStore() *store { return &store{data: make(map[string]string)} }
+
+// apply applies an event to the store
+func (s *store) apply(ev interface{}) error {
+	switch ev := ev.(type) {
+	case *putEvent:
+		s.data[ev.Key] = ev.Value
+		if ev.Op >= 0 {
+			s.ops = ev.Op + 1
+		}
+	case *delEvent:
+		delete(s.data, ev.Key)
+		s.ops = ev.Op + 1
+	case *markEvent:
+		s.ops = ev.Ops
+	default:
+		return fmt.Errorf("unexpected event %T", ev)
+	}
+	return nil
+}
+
+// fingerprint returns a hash of the store's content
+func (s *store) fingerprint() uint64 {
+	keys := make([]string, 0, len(s.data))
+	for k := range s.data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := fnv.New64a()
+	for _, k := range keys {
+		io.WriteString(h, k+"="+s.data[k]+"\n")
+	}
+	io.WriteString(h, strconv.Itoa(s.ops))
+	return h.Sum64()
+}
+
+// operation returns the event of operation op of the sequence determined by seed, the
+// sequence being the same for the writer and for the harness, which simulates it
+func operation(seed int64, op, keys int) interface{} {
+	h := splitmix(uint64(seed) + uint64(op))
+	key := "k" + strconv.Itoa(int(h%uint64(keys)))
+	h = splitmix(h)
+	if h%5 == 0 {
+		return &delEvent{Key: key, Op: op}
+	}
+	h = splitmix(h)
+	word := strconv.FormatUint(h, 36)
+	return &putEvent{Key: key, Value: strings.Repeat(word, 1+int(h%16)), Op: op}
+}
+
+func splitmix(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// client is the log client of the store, the mutex orders the operations and the snapshot
+type client struct {
+	mu sync.Mutex
+	s  *store
+}
+
+func (c *client) Replay(ev interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.s.apply(ev)
+}
+
+func (c *client) PersistAll(pl persist.Log) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, v := range c.s.data {
+		pl.Output(&putEvent{Key: k, Value: v, Op: -1})
+	}
+	pl.Output(&markEvent{Ops: c.s.ops})
+}
+
+// do applies and outputs the next operation
+func (c *client) do(pl persist.Log, seed int64, keys int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ev := operation(seed, c.s.ops, keys)
+	c.s.apply(ev)
+	return pl.Output(ev)
+}
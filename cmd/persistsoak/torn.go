@@ -0,0 +1,65 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rightscale/persist"
+)
+
+// countingReader counts the bytes read, it implements io.ByteReader so the gob decoder
+// doesn't add buffering of its own and the count reflects what has been decoded
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.n++
+	}
+	return b, err
+}
+
+// truncateTorn truncates the latest log file of the log set after its last complete record
+// and returns true if it ended with a partial one. A SIGKILL can interrupt the write of a
+// record at a page boundary, which leaves the record partially written, and persist fails
+// the replay rather than silently dropping the end of a log, hence the harness repairs the
+// log file like an operator would.
+func truncateTorn(basepath string) (bool, error) {
+	names, err := persist.LogFiles(basepath)
+	if err != nil || len(names) == 0 {
+		return false, err
+	}
+	name := names[len(names)-1]
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	cr := &countingReader{r: bufio.NewReader(f)}
+	dec := persist.GobCodec.NewDecoder(cr)
+	for {
+		end := cr.n
+		_, err := dec.Decode()
+		switch {
+		case err == io.EOF:
+			return false, nil
+		case err == io.ErrUnexpectedEOF:
+			return true, os.Truncate(name, end)
+		case err != nil:
+			return false, fmt.Errorf("%s is corrupt at offset %d: %s", name, end, err.Error())
+		}
+	}
+}
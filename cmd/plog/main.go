@@ -0,0 +1,16 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+// Command plog inspects persist log files, see package plog. It doesn't know any
+// application event types, build a tool of your own that registers them in order to
+// decode the events.
+package main
+
+import (
+	"os"
+
+	"github.com/rightscale/persist/plog"
+)
+
+func main() {
+	os.Exit(plog.Main(os.Args[1:], os.Stdout, os.Stderr))
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+// Command plogrepair detects and fixes log sets left in a state that cannot be opened,
+// typically due to a crash during a rotation. It prints the repair plan and only performs
+// it when given -apply, see persist.PlanRepair for the rules it follows.
+//
+// Usage: plogrepair [-apply] <basepath>
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rightscale/persist"
+)
+
+func main() {
+	apply := flag.Bool("apply", false, "perform the repair instead of just printing the plan")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: plogrepair [-apply] <basepath>\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	basepath := flag.Arg(0)
+
+	actions, err := persist.PlanRepair(basepath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "plogrepair: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if len(actions) == 0 {
+		if _, err := persist.ReplayFiles(basepath); err != nil {
+			fmt.Fprintf(os.Stderr, "plogrepair: no repair possible: %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("%s: log set is healthy\n", basepath)
+		return
+	}
+	for _, a := range actions {
+		fmt.Printf("mv %s %s  # %s\n", a.From, a.To, a.Reason)
+	}
+	if !*apply {
+		fmt.Printf("dry run, use -apply to perform the repair\n")
+		return
+	}
+	if err := persist.Repair(actions); err != nil {
+		fmt.Fprintf(os.Stderr, "plogrepair: %s\n", err.Error())
+		os.Exit(1)
+	}
+	fmt.Printf("%s: repaired\n", basepath)
+}
@@ -0,0 +1,258 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// A Codec serializes log events. It produces encoders that write a stream of events and
+// decoders that read such a stream back. Each log rotation starts a fresh stream.
+type Codec interface {
+	NewEncoder(w io.Writer) Encoder
+	NewDecoder(r io.Reader) Decoder
+}
+
+// An Encoder writes events to a stream
+type Encoder interface {
+	Encode(logEvent interface{}) error
+}
+
+// A Decoder reads events from a stream, Decode returns io.EOF at the end of the stream
+type Decoder interface {
+	Decode() (interface{}, error)
+}
+
+// GobCodec is the default codec, it uses gob serialization and requires all event types
+// to be registered using Register. When decoding it limits messages to 64MB, streams to
+// 10000 type definitions, and events to 1000 levels of nesting, see GobCodecWithLimits.
+var GobCodec Codec = gobCodec{limits: defaultDecodeLimits}
+
+// WithCodec makes the log encode and replay its events using codec instead of GobCodec,
+// e.g. CompressedCodec, such that applications can swap the serialization without forking
+// persist, a nil codec selects GobCodec. The destinations don't record the codec, the log
+// must thus always be opened with the same one, and the plog tool only reads logs written
+// using the gob codec. WithDecodeLimits and WithTypeRegistry modify the gob codec the log
+// uses, in any order with respect to WithCodec, and NewLog fails if they're combined with
+// another codec. Handoff requires the gob codec.
+func WithCodec(codec Codec) LogOption {
+	return func(pl *pLog) {
+		if codec == nil {
+			codec = GobCodec
+		}
+		pl.codec = codec
+	}
+}
+
+// resolveCodec applies WithTypeRegistry and WithDecodeLimits to the gob codec once all the
+// options are applied, such that their order doesn't matter
+func (pl *pLog) resolveCodec() error {
+	if pl.typeReg == nil && pl.decodeLimits == nil {
+		return nil
+	}
+	gc, ok := pl.codec.(gobCodec)
+	if !ok {
+		return fmt.Errorf("WithTypeRegistry and WithDecodeLimits require the gob codec, " +
+			"the log uses another codec, see WithCodec")
+	}
+	if pl.typeReg != nil {
+		gc.reg = pl.typeReg
+	}
+	if pl.decodeLimits != nil {
+		gc.limits = *pl.decodeLimits
+	}
+	pl.codec = gc
+	return nil
+}
+
+type gobCodec struct {
+	limits DecodeLimits
+	reg    *TypeRegistry // nil to use gob's global registry
+}
+
+func (gc gobCodec) NewEncoder(w io.Writer) Encoder {
+	rb := &recordBuffer{w: w}
+	if gc.reg != nil {
+		return registryEncoder{enc: gob.NewEncoder(rb), reg: gc.reg, rb: rb}
+	}
+	return gobEncoder{enc: gob.NewEncoder(rb), rb: rb}
+}
+
+// recordBuffer collects the messages gob writes for a record, i.e., the definitions of the
+// types the record introduces and its value, such that the record reaches the destination
+// in a single write and a crash can't leave part of it at the end of the log
+type recordBuffer struct {
+	bytes.Buffer
+	w    io.Writer
+	fast []byte // reused to encode fast records, see appendFast
+}
+
+// flush writes the record, what gob produced is written even if encoding failed since the
+// encoder assumes the types it defined were sent
+func (rb *recordBuffer) flush(err error) error {
+	if rb.Len() == 0 {
+		return err
+	}
+	n, werr := rb.w.Write(rb.Bytes())
+	if werr == nil && n != rb.Len() {
+		werr = io.ErrShortWrite
+	}
+	rb.Reset()
+	if err == nil {
+		err = werr
+	}
+	return err
+}
+
+// writeFast writes the fast record of the event if it's a FastEvent whose type has a name,
+// it returns false otherwise
+func (rb *recordBuffer) writeFast(ev interface{},
+	name func(reflect.Type) (string, bool)) (bool, error) {
+
+	if cap(rb.fast) < fastHeaderSize {
+		rb.fast = make([]byte, fastHeaderSize, 256)
+	}
+	b, ok := appendFast(rb.fast[:fastHeaderSize], ev, name)
+	if !ok {
+		return false, nil
+	}
+	rb.fast = b
+	rec := frameFast(b)
+	n, err := rb.w.Write(rec)
+	if err == nil && n != len(rec) {
+		err = io.ErrShortWrite
+	}
+	return true, err
+}
+
+func (gc gobCodec) NewDecoder(r io.Reader) Decoder {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	sd := withSequence(gc.streamDecoder(br))
+	if gc.reg == nil {
+		// gob doesn't read ahead of a byteReader, so a decoder created later picks up the
+		// stream where the previous one left off
+		sd.restart = func() Decoder { return gc.streamDecoder(br) }
+	} else {
+		sd.restart = func() Decoder { return sd.Decoder.(*registryDecoder).restart() }
+	}
+	return sd
+}
+
+// streamDecoder returns a decoder of the stream read from r
+func (gc gobCodec) streamDecoder(r byteReader) Decoder {
+	var rr io.Reader = r
+	if gc.limits.MaxRecordSize > 0 || gc.limits.MaxTypes > 0 {
+		rr = newLimitReader(r, gc.limits)
+	}
+	if gc.reg != nil {
+		return newRegistryDecoder(rr, gc.reg, gc.limits.MaxDepth)
+	}
+	return newGobDecoder(rr, gc.limits.MaxDepth)
+}
+
+type gobEncoder struct {
+	enc *gob.Encoder
+	rb  *recordBuffer
+}
+
+func (ge gobEncoder) Encode(logEvent interface{}) error {
+	if ok, err := ge.rb.writeFast(logEvent, fastName); ok {
+		return err
+	}
+	// perverse stuff: we need to slap the event into an interface{} so gob later allows
+	// us to decode into an interface{}
+	var t interface{} = logEvent
+	return ge.rb.flush(ge.enc.Encode(&t))
+}
+
+type gobDecoder struct {
+	dec      *gob.Decoder
+	fs       *fastStream // nil if the stream has no fast records
+	maxDepth int
+}
+
+func newGobDecoder(r io.Reader, maxDepth int) gobDecoder {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	fs := &fastStream{r: br}
+	return gobDecoder{dec: gob.NewDecoder(fs), fs: fs, maxDepth: maxDepth}
+}
+
+func (gd gobDecoder) Decode() (interface{}, error) {
+	var ev interface{}
+	var err error
+	if rec, ok, ferr := gd.fs.next(); ferr != nil {
+		return nil, ferr
+	} else if ok {
+		ev, err = rec.decode()
+	} else {
+		err = gd.dec.Decode(&ev)
+	}
+	if err == nil && gd.maxDepth > 0 && tooDeep(reflect.ValueOf(ev), gd.maxDepth) {
+		return nil, fmt.Errorf("%T event nests more than %d levels deep", ev, gd.maxDepth)
+	}
+	return ev, err
+}
+
+// frameDecoder returns a decoder of the events of a shard frame, see ParallelSnapshot
+func (gd gobDecoder) frameDecoder(r io.Reader) Decoder {
+	return newGobDecoder(r, gd.maxDepth)
+}
+
+// fastStream passes the stream on to the gob decoder and takes the fast records out of it,
+// see appendFast. It reads the first byte of each record to tell them apart from gob
+// messages and hands it back to gob otherwise, and never reads ahead of what it needs.
+type fastStream struct {
+	r      byteReader
+	peeked bool // b was read and is yet to be passed on
+	b      byte
+	buf    []byte // body of the last fast record
+}
+
+func (fs *fastStream) Read(p []byte) (int, error) {
+	if fs.peeked && len(p) > 0 {
+		fs.peeked = false
+		p[0] = fs.b
+		return 1, nil
+	}
+	return fs.r.Read(p)
+}
+
+func (fs *fastStream) ReadByte() (byte, error) {
+	if fs.peeked {
+		fs.peeked = false
+		return fs.b, nil
+	}
+	return fs.r.ReadByte()
+}
+
+// next reads the fast record that comes next in the stream, it returns false if a gob
+// message comes next instead, which includes a nil stream
+func (fs *fastStream) next() (fastRecord, bool, error) {
+	if fs == nil || fs.peeked {
+		return fastRecord{}, false, nil
+	}
+	b, err := fs.r.ReadByte()
+	if err != nil {
+		return fastRecord{}, false, err
+	}
+	if b != 0 {
+		fs.peeked, fs.b = true, b
+		return fastRecord{}, false, nil
+	}
+	if fs.buf, err = readFast(fs.r, fs.buf); err != nil {
+		return fastRecord{}, false, err
+	}
+	rec, err := parseFast(fs.buf)
+	return rec, err == nil, err
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// codec writing one line of JSON per event, for testing only, it cannot decode
+type jsonLinesCodec struct{}
+
+func (jsonLinesCodec) NewEncoder(w io.Writer) Encoder {
+	return jsonLinesEncoder{json.NewEncoder(w)}
+}
+func (jsonLinesCodec) NewDecoder(r io.Reader) Decoder { return nil }
+
+type jsonLinesEncoder struct{ enc *json.Encoder }
+
+func (je jsonLinesEncoder) Encode(logEvent interface{}) error {
+	return je.enc.Encode(map[string]interface{}{
+		"type": fmt.Sprintf("%T", logEvent), "event": logEvent})
+}
+
+var _ = Describe("Secondary codec", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+
+	It("encodes the secondary with its own codec", func() {
+		fd, err := NewFileDest(PT+"/audit", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &testLogClient{}, log15.Root(),
+			WithSecondaryCodec(jsonLinesCodec{}))
+		Ω(err).ShouldNot(HaveOccurred())
+		var sec bytes.Buffer
+		Ω(pl.SetSecondaryDestination(NewWriterDest(&sec, nil))).ShouldNot(HaveOccurred())
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(2.0))
+		Ω(pl.Output(&logEv2{A: 1, B: "live"})).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		lines := strings.Split(strings.TrimSpace(sec.String()), "\n")
+		Ω(lines).Should(HaveLen(5))
+		Ω(lines[0]).Should(HavePrefix("{"))
+		Ω(lines[0]).Should(ContainSubstring(`"type":"*persist.GenerationMeta"`))
+		Ω(lines[0]).Should(ContainSubstring(`"Gen":2`))
+		Ω(lines[1]).Should(MatchJSON(`{"type":"*persist.logEv1","event":{"S":"hello world #1!"}}`))
+		Ω(lines[4]).Should(MatchJSON(`{"type":"*persist.logEv2","event":{"A":1,"B":"live"}}`))
+
+		By("replaying the primary, which stays gob")
+		fd, err = NewFileDest(PT+"/audit", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{}
+		pl, err = NewLog(fd, rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(HaveLen(4))
+		Ω(rc.events[3]).Should(Equal(&logEv2{A: 1, B: "live"}))
+		pl.(*pLog).Close()
+	})
+})
+
+var _ = Describe("WithCodec", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	codec := CompressedCodec(GobCodec, flateCompressor{name: "flate"})
+	events := []interface{}{&logEv1{S: strings.Repeat("compressible ", 100)}, &logEv2{A: 1}}
+
+	It("encodes and replays the log using the codec", func() {
+		fd, err := NewFileDest(PT+"/codec", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{events: events}, log15.Root(), WithCodec(codec))
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+		files, err := LogFiles(PT + "/codec")
+		Ω(err).ShouldNot(HaveOccurred())
+		data, err := os.ReadFile(files[0])
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(data)).ShouldNot(ContainSubstring("compressible compressible"))
+
+		fd, err = NewFileDest(PT+"/codec", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{}
+		pl, err = NewLog(fd, rc, log15.Root(), WithCodec(codec))
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+		Ω(rc.events).Should(Equal(events))
+
+		By("failing to replay the log using another codec")
+		fd, err = NewFileDest(PT+"/codec", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = NewLog(fd, &recordingClient{}, log15.Root(), WithCodec(nil))
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("applies the gob codec options in any order", func() {
+		reg := NewTypeRegistry()
+		limits := DecodeLimits{MaxDepth: 10}
+		gob := WithCodec(GobCodecWithLimits(DecodeLimits{MaxTypes: 5}))
+		for _, opts := range [][]LogOption{
+			{gob, WithTypeRegistry(reg), WithDecodeLimits(limits)},
+			{WithTypeRegistry(reg), WithDecodeLimits(limits), gob},
+		} {
+			fd, err := NewFileDest(PT+"/codec", true, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			pl, err := NewLog(fd, &recordingClient{}, log15.Root(), opts...)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(pl.(*pLog).codec).Should(Equal(gobCodec{limits: limits, reg: reg}))
+			pl.(*pLog).Close()
+			os.RemoveAll(PT)
+			os.Mkdir(PT, 0777)
+		}
+	})
+
+	It("refuses gob codec options with another codec in any order", func() {
+		for _, opts := range [][]LogOption{
+			{WithCodec(codec), WithTypeRegistry(NewTypeRegistry())},
+			{WithDecodeLimits(DecodeLimits{MaxDepth: 10}), WithCodec(codec)},
+		} {
+			fd, err := NewFileDest(PT+"/codec", true, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			_, err = NewLog(fd, &recordingClient{}, log15.Root(), opts...)
+			fd.Close()
+			Ω(err).Should(MatchError(ContainSubstring("require the gob codec")))
+		}
+	})
+})
+
+// event type registered under a name unrelated to its Go type
+type namedEv struct{ X int }
+
+func init() {
+	RegisterNamed("acme.Widget", &namedEv{})
+}
+
+var _ = Describe("RegisterNamed", func() {
+
+	It("identifies types by their registered name", func() {
+		var buf bytes.Buffer
+		Ω(GobCodec.NewEncoder(&buf).Encode(&namedEv{X: 7})).ShouldNot(HaveOccurred())
+		Ω(buf.String()).Should(ContainSubstring("acme.Widget"))
+		Ω(buf.String()).ShouldNot(ContainSubstring("persist.namedEv"))
+
+		rc := &recordingClient{}
+		n, err := ReplayFrom(&buf, nil, rc)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(n).Should(Equal(1))
+		Ω(rc.events).Should(Equal([]interface{}{&namedEv{X: 7}}))
+	})
+})
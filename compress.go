@@ -0,0 +1,194 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A Compressor compresses blocks of data, it's typically a thin adapter around a fast block
+// compression library, e.g. github.com/golang/snappy's Encode and Decode have the right
+// signatures. The lz4 subpackage provides a Compressor using LZ4 block compression.
+type Compressor interface {
+	// Name identifies the compression in the streams it writes, a stream can only be
+	// decoded with a Compressor that has the same name
+	Name() string
+	// Compress appends the compressed src to dst, which may be nil, and returns it
+	Compress(dst, src []byte) []byte
+	// Decompress returns the decompressed src, using dst if it's large enough
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+// compressMinSize is the size under which records are stored without compression
+const compressMinSize = 64
+
+// frame flags, see compressedEncoder
+const (
+	frameStored     = 0
+	frameCompressed = 1
+)
+
+// CompressedCodec returns a codec that compresses each record encoded by codec on its own,
+// which keeps the records self-contained: each one is written to the destination by a
+// single Write, as without compression, and nothing needs to be flushed. Records smaller
+// than 64 bytes, or that don't shrink, are stored as they are. It suits block compressors
+// such as snappy and LZ4, whose cost per record is negligible compared to streaming
+// compressors such as gzip. The codec can be used wherever persist accepts one, e.g. with
+// WithCodec, WithSecondaryCodec, or ReplayFrom, streams are decoded by the same codec.
+func CompressedCodec(codec Codec, comp Compressor) Codec {
+	return compressedCodec{codec: codec, comp: comp}
+}
+
+type compressedCodec struct {
+	codec Codec
+	comp  Compressor
+}
+
+func (cc compressedCodec) NewEncoder(w io.Writer) Encoder {
+	ce := &compressedEncoder{w: w, comp: cc.comp}
+	ce.enc = cc.codec.NewEncoder(&ce.buf)
+	return ce
+}
+
+func (cc compressedCodec) NewDecoder(r io.Reader) Decoder {
+	return cc.codec.NewDecoder(&frameReader{r: bufio.NewReader(r), comp: cc.comp})
+}
+
+// compressedEncoder writes each record as a frame: its length as a uvarint, a flag telling
+// whether it's compressed, and the data. The stream starts with the compressor's name.
+type compressedEncoder struct {
+	enc     Encoder      // encoder of the uncompressed stream into buf
+	buf     bytes.Buffer // uncompressed record
+	w       io.Writer
+	comp    Compressor
+	frame   []byte // frame being written, reused from one record to the next
+	started bool   // the stream header was written
+}
+
+func (ce *compressedEncoder) Encode(logEvent interface{}) error {
+	ce.buf.Reset()
+	if err := ce.enc.Encode(logEvent); err != nil {
+		return err
+	}
+	ce.frame = ce.frame[:0]
+	if !ce.started {
+		ce.frame = AppendString(ce.frame, ce.comp.Name())
+	}
+	data, flag := ce.buf.Bytes(), byte(frameStored)
+	if len(data) >= compressMinSize {
+		if c := ce.comp.Compress(nil, data); len(c) < len(data) {
+			data, flag = c, frameCompressed
+		}
+	}
+	ce.frame = append(AppendUint(ce.frame, uint64(len(data)+1)), flag)
+	ce.frame = append(ce.frame, data...)
+	if _, err := ce.w.Write(ce.frame); err != nil {
+		return err
+	}
+	ce.started = true
+	return nil
+}
+
+// frameReader reads the uncompressed stream of a compressedEncoder
+type frameReader struct {
+	r       *bufio.Reader
+	comp    Compressor
+	started bool   // the stream header was read
+	data    []byte // uncompressed record being read
+	frame   []byte // frame being read, reused from one frame to the next
+	scratch []byte // buffer for decompressing records
+	err     error  // sticky error
+}
+
+func (fr *frameReader) Read(p []byte) (int, error) {
+	for len(fr.data) == 0 {
+		if err := fr.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, fr.data)
+	fr.data = fr.data[n:]
+	return n, nil
+}
+
+func (fr *frameReader) ReadByte() (byte, error) {
+	for len(fr.data) == 0 {
+		if err := fr.next(); err != nil {
+			return 0, err
+		}
+	}
+	b := fr.data[0]
+	fr.data = fr.data[1:]
+	return b, nil
+}
+
+// next reads the next frame, it returns io.EOF at the end of the stream
+func (fr *frameReader) next() error {
+	if fr.err != nil {
+		return fr.err
+	}
+	if !fr.started {
+		name, err := fr.readFrame()
+		if err != nil {
+			return fr.fail(err)
+		}
+		if string(name) != fr.comp.Name() {
+			return fr.fail(fmt.Errorf("stream is compressed with %q, not %q", name,
+				fr.comp.Name()))
+		}
+		fr.started = true
+	}
+	frame, err := fr.readFrame()
+	if err != nil {
+		return fr.fail(err)
+	}
+	if len(frame) == 0 {
+		return fr.fail(fmt.Errorf("invalid compressed frame"))
+	}
+	switch frame[0] {
+	case frameStored:
+		fr.data = frame[1:]
+	case frameCompressed:
+		fr.data, err = fr.comp.Decompress(fr.scratch[:cap(fr.scratch)], frame[1:])
+		if err != nil {
+			return fr.fail(fmt.Errorf("cannot decompress record: %s", err.Error()))
+		}
+		if cap(fr.data) > cap(fr.scratch) {
+			fr.scratch = fr.data
+		}
+	default:
+		return fr.fail(fmt.Errorf("unknown compressed frame flag %d", frame[0]))
+	}
+	return nil
+}
+
+// readFrame reads a length-prefixed frame, it returns io.EOF at the end of the stream and
+// io.ErrUnexpectedEOF if the stream ends within a frame. The frame is only valid until the
+// next call.
+func (fr *frameReader) readFrame() ([]byte, error) {
+	n, err := binary.ReadUvarint(fr.r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(defaultDecodeLimits.MaxRecordSize) {
+		return nil, fmt.Errorf("compressed frame of %d bytes exceeds the record size "+
+			"limit", n)
+	}
+	if uint64(cap(fr.frame)) < n {
+		fr.frame = make([]byte, n)
+	}
+	b := fr.frame[:n]
+	if _, err := io.ReadFull(fr.r, b); err != nil {
+		return nil, eofInRecord(err)
+	}
+	return b, nil
+}
+
+func (fr *frameReader) fail(err error) error {
+	fr.err = err
+	return err
+}
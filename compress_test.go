@@ -0,0 +1,103 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// flateCompressor stands in for a block compressor such as snappy
+type flateCompressor struct{ name string }
+
+func (fc flateCompressor) Name() string { return fc.name }
+
+func (fc flateCompressor) Compress(dst, src []byte) []byte {
+	buf := bytes.NewBuffer(dst)
+	w, _ := flate.NewWriter(buf, flate.BestSpeed)
+	w.Write(src)
+	w.Close()
+	return buf.Bytes()
+}
+
+func (fc flateCompressor) Decompress(dst, src []byte) ([]byte, error) {
+	return ioutil.ReadAll(flate.NewReader(bytes.NewReader(src)))
+}
+
+// countingWriter counts the writes made to a buffer
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.writes++
+	return cw.Buffer.Write(p)
+}
+
+var _ = Describe("CompressedCodec", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	codec := CompressedCodec(GobCodec, flateCompressor{name: "flate"})
+	long := strings.Repeat("compressible ", 50)
+
+	It("compresses each record in a single write", func() {
+		var plain bytes.Buffer
+		var compressed countingWriter
+		enc, penc := codec.NewEncoder(&compressed), GobCodec.NewEncoder(&plain)
+		events := []interface{}{&logEv1{S: "short"}, &logEv1{S: long}, &logEv2{A: 1, B: long}}
+		for _, ev := range events {
+			Ω(enc.Encode(ev)).ShouldNot(HaveOccurred())
+			Ω(penc.Encode(ev)).ShouldNot(HaveOccurred())
+		}
+		Ω(compressed.writes).Should(Equal(len(events)))
+		Ω(compressed.Len()).Should(BeNumerically("<", plain.Len()/2))
+
+		rc := &recordingClient{}
+		n, err := ReplayFrom(bytes.NewReader(compressed.Bytes()), codec, rc)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(n).Should(Equal(3))
+		Ω(rc.events).Should(Equal(events))
+
+		By("failing on truncated streams")
+		_, err = ReplayFrom(bytes.NewReader(compressed.Bytes()[:compressed.Len()-1]), codec,
+			&recordingClient{})
+		Ω(err).Should(MatchError(ContainSubstring(io.ErrUnexpectedEOF.Error())))
+
+		By("refusing streams written with another compressor")
+		other := CompressedCodec(GobCodec, flateCompressor{name: "other"})
+		_, err = ReplayFrom(bytes.NewReader(compressed.Bytes()), other, &recordingClient{})
+		Ω(err).Should(MatchError(ContainSubstring(`compressed with "flate", not "other"`)))
+	})
+
+	It("compresses a secondary destination", func() {
+		fd, err := NewFileDest(PT+"/compressed", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{events: []interface{}{&logEv1{S: long}}}
+		pl, err := NewLog(fd, rc, log15.Root(), WithSecondaryCodec(codec))
+		Ω(err).ShouldNot(HaveOccurred())
+		var sec bytes.Buffer
+		Ω(pl.SetSecondaryDestination(NewWriterDest(&sec, nil))).ShouldNot(HaveOccurred())
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(2.0))
+		Ω(pl.Output(&logEv2{A: 1, B: long})).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		replayed := &recordingClient{}
+		_, err = ReplayFrom(&sec, codec, replayed)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(replayed.events).Should(Equal([]interface{}{&logEv1{S: long}, &logEv2{A: 1, B: long}}))
+	})
+})
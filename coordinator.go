@@ -0,0 +1,213 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// A Coordinator rotates the logs of an application that runs several of them, e.g., one
+// per shard, at a point that is consistent across all of them. Rotate stops the outputs
+// of all the logs while each one starts its fresh stream, hence the generation each log
+// ends at that point, the cut, holds the events output before it and none of the events
+// output after it. The cut is numbered by an epoch, which the metadata record of the
+// generation that starts at the cut records, see GenerationMeta, and the generations that
+// follow carry forward, such that a restore can replay the generation that ends at the
+// cut of the same epoch in every log and obtain a mutually consistent state, see
+// ConsistentCut.
+type Coordinator struct {
+	mu   sync.Mutex // serializes the rotations
+	logs []*pLog
+}
+
+// NewCoordinator returns a coordinator of logs created by NewLog, whose destinations must
+// be able to rotate. The logs must not write to one another, e.g., using a ChainedDest.
+func NewCoordinator(logs ...Log) (*Coordinator, error) {
+	c := &Coordinator{}
+	seen := make(map[*pLog]bool)
+	for i, log := range logs {
+		pl, ok := log.(*pLog)
+		if !ok {
+			return nil, fmt.Errorf("Coordinator requires logs created by NewLog")
+		}
+		if !pl.priCaps.CanRotate {
+			return nil, fmt.Errorf("log %d cannot be coordinated, its destination cannot "+
+				"rotate", i)
+		}
+		if seen[pl] {
+			return nil, fmt.Errorf("log %d is passed more than once", i)
+		}
+		seen[pl] = true
+		c.logs = append(c.logs, pl)
+	}
+	return c, nil
+}
+
+// Rotate rotates all the logs at a consistent cut and waits for their snapshots to
+// complete, it returns the epoch of the cut. It waits for rotations in progress to
+// complete first. The epoch is greater than the epochs of all the generations the logs
+// have written or replayed. The cut is only usable if Rotate returns no error, i.e., if
+// all the rotations completed, a log that fails is left in error state.
+func (c *Coordinator) Rotate() (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lockIdle()
+	var epoch uint64
+	for _, pl := range c.logs {
+		err := pl.checkState()
+		if err == nil && pl.handedOff {
+			err = fmt.Errorf("log was handed off")
+		}
+		if err != nil {
+			c.unlock()
+			return 0, err
+		}
+		if pl.epoch > epoch {
+			epoch = pl.epoch
+		}
+	}
+	epoch++
+
+	// start the fresh streams while all the logs are locked
+	rotations := make([]uint64, len(c.logs))
+	for i, pl := range c.logs {
+		pl.epoch, pl.cut = epoch, true
+		pl.rotating = true
+		pl.rotation++
+		rotations[i] = pl.rotation
+		pl.log.Info("Persist: starting coordinated rotation", "epoch", epoch)
+		if pl.startRotation() {
+			pl.runRotation(true)
+		}
+		pl.cut = false
+	}
+	c.unlock()
+
+	var err error
+	for i, pl := range c.logs {
+		if rerr := pl.awaitRotation(rotations[i]); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return epoch, err
+}
+
+// lockIdle locks all the logs once none of them is rotating or catching up
+func (c *Coordinator) lockIdle() {
+	for {
+		idle := true
+		for i, pl := range c.logs {
+			pl.Lock()
+			if pl.rotating || pl.catchingUp {
+				for _, locked := range c.logs[:i+1] {
+					locked.Unlock()
+				}
+				idle = false
+				break
+			}
+		}
+		if idle {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (c *Coordinator) unlock() {
+	for _, pl := range c.logs {
+		pl.Unlock()
+	}
+}
+
+// awaitRotation waits until rotation n is no longer in progress and returns the log's error
+// state, must be called without holding the lock
+func (pl *pLog) awaitRotation(n uint64) error {
+	for {
+		pl.Lock()
+		done, err := !pl.rotating || pl.rotation != n, pl.errState
+		pl.Unlock()
+		if err != nil || done {
+			return err
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// ConsistentCut finds the latest epoch of coordinated rotations, see Coordinator, whose cut
+// is available in all the log sets at basepaths, and returns it along with the log file of
+// each log set that ends at the cut, i.e., the file to replay, e.g., using ReplayFrom, to
+// restore the state of that log at the cut. It fails if the log sets have no cut in
+// common. The file of a cut holds a full snapshot unless the logs use delta snapshots, see
+// WithDeltaSnapshots, and older cuts are only found while their files are retained, see
+// RetainUnderUsage.
+func ConsistentCut(basepaths ...string) (uint64, []string, error) {
+	if len(basepaths) == 0 {
+		return 0, nil, fmt.Errorf("no log sets given")
+	}
+	cuts := make([]map[uint64]string, len(basepaths))
+	for i, bp := range basepaths {
+		var err error
+		if cuts[i], err = logSetCuts(bp); err != nil {
+			return 0, nil, err
+		}
+	}
+	var epoch uint64
+	for e := range cuts[0] {
+		common := true
+		for _, c := range cuts[1:] {
+			if _, ok := c[e]; !ok {
+				common = false
+				break
+			}
+		}
+		if common && e > epoch {
+			epoch = e
+		}
+	}
+	if epoch == 0 {
+		return 0, nil, fmt.Errorf("the log sets have no coordinated rotation in common")
+	}
+	files := make([]string, len(basepaths))
+	for i, c := range cuts {
+		files[i] = c[epoch]
+	}
+	return epoch, files, nil
+}
+
+// logSetCuts returns the log file of the log set that ends at each cut it has, by epoch
+func logSetCuts(basepath string) (map[uint64]string, error) {
+	files, err := LogFiles(basepath)
+	if err != nil {
+		return nil, err
+	}
+	cuts := make(map[uint64]string)
+	var prev *GenerationMeta
+	for i, name := range files {
+		m, err := fileMeta(name)
+		if err != nil {
+			return nil, err
+		}
+		if m != nil && m.Cut && prev != nil && prev.Gen+1 == m.Gen {
+			cuts[m.Epoch] = files[i-1]
+		}
+		prev = m
+	}
+	return cuts, nil
+}
+
+// fileMeta returns the metadata record of a log file, nil if it has none
+func fileMeta(name string) (*GenerationMeta, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := ReplayMeta(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err.Error())
+	}
+	return m, nil
+}
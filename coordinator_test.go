@@ -0,0 +1,117 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("Coordinator", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	shards := []string{PT + "/shard0", PT + "/shard1"}
+
+	open := func(basepath string, create bool) Log {
+		fd, err := NewFileDest(basepath, create, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{events: []interface{}{&logEv1{S: basepath}}}
+		pl, err := NewLog(fd, rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		return pl
+	}
+
+	// output outputs an event numbered by the log and the step to each log
+	output := func(logs []Log, step int) {
+		for i, pl := range logs {
+			Ω(pl.Output(&logEv2{A: 10*i + step})).ShouldNot(HaveOccurred())
+		}
+	}
+
+	It("rotates the logs at a cut that a restore finds", func() {
+		logs := []Log{open(shards[0], true), open(shards[1], true)}
+		c, err := NewCoordinator(logs...)
+		Ω(err).ShouldNot(HaveOccurred())
+		output(logs, 1)
+		Ω(c.Rotate()).Should(Equal(uint64(1)))
+		output(logs, 2)
+		Ω(c.Rotate()).Should(Equal(uint64(2)))
+		output(logs, 3)
+		for _, pl := range logs {
+			Ω(pl.Stats()["Epoch"]).Should(Equal(2.0))
+			Ω(pl.Stats()["Generation"]).Should(Equal(3.0))
+			pl.(*pLog).Close()
+		}
+
+		epoch, files, err := ConsistentCut(shards...)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(epoch).Should(Equal(uint64(2)))
+		Ω(files).Should(HaveLen(2))
+		for i, name := range files {
+			data, err := os.ReadFile(name)
+			Ω(err).ShouldNot(HaveOccurred())
+			rc := &recordingClient{}
+			_, err = ReplayFrom(bytes.NewReader(data), nil, rc)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(rc.events).Should(Equal([]interface{}{&logEv1{S: shards[i]},
+				&logEv2{A: 10*i + 2}}))
+		}
+
+		By("continuing the epochs after a restart")
+		logs = []Log{open(shards[0], false), open(shards[1], false)}
+		Ω(logs[0].Stats()["Epoch"]).Should(Equal(2.0))
+		c, err = NewCoordinator(logs...)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(c.Rotate()).Should(Equal(uint64(3)))
+		for _, pl := range logs {
+			pl.(*pLog).Close()
+		}
+		epoch, _, err = ConsistentCut(shards...)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(epoch).Should(Equal(uint64(3)))
+	})
+
+	It("finds no cut in log sets rotated separately", func() {
+		for _, bp := range shards {
+			pl := open(bp, true)
+			c, err := NewCoordinator(pl)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(c.Rotate()).Should(Equal(uint64(1)))
+			if bp == shards[0] {
+				Ω(c.Rotate()).Should(Equal(uint64(2)))
+			}
+			pl.(*pLog).Close()
+		}
+		epoch, _, err := ConsistentCut(shards...)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(epoch).Should(Equal(uint64(1)))
+
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+		open(shards[0], true).(*pLog).Close()
+		_, _, err = ConsistentCut(shards[0])
+		Ω(err).Should(MatchError(ContainSubstring("no coordinated rotation")))
+	})
+
+	It("requires logs that can rotate", func() {
+		pl, err := NewLog(NewWriterDest(&bytes.Buffer{}, nil), &recordingClient{},
+			log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = NewCoordinator(pl)
+		Ω(err).Should(MatchError(ContainSubstring("cannot rotate")))
+
+		pl = open(shards[0], true)
+		defer pl.(*pLog).Close()
+		_, err = NewCoordinator(pl, pl)
+		Ω(err).Should(MatchError("log 1 is passed more than once"))
+	})
+})
@@ -0,0 +1,46 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// WithWriteDeadlines sets the time after which a write to the primary or the secondary
+// destination is abandoned, 0 for none, such that a hung connection to a network or cloud
+// destination can't block Output, and the log, indefinitely. The deadlines only apply to
+// destinations that are ContextWriters, e.g. the HTTP destination, the writes of others
+// can't be interrupted. A primary write that misses its deadline puts the log into error
+// state, which HealthCheck reports until a rotation repairs it, while a secondary write
+// that misses it marks the secondary as failed, it's then caught up as after any other
+// error, see WithSecondaryRetry. By default writes have no deadline.
+func WithWriteDeadlines(primary, secondary time.Duration) LogOption {
+	return runtimeOption(func(pl *pLog) { pl.priTimeout, pl.secTimeout = primary, secondary })
+}
+
+// writeDest writes p to dest, abandoning the write when ctx is done or once timeout has
+// passed if dest is a ContextWriter. The error of a missed deadline is not ctx's error,
+// ctx may be nil.
+func writeDest(ctx context.Context, dest LogDestination, timeout time.Duration,
+	p []byte) (int, error) {
+
+	cw, ok := dest.(ContextWriter)
+	if !ok || ctx == nil && timeout <= 0 {
+		return dest.Write(p)
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if timeout <= 0 {
+		return cw.WriteContext(ctx, p)
+	}
+	wctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	n, err := cw.WriteContext(wctx, p)
+	if err != nil && ctx.Err() == nil && wctx.Err() != nil {
+		err = fmt.Errorf("write did not complete within %s", timeout)
+	}
+	return n, err
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("WithWriteDeadlines", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	It("fails the log when a primary write misses its deadline", func() {
+		fd, err := NewFileDest(PT+"/deadline", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		sd := &stallDest{LogDestination: fd}
+		pl, err := NewLog(sd, &recordingClient{}, log15.Root(),
+			WithWriteDeadlines(10*time.Millisecond, 0))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+
+		sd.stalled = true
+		err = pl.Output(&logEv1{S: "b"})
+		Ω(err).Should(MatchError(ContainSubstring("write did not complete within 10ms")))
+		Ω(pl.HealthCheck()).Should(HaveOccurred())
+		sd.stalled = false
+		pl.(*pLog).Close()
+	})
+
+	It("fails the secondary when one of its writes misses its deadline", func() {
+		fd, err := NewFileDest(PT+"/deadline", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root(),
+			WithWriteDeadlines(0, 10*time.Millisecond))
+		Ω(err).ShouldNot(HaveOccurred())
+		var buf bytes.Buffer
+		sd := &stallDest{LogDestination: NewWriterDest(&buf, nil)}
+		Ω(pl.SetSecondaryDestination(sd)).ShouldNot(HaveOccurred())
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(2.0))
+		Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()["SecondaryErrorState"]).Should(BeZero())
+
+		sd.stalled = true
+		Ω(pl.Output(&logEv1{S: "b"})).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()["SecondaryErrorState"]).Should(Equal(1.0))
+		Ω(pl.HealthCheck()).ShouldNot(HaveOccurred())
+		sd.stalled = false
+		pl.(*pLog).Close()
+	})
+})
@@ -0,0 +1,305 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// DeltaSnapshot is written after the metadata record of a generation whose snapshot only
+// holds the resources output since the snapshot of the previous generation, see
+// WithDeltaSnapshots. It's never replayed to the client.
+type DeltaSnapshot struct {
+	Base  uint64 // generation whose snapshot this one builds on
+	Depth int    // delta snapshots in the chain, generation Base-Depth+1 has a full one
+}
+
+// SnapshotEnd marks the end of the snapshot of a generation written by a log with delta
+// snapshots, the replay of a later delta snapshot stops reading the generation there.
+type SnapshotEnd struct {
+	Gen uint64
+}
+
+// deltaRemoval records in a delta snapshot that a resource output during the previous
+// generation no longer exists, replay passes it to the client as a Tombstone
+type deltaRemoval struct {
+	NS, Key string
+}
+
+func init() {
+	Register(&DeltaSnapshot{})
+	Register(&SnapshotEnd{})
+	Register(&deltaRemoval{})
+}
+
+// resKey identifies a resource in delta snapshots, see KeyedEvent and OutputNS
+type resKey struct {
+	ns, key string
+}
+
+// WithDeltaSnapshots makes rotations write delta snapshots, which only hold the resources
+// output since the previous snapshot, followed by a record of the resources that no
+// longer exist, which replay passes to the client as Tombstones. Replay then reads the
+// snapshots of the previous generations first, chaining back through at most k delta
+// snapshots to a full one. This saves writing the resources that didn't change, which
+// suits large states that change little, and requires a file destination that retains the
+// log files of the chain. Rotations write a full snapshot when the chain has k delta
+// snapshots, when an event that isn't a KeyedEvent was output, when keys are being
+// erased, when TTLs are set, and while there is a secondary destination, since the
+// secondary doesn't hold the previous generations. NewLog always writes a full
+// snapshot. Logs with delta snapshots cannot be replayed by versions of persist that
+// predate them.
+func WithDeltaSnapshots(k int) LogOption {
+	return func(pl *pLog) { pl.deltaMax = k }
+}
+
+// generationReader is implemented by destinations that can read the stream of a previous
+// generation, which the replay of a delta snapshot requires
+type generationReader interface {
+	readGeneration(gen uint64, codec Codec) (io.ReadCloser, error)
+}
+
+// deltaKey returns the resource of an event, false if the event isn't keyed
+func deltaKey(logEvent interface{}) (resKey, bool) {
+	ns, ev := Namespace(logEvent)
+	if ke, ok := ev.(KeyedEvent); ok {
+		return resKey{ns: ns, key: ke.EventKey()}, true
+	}
+	return resKey{}, false
+}
+
+// trackDelta records the resource of an event output by the application, an event without
+// a key makes the next snapshot a full one, must be called while holding the lock
+func (pl *pLog) trackDelta(logEvent interface{}) {
+	if pl.changed == nil || isInternal(logEvent) {
+		return
+	}
+	if k, ok := deltaKey(logEvent); ok {
+		pl.changed[k] = true
+	} else {
+		pl.changed = nil
+	}
+}
+
+// inDelta returns true if a snapshot event belongs in the delta snapshot being written
+func (pl *pLog) inDelta(logEvent interface{}) bool {
+	k, ok := deltaKey(logEvent)
+	if _, found := pl.deltaKeys[k]; !ok || !found {
+		return false
+	}
+	pl.deltaKeys[k] = false
+	return true
+}
+
+// startSnapshot determines whether the snapshot of the generation just started is a delta
+// snapshot and, if so, writes the DeltaSnapshot record, must be called while holding the
+// lock
+func (pl *pLog) startSnapshot(rotation bool) error {
+	pl.deltaKeys = nil
+	pl.dropHeld() // left behind by an abandoned rotation
+	if pl.deltaMax <= 0 {
+		return nil
+	}
+	changed := pl.changed
+	pl.changed = make(map[resKey]bool)
+	if !rotation || changed == nil || pl.deltaDepth >= pl.deltaMax || pl.erasing != nil ||
+		len(pl.ttls) > 0 || pl.secDest != nil {
+		pl.deltaDepth = 0
+		return nil
+	}
+	pl.deltaDepth++
+	pl.deltaKeys = changed
+	return pl.encodeMarker(&DeltaSnapshot{Base: pl.gen - 1, Depth: pl.deltaDepth})
+}
+
+// endSnapshot writes the removals of a delta snapshot, i.e., the resources output during the
+// previous generation that PersistAll didn't output and that haven't been output since,
+// and marks the end of the snapshot, must be called while holding the lock
+func (pl *pLog) endSnapshot() error {
+	if pl.deltaMax <= 0 {
+		return nil
+	}
+	var removed []resKey
+	for k, pending := range pl.deltaKeys {
+		if pending && !pl.changed[k] {
+			removed = append(removed, k)
+		}
+	}
+	sort.Slice(removed, func(i, j int) bool {
+		return removed[i].ns < removed[j].ns ||
+			removed[i].ns == removed[j].ns && removed[i].key < removed[j].key
+	})
+	for _, k := range removed {
+		if err := pl.encodeMarker(&deltaRemoval{NS: k.ns, Key: k.key}); err != nil {
+			return err
+		}
+	}
+	pl.deltaKeys = nil
+	return pl.encodeMarker(&SnapshotEnd{Gen: pl.gen})
+}
+
+// deltaDecoder replays the snapshots a delta snapshot builds on when it decodes the
+// DeltaSnapshot record of the first stream replayed, and turns the removals of delta
+// snapshots into tombstones
+type deltaDecoder struct {
+	Decoder
+	pl     *pLog
+	window *keyWindow
+	chain  bool            // the stream is the first one replayed
+	bases  []io.ReadCloser // streams of the snapshots being replayed, oldest first
+	dec    Decoder         // decoder of bases[0]
+	gen    uint64          // generation of bases[0]
+	depth  int             // expected depth of the snapshot of bases[0]
+}
+
+func (dd *deltaDecoder) Decode() (interface{}, error) {
+	for {
+		var ev interface{}
+		var err error
+		if dd.dec != nil {
+			if ev, err = dd.decodeBase(); err != nil {
+				dd.close()
+				return nil, err
+			} else if ev == nil {
+				continue
+			}
+		} else if ev, err = dd.Decoder.Decode(); err != nil {
+			return ev, err
+		} else if ds, ok := ev.(*DeltaSnapshot); ok && dd.chain {
+			dd.chain = false
+			if err := dd.open(ds); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if r, ok := ev.(*deltaRemoval); ok {
+			if dd.pl.nsKeep != nil && !dd.pl.nsKeep(r.NS) {
+				continue
+			}
+			ev = &Tombstone{Key: r.Key}
+			if r.NS != "" {
+				ev = &NamespacedEvent{NS: r.NS, Event: ev}
+			}
+		}
+		return ev, nil
+	}
+}
+
+// open opens the streams of the generations a delta snapshot builds on
+func (dd *deltaDecoder) open(ds *DeltaSnapshot) error {
+	gr, ok := dd.pl.priDest.(generationReader)
+	if !ok {
+		return fmt.Errorf("delta snapshot requires a destination that can read previous " +
+			"generations")
+	}
+	dd.gen = ds.Base + 1 - uint64(ds.Depth)
+	for g := dd.gen; g <= ds.Base; g++ {
+		r, err := gr.readGeneration(g, dd.pl.codec)
+		if err != nil {
+			dd.close()
+			return fmt.Errorf("cannot read generation %d, which the delta snapshot builds "+
+				"on: %s", g, err.Error())
+		}
+		dd.bases = append(dd.bases, r)
+	}
+	dd.startBase()
+	return nil
+}
+
+// startBase starts decoding bases[0]
+func (dd *deltaDecoder) startBase() {
+	dd.dec = nil
+	if len(dd.bases) > 0 {
+		sd := withSequence(dd.pl.codec.NewDecoder(dd.bases[0]))
+		dd.dec = dd.pl.replayDecoder(sd, dd.window)
+	}
+}
+
+// decodeBase decodes the next event of the snapshot of bases[0], it returns nil for records
+// that are not replayed
+func (dd *deltaDecoder) decodeBase() (interface{}, error) {
+	ev, err := dd.dec.Decode()
+	if err == io.EOF {
+		return nil, fmt.Errorf("snapshot of generation %d is incomplete", dd.gen)
+	} else if err != nil {
+		return nil, fmt.Errorf("replay of generation %d failed: %s", dd.gen, err.Error())
+	}
+	switch e := ev.(type) {
+	case *GenerationMeta:
+		if e.Gen != dd.gen {
+			return nil, fmt.Errorf("found generation %d instead of %d", e.Gen, dd.gen)
+		}
+		return nil, nil // the metadata of the stream being replayed is what counts
+	case *DeltaSnapshot:
+		if e.Depth != dd.depth {
+			return nil, fmt.Errorf("generation %d is a delta snapshot of depth %d, "+
+				"expected %d", dd.gen, e.Depth, dd.depth)
+		}
+		return nil, nil
+	case *SnapshotEnd:
+		dd.bases[0].Close()
+		dd.bases = dd.bases[1:]
+		dd.gen++
+		dd.depth++
+		dd.startBase()
+		return nil, nil
+	}
+	return ev, nil
+}
+
+// close closes the streams of the snapshots not replayed yet
+func (dd *deltaDecoder) close() {
+	for _, r := range dd.bases {
+		r.Close()
+	}
+	dd.bases, dd.dec = nil, nil
+}
+
+// readGeneration opens the log file of a previous generation, the most recent one if
+// several files hold the generation
+func (fd *fileDest) readGeneration(gen uint64, codec Codec) (io.ReadCloser, error) {
+	files, err := LogFiles(fd.basepath)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		f, err := os.Open(files[i])
+		if err != nil {
+			return nil, err
+		}
+		m, err := ReplayMeta(f, codec)
+		if err == nil && m != nil && m.Gen == gen {
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				f.Close()
+				return nil, err
+			}
+			return f, nil
+		}
+		f.Close()
+	}
+	return nil, fmt.Errorf("no log file of generation %d found at %s", gen, fd.basepath)
+}
+
+// snapshotDepth returns the number of previous generations the replay of a log file needs,
+// i.e. the depth of its delta snapshot, 0 if it's a full one or cannot be read
+func snapshotDepth(name string) int {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	dec := GobCodec.NewDecoder(f)
+	for i := 0; i < 2; i++ {
+		ev, err := dec.Decode()
+		if err != nil {
+			return 0
+		}
+		if ds, ok := ev.(*DeltaSnapshot); ok {
+			return ds.Depth
+		}
+	}
+	return 0
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"io"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// event deleting a resource
+type delEv struct {
+	K string
+}
+
+func (de *delEv) EventKey() string { return de.K }
+
+func init() {
+	Register(&delEv{})
+}
+
+// deltaClient is a keyClient whose delEv events delete their resource
+type deltaClient struct {
+	keyClient
+}
+
+func (dc *deltaClient) Replay(ev interface{}) error {
+	if de, ok := ev.(*delEv); ok {
+		delete(dc.state, de.K)
+		return nil
+	}
+	return dc.keyClient.Replay(ev)
+}
+
+// output outputs an event and applies it to the client's state, like an application
+func (dc *deltaClient) output(pl Log, ev interface{}) {
+	Ω(dc.Replay(ev)).ShouldNot(HaveOccurred())
+	Ω(pl.Output(ev)).ShouldNot(HaveOccurred())
+}
+
+var _ = Describe("Delta snapshots", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	open := func(dc *deltaClient, create bool) Log {
+		fd, err := NewFileDest(PT+"/delta", create, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, dc, log15.Root(), WithDeltaSnapshots(2))
+		Ω(err).ShouldNot(HaveOccurred())
+		return pl
+	}
+
+	rotate := func(pl Log) {
+		gen := pl.Stats()["Generation"]
+		pl.(*pLog).Lock()
+		pl.(*pLog).rotate()
+		pl.(*pLog).Unlock()
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(gen + 1))
+		Eventually(func() bool {
+			pl.(*pLog).Lock()
+			defer pl.(*pLog).Unlock()
+			return pl.(*pLog).rotating
+		}).Should(BeFalse())
+	}
+
+	// snapshot returns the events of the snapshot in the current log file
+	snapshot := func() []interface{} {
+		files, err := LogFiles(PT + "/delta")
+		Ω(err).ShouldNot(HaveOccurred())
+		f, err := os.Open(files[len(files)-1])
+		Ω(err).ShouldNot(HaveOccurred())
+		defer f.Close()
+		dec := withSequence(GobCodec.NewDecoder(f))
+		var events []interface{}
+		for {
+			ev, err := dec.Decode()
+			if err == io.EOF {
+				Fail("no end of snapshot")
+			}
+			Ω(err).ShouldNot(HaveOccurred())
+			switch ev.(type) {
+			case *SnapshotEnd:
+				return events
+			case *GenerationMeta:
+			default:
+				events = append(events, ev)
+			}
+		}
+	}
+
+	It("writes the resources output since the previous snapshot", func() {
+		dc := &deltaClient{}
+		dc.state = map[string]interface{}{"a": &keyEv{K: "a"}, "b": &keyEv{K: "b"},
+			"c": &keyEv{K: "c"}}
+		pl := open(dc, true)
+		Ω(snapshot()).Should(HaveLen(3))
+
+		dc.output(pl, &keyEv{K: "a", V: 1})
+		dc.output(pl, &delEv{K: "b"})
+		rotate(pl)
+		Ω(snapshot()).Should(Equal([]interface{}{
+			&DeltaSnapshot{Base: 1, Depth: 1}, &keyEv{K: "a", V: 1}, &deltaRemoval{Key: "b"}}))
+		Ω(pl.Stats()["DeltaDepth"]).Should(Equal(1.0))
+
+		dc.output(pl, &keyEv{K: "d", V: 1})
+		rotate(pl)
+		Ω(snapshot()).Should(Equal([]interface{}{
+			&DeltaSnapshot{Base: 2, Depth: 2}, &keyEv{K: "d", V: 1}}))
+		dc.output(pl, &keyEv{K: "c", V: 1})
+		pl.(*pLog).Close()
+
+		By("replaying the chain of snapshots")
+		replayed := &deltaClient{}
+		pl = open(replayed, false)
+		Ω(replayed.state).Should(Equal(dc.state))
+		Ω(pl.Stats()["DeltaDepth"]).Should(Equal(0.0))
+		Ω(snapshot()).Should(HaveLen(3))
+		pl.(*pLog).Close()
+	})
+
+	It("writes a full snapshot after k delta snapshots", func() {
+		dc := &deltaClient{}
+		dc.state = map[string]interface{}{"a": &keyEv{K: "a"}, "b": &keyEv{K: "b"}}
+		pl := open(dc, true)
+		for i := 1; i <= 3; i++ {
+			dc.output(pl, &keyEv{K: "a", V: i})
+			rotate(pl)
+		}
+		Ω(pl.Stats()["DeltaDepth"]).Should(Equal(0.0))
+		Ω(snapshot()).Should(Equal([]interface{}{&keyEv{K: "a", V: 3}, &keyEv{K: "b"}}))
+		pl.(*pLog).Close()
+	})
+
+	It("writes a full snapshot after an event without a key", func() {
+		dc := &deltaClient{}
+		dc.state = map[string]interface{}{"a": &keyEv{K: "a"}}
+		pl := open(dc, true)
+		Ω(pl.Output(&logEv1{S: "unkeyed"})).ShouldNot(HaveOccurred())
+		rotate(pl)
+		Ω(pl.Stats()["DeltaDepth"]).Should(Equal(0.0))
+		Ω(snapshot()).Should(Equal([]interface{}{&keyEv{K: "a"}}))
+		pl.(*pLog).Close()
+	})
+
+	It("keeps the files of the chain when trimming", func() {
+		dc := &deltaClient{}
+		dc.state = map[string]interface{}{"a": &keyEv{K: "a"}}
+		pl := open(dc, true)
+		for i := 1; i <= 2; i++ {
+			dc.output(pl, &keyEv{K: "b", V: i})
+			rotate(pl)
+		}
+		trimmed, err := TrimLogSet(PT+"/delta", 1, true)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(trimmed).Should(BeEmpty())
+		pl.(*pLog).Close()
+	})
+
+	It("fails the replay when a generation of the chain is missing", func() {
+		dc := &deltaClient{}
+		dc.state = map[string]interface{}{"a": &keyEv{K: "a"}}
+		pl := open(dc, true)
+		dc.output(pl, &keyEv{K: "a", V: 1})
+		rotate(pl)
+		pl.(*pLog).Close()
+		files, _ := LogFiles(PT + "/delta")
+		Ω(os.Remove(files[0])).ShouldNot(HaveOccurred())
+
+		fd, err := NewFileDest(PT+"/delta", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = NewLog(fd, &deltaClient{}, log15.Root())
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("cannot read generation 1"))
+		fd.Close()
+	})
+
+	It("requires a destination that can read previous generations", func() {
+		fd, err := NewFileDest(PT+"/delta", true, nil, DirectoryPerGeneration())
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = NewLog(fd, &deltaClient{}, log15.Root(), WithDeltaSnapshots(2))
+		Ω(err).Should(HaveOccurred())
+		fd.Close()
+	})
+})
@@ -0,0 +1,266 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+const (
+	dirManifest    = "manifest.json"
+	dirSegmentFmt  = "%06d.plog"
+	dirSegmentSize = 64 * 1024 * 1024 // size at which a new segment is started
+)
+
+// DirectoryPerGeneration makes NewFileDest store each generation in its own subdirectory
+// of basepath, which is created if necessary. Generation directories are numbered in
+// the order they are created and each holds the log in segment files of up to 64MB
+// followed, once the generation's snapshot is complete, by a manifest.json listing the
+// segments and their sizes. The generation's metadata is the first record of its first
+// segment. This layout suits tools that sync directories to object stores, and removing a
+// generation is a directory delete, which persist does once a rotation completes. Such a log
+// set is not understood by the functions and tools that work on log files, such as
+// LogFiles, and NewFileDest refuses the other file destination options, such as BackupTo or
+// SyncInterval, with this layout.
+func DirectoryPerGeneration() FileDestOption {
+	return func(fd *fileDest) { fd.dirLayout = true }
+}
+
+// dirLayoutOption returns the name of an option that the directory per generation layout
+// doesn't support, "" if none was passed, see DirectoryPerGeneration
+func (fd *fileDest) dirLayoutOption() string {
+	switch {
+	case fd.backup != nil:
+		return "BackupTo"
+	case fd.namer != nil:
+		return "WithNamer"
+	case fd.fencing:
+		return "WithFencing"
+	case fd.syncEvery != 0:
+		return "SyncInterval"
+	case fd.directIO:
+		return "DirectIO"
+	case fd.usage != nil:
+		return "RetainUnderUsage"
+	case fd.spaceUsage != nil:
+		return "FreeSpaceWatermarks"
+	case fd.downgrade:
+		return "ForceDowngradeFiles"
+	case fd.takeOver:
+		return "TakeOver"
+	case fd.manifest != nil:
+		return "WithTypeManifest"
+	}
+	return ""
+}
+
+// dirManifestData is the content of a generation's manifest
+type dirManifestData struct {
+	Gen      uint64
+	Segments []dirSegment
+}
+
+type dirSegment struct {
+	Name string
+	Size int64
+}
+
+// newDirDest opens a log set with a directory per generation
+func newDirDest(dir string, create bool, log log15.Logger) (LogDestination, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	rd, err := newRecordDest(&dirStore{dir: dir}, create, log.New("layout", "dir"))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", dir, err.Error())
+	}
+	return rd, nil
+}
+
+// dirStore is a recordStore keeping each generation in a directory
+type dirStore struct {
+	dir     string
+	gen     uint64   // generation being written
+	seg     *os.File // segment being written, nil if none
+	segNum  int      // number of the segment being written
+	segSize int64    // size of the segment being written
+}
+
+func (ds *dirStore) genDir(gen uint64) string {
+	return filepath.Join(ds.dir, fmt.Sprintf("%010d", gen))
+}
+
+func (ds *dirStore) generations() ([]uint64, map[uint64]bool, error) {
+	infos, err := ioutil.ReadDir(ds.dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var all []uint64
+	complete := make(map[uint64]bool)
+	for _, info := range infos {
+		gen, err := strconv.ParseUint(info.Name(), 10, 64)
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		all = append(all, gen)
+		if _, err := os.Stat(filepath.Join(ds.genDir(gen), dirManifest)); err == nil {
+			complete[gen] = true
+		}
+	}
+	sort.Sort(uint64s(all))
+	return all, complete, nil
+}
+
+func (ds *dirStore) append(gen, seq uint64, rec []byte) error {
+	if ds.seg == nil || gen != ds.gen || ds.segSize >= dirSegmentSize {
+		if err := ds.startSegment(gen); err != nil {
+			return err
+		}
+	}
+	n, err := ds.seg.Write(rec)
+	ds.segSize += int64(n)
+	return err
+}
+
+// startSegment starts a new segment, which starts a new generation if gen is not the
+// generation being written
+func (ds *dirStore) startSegment(gen uint64) error {
+	if ds.seg != nil {
+		ds.seg.Close()
+		ds.seg = nil
+	}
+	if gen != ds.gen || ds.segNum == 0 {
+		if err := os.MkdirAll(ds.genDir(gen), 0777); err != nil {
+			return err
+		}
+		ds.gen, ds.segNum = gen, 0
+	}
+	name := filepath.Join(ds.genDir(gen), fmt.Sprintf(dirSegmentFmt, ds.segNum))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	ds.seg, ds.segNum, ds.segSize = f, ds.segNum+1, 0
+	return nil
+}
+
+// segments returns the names of the segments of a generation in order
+func (ds *dirStore) segments(gen uint64) ([]string, error) {
+	names, err := filepath.Glob(filepath.Join(ds.genDir(gen), "*.plog"))
+	sort.Strings(names)
+	return names, err
+}
+
+func (ds *dirStore) records(gen uint64) ([][]byte, error) {
+	names, err := ds.segments(gen)
+	if err != nil {
+		return nil, err
+	}
+	var m *dirManifestData
+	if data, err := ioutil.ReadFile(filepath.Join(ds.genDir(gen), dirManifest)); err == nil {
+		m = &dirManifestData{}
+		if err := json.Unmarshal(data, m); err != nil {
+			return nil, fmt.Errorf("corrupt manifest: %s", err.Error())
+		}
+	}
+	recs := make([][]byte, len(names))
+	for i, name := range names {
+		if recs[i], err = ioutil.ReadFile(name); err != nil {
+			return nil, err
+		}
+	}
+
+	// check that the segments of complete generations are intact, segments may have been
+	// appended to since the manifest was written
+	if m != nil {
+		if len(names) < len(m.Segments) {
+			return nil, fmt.Errorf("generation %d has %d segments, manifest lists %d",
+				gen, len(names), len(m.Segments))
+		}
+		for i, s := range m.Segments {
+			if filepath.Base(names[i]) != s.Name || int64(len(recs[i])) < s.Size {
+				return nil, fmt.Errorf("segment %s is missing or shorter than the %d "+
+					"bytes in the manifest", s.Name, s.Size)
+			}
+		}
+	}
+	return recs, nil
+}
+
+func (ds *dirStore) complete(gen uint64) error {
+	if ds.seg != nil && gen == ds.gen {
+		if err := ds.seg.Sync(); err != nil {
+			return err
+		}
+	}
+	m := dirManifestData{Gen: gen}
+	names, err := ds.segments(gen)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		m.Segments = append(m.Segments, dirSegment{Name: filepath.Base(name),
+			Size: info.Size()})
+	}
+	data, err := json.Marshal(&m)
+	if err != nil {
+		return err
+	}
+
+	// write the manifest atomically, its presence marks the generation as complete
+	dir := ds.genDir(gen)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, dirManifest+".tmp")
+	if err := writeFileSync(tmp, data); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, dirManifest)); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+func (ds *dirStore) Close() error {
+	if ds.seg == nil {
+		return nil
+	}
+	err := ds.seg.Close()
+	ds.seg = nil
+	return err
+}
+
+func (ds *dirStore) drop(gen uint64) error {
+	return os.RemoveAll(ds.genDir(gen))
+}
+
+// writeFileSync writes a file and flushes it to disk
+func writeFileSync(name string, data []byte) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("DirectoryPerGeneration", func() {
+	dir := PT + "/dirlog"
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	// genDirs returns the names of the generation directories
+	genDirs := func() []string {
+		infos, err := ioutil.ReadDir(dir)
+		Ω(err).ShouldNot(HaveOccurred())
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		return names
+	}
+
+	It("keeps each generation in a directory", func() {
+		fd, err := NewFileDest(dir, true, nil, DirectoryPerGeneration())
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{events: []interface{}{&logEv1{S: "a"}}}
+		pl, err := NewLog(fd, rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(genDirs()).Should(Equal([]string{"0000000000"}))
+		pl.SetSizeLimit(10)
+		Ω(pl.Output(&logEv1{S: "b"})).ShouldNot(HaveOccurred())
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(2.0))
+		pl.(*pLog).Close()
+
+		Ω(genDirs()).Should(Equal([]string{"0000000001"}))
+		files, err := filepath.Glob(dir + "/0000000001/*")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files).Should(Equal([]string{dir + "/0000000001/000000.plog",
+			dir + "/0000000001/manifest.json"}))
+
+		fd, err = NewFileDest(dir, false, nil, DirectoryPerGeneration())
+		Ω(err).ShouldNot(HaveOccurred())
+		rc = &recordingClient{}
+		pl, err = NewLog(fd, rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(Equal([]interface{}{&logEv1{S: "a"}}))
+		pl.(*pLog).Close()
+		Ω(genDirs()).Should(Equal([]string{"0000000002"}))
+	})
+
+	It("rolls segments and detects truncated ones", func() {
+		ds := &dirStore{dir: dir}
+		Ω(os.MkdirAll(dir, 0777)).ShouldNot(HaveOccurred())
+		Ω(ds.append(3, 0, []byte("hello"))).ShouldNot(HaveOccurred())
+		ds.segSize = dirSegmentSize
+		Ω(ds.append(3, 1, []byte("world"))).ShouldNot(HaveOccurred())
+		Ω(ds.complete(3)).ShouldNot(HaveOccurred())
+		Ω(ds.Close()).ShouldNot(HaveOccurred())
+
+		all, complete, err := ds.generations()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(all).Should(Equal([]uint64{3}))
+		Ω(complete[3]).Should(BeTrue())
+		recs, err := ds.records(3)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(recs).Should(Equal([][]byte{[]byte("hello"), []byte("world")}))
+
+		Ω(os.Truncate(dir+"/0000000003/000001.plog", 2)).ShouldNot(HaveOccurred())
+		_, err = ds.records(3)
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("000001.plog is missing or shorter"))
+	})
+
+	It("doesn't support backups", func() {
+		_, err := NewFileDest(dir, true, nil, DirectoryPerGeneration(),
+			BackupTo(&testUploader{uploads: make(chan string, 10)}))
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("refuses the options it doesn't support", func() {
+		for name, opt := range map[string]FileDestOption{
+			"SyncInterval":        SyncInterval(time.Second),
+			"DirectIO":            DirectIO(),
+			"RetainUnderUsage":    RetainUnderUsage(0.8, 2),
+			"FreeSpaceWatermarks": FreeSpaceWatermarks(0.2, 0.1),
+			"ForceDowngradeFiles": ForceDowngradeFiles(),
+			"TakeOver":            TakeOver(),
+			"WithTypeManifest":    WithTypeManifest(nil),
+		} {
+			_, err := NewFileDest(dir, true, nil, DirectoryPerGeneration(), opt)
+			Ω(err).Should(MatchError(name + " is not supported with DirectoryPerGeneration"))
+		}
+	})
+})
@@ -0,0 +1,95 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+	"unsafe"
+)
+
+const (
+	directPage   = 4 << 10   // alignment of the memory, offsets, and sizes of direct writes
+	directBuffer = 256 << 10 // max size of a direct write
+)
+
+// DirectIO makes a file destination write log files bypassing the page cache, using
+// O_DIRECT on Linux and F_NOCACHE on macOS, such that writing snapshots doesn't evict the
+// pages the application relies on. Direct writes must cover whole pages, so each write is
+// split: the pages it completes are written directly, and the data of the last, partial
+// page goes through the page cache until a later write completes it, which bounds the
+// cache used by a log file to a page. Every write thus still reaches the file before Write
+// returns. If the platform or the filesystem doesn't support direct I/O, e.g. tmpfs, a
+// warning is logged and the files are written as usual, as is a file that TakeOver
+// appends to, until the next rotation.
+func DirectIO() FileDestOption {
+	return func(fd *fileDest) { fd.directIO = true }
+}
+
+// directWriter writes a log file using direct I/O for whole pages
+type directWriter struct {
+	f   *os.File // the log file opened for direct I/O
+	buf []byte   // page-aligned buffer holding the partial page at the end of the file
+	off int64    // offset of buf in the file, a multiple of directPage
+}
+
+// openDirect opens the output file for direct I/O as well, falling back to buffered I/O
+func (fd *fileDest) openDirect() {
+	if !fd.directIO {
+		return
+	}
+	f, err := openDirectFile(fd.outputFilename)
+	if err != nil {
+		fd.log.Warn("Cannot use direct I/O, writing through the page cache",
+			"file", fd.outputFilename, "err", err)
+		return
+	}
+	fd.direct = &directWriter{f: f, buf: alignedBuffer(directBuffer)[:0]}
+}
+
+// closeDirect closes the file opened for direct I/O, if any
+func (fd *fileDest) closeDirect() {
+	if fd.direct != nil {
+		fd.direct.f.Close()
+		fd.direct = nil
+	}
+}
+
+// write appends p to the file, out being the file opened without direct I/O
+func (dw *directWriter) write(out *os.File, p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		m := copy(dw.buf[len(dw.buf):cap(dw.buf)], p)
+		end := len(dw.buf) + m
+		dw.buf = dw.buf[:end]
+		// write the pages completed directly
+		if full := end / directPage * directPage; full > 0 {
+			if _, err := dw.f.WriteAt(dw.buf[:full], dw.off); err != nil {
+				return 0, err
+			}
+			dw.off += int64(full)
+			dw.buf = dw.buf[:copy(dw.buf, dw.buf[full:])]
+		}
+		// the bytes of p left in the partial page go through the page cache
+		tail := len(dw.buf)
+		if tail > m {
+			tail = m
+		}
+		if tail > 0 {
+			if _, err := out.WriteAt(dw.buf[len(dw.buf)-tail:], dw.end()-int64(tail)); err != nil {
+				return 0, err
+			}
+		}
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// end returns the size of the file
+func (dw *directWriter) end() int64 { return dw.off + int64(len(dw.buf)) }
+
+// alignedBuffer returns a buffer whose memory starts at a multiple of directPage
+func alignedBuffer(size int) []byte {
+	b := make([]byte, size+directPage)
+	shift := (directPage - int(uintptr(unsafe.Pointer(&b[0]))%directPage)) % directPage
+	return b[shift : shift+size : shift+size]
+}
@@ -0,0 +1,23 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+	"syscall"
+)
+
+// openDirectFile opens a file for writing with F_NOCACHE, which turns caching off for the
+// file descriptor
+func openDirectFile(name string) (*os.File, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_NOCACHE, 1)
+	if errno != 0 {
+		f.Close()
+		return nil, errno
+	}
+	return f, nil
+}
@@ -0,0 +1,14 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+	"syscall"
+)
+
+// openDirectFile opens a file for writing with O_DIRECT, which filesystems such as tmpfs
+// refuse
+func openDirectFile(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_WRONLY|syscall.O_DIRECT, 0)
+}
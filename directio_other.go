@@ -0,0 +1,16 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package persist
+
+import (
+	"fmt"
+	"os"
+)
+
+// openDirectFile is not implemented on this platform
+func openDirectFile(name string) (*os.File, error) {
+	return nil, fmt.Errorf("direct I/O is not supported on this platform")
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("DirectIO", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	It("writes the exact data whatever its alignment", func() {
+		d, err := NewFileDest(PT+"/direct", true, nil, DirectIO())
+		Ω(err).ShouldNot(HaveOccurred())
+		fd := d.(*fileDest)
+		if runtime.GOOS == "linux" {
+			Ω(fd.direct).ShouldNot(BeNil())
+		}
+		var want []byte
+		for i, size := range []int{10, directPage - 10, 1, directPage + 3, 3 * directBuffer, 7} {
+			p := bytes.Repeat([]byte{byte('a' + i)}, size)
+			Ω(fd.Write(p)).Should(Equal(size))
+			want = append(want, p...)
+			_, off := fd.segment()
+			Ω(off).Should(Equal(int64(len(want))))
+			// the data is in the file before Write returns
+			Ω(ioutil.ReadFile(fd.outputFilename)).Should(Equal(want))
+		}
+		fd.Close()
+		Ω(fd.direct).Should(BeNil())
+	})
+
+	It("replays a log written using direct I/O", func() {
+		big := strings.Repeat("snapshot ", 2000)
+		rc := &recordingClient{events: []interface{}{&logEv1{S: big}, &logEv2{A: 1}}}
+		fd, err := NewFileDest(PT+"/direct", true, nil, DirectIO())
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		// the snapshot of the rotation doesn't include "a"
+		pl.(*pLog).Lock()
+		pl.(*pLog).rotate()
+		pl.(*pLog).Unlock()
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(2.0))
+		Ω(pl.Output(&logEv2{A: 2, B: big})).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		rc = &recordingClient{}
+		fd, err = NewFileDest(PT+"/direct", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err = NewLog(fd, rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(Equal([]interface{}{&logEv1{S: big}, &logEv2{A: 1},
+			&logEv2{A: 2, B: big}}))
+		pl.(*pLog).Close()
+	})
+})
@@ -0,0 +1,13 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package persist
+
+import "fmt"
+
+// diskUsage is not implemented on this platform
+func diskUsage(path string) (float64, error) {
+	return 0, fmt.Errorf("disk usage is not supported on this platform")
+}
@@ -0,0 +1,21 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package persist
+
+import "syscall"
+
+// diskUsage returns the fraction of the filesystem holding path that is in use, counting
+// blocks reserved for the superuser as used since persist can't rely on them
+func diskUsage(path string) (float64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	if st.Blocks == 0 {
+		return 0, nil
+	}
+	return 1 - float64(st.Bavail)/float64(st.Blocks), nil
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+// dupFilter remembers the digest of the preceding events to drop exact duplicates, see
+// DropConsecutiveDuplicates
+type dupFilter struct {
+	byKey   bool
+	last    [sha256.Size]byte            // digest of the preceding event
+	hasLast bool                         // last is set
+	keys    map[resKey][sha256.Size]byte // digest of the preceding event of each resource
+	next    [sha256.Size]byte            // digest of the event being output
+	nextKey resKey                       // resource of the event being output
+	keyed   bool                         // the event being output is compared by resource
+	pending bool                         // next is to be recorded once written
+	buf     bytes.Buffer
+	dropped uint64 // number of events dropped, for stats
+}
+
+// DropConsecutiveDuplicates makes Output drop an event whose encoding is identical to that
+// of the event output immediately before it, which saves the space and replay time of the
+// exact duplicates that retry loops tend to produce. With byKey, the event is compared to
+// the preceding event of the same resource instead, see KeyedEvent, events that aren't
+// keyed are still compared to the immediately preceding event. Only the events output
+// individually by the application are compared and the comparison starts afresh after any
+// other record, such as the events of a transaction or of a snapshot. Output returns nil
+// for an event it drops, Stats reports their number as DuplicatesDropped. Each event is
+// encoded an extra time to be compared and with byKey a digest is remembered per resource.
+func DropConsecutiveDuplicates(byKey bool) LogOption {
+	return func(pl *pLog) { pl.dups = &dupFilter{byKey: byKey} }
+}
+
+// isDuplicate returns true if an event output by the application must be dropped because
+// it duplicates the preceding one, otherwise the event becomes the preceding one once
+// written, see written, must be called while holding the pl.Lock()
+func (pl *pLog) isDuplicate(logEvent interface{}) bool {
+	df := pl.dups
+	if df == nil {
+		return false
+	}
+	df.pending = false
+	// a fresh encoder encodes the same event to the same bytes, type definitions included
+	df.buf.Reset()
+	if err := pl.codec.NewEncoder(&df.buf).Encode(logEvent); err != nil {
+		return false // the error is reported when the event is output
+	}
+	df.next = sha256.Sum256(df.buf.Bytes())
+	df.nextKey, df.keyed = deltaKey(logEvent)
+	df.keyed = df.keyed && df.byKey
+	var dup bool
+	if df.keyed {
+		prev, found := df.keys[df.nextKey]
+		dup = found && prev == df.next
+	} else {
+		dup = df.hasLast && df.last == df.next
+	}
+	if dup {
+		df.dropped++
+	}
+	df.pending = !dup
+	return dup
+}
+
+// written records that the event isDuplicate was last called for has been written, an event
+// that failed to be written doesn't count as the preceding one, so its retry isn't dropped
+func (df *dupFilter) written() {
+	if df == nil || !df.pending {
+		return
+	}
+	df.pending = false
+	if df.keyed {
+		if df.keys == nil {
+			df.keys = make(map[resKey][sha256.Size]byte)
+		}
+		df.keys[df.nextKey] = df.next
+	}
+	df.last, df.hasLast = df.next, true
+}
+
+// reset starts the comparison afresh, when a record that isn't compared is written
+func (df *dupFilter) reset() {
+	if df != nil {
+		df.hasLast, df.keys, df.pending = false, nil, false
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("DropConsecutiveDuplicates", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	open := func(rc *recordingClient, opts ...LogOption) Log {
+		fd, err := NewFileDest(PT+"/dups", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, rc, log15.Root(), opts...)
+		Ω(err).ShouldNot(HaveOccurred())
+		return pl
+	}
+
+	// replay returns the events replayed from the log, whose snapshots are empty
+	replay := func() []interface{} {
+		rc := &recordingClient{}
+		open(rc).(*pLog).Close()
+		return rc.events
+	}
+
+	It("drops an event identical to the preceding one", func() {
+		pl := open(&recordingClient{}, DropConsecutiveDuplicates(false))
+		for _, s := range []string{"a", "a", "b", "a", "a", "a"} {
+			Ω(pl.Output(&logEv1{S: s})).ShouldNot(HaveOccurred())
+		}
+		By("starting afresh after a transaction")
+		Ω(Txn(pl, func(w TxnWriter) error { return w.Output(&logEv1{S: "a"}) })).
+			ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()["DuplicatesDropped"]).Should(Equal(3.0))
+		pl.(*pLog).Close()
+
+		Ω(replay()).Should(Equal([]interface{}{&logEv1{S: "a"}, &logEv1{S: "b"},
+			&logEv1{S: "a"}, &logEv1{S: "a"}, &logEv1{S: "a"}}))
+	})
+
+	It("compares the events of each resource", func() {
+		pl := open(&recordingClient{}, DropConsecutiveDuplicates(true))
+		for _, ev := range []interface{}{&keyEv{K: "a", V: 1}, &keyEv{K: "b", V: 1},
+			&keyEv{K: "a", V: 1}, &logEv1{S: "x"}, &logEv1{S: "x"}, &keyEv{K: "a", V: 2},
+			&keyEv{K: "b", V: 1}, &keyEv{K: "a", V: 1}} {
+			Ω(pl.Output(ev)).ShouldNot(HaveOccurred())
+		}
+		Ω(pl.Stats()["DuplicatesDropped"]).Should(Equal(3.0))
+		pl.(*pLog).Close()
+
+		Ω(replay()).Should(Equal([]interface{}{&keyEv{K: "a", V: 1}, &keyEv{K: "b", V: 1},
+			&logEv1{S: "x"}, &keyEv{K: "a", V: 2}, &keyEv{K: "a", V: 1}}))
+	})
+
+	It("doesn't report drops when disabled", func() {
+		pl := open(&recordingClient{})
+		Ω(pl.Stats()).ShouldNot(HaveKey("DuplicatesDropped"))
+		pl.(*pLog).Close()
+	})
+})
@@ -0,0 +1,156 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// DynamoDBClient is the subset of a DynamoDB client used by the DynamoDB destination. The
+// table must have a string partition key and a numeric sort key, which DynamoItem.PK and
+// DynamoItem.SK map to; the remaining fields map to regular attributes. Implementing this
+// interface on top of the AWS SDK takes a handful of lines per method.
+type DynamoDBClient interface {
+	// PutItem creates or replaces an item
+	PutItem(item DynamoItem) error
+	// Query returns all items with the given partition key in ascending sort key order,
+	// following pagination as necessary
+	Query(pk string) ([]DynamoItem, error)
+	// DeleteItem deletes an item given its primary key
+	DeleteItem(pk string, sk uint64) error
+}
+
+// DynamoItem is an item written to DynamoDB by the DynamoDB destination
+type DynamoItem struct {
+	PK       string // partition key
+	SK       uint64 // sort key
+	Data     []byte // record data, for record items
+	Complete bool   // generation has a complete snapshot, for manifest items
+	Items    uint64 // number of record items in the snapshot, for complete manifest items
+}
+
+// dynamoMaxData is the max amount of data in an item, DynamoDB limits items to 400KB
+const dynamoMaxData = 256 * 1024
+
+// NewDynamoDBDest creates or opens a log stored in a DynamoDB table. Records are stored as
+// items with a partition key of <name>#<generation> and a sort key holding a sequence number,
+// records that exceed the item size limit are split into multiple items. Each generation
+// has a manifest item with partition key <name>#manifest and the generation as sort key,
+// which records whether the generation's snapshot is complete and how many items the
+// snapshot consists of such that replay can detect missing items. Older generations are
+// deleted once a rotation completes.
+func NewDynamoDBDest(client DynamoDBClient, name string, create bool,
+	log log15.Logger) (LogDestination, error) {
+
+	if log == nil {
+		log = log15.Root()
+	}
+	log = log.New("name", name, "dest", "dynamodb")
+	ds := &dynamoStore{client: client, name: name}
+	rd, err := newRecordDest(ds, create, log)
+	if err != nil {
+		return nil, fmt.Errorf("dynamodb %s: %s", name, err.Error())
+	}
+	rd.durable = true // DynamoDB writes are durable once acknowledged
+	return rd, nil
+}
+
+type dynamoStore struct {
+	client DynamoDBClient
+	name   string
+	gen    uint64 // generation being written
+	items  uint64 // number of items written in generation being written
+	inited bool   // manifest item has been written for the generation being written
+}
+
+func (ds *dynamoStore) manifestPK() string      { return ds.name + "#manifest" }
+func (ds *dynamoStore) genPK(gen uint64) string { return fmt.Sprintf("%s#%010d", ds.name, gen) }
+
+func (ds *dynamoStore) generations() ([]uint64, map[uint64]bool, error) {
+	items, err := ds.client.Query(ds.manifestPK())
+	if err != nil {
+		return nil, nil, err
+	}
+	var all []uint64
+	complete := make(map[uint64]bool)
+	for _, it := range items {
+		all = append(all, it.SK)
+		complete[it.SK] = it.Complete
+	}
+	return all, complete, nil
+}
+
+func (ds *dynamoStore) append(gen, seq uint64, rec []byte) error {
+	if !ds.inited || gen != ds.gen {
+		// the manifest item goes first so records never exist without one
+		if err := ds.client.PutItem(DynamoItem{PK: ds.manifestPK(), SK: gen}); err != nil {
+			return err
+		}
+		ds.gen, ds.items, ds.inited = gen, 0, true
+	}
+	for len(rec) > 0 {
+		l := len(rec)
+		if l > dynamoMaxData {
+			l = dynamoMaxData
+		}
+		err := ds.client.PutItem(DynamoItem{PK: ds.genPK(gen), SK: ds.items, Data: rec[:l]})
+		if err != nil {
+			return err
+		}
+		ds.items++
+		rec = rec[l:]
+	}
+	return nil
+}
+
+func (ds *dynamoStore) records(gen uint64) ([][]byte, error) {
+	items, err := ds.client.Query(ds.genPK(gen))
+	if err != nil {
+		return nil, err
+	}
+	recs := make([][]byte, len(items))
+	for i, it := range items {
+		if it.SK != uint64(i) {
+			return nil, fmt.Errorf("generation %d is missing item %d", gen, i)
+		}
+		recs[i] = it.Data
+	}
+
+	// check that the snapshot of complete generations is intact, items are contiguous
+	// so this only needs to check that there are enough of them
+	manifest, err := ds.client.Query(ds.manifestPK())
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range manifest {
+		if m.SK == gen && m.Complete && m.Items > uint64(len(items)) {
+			return nil, fmt.Errorf("generation %d has %d items, snapshot alone has %d",
+				gen, len(items), m.Items)
+		}
+	}
+	return recs, nil
+}
+
+func (ds *dynamoStore) complete(gen uint64) error {
+	var items uint64
+	if ds.inited && gen == ds.gen {
+		items = ds.items
+	}
+	return ds.client.PutItem(DynamoItem{PK: ds.manifestPK(), SK: gen, Complete: true,
+		Items: items})
+}
+
+func (ds *dynamoStore) drop(gen uint64) error {
+	items, err := ds.client.Query(ds.genPK(gen))
+	if err != nil {
+		return err
+	}
+	for _, it := range items {
+		if err := ds.client.DeleteItem(it.PK, it.SK); err != nil {
+			return err
+		}
+	}
+	return ds.client.DeleteItem(ds.manifestPK(), gen)
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sort"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// in-memory DynamoDB table used for testing
+type testDynamo struct {
+	items map[string]map[uint64]DynamoItem
+}
+
+func (td *testDynamo) PutItem(item DynamoItem) error {
+	if td.items[item.PK] == nil {
+		td.items[item.PK] = make(map[uint64]DynamoItem)
+	}
+	td.items[item.PK][item.SK] = item
+	return nil
+}
+
+func (td *testDynamo) Query(pk string) ([]DynamoItem, error) {
+	var res []DynamoItem
+	for _, it := range td.items[pk] {
+		res = append(res, it)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].SK < res[j].SK })
+	return res, nil
+}
+
+func (td *testDynamo) DeleteItem(pk string, sk uint64) error {
+	delete(td.items[pk], sk)
+	return nil
+}
+
+var _ = Describe("DynamoDBDest", func() {
+	var td *testDynamo
+
+	BeforeEach(func() {
+		td = &testDynamo{items: make(map[string]map[uint64]DynamoItem)}
+	})
+
+	readAll := func(dd LogDestination) []string {
+		var res []string
+		for _, rr := range dd.ReplayReaders() {
+			buf, err := ioutil.ReadAll(rr)
+			Ω(err).ShouldNot(HaveOccurred())
+			res = append(res, string(buf))
+		}
+		return res
+	}
+
+	It("replays the current and the incomplete generation", func() {
+		dd, err := NewDynamoDBDest(td, "app", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		dd.Write([]byte("Hello World"))
+		Ω(dd.EndRotate()).ShouldNot(HaveOccurred())
+		dd.Write([]byte("Hello Again"))
+		Ω(dd.StartRotate()).ShouldNot(HaveOccurred())
+		dd.Write([]byte("Snapshot"))
+		dd.Close()
+
+		dd, err = NewDynamoDBDest(td, "app", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(readAll(dd)).Should(Equal([]string{"Hello WorldHello Again", "Snapshot"}))
+		Ω(dd.EndRotate()).ShouldNot(HaveOccurred())
+		dd.Close()
+
+		By("dropping the old generations")
+		Ω(td.items["app#manifest"]).Should(HaveLen(1))
+		Ω(td.items["app#0000000000"]).Should(BeEmpty())
+	})
+
+	It("splits large records into multiple items", func() {
+		big := bytes.Repeat([]byte("0123456789"), 30000)
+		dd, err := NewDynamoDBDest(td, "app", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		dd.Write(big)
+		Ω(dd.EndRotate()).ShouldNot(HaveOccurred())
+		dd.Close()
+		Ω(td.items["app#0000000000"]).Should(HaveLen(2))
+
+		dd, err = NewDynamoDBDest(td, "app", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(readAll(dd)).Should(Equal([]string{string(big)}))
+		dd.Close()
+	})
+
+	It("detects missing items", func() {
+		dd, err := NewDynamoDBDest(td, "app", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		dd.Write([]byte("Hello World"))
+		dd.Write([]byte("Hello Again"))
+		Ω(dd.EndRotate()).ShouldNot(HaveOccurred())
+		dd.Close()
+		td.DeleteItem("app#0000000000", 1)
+
+		_, err = NewDynamoDBDest(td, "app", false, nil)
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("snapshot alone has 2"))
+	})
+})
@@ -0,0 +1,194 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"os"
+)
+
+// Tombstone records that the events of a resource were erased, see Erase. It's replayed
+// like any other event so the client can drop the resource, it implements KeyedEvent and
+// the deletion interface of the kvstate package.
+type Tombstone struct {
+	Key string
+}
+
+func init() {
+	Register(&Tombstone{})
+}
+
+// EventKey returns the key of the erased resource
+func (t *Tombstone) EventKey() string { return t.Key }
+
+// IsDeletion returns true, a tombstone deletes its resource
+func (t *Tombstone) IsDeletion() bool { return true }
+
+// Erase erases the events of the resource identified by key, see KeyedEvent, from a log
+// created by NewLog. It outputs a Tombstone and, from the next rotation on, drops the keyed
+// events with that key that PersistAll outputs, including events wrapped by OutputNS. Once
+// that rotation completes the primary destination deletes the data of all the previous
+// generations, such that none of the data it retains holds events of the resource.
+// Erasures not yet completed are replayed from the tombstones and completed by the
+// snapshot taken when the log is opened. Events output using the key after Erase belong
+// to a new resource and are kept. The primary destination must be able to delete previous
+// generations, which file destinations can, and so must the secondary destination, if
+// any. Erase refuses to erase the events of a log whose file destination uploads backups,
+// see BackupTo, since it cannot delete the copies. Stats reports the erasures in progress
+// as ErasePending, which includes those that the rotation couldn't complete, e.g. because
+// a secondary destination that cannot delete previous generations was added since.
+// Versions of persist that predate Erase refuse to replay logs that contain tombstones.
+func Erase(log Log, key string) error {
+	pl, ok := log.(*pLog)
+	if !ok {
+		return fmt.Errorf("erase requires a log created by NewLog")
+	}
+	pl.Lock()
+	err := pl.checkErase()
+	pl.Unlock()
+	if err != nil {
+		return err
+	}
+	return pl.Output(&Tombstone{Key: key})
+}
+
+// checkErase returns an error if the log holds copies of its data that cannot be erased,
+// must be called while holding the pl.Lock()
+func (pl *pLog) checkErase() error {
+	if _, ok := pl.priDest.(generationPurger); !ok {
+		return fmt.Errorf("erase requires a destination that can delete previous " +
+			"generations")
+	}
+	if _, ok := pl.secDest.(generationPurger); pl.secDest != nil && !ok {
+		return fmt.Errorf("erase requires a secondary destination that can delete " +
+			"previous generations")
+	}
+	if fd, ok := pl.priDest.(*fileDest); ok && fd.backup != nil {
+		return fmt.Errorf("erase cannot delete the backups of the log files, see BackupTo")
+	}
+	return nil
+}
+
+// generationPurger is implemented by destinations that can delete the data of all the
+// generations preceding the current one
+type generationPurger interface {
+	purgePrevious() error
+}
+
+// eventKey returns the key of a keyed event, which may be wrapped by OutputNS
+func eventKey(logEvent interface{}) (string, bool) {
+	_, ev := Namespace(logEvent)
+	if ke, ok := ev.(KeyedEvent); ok {
+		return ke.EventKey(), true
+	}
+	return "", false
+}
+
+// trackErase records the keys erased by a tombstone and forgets the erasure of a key
+// when an event for a new resource with that key is output or replayed
+func (pl *pLog) trackErase(logEvent interface{}) {
+	if t, ok := logEvent.(*Tombstone); ok {
+		if pl.erased == nil {
+			pl.erased = make(map[string]bool)
+		}
+		pl.erased[t.Key] = true
+		return
+	}
+	if len(pl.erased) == 0 && len(pl.erasing) == 0 {
+		return
+	}
+	if key, ok := eventKey(logEvent); ok {
+		delete(pl.erased, key)
+		delete(pl.erasing, key)
+	}
+}
+
+// isErased returns true if a snapshot event must be dropped because it's been erased
+func (pl *pLog) isErased(logEvent interface{}) bool {
+	if len(pl.erased) == 0 && len(pl.erasing) == 0 {
+		return false
+	}
+	key, ok := eventKey(logEvent)
+	return ok && (pl.erased[key] || pl.erasing[key])
+}
+
+// startErase makes the snapshot of a rotation complete the pending erasures, must be
+// called while holding the lock
+func (pl *pLog) startErase() {
+	if len(pl.erased) > 0 {
+		pl.erasing, pl.erased = pl.erased, nil
+	}
+}
+
+// finishErase deletes the previous generations from the destinations once the snapshot of
+// a rotation that erases keys is complete, must be called while holding the lock
+func (pl *pLog) finishErase() {
+	if pl.erasing == nil {
+		return
+	}
+	err := pl.priDest.(generationPurger).purgePrevious()
+	if err == nil && pl.secDest != nil {
+		if sp, ok := pl.secDest.(generationPurger); !ok || !pl.secSynced {
+			err = fmt.Errorf("the secondary destination cannot delete previous generations")
+		} else {
+			err = sp.purgePrevious()
+		}
+	}
+	if err != nil {
+		// try again at the end of the next rotation
+		pl.log.Crit("Cannot delete previous generations to erase resources", "err", err)
+		if pl.erased == nil {
+			pl.erased = make(map[string]bool)
+		}
+		for k := range pl.erasing {
+			pl.erased[k] = true
+		}
+	} else {
+		pl.log.Info("Erased resources", "count", len(pl.erasing))
+	}
+	pl.erasing = nil
+}
+
+// eraseDecoder tracks the erasures of the events it decodes, see trackErase
+type eraseDecoder struct {
+	Decoder
+	pl *pLog
+}
+
+func (ed eraseDecoder) Decode() (interface{}, error) {
+	ev, err := ed.Decoder.Decode()
+	if err == nil {
+		ed.pl.trackErase(ev)
+	}
+	return ev, err
+}
+
+// purgePrevious deletes the log files that precede the current one
+func (fd *fileDest) purgePrevious() error {
+	files, err := LogFiles(fd.basepath)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f >= fd.outputFilename {
+			continue
+		}
+		if err := os.Remove(f); err != nil {
+			return err
+		}
+		os.Remove(f + checksumExt)
+		fd.log.Info("Deleted previous log file", "file", f)
+	}
+	return nil
+}
+
+// purgePrevious drops the generations that precede the current one
+func (rd *recordDest) purgePrevious() error {
+	for len(rd.old) > 0 {
+		if err := rd.store.drop(rd.old[0]); err != nil {
+			return err
+		}
+		rd.old = rd.old[1:]
+	}
+	return nil
+}
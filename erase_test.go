@@ -0,0 +1,279 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+	"sort"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// keyed event type
+type keyEv struct {
+	K string
+	V int
+}
+
+func (ke *keyEv) EventKey() string { return ke.K }
+
+func init() {
+	Register(&keyEv{})
+}
+
+// keyClient holds the latest event of each key, like kvstate
+type keyClient struct {
+	state map[string]interface{}
+}
+
+func (kc *keyClient) Replay(ev interface{}) error {
+	if kc.state == nil {
+		kc.state = map[string]interface{}{}
+	}
+	if t, ok := ev.(*Tombstone); ok {
+		delete(kc.state, t.Key)
+	} else if k, ok := eventKey(ev); ok {
+		kc.state[k] = ev
+	}
+	return nil
+}
+
+// PersistAll outputs all the events it ever saw, persist must drop the erased ones
+func (kc *keyClient) PersistAll(pl Log) {
+	var keys []string
+	for k := range kc.state {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		Ω(pl.Output(kc.state[k])).ShouldNot(HaveOccurred())
+	}
+}
+
+// output outputs an event and records it in the client's state, like an application
+func (kc *keyClient) output(pl Log, ev interface{}) {
+	Ω(kc.Replay(ev)).ShouldNot(HaveOccurred())
+	Ω(pl.Output(ev)).ShouldNot(HaveOccurred())
+}
+
+var _ = Describe("Erase", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	// keysOnDisk returns the keys of the events in all the log files, in order
+	keysOnDisk := func(basepath string) []string {
+		files, err := LogFiles(basepath)
+		Ω(err).ShouldNot(HaveOccurred())
+		var keys []string
+		for _, f := range files {
+			r, err := os.Open(f)
+			Ω(err).ShouldNot(HaveOccurred())
+			rc := &recordingClient{}
+			_, err = ReplayFrom(r, nil, rc)
+			r.Close()
+			Ω(err).ShouldNot(HaveOccurred())
+			for _, ev := range rc.events {
+				if k, ok := eventKey(ev); ok {
+					keys = append(keys, k)
+				}
+			}
+		}
+		return keys
+	}
+
+	rotate := func(pl Log) {
+		gen := pl.Stats()["Generation"]
+		pl.(*pLog).Lock()
+		pl.(*pLog).rotate()
+		pl.(*pLog).Unlock()
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(gen + 1))
+		Eventually(func() bool {
+			pl.(*pLog).Lock()
+			defer pl.(*pLog).Unlock()
+			return pl.(*pLog).rotating
+		}).Should(BeFalse())
+	}
+
+	It("deletes a resource from the log files at the next rotation", func() {
+		fd, err := NewFileDest(PT+"/erase", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		kc := &keyClient{}
+		pl, err := NewLog(fd, kc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		kc.output(pl, &keyEv{K: "a", V: 1})
+		kc.output(pl, &keyEv{K: "b", V: 1})
+		rotate(pl)
+		Ω(OutputNS(pl, "t", &keyEv{K: "a", V: 2})).ShouldNot(HaveOccurred())
+		Ω(keysOnDisk(PT + "/erase")).Should(Equal([]string{"a", "b", "a", "b", "a"}))
+
+		Ω(Erase(pl, "a")).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()["ErasePending"]).Should(Equal(1.0))
+		// the client doesn't see its own tombstone, persist must drop its events anyway
+		rotate(pl)
+		Ω(pl.Stats()["ErasePending"]).Should(Equal(0.0))
+		Ω(keysOnDisk(PT + "/erase")).Should(Equal([]string{"b"}))
+		files, err := LogFiles(PT + "/erase")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files).Should(HaveLen(1))
+		pl.(*pLog).Close()
+
+		fd, err = NewFileDest(PT+"/erase", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		kc = &keyClient{}
+		pl, err = NewLog(fd, kc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(kc.state).Should(Equal(map[string]interface{}{"b": &keyEv{K: "b", V: 1}}))
+		pl.(*pLog).Close()
+	})
+
+	It("completes erasures when the log is opened", func() {
+		fd, err := NewFileDest(PT+"/erase", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		kc := &keyClient{}
+		pl, err := NewLog(fd, kc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		kc.output(pl, &keyEv{K: "a", V: 1})
+		kc.output(pl, &keyEv{K: "b", V: 1})
+		Ω(Erase(pl, "a")).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		fd, err = NewFileDest(PT+"/erase", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		// a client that ignores tombstones
+		rc := &recordingClient{}
+		pl, err = NewLog(fd, rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(HaveLen(3))
+		Ω(pl.Stats()["ErasePending"]).Should(Equal(0.0))
+		pl.(*pLog).Close()
+		Ω(keysOnDisk(PT + "/erase")).Should(Equal([]string{"b"}))
+	})
+
+	It("keeps resources created again after the erasure", func() {
+		fd, err := NewFileDest(PT+"/erase", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		kc := &keyClient{}
+		pl, err := NewLog(fd, kc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		kc.output(pl, &keyEv{K: "a", V: 1})
+		Ω(Erase(pl, "a")).ShouldNot(HaveOccurred())
+		kc.output(pl, &keyEv{K: "a", V: 2})
+		Ω(pl.Stats()["ErasePending"]).Should(Equal(0.0))
+		rotate(pl)
+		// the previous generation is kept, with the tombstone
+		Ω(keysOnDisk(PT + "/erase")).Should(Equal([]string{"a", "a", "a", "a"}))
+		pl.(*pLog).Close()
+	})
+
+	It("requires a destination that can delete previous generations", func() {
+		fd, err := NewFileDest(PT+"/erase", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(&flakyDest{LogDestination: fd}, &keyClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		err = Erase(pl, "a")
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("can delete previous generations"))
+		pl.(*pLog).Close()
+	})
+
+	It("erases the secondary destination", func() {
+		fd, err := NewFileDest(PT+"/erase", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		kc := &keyClient{}
+		pl, err := NewLog(fd, kc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		sd, err := NewFileDest(PT+"/erase2", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.SetSecondaryDestination(sd)).ShouldNot(HaveOccurred())
+		Eventually(func() bool {
+			pl.(*pLog).Lock()
+			defer pl.(*pLog).Unlock()
+			return pl.(*pLog).secSynced && !pl.(*pLog).catchingUp && !pl.(*pLog).rotating
+		}).Should(BeTrue())
+		kc.output(pl, &keyEv{K: "a", V: 1})
+		kc.output(pl, &keyEv{K: "b", V: 1})
+		rotate(pl)
+		Ω(keysOnDisk(PT + "/erase2")).Should(ContainElement("a"))
+
+		Ω(Erase(pl, "a")).ShouldNot(HaveOccurred())
+		rotate(pl)
+		Ω(pl.Stats()["ErasePending"]).Should(Equal(0.0))
+		Ω(keysOnDisk(PT + "/erase")).Should(Equal([]string{"b"}))
+		Ω(keysOnDisk(PT + "/erase2")).Should(Equal([]string{"b"}))
+		pl.(*pLog).Close()
+	})
+
+	It("refuses to erase copies it cannot delete", func() {
+		fd, err := NewFileDest(PT+"/erase", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		kc := &keyClient{}
+		pl, err := NewLog(fd, kc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		sd, err := NewFileDest(PT+"/erase2", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.SetSecondaryDestination(&flakyDest{LogDestination: sd})).ShouldNot(HaveOccurred())
+		err = Erase(pl, "a")
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("secondary destination"))
+		pl.(*pLog).Close()
+
+		By("refusing logs that upload backups")
+		os.RemoveAll(PT + "/erase")
+		fd, err = NewFileDest(PT+"/erase", true, nil,
+			BackupTo(&testUploader{uploads: make(chan string, 10)}))
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err = NewLog(fd, kc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		err = Erase(pl, "a")
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("BackupTo"))
+		pl.(*pLog).Close()
+	})
+
+	It("keeps an erasure pending while a secondary cannot delete previous generations", func() {
+		fd, err := NewFileDest(PT+"/erase", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		kc := &keyClient{}
+		pl, err := NewLog(fd, kc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		kc.output(pl, &keyEv{K: "a", V: 1})
+		Ω(Erase(pl, "a")).ShouldNot(HaveOccurred())
+		sd, err := NewFileDest(PT+"/erase2", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.SetSecondaryDestination(&flakyDest{LogDestination: sd})).ShouldNot(HaveOccurred())
+		rotate(pl)
+		Ω(pl.Stats()["ErasePending"]).Should(Equal(1.0))
+		pl.(*pLog).Close()
+	})
+
+	It("erases from a log that uses a type registry", func() {
+		reg := NewTypeRegistry()
+		Ω(reg.Register("test.keyEv", &keyEv{})).ShouldNot(HaveOccurred())
+		fd, err := NewFileDest(PT+"/erase", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		kc := &keyClient{}
+		pl, err := NewLog(fd, kc, log15.Root(), WithTypeRegistry(reg))
+		Ω(err).ShouldNot(HaveOccurred())
+		kc.output(pl, &keyEv{K: "a", V: 1})
+		kc.output(pl, &keyEv{K: "b", V: 1})
+		Ω(Erase(pl, "a")).ShouldNot(HaveOccurred())
+		Ω(pl.HealthCheck()).ShouldNot(HaveOccurred())
+		kc.output(pl, &keyEv{K: "c", V: 1})
+		pl.(*pLog).Close()
+
+		fd, err = NewFileDest(PT+"/erase", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		kc = &keyClient{}
+		pl, err = NewLog(fd, kc, log15.Root(), WithTypeRegistry(reg))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(kc.state).Should(Equal(map[string]interface{}{
+			"b": &keyEv{K: "b", V: 1}, "c": &keyEv{K: "c", V: 1}}))
+		pl.(*pLog).Close()
+	})
+})
@@ -0,0 +1,116 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// OpError is the error returned when writing to or replaying a log fails, it records where
+// the failure happened such that the file and byte offset implicated can be told without
+// enabling debug logging. Errors that put a log into error state, i.e., that HealthCheck
+// returns, are OpErrors, so are the errors ReplayErrors wrap.
+type OpError struct {
+	Op      string // operation that failed: write, encode, rotate, snapshot, or replay
+	Segment string // log file or segment being written or replayed, empty if unknown
+	Offset  int64  // byte offset in the segment at which the failure happened, -1 if unknown
+	Gen     uint64 // generation being written or replayed, 0 if unknown
+	// Correlation is the correlation ID of the output that failed, see WithCorrelationID
+	Correlation string
+	Err         error
+}
+
+func (e *OpError) Error() string {
+	msg := e.Op
+	if e.Segment != "" {
+		msg += " " + e.Segment
+	}
+	if e.Offset >= 0 {
+		msg += fmt.Sprintf(" at offset %d", e.Offset)
+	}
+	if e.Gen > 0 {
+		msg += fmt.Sprintf(" in generation %d", e.Gen)
+	}
+	if e.Correlation != "" {
+		msg += " for correlation ID " + e.Correlation
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *OpError) Unwrap() error { return e.Err }
+
+// segmentLocator is implemented by destinations that can tell where they are writing
+type segmentLocator interface {
+	// segment returns the name of the segment being written and the offset of the next
+	// write in it, -1 if unknown
+	segment() (name string, offset int64)
+}
+
+func (fd *fileDest) segment() (string, int64) {
+	if fd.outputFile == nil {
+		return fd.outputFilename, -1
+	}
+	if fd.direct != nil {
+		return fd.outputFilename, fd.direct.end()
+	}
+	off, err := fd.outputFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		off = -1
+	}
+	return fd.outputFilename, off
+}
+
+func (sd *sftpDest) segment() (string, int64) { return sd.outputFilename, sd.outputSize }
+
+// fail puts the log into error state with an OpError describing where the operation
+// failed, which is returned, errors that are OpErrors already are left as is, must be
+// called while holding the pl.Lock()
+func (pl *pLog) fail(op string, err error) error {
+	if _, ok := err.(*OpError); !ok {
+		oe := &OpError{Op: op, Offset: -1, Gen: pl.gen, Correlation: pl.correlation, Err: err}
+		if sl, ok := pl.priDest.(segmentLocator); ok {
+			oe.Segment, oe.Offset = sl.segment()
+		}
+		err = oe
+	}
+	pl.errState = err
+	pl.trace("error", 0, err.Error())
+	return err
+}
+
+// countingReader counts the bytes read from a replay reader, it implements io.ByteReader
+// so the gob decoder doesn't add buffering of its own and the count reflects what has been
+// decoded
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func newCountingReader(r io.Reader) *countingReader {
+	return &countingReader{r: bufio.NewReader(r)}
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.n++
+	}
+	return b, err
+}
+
+// readerName returns the name of a replay reader that is a file, empty otherwise
+func readerName(r io.Reader) string {
+	if n, ok := r.(interface{ Name() string }); ok {
+		return n.Name()
+	}
+	return ""
+}
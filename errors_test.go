@@ -0,0 +1,80 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("OpError", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	It("locates a failed write", func() {
+		fd, err := NewFileDest(PT+"/oe", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		// swap the output file for a read-only one, positioned at its end
+		name := fd.(*fileDest).outputFilename
+		ro, err := os.Open(name)
+		Ω(err).ShouldNot(HaveOccurred())
+		size, err := ro.Seek(0, io.SeekEnd)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.(*pLog).Lock()
+		fd.(*fileDest).outputFile.Close()
+		fd.(*fileDest).outputFile = ro
+		pl.(*pLog).Unlock()
+
+		err = pl.Output(&logEv1{S: "a"})
+		var oe *OpError
+		Ω(errors.As(err, &oe)).Should(BeTrue())
+		Ω(oe.Op).Should(Equal("write"))
+		Ω(oe.Segment).Should(Equal(name))
+		Ω(oe.Offset).Should(Equal(size))
+		Ω(oe.Gen).Should(Equal(uint64(1)))
+		Ω(pl.HealthCheck()).Should(Equal(err))
+		Ω(err.Error()).Should(HavePrefix("write " + name + " at offset "))
+		pl.(*pLog).Close()
+	})
+
+	It("locates a failed replay", func() {
+		fd, err := NewFileDest(PT+"/oe", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		files, _ := LogFiles(PT + "/oe")
+		f, err := os.OpenFile(files[0], os.O_WRONLY|os.O_APPEND, 0)
+		Ω(err).ShouldNot(HaveOccurred())
+		size, _ := f.Seek(0, io.SeekEnd)
+		f.Write([]byte("\x05hello"))
+		f.Close()
+
+		fd, err = NewFileDest(PT+"/oe", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).Should(BeAssignableToTypeOf(&ReplayError{}))
+		Ω(err.Error()).Should(ContainSubstring("replay failed in log 1: replay " + files[0]))
+		var oe *OpError
+		Ω(errors.As(err, &oe)).Should(BeTrue())
+		Ω(oe.Op).Should(Equal("replay"))
+		Ω(oe.Segment).Should(Equal(files[0]))
+		Ω(oe.Offset).Should(Equal(size + 6))
+		Ω(oe.Gen).Should(Equal(uint64(1)))
+		fd.Close()
+	})
+})
@@ -0,0 +1,129 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// EtcdKV is the subset of an etcd client used by the etcd destination. It is easily
+// implemented on top of the clientv3.KV interface of the official etcd client using
+// clientv3.WithPrefix() and clientv3.WithKeysOnly().
+type EtcdKV interface {
+	// Put sets a key to a value
+	Put(key string, value []byte) error
+	// GetPrefix returns all keys starting with prefix, the values may be omitted
+	// if keysOnly is true
+	GetPrefix(prefix string, keysOnly bool) ([]EtcdKeyValue, error)
+	// DeletePrefix deletes all keys starting with prefix
+	DeletePrefix(prefix string) error
+}
+
+// EtcdKeyValue is a key-value pair as returned by etcd, ModRevision is the revision of the
+// last modification of the key
+type EtcdKeyValue struct {
+	Key         string
+	Value       []byte
+	ModRevision int64
+}
+
+// NewEtcdDest creates or opens a log stored in etcd under the given key prefix. Each record
+// written to the log becomes an etcd key of the form <prefix>/<generation>/<sequence> and a
+// <prefix>/<generation>/done key marks generations with a complete snapshot. Replay reads
+// records in the order of their etcd revision. Older generations are deleted once a
+// rotation completes, which keeps the amount of data in etcd proportional to the live state.
+// This destination is intended for small amounts of control-plane state, etcd is not
+// designed to hold large volumes of data.
+func NewEtcdDest(kv EtcdKV, prefix string, create bool, log log15.Logger) (LogDestination,
+	error) {
+
+	if log == nil {
+		log = log15.Root()
+	}
+	log = log.New("prefix", prefix, "dest", "etcd")
+	rd, err := newRecordDest(&etcdStore{kv: kv, prefix: prefix}, create, log)
+	if err != nil {
+		return nil, fmt.Errorf("etcd %s: %s", prefix, err.Error())
+	}
+	rd.durable = true // etcd commits through raft before responding
+	return rd, nil
+}
+
+type etcdStore struct {
+	kv     EtcdKV
+	prefix string
+}
+
+func (es *etcdStore) genPrefix(gen uint64) string {
+	return fmt.Sprintf("%s/%010d/", es.prefix, gen)
+}
+
+func (es *etcdStore) generations() ([]uint64, map[uint64]bool, error) {
+	kvs, err := es.kv.GetPrefix(es.prefix+"/", true)
+	if err != nil {
+		return nil, nil, err
+	}
+	var all []uint64
+	seen := make(map[uint64]bool)
+	complete := make(map[uint64]bool)
+	for _, kv := range kvs {
+		var gen uint64
+		var rest string
+		n, _ := fmt.Sscanf(strings.TrimPrefix(kv.Key, es.prefix+"/"), "%d/%s", &gen, &rest)
+		if n != 2 {
+			continue
+		}
+		if !seen[gen] {
+			seen[gen] = true
+			all = append(all, gen)
+		}
+		if rest == "done" {
+			complete[gen] = true
+		}
+	}
+	sort.Sort(uint64s(all))
+	return all, complete, nil
+}
+
+func (es *etcdStore) append(gen, seq uint64, rec []byte) error {
+	return es.kv.Put(fmt.Sprintf("%s%010d", es.genPrefix(gen), seq), rec)
+}
+
+func (es *etcdStore) records(gen uint64) ([][]byte, error) {
+	kvs, err := es.kv.GetPrefix(es.genPrefix(gen), false)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byRevision(kvs))
+	recs := make([][]byte, 0, len(kvs))
+	for _, kv := range kvs {
+		if !strings.HasSuffix(kv.Key, "/done") {
+			recs = append(recs, kv.Value)
+		}
+	}
+	return recs, nil
+}
+
+func (es *etcdStore) complete(gen uint64) error {
+	return es.kv.Put(es.genPrefix(gen)+"done", nil)
+}
+
+func (es *etcdStore) drop(gen uint64) error {
+	return es.kv.DeletePrefix(es.genPrefix(gen))
+}
+
+type byRevision []EtcdKeyValue
+
+func (b byRevision) Len() int           { return len(b) }
+func (b byRevision) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byRevision) Less(i, j int) bool { return b[i].ModRevision < b[j].ModRevision }
+
+type uint64s []uint64
+
+func (u uint64s) Len() int           { return len(u) }
+func (u uint64s) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+func (u uint64s) Less(i, j int) bool { return u[i] < u[j] }
@@ -0,0 +1,95 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"io/ioutil"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// in-memory etcd used for testing
+type testEtcd struct {
+	rev  int64
+	keys map[string]EtcdKeyValue
+}
+
+func (te *testEtcd) Put(key string, value []byte) error {
+	te.rev++
+	te.keys[key] = EtcdKeyValue{Key: key, Value: value, ModRevision: te.rev}
+	return nil
+}
+
+func (te *testEtcd) GetPrefix(prefix string, keysOnly bool) ([]EtcdKeyValue, error) {
+	var res []EtcdKeyValue
+	for k, kv := range te.keys {
+		if strings.HasPrefix(k, prefix) {
+			if keysOnly {
+				kv.Value = nil
+			}
+			res = append(res, kv)
+		}
+	}
+	return res, nil
+}
+
+func (te *testEtcd) DeletePrefix(prefix string) error {
+	for k := range te.keys {
+		if strings.HasPrefix(k, prefix) {
+			delete(te.keys, k)
+		}
+	}
+	return nil
+}
+
+var _ = Describe("EtcdDest", func() {
+	var te *testEtcd
+
+	BeforeEach(func() {
+		te = &testEtcd{keys: make(map[string]EtcdKeyValue)}
+	})
+
+	readAll := func(ed LogDestination) []string {
+		var res []string
+		for _, rr := range ed.ReplayReaders() {
+			buf, err := ioutil.ReadAll(rr)
+			Ω(err).ShouldNot(HaveOccurred())
+			res = append(res, string(buf))
+		}
+		return res
+	}
+
+	It("does not create a log without create=true", func() {
+		_, err := NewEtcdDest(te, "/app/log", false, nil)
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("No existing"))
+	})
+
+	It("replays the current and the incomplete generation", func() {
+		ed, err := NewEtcdDest(te, "/app/log", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		ed.Write([]byte("Hello World"))
+		Ω(ed.EndRotate()).ShouldNot(HaveOccurred())
+		ed.Write([]byte("Hello Again"))
+		Ω(ed.StartRotate()).ShouldNot(HaveOccurred())
+		ed.Write([]byte("Snapshot"))
+		ed.Close()
+
+		ed, err = NewEtcdDest(te, "/app/log", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(readAll(ed)).Should(Equal([]string{"Hello WorldHello Again", "Snapshot"}))
+		ed.Write([]byte("Final"))
+		Ω(ed.EndRotate()).ShouldNot(HaveOccurred())
+		ed.Close()
+
+		By("dropping the old generations")
+		Ω(te.keys).Should(HaveLen(2))
+
+		ed, err = NewEtcdDest(te, "/app/log", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(readAll(ed)).Should(Equal([]string{"Final"}))
+		ed.Close()
+	})
+})
@@ -0,0 +1,52 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"sort"
+)
+
+// largestEvents is the number of events LargestEvents reports
+const largestEvents = 10
+
+// EventSize describes an event written to the log
+type EventSize struct {
+	Type string // type of the event, e.g. *main.Resource
+	Size int    // encoded size in bytes, including type definitions sent along with it
+	Seq  uint64 // sequence number with RecordSequenceNumbers, else number of events output
+}
+
+// eventSizes tracks the sizes of the events of the current generation
+type eventSizes struct {
+	hist    histogram
+	largest []EventSize // in decreasing size order
+}
+
+func (es *eventSizes) record(logEvent interface{}, size int, seq uint64) {
+	es.hist.record(uint64(size))
+	n := len(es.largest)
+	if n == largestEvents && size <= es.largest[n-1].Size {
+		return
+	}
+	i := sort.Search(n, func(i int) bool { return es.largest[i].Size < size })
+	if n < largestEvents {
+		es.largest = append(es.largest, EventSize{})
+	}
+	copy(es.largest[i+1:], es.largest[i:])
+	es.largest[i] = EventSize{Type: fmt.Sprintf("%T", logEvent), Size: size, Seq: seq}
+}
+
+// LargestEvents returns the largest events output to a log since it last rotated, in
+// decreasing size order, which helps identify the events that bloat the log. The
+// distribution of the event sizes is reported by Stats. It returns nil for a Log that
+// wasn't created by NewLog.
+func LargestEvents(log Log) []EventSize {
+	pl, ok := log.(*pLog)
+	if !ok {
+		return nil
+	}
+	pl.Lock()
+	defer pl.Unlock()
+	return append([]EventSize(nil), pl.sizes.largest...)
+}
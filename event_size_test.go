@@ -0,0 +1,55 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("Event sizes", func() {
+
+	It("keeps the largest events in decreasing size order", func() {
+		var es eventSizes
+		for i := 1; i <= 3*largestEvents; i++ {
+			es.record(&logEv1{}, (i*7)%(3*largestEvents+1), uint64(i))
+		}
+		Ω(es.largest).Should(HaveLen(largestEvents))
+		Ω(es.largest[0]).Should(Equal(EventSize{Type: "*persist.logEv1", Size: 30, Seq: 22}))
+		for i := 1; i < len(es.largest); i++ {
+			Ω(es.largest[i].Size).Should(BeNumerically("<", es.largest[i-1].Size))
+		}
+		Ω(es.largest[largestEvents-1].Size).Should(Equal(21))
+		Ω(es.hist.total).Should(Equal(uint64(3 * largestEvents)))
+	})
+
+	It("tracks the events output since the last rotation", func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+		defer os.RemoveAll(PT)
+		fd, err := NewFileDest(PT+"/sizes", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root(), RecordSequenceNumbers())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: strings.Repeat("b", 1000)})).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "c"})).ShouldNot(HaveOccurred())
+
+		largest := LargestEvents(pl)
+		Ω(largest).Should(HaveLen(3))
+		Ω(largest[0].Seq).Should(Equal(uint64(1)))
+		Ω(largest[0].Size).Should(BeNumerically(">", 1000))
+		Ω(pl.Stats()["EventSizeMax"]).Should(BeNumerically("==", largest[0].Size))
+
+		pl.SetSizeLimit(10)
+		Ω(pl.Output(&logEv1{S: "d"})).ShouldNot(HaveOccurred())
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(2.0))
+		pl.(*pLog).Close()
+		Ω(LargestEvents(pl)).Should(BeEmpty())
+		Ω(LargestEvents(snapshotLog{pl.(*pLog)})).Should(BeNil())
+	})
+})
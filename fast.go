@@ -0,0 +1,411 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// FastEvent is implemented by event types with generated encoding methods, see the
+// persistgen command, which the gob codec uses instead of encoding the event's fields
+// using reflection. MarshalPersist appends the encoded event to b and UnmarshalPersist
+// decodes it into the event, which must accept data that lacks the fields appended to the
+// type since the data was written, see FastReader, and must copy what it keeps of the data
+// since the codecs reuse it. The type must be registered using RegisterFast, other events
+// are encoded by gob as usual.
+type FastEvent interface {
+	MarshalPersist(b []byte) []byte
+	UnmarshalPersist(data []byte) error
+}
+
+// fastTypes holds the types registered using RegisterFast
+var fastTypes = struct {
+	sync.RWMutex
+	byName map[string]reflect.Type
+	byType map[reflect.Type]string
+}{byName: map[string]reflect.Type{}, byType: map[reflect.Type]string{}}
+
+// RegisterFast registers a pointer to a FastEvent type under a name that identifies it in
+// log files, the code generated by persistgen calls it. The type should also be registered
+// using Register so the events written before it had generated methods can be replayed.
+// A generation holding events written with the generated methods records format version
+// 14, which versions of persist that predate them refuse to replay, see FormatVersion. Nor
+// can they be replayed by processes in which the type isn't registered using RegisterFast.
+func RegisterFast(name string, value FastEvent) {
+	t := reflect.TypeOf(value)
+	if t.Kind() != reflect.Ptr {
+		panic(fmt.Sprintf("persist: RegisterFast requires a pointer type, not %s", t))
+	}
+	fastTypes.Lock()
+	defer fastTypes.Unlock()
+	if other, ok := fastTypes.byName[name]; ok && other != t {
+		panic(fmt.Sprintf("persist: name %q is already registered for type %s", name, other))
+	}
+	fastTypes.byName[name] = t
+	fastTypes.byType[t] = name
+}
+
+// fastName returns the name of a registered FastEvent's type
+func fastName(t reflect.Type) (string, bool) {
+	fastTypes.RLock()
+	defer fastTypes.RUnlock()
+	name, ok := fastTypes.byType[t]
+	return name, ok
+}
+
+// Fast records are written by the gob codecs for FastEvents straight into the gob stream,
+// between gob messages. A fast record starts with a 0 byte, which gob never sends as the
+// byte count of a message, followed by the length of its body as a gob unsigned integer.
+// The body consists of flags telling how the event is wrapped, the sequence number, the
+// namespace and annotations as the flags tell, the name of the event's type, and the data
+// produced by MarshalPersist.
+const (
+	fastSequenced  = 1 << iota // wrapped in a SequencedEvent
+	fastNamespaced             // wrapped in a NamespacedEvent
+	fastAnnotated              // the NamespacedEvent has annotations
+)
+
+// fastHeaderSize is the room left at the start of a fast record for the 0 byte and length
+const fastHeaderSize = 1 + 9
+
+// maxFastRecord is the size of the largest fast record accepted, like gob's limit
+const maxFastRecord = 1 << 30
+
+// appendFast appends the body of the fast record of a FastEvent, possibly wrapped, to b,
+// which holds fastHeaderSize bytes of room for the header, see frameFast. It returns false
+// if the event isn't a FastEvent whose type has a name.
+func appendFast(b []byte, ev interface{},
+	name func(reflect.Type) (string, bool)) ([]byte, bool) {
+
+	var flags byte
+	var seq uint64
+	var ne *NamespacedEvent
+	if se, ok := ev.(*SequencedEvent); ok {
+		flags, seq, ev = flags|fastSequenced, se.Seq, se.Event
+	}
+	if e, ok := ev.(*NamespacedEvent); ok {
+		flags, ne, ev = flags|fastNamespaced, e, e.Event
+		if len(e.Annotations) > 0 {
+			flags |= fastAnnotated
+		}
+	}
+	fe, ok := ev.(FastEvent)
+	if !ok {
+		return nil, false
+	}
+	typeName, ok := name(reflect.TypeOf(ev))
+	if !ok {
+		return nil, false
+	}
+	b = append(b, flags)
+	if flags&fastSequenced != 0 {
+		b = AppendUint(b, seq)
+	}
+	if flags&fastNamespaced != 0 {
+		b = AppendString(b, ne.NS)
+	}
+	if flags&fastAnnotated != 0 {
+		b = AppendUint(b, uint64(len(ne.Annotations)))
+		for k, v := range ne.Annotations {
+			b = AppendString(AppendString(b, k), v)
+		}
+	}
+	return fe.MarshalPersist(AppendString(b, typeName)), true
+}
+
+// frameFast writes the header of a fast record into the room left by appendFast and
+// returns the record, which starts within the room
+func frameFast(b []byte) []byte {
+	// gob unsigned integers are either a single byte < 128 or the negated number of bytes
+	// that follow in big-endian order
+	n := uint64(len(b) - fastHeaderSize)
+	start := fastHeaderSize - 1
+	if n < 0x80 {
+		b[start] = byte(n)
+	} else {
+		size := 8 - bits.LeadingZeros64(n)/8
+		start -= size
+		for i := size; i > 0; i, n = i-1, n>>8 {
+			b[start+i] = byte(n)
+		}
+		b[start] = byte(256 - size)
+	}
+	start--
+	b[start] = 0
+	return b[start:]
+}
+
+// readFast reads the body of the fast record that follows the 0 byte into buf, it returns
+// the body, which reuses buf when large enough
+func readFast(r byteReader, buf []byte) ([]byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, eofInRecord(err)
+	}
+	n := uint64(b)
+	if b >= 0x80 {
+		size := 256 - int(b)
+		if size > 8 {
+			return nil, fmt.Errorf("corrupt fast record: invalid length")
+		}
+		n = 0
+		for ; size > 0; size-- {
+			if b, err = r.ReadByte(); err != nil {
+				return nil, eofInRecord(err)
+			}
+			n = n<<8 | uint64(b)
+		}
+	}
+	if n == 0 || n > maxFastRecord {
+		return nil, fmt.Errorf("corrupt fast record: invalid length %d", n)
+	}
+	if uint64(cap(buf)) < n {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, eofInRecord(err)
+	}
+	return buf, nil
+}
+
+// fastRecord is the content of the body of a fast record
+type fastRecord struct {
+	flags byte
+	seq   uint64
+	ns    string
+	ann   map[string]string
+	name  []byte // name of the event's type, within the body
+	data  []byte // data produced by MarshalPersist, within the body
+}
+
+// parseFast parses the body of a fast record
+func parseFast(body []byte) (fastRecord, error) {
+	rec := fastRecord{flags: body[0]}
+	fr := NewFastReader(body[1:])
+	if rec.flags&fastSequenced != 0 {
+		rec.seq = fr.ReadUint()
+	}
+	if rec.flags&fastNamespaced != 0 {
+		rec.ns = fr.ReadString()
+	}
+	if rec.flags&fastAnnotated != 0 {
+		n := fr.ReadUint()
+		if n > uint64(len(fr.data)) {
+			return rec, fmt.Errorf("corrupt fast record: %d annotations", n)
+		}
+		rec.ann = make(map[string]string, n)
+		for i := uint64(0); i < n; i++ {
+			k := fr.ReadString()
+			rec.ann[k] = fr.ReadString()
+		}
+	}
+	rec.name = fr.readRaw()
+	if fr.err != nil {
+		return rec, fmt.Errorf("corrupt fast record: %s", fr.err.Error())
+	}
+	rec.data = fr.data
+	return rec, nil
+}
+
+// wrap wraps the event decoded from the record like it was when written
+func (rec *fastRecord) wrap(ev interface{}) interface{} {
+	if rec.flags&fastNamespaced != 0 {
+		ev = &NamespacedEvent{NS: rec.ns, Event: ev, Annotations: rec.ann}
+	}
+	if rec.flags&fastSequenced != 0 {
+		ev = &SequencedEvent{Seq: rec.seq, Event: ev}
+	}
+	return ev
+}
+
+// decode decodes the event of a record written by the gob codec, whose type is registered
+// using RegisterFast
+func (rec *fastRecord) decode() (interface{}, error) {
+	t, ok := fastType(rec.name)
+	if !ok {
+		return nil, fmt.Errorf("type %q is not registered using RegisterFast", rec.name)
+	}
+	ev, err := unmarshalFast(reflect.New(t.Elem()), rec.data)
+	if err != nil {
+		return nil, err
+	}
+	return rec.wrap(ev), nil
+}
+
+// fastType returns the type registered using RegisterFast under a name
+func fastType(name []byte) (reflect.Type, bool) {
+	fastTypes.RLock()
+	defer fastTypes.RUnlock()
+	t, ok := fastTypes.byName[string(name)]
+	return t, ok
+}
+
+// unmarshalFast decodes data into v, a pointer to a FastEvent type
+func unmarshalFast(v reflect.Value, data []byte) (interface{}, error) {
+	ev := v.Interface()
+	fe, ok := ev.(FastEvent)
+	if !ok {
+		return nil, fmt.Errorf("%T has no generated methods to decode it", ev)
+	}
+	if err := fe.UnmarshalPersist(data); err != nil {
+		return nil, fmt.Errorf("cannot decode %T: %s", ev, err.Error())
+	}
+	return ev, nil
+}
+
+// The Append functions encode the fields of a FastEvent, a FastReader decodes them in the
+// same order.
+
+// AppendUint appends an unsigned integer
+func AppendUint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// AppendInt appends a signed integer
+func AppendInt(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+// AppendBool appends a boolean
+func AppendBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+// AppendFloat appends a floating-point number
+func AppendFloat(b []byte, v float64) []byte {
+	return AppendUint(b, math.Float64bits(v))
+}
+
+// AppendString appends a string
+func AppendString(b []byte, v string) []byte {
+	return append(AppendUint(b, uint64(len(v))), v...)
+}
+
+// AppendBytes appends a byte slice
+func AppendBytes(b []byte, v []byte) []byte {
+	return append(AppendUint(b, uint64(len(v))), v...)
+}
+
+// AppendTime appends a time, including its offset from UTC
+func AppendTime(b []byte, v time.Time) []byte {
+	if v.IsZero() {
+		return AppendBytes(b, nil)
+	}
+	data, err := v.MarshalBinary()
+	if err != nil {
+		// the offset isn't a whole number of minutes, keep the instant
+		data, _ = v.UTC().MarshalBinary()
+	}
+	return AppendBytes(b, data)
+}
+
+// FastReader decodes the fields of a FastEvent. Reading past the end of the data returns
+// zero values, such that the fields appended to a type since the data was written read as
+// zero. Errors are sticky, the generated code checks Err once all fields are read.
+type FastReader struct {
+	data []byte
+	err  error
+}
+
+// NewFastReader returns a reader of the data passed to UnmarshalPersist
+func NewFastReader(data []byte) *FastReader {
+	return &FastReader{data: data}
+}
+
+// Err returns the first error encountered
+func (fr *FastReader) Err() error { return fr.err }
+
+// ReadUint reads an unsigned integer
+func (fr *FastReader) ReadUint() uint64 {
+	if fr.err != nil || len(fr.data) == 0 {
+		return 0
+	}
+	v, n := binary.Uvarint(fr.data)
+	if n <= 0 {
+		fr.err = fmt.Errorf("invalid unsigned integer")
+		return 0
+	}
+	fr.data = fr.data[n:]
+	return v
+}
+
+// ReadInt reads a signed integer
+func (fr *FastReader) ReadInt() int64 {
+	if fr.err != nil || len(fr.data) == 0 {
+		return 0
+	}
+	v, n := binary.Varint(fr.data)
+	if n <= 0 {
+		fr.err = fmt.Errorf("invalid integer")
+		return 0
+	}
+	fr.data = fr.data[n:]
+	return v
+}
+
+// ReadBool reads a boolean
+func (fr *FastReader) ReadBool() bool {
+	if fr.err != nil || len(fr.data) == 0 {
+		return false
+	}
+	v := fr.data[0]
+	fr.data = fr.data[1:]
+	return v != 0
+}
+
+// ReadFloat reads a floating-point number
+func (fr *FastReader) ReadFloat() float64 {
+	return math.Float64frombits(fr.ReadUint())
+}
+
+// ReadBytes reads a byte slice, it returns nil for an empty slice
+func (fr *FastReader) ReadBytes() []byte {
+	if v := fr.readRaw(); v != nil {
+		return append([]byte(nil), v...)
+	}
+	return nil
+}
+
+// ReadString reads a string
+func (fr *FastReader) ReadString() string {
+	return string(fr.readRaw())
+}
+
+// readRaw reads a byte slice without copying it out of the data
+func (fr *FastReader) readRaw() []byte {
+	n := fr.ReadUint()
+	if fr.err != nil || n == 0 {
+		return nil
+	}
+	if n > uint64(len(fr.data)) {
+		fr.err = fmt.Errorf("truncated data: %d bytes expected, %d left", n, len(fr.data))
+		return nil
+	}
+	v := fr.data[:n:n]
+	fr.data = fr.data[n:]
+	return v
+}
+
+// ReadTime reads a time
+func (fr *FastReader) ReadTime() time.Time {
+	var v time.Time
+	if data := fr.ReadBytes(); data != nil && fr.err == nil {
+		if err := v.UnmarshalBinary(data); err != nil {
+			fr.err = err
+		}
+	}
+	return v
+}
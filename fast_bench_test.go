@@ -0,0 +1,91 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// gobEv has the fields of fastEv without generated methods, gob encodes it using reflection
+type gobEv struct {
+	K    string
+	N    int
+	U    uint16
+	F    float64
+	On   bool
+	At   time.Time
+	Data []byte
+}
+
+func init() {
+	Register(&gobEv{})
+}
+
+var benchAt = time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// benchEncode encodes sequenced events the way a log outputs them
+func benchEncode(b *testing.B, codec Codec, ev func(i int) interface{}) {
+	enc := codec.NewEncoder(ioutil.Discard)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := enc.Encode(&SequencedEvent{Seq: uint64(i), Event: ev(i)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchDecode decodes b.N sequenced events encoded beforehand
+func benchDecode(b *testing.B, codec Codec, ev func(i int) interface{}) {
+	var buf bytes.Buffer
+	enc := codec.NewEncoder(&buf)
+	for i := 0; i < b.N; i++ {
+		if err := enc.Encode(&SequencedEvent{Seq: uint64(i), Event: ev(i)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	dec := codec.NewDecoder(bytes.NewReader(buf.Bytes()))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := dec.Decode(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if _, err := dec.Decode(); err != io.EOF {
+		b.Fatal(err)
+	}
+}
+
+func benchFastEv(i int) interface{} {
+	return &fastEv{K: "resource", N: i, U: 7, F: 1.5, On: true, At: benchAt,
+		Data: []byte("payload")}
+}
+
+func benchGobEv(i int) interface{} {
+	return &gobEv{K: "resource", N: i, U: 7, F: 1.5, On: true, At: benchAt,
+		Data: []byte("payload")}
+}
+
+func benchRegistry() Codec {
+	reg := NewTypeRegistry()
+	reg.Register("fast", &fastEv{})
+	reg.Register("gob", &gobEv{})
+	return GobCodecWithRegistry(reg)
+}
+
+func BenchmarkEncodeGob(b *testing.B)  { benchEncode(b, GobCodec, benchGobEv) }
+func BenchmarkEncodeFast(b *testing.B) { benchEncode(b, GobCodec, benchFastEv) }
+
+func BenchmarkEncodeRegistryGob(b *testing.B)  { benchEncode(b, benchRegistry(), benchGobEv) }
+func BenchmarkEncodeRegistryFast(b *testing.B) { benchEncode(b, benchRegistry(), benchFastEv) }
+
+func BenchmarkDecodeGob(b *testing.B)  { benchDecode(b, GobCodec, benchGobEv) }
+func BenchmarkDecodeFast(b *testing.B) { benchDecode(b, GobCodec, benchFastEv) }
+
+func BenchmarkDecodeRegistryGob(b *testing.B)  { benchDecode(b, benchRegistry(), benchGobEv) }
+func BenchmarkDecodeRegistryFast(b *testing.B) { benchDecode(b, benchRegistry(), benchFastEv) }
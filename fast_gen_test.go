@@ -0,0 +1,32 @@
+// Code generated by persistgen; DO NOT EDIT.
+
+package persist
+
+func init() {
+	RegisterFast("persist.fastEv", (*fastEv)(nil))
+}
+
+// MarshalPersist appends the encoded event to b, see FastEvent
+func (ev *fastEv) MarshalPersist(b []byte) []byte {
+	b = AppendString(b, ev.K)
+	b = AppendInt(b, int64(ev.N))
+	b = AppendUint(b, uint64(ev.U))
+	b = AppendFloat(b, float64(ev.F))
+	b = AppendBool(b, ev.On)
+	b = AppendTime(b, ev.At)
+	b = AppendBytes(b, ev.Data)
+	return b
+}
+
+// UnmarshalPersist decodes the event, see FastEvent
+func (ev *fastEv) UnmarshalPersist(data []byte) error {
+	r := NewFastReader(data)
+	ev.K = r.ReadString()
+	ev.N = int(r.ReadInt())
+	ev.U = uint16(r.ReadUint())
+	ev.F = float64(r.ReadFloat())
+	ev.On = r.ReadBool()
+	ev.At = r.ReadTime()
+	ev.Data = r.ReadBytes()
+	return r.Err()
+}
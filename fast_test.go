@@ -0,0 +1,142 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+//go:generate go run ./cmd/persistgen -type fastEv -output fast_gen_test.go fast_test.go
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// fastEv has methods generated by persistgen, see fast_gen_test.go
+type fastEv struct {
+	K    string
+	N    int
+	U    uint16
+	F    float64
+	On   bool
+	At   time.Time
+	Data []byte
+	note string // skipped like gob does
+}
+
+// fastEvV1 is fastEv before fields were appended to it
+type fastEvV1 struct {
+	K string
+	N int
+}
+
+func (ev *fastEvV1) MarshalPersist(b []byte) []byte {
+	return AppendInt(AppendString(b, ev.K), int64(ev.N))
+}
+
+func (ev *fastEvV1) UnmarshalPersist(data []byte) error { return nil }
+
+func init() {
+	Register(&fastEv{})
+}
+
+var _ = Describe("FastEvent", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	at := time.Date(2015, 6, 1, 12, 0, 0, 0, time.FixedZone("PDT", -7*3600))
+	full := &fastEv{K: "a", N: -3, U: 7, F: 1.5, On: true, At: at, Data: []byte("xyz")}
+
+	It("encodes and decodes the fields", func() {
+		ev := &fastEv{}
+		Ω(ev.UnmarshalPersist(full.MarshalPersist(nil))).ShouldNot(HaveOccurred())
+		Ω(ev.At.Equal(at)).Should(BeTrue())
+		ev.At = at
+		Ω(ev).Should(Equal(full))
+
+		By("reading the fields appended since the data was written as zero")
+		ev = &fastEv{}
+		v1 := (&fastEvV1{K: "b", N: 2}).MarshalPersist(nil)
+		Ω(ev.UnmarshalPersist(v1)).ShouldNot(HaveOccurred())
+		Ω(ev).Should(Equal(&fastEv{K: "b", N: 2}))
+
+		By("failing on truncated data")
+		data := full.MarshalPersist(nil)
+		Ω(ev.UnmarshalPersist(data[:len(data)-1])).Should(HaveOccurred())
+	})
+
+	It("is used by the codecs and replays with events written by gob", func() {
+		reg := NewTypeRegistry()
+		Ω(reg.Register("fast", &fastEv{})).ShouldNot(HaveOccurred())
+		Ω(reg.Register("gob", &logEv1{})).ShouldNot(HaveOccurred())
+		limited := DecodeLimits{MaxRecordSize: 100, MaxTypes: 10}
+		codecs := []Codec{GobCodec, GobCodecWithRegistry(reg), GobCodecWithLimits(limited)}
+		for _, codec := range codecs {
+			var buf bytes.Buffer
+			enc := codec.NewEncoder(&buf)
+			ann := map[string]string{"k": "v"}
+			Ω(enc.Encode(&SequencedEvent{Seq: 1, Event: full})).ShouldNot(HaveOccurred())
+			Ω(enc.Encode(&logEv1{S: "gob"})).ShouldNot(HaveOccurred())
+			Ω(enc.Encode(&SequencedEvent{Seq: 2, Event: &NamespacedEvent{NS: "n", Event: full,
+				Annotations: ann}})).ShouldNot(HaveOccurred())
+			Ω(enc.Encode(&logEv1{S: "gob"})).ShouldNot(HaveOccurred())
+			dec := codec.NewDecoder(&buf)
+			for i := 1; i <= 2; i++ {
+				ev, err := dec.Decode()
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(dec.(*seqDecoder).last).Should(BeEquivalentTo(i))
+				if ne, ok := ev.(*NamespacedEvent); ok {
+					Ω(ne.NS).Should(Equal("n"))
+					Ω(ne.Annotations).Should(Equal(ann))
+					ev = ne.Event
+				}
+				Ω(ev.(*fastEv).K).Should(Equal("a"))
+				Ω(ev.(*fastEv).Data).Should(Equal([]byte("xyz")))
+				Ω(dec.Decode()).Should(Equal(&logEv1{S: "gob"}))
+			}
+			_, err := dec.Decode()
+			Ω(err).Should(Equal(io.EOF))
+		}
+
+		By("limiting the size of fast records")
+		var big bytes.Buffer
+		enc := GobCodec.NewEncoder(&big)
+		Ω(enc.Encode(&fastEv{K: strings.Repeat("x", 200)})).ShouldNot(HaveOccurred())
+		_, err := GobCodecWithLimits(limited).NewDecoder(&big).Decode()
+		Ω(err).Should(MatchError(ContainSubstring("exceeds the limit of 100 bytes")))
+
+		// a record written by gob before the type had generated methods
+		var buf bytes.Buffer
+		var old interface{} = &fastEv{K: "old", N: 1}
+		Ω(gob.NewEncoder(&buf).Encode(&old)).ShouldNot(HaveOccurred())
+		Ω(GobCodec.NewDecoder(&buf).Decode()).Should(Equal(&fastEv{K: "old", N: 1}))
+	})
+
+	It("persists and replays a log", func() {
+		fd, err := NewFileDest(PT+"/fast", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{events: []interface{}{&fastEv{K: "snap", N: 1}}}
+		pl, err := NewLog(fd, rc, log15.Root(), RecordSequenceNumbers())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&fastEv{K: "live", N: 2})).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		fd, err = NewFileDest(PT+"/fast", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc = &recordingClient{}
+		pl, err = NewLog(fd, rc, log15.Root(), RecordSequenceNumbers())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(Equal([]interface{}{&fastEv{K: "snap", N: 1},
+			&fastEv{K: "live", N: 2}}))
+		pl.(*pLog).Close()
+	})
+})
@@ -0,0 +1,80 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// fenceExt is appended to the basepath to name the file holding the fencing token
+const fenceExt = "-fence"
+
+// WithFencing makes a file destination fence out other instances that write the same log
+// set, e.g., after a split brain on shared storage. Opening the log set increments a
+// fencing token stored in the <basepath>-fence file, and the destination checks that the
+// file still holds its token before creating each log file and before renaming the files at
+// the end of a rotation. If another instance opened the log set since, the check fails with
+// an error, which puts the log in error state, such that the stale instance stops at its
+// next rotation instead of interleaving its files with those of the other instance. The
+// events it outputs until then are lost. All the instances must use WithFencing. MoveLogSet
+// moves the fence file along with the log files.
+func WithFencing() FileDestOption {
+	return func(fd *fileDest) { fd.fencing = true }
+}
+
+// acquireFence increments the fencing token of the log set and makes it the destination's
+func (fd *fileDest) acquireFence() error {
+	token, err := readFence(fd.basepath)
+	if err != nil {
+		return err
+	}
+	token++
+	tmp := fd.basepath + fenceExt + ".tmp"
+	data := []byte(strconv.FormatUint(token, 10) + "\n")
+	if err := ioutil.WriteFile(tmp, data, 0660); err != nil {
+		return fmt.Errorf("cannot write fencing token: %s", err.Error())
+	}
+	if err := os.Rename(tmp, fd.basepath+fenceExt); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot write fencing token: %s", err.Error())
+	}
+	fd.fence = token
+	fd.log.Info("Acquired fencing token", "token", token)
+	return nil
+}
+
+// checkFence fails if another instance acquired the fencing token since this one did
+func (fd *fileDest) checkFence() error {
+	if !fd.fencing {
+		return nil
+	}
+	token, err := readFence(fd.basepath)
+	if err != nil {
+		return err
+	}
+	if token != fd.fence {
+		return fmt.Errorf("fenced out of %s: another instance holds fencing token %d, "+
+			"this one holds %d", fd.basepath, token, fd.fence)
+	}
+	return nil
+}
+
+// readFence returns the fencing token of the log set at basepath, 0 if it has none
+func readFence(basepath string) (uint64, error) {
+	data, err := ioutil.ReadFile(basepath + fenceExt)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("cannot read fencing token: %s", err.Error())
+	}
+	token, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid fencing token in %s: %s", basepath+fenceExt,
+			err.Error())
+	}
+	return token, nil
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("Fencing", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	open := func(create bool) Log {
+		fd, err := NewFileDest(PT+"/fenced", create, nil, WithFencing())
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{events: []interface{}{&logEv1{S: "a"}}},
+			log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		return pl
+	}
+
+	It("fences out the instance that opened the log set first", func() {
+		stale := open(true)
+		Ω(ioutil.ReadFile(PT + "/fenced-fence")).Should(Equal([]byte("1\n")))
+		current := open(false)
+		Ω(ioutil.ReadFile(PT + "/fenced-fence")).Should(Equal([]byte("2\n")))
+
+		pl := stale.(*pLog)
+		pl.Lock()
+		pl.rotate()
+		pl.Unlock()
+		Eventually(stale.HealthCheck).Should(MatchError(ContainSubstring(
+			"another instance holds fencing token 2, this one holds 1")))
+		pl.Close()
+
+		pl = current.(*pLog)
+		pl.Lock()
+		pl.rotate()
+		pl.Unlock()
+		Eventually(func() float64 { return current.Stats()["Generation"] }).Should(
+			Equal(3.0))
+		Ω(current.HealthCheck()).ShouldNot(HaveOccurred())
+		pl.Close()
+	})
+
+	It("moves the fencing token along with the log set", func() {
+		open(true).(*pLog).Close()
+		Ω(MoveLogSet(PT+"/fenced", PT+"/moved/fenced")).ShouldNot(HaveOccurred())
+		Ω(ioutil.ReadFile(PT + "/moved/fenced-fence")).Should(Equal([]byte("1\n")))
+		_, err := os.Stat(PT + "/fenced-fence")
+		Ω(os.IsNotExist(err)).Should(BeTrue())
+	})
+})
@@ -19,11 +19,39 @@ type fileDest struct {
 	replayReaders  []io.ReadCloser
 	outputFile     *os.File
 	outputFilename string
-	oldFilename    string // name of previous file (used at end of rotation)
-	snapOK         bool   // true when the initial snapshot is completed
+	oldFilename    string        // name of previous file (used at end of rotation)
+	snapOK         bool          // true when the initial snapshot is completed
+	backup         *backupPusher // optional off-host backup of each new snapshot
+	downgrade      bool          // open logs written in a newer format, see ForceDowngradeFiles
+	dirLayout      bool          // directory per generation, see DirectoryPerGeneration
+	maxUsage       float64       // disk usage above which old files are deleted
+	keepGens       int           // generations whose files are never deleted
+	usage          usageFunc     // nil unless RetainUnderUsage
+	warning        error         // disk usage remains above maxUsage
+	spaceWarn      float64       // free fraction below which a warning is raised
+	spaceCrit      float64       // free fraction below which HealthCheck fails
+	spaceUsage     usageFunc     // nil unless FreeSpaceWatermarks
+	spaceFree      float64       // free fraction found by the last check
+	spaceLevel     int           // watermark level found by the last check
+	spaceChecked   time.Time     // time of the last check
+	takeOver       bool          // append to a log that was handed off, see TakeOver
+	syncEvery      time.Duration // interval between syncs of the log file, see SyncInterval
+	synced         time.Time     // time of the last sync
+	directIO       bool          // bypass the page cache, see DirectIO
+	direct         *directWriter // nil unless the log file is written using direct I/O
+	namer          Namer         // names new log files, nil for the default, see WithNamer
+	fencing        bool          // fence out other instances, see WithFencing
+	fence          uint64        // fencing token acquired when opening the log set
+	manifest       *TypeRegistry // types written to the manifest, see WithTypeManifest
+	runtimeOpt     bool          // set by the options Reconfigure accepts, see runtimeFileOption
+	sum            *fileSum      // checksum of the log file, nil if another process wrote it
+	oldSum         *fileSum      // checksum of the file a rotation in progress supersedes
 	log            log15.Logger
 }
 
+// FileDestOption configures optional behavior of a file destination, see NewFileDest
+type FileDestOption func(fd *fileDest)
+
 const (
 	newExt  = "-new.plog"        // new log with incomplete initial snapshot
 	currExt = "-curr.plog"       // current log with complete initial snapshot
@@ -32,11 +60,14 @@ const (
 )
 
 // NewFileDest creates or opens a file for logging. The basepath must not contain any character
-// in the set '*', '?', '[', '\', or '.'. The individual log file names will have a -<timestamp>
-// and possibly a <-new>, <-curr>, and '.plog' extension appended.
+// in the set '*', '?', '[', '\', or '.'. The individual log file names will have a -<timestamp>,
+// or a segment name chosen by WithNamer, and a <-new>, <-curr>, or <-old> and '.plog' extension
+// appended.
 // The create argument determines whether it's OK to create a new set of log files or whether
 // an existing set is expected to be found.
-func NewFileDest(basepath string, create bool, log log15.Logger) (LogDestination, error) {
+// Additional options, such as BackupTo, may be passed to customize the destination.
+func NewFileDest(basepath string, create bool, log log15.Logger,
+	opts ...FileDestOption) (LogDestination, error) {
 	if log == nil {
 		log = log15.Root()
 	}
@@ -51,45 +82,60 @@ func NewFileDest(basepath string, create bool, log log15.Logger) (LogDestination
 	}
 
 	fd := &fileDest{basepath: basepath, log: log}
+	for _, opt := range opts {
+		opt(fd)
+	}
+	if fd.dirLayout {
+		if opt := fd.dirLayoutOption(); opt != "" {
+			fd.Close()
+			return nil, fmt.Errorf("%s is not supported with DirectoryPerGeneration", opt)
+		}
+		return newDirDest(basepath, create, log)
+	}
+	if fd.fencing && (len(m) > 0 || create) {
+		if err := fd.acquireFence(); err != nil {
+			fd.Close()
+			return nil, err
+		}
+	}
 
 	if len(m) > 0 {
-		sort.Strings(m)
-		lm := len(m) - 1
-		if strings.HasSuffix(m[lm], currExt) {
-			// the most recent log file is current, i.e. it's all we need
-			f0, err := os.Open(m[lm])
-			if err != nil {
-				return nil, fmt.Errorf("error opening %s: %s", m[lm], err.Error())
-			}
-			fd.replayReaders = []io.ReadCloser{f0}
-			fd.oldFilename = m[lm]
-			stat, _ := f0.Stat()
-			log.Info("Opening existing log, replaying one file",
-				"file1", m[lm], "len1", stat.Size())
-		} else if strings.HasSuffix(m[lm], newExt) && lm > 0 &&
-			strings.HasSuffix(m[lm-1], currExt) {
-			// the most recent log is not a complete snapshot, we need it and
-			// the prior log file (and we have both)
-			// we create a multi-reader that reads from the prior log file and then
-			// from the new one
-			f0, err := os.Open(m[lm-1])
+		names, err := replaySet(basepath, m)
+		if err != nil {
+			fd.Close()
+			return nil, err
+		}
+		for _, n := range names {
+			f, err := os.Open(n)
 			if err != nil {
-				return nil, fmt.Errorf("error opening %s: %s", m[lm-1], err.Error())
+				fd.Close()
+				return nil, fmt.Errorf("error opening %s: %s", n, err.Error())
 			}
-			f1, err := os.Open(m[lm])
-			if err != nil {
-				f0.Close()
-				return nil, fmt.Errorf("error opening %s: %s", m[lm], err.Error())
+			fd.replayReaders = append(fd.replayReaders, f)
+			// refuse before starting a new file, which would alter the log set
+			if err := checkFileFormat(f, fd.downgrade, log); err != nil {
+				fd.Close()
+				return nil, fmt.Errorf("%s: %s", n, err.Error())
 			}
-			fd.replayReaders = []io.ReadCloser{f0, f1}
-			fd.oldFilename = m[lm]
-			log.Info("Opening existing log, replaying two files", "file1", m[lm-1],
-				"file2", m[lm])
+		}
+		fd.oldFilename = names[len(names)-1]
+		if len(names) == 1 {
+			stat, _ := fd.replayReaders[0].(*os.File).Stat()
+			log.Info("Opening existing log, replaying one file",
+				"file1", names[0], "len1", stat.Size())
 		} else {
-			return nil, fmt.Errorf(
-				"Cannot determine current (&new) logs from basepath %s", basepath)
+			log.Info("Opening existing log, replaying two files", "file1", names[0],
+				"file2", names[1])
+		}
+		if fd.takeOver {
+			if err := fd.openTakeOver(names); err != nil {
+				fd.Close()
+				return nil, err
+			}
+			return fd, nil
 		}
-	} else if !create {
+	} else if !create || fd.takeOver {
+		fd.Close()
 		return nil, fmt.Errorf("No existing log file found at %s", basepath)
 	} else {
 		log.Info("No existing log found, creating a new one")
@@ -98,22 +144,113 @@ func NewFileDest(basepath string, create bool, log log15.Logger) (LogDestination
 	// Open new destination
 	err = fd.startNew(len(m) > 0)
 	if err != nil {
-		if fd.replayReaders != nil {
-			for _, rr := range fd.replayReaders {
-				rr.Close()
-			}
-			fd.replayReaders = nil
-		}
+		fd.Close()
 		return nil, err
 	}
 	return fd, nil
 }
 
+// ForceDowngradeFiles allows NewFileDest to open a log set written in a newer format than
+// FormatVersion, see ForceDowngrade
+func ForceDowngradeFiles() FileDestOption {
+	return func(fd *fileDest) { fd.downgrade = true }
+}
+
+// checkFileFormat checks the format version of a log file, it leaves the file positioned
+// at its start. Files whose metadata cannot be read are left for the replay to judge.
+func checkFileFormat(f *os.File, force bool, log log15.Logger) error {
+	m, err := ReplayMeta(f, nil)
+	if _, serr := f.Seek(0, io.SeekStart); serr != nil {
+		return serr
+	}
+	if err != nil || m == nil {
+		return nil
+	}
+	return checkFormat(m, force, log)
+}
+
+// LogFiles returns the names of all the log files of the log set at basepath in chronological
+// order, including old log files that are no longer needed for replay.
+func LogFiles(basepath string) ([]string, error) {
+	if strings.ContainsAny(basepath, "*?[\\.") {
+		return nil, fmt.Errorf("basepath cannot contain '*', '?', '[', '\\' or '.'")
+	}
+	// the timestamp starts with a dash, matching it avoids picking up the files of other
+	// log sets whose basepath starts with this one
+	m, err := filepath.Glob(basepath + "-*.plog")
+	if err != nil {
+		return nil, fmt.Errorf("basepath invalid: %s", err.Error())
+	}
+	sort.Strings(m)
+	return m, nil
+}
+
+// ReplayFiles returns the names of the log files of the log set at basepath that a file
+// destination replays when opening the log set, in replay order.
+func ReplayFiles(basepath string) ([]string, error) {
+	m, err := LogFiles(basepath)
+	if err != nil {
+		return nil, err
+	}
+	return replaySet(basepath, m)
+}
+
+// replaySet determines which log files of a log set need to be replayed given the names of
+// all the log files in the set. Either the most recent log file is current, i.e. it's all we
+// need, or the most recent log is not a complete snapshot, in which case we need it and the
+// prior log file, which must be current.
+func replaySet(basepath string, names []string) ([]string, error) {
+	sort.Strings(names)
+	lm := len(names) - 1
+	if lm >= 0 && strings.HasSuffix(names[lm], currExt) {
+		return names[lm:], nil
+	} else if lm > 0 && strings.HasSuffix(names[lm], newExt) &&
+		strings.HasSuffix(names[lm-1], currExt) {
+		return names[lm-1:], nil
+	}
+	return nil, fmt.Errorf(
+		"Cannot determine current (&new) logs from basepath %s", basepath)
+}
+
+// rotatedNames returns the names to which the new log file and the old log file must be
+// renamed at the end of a rotation, state describes the destination for internalError
+func rotatedNames(newFilename, oldFilename string,
+	state []interface{}) (string, string, error) {
+
+	if !strings.HasSuffix(newFilename, newExt) {
+		return "", "", internalError(state, "new log file (%s) does not have %s suffix !?",
+			newFilename, newExt)
+	}
+	currName := strings.TrimSuffix(newFilename, newExt) + currExt
+
+	var oldName string // new name for old file...
+	if strings.HasSuffix(oldFilename, currExt) {
+		oldName = strings.TrimSuffix(oldFilename, currExt) + oldExt
+	} else if strings.HasSuffix(oldFilename, newExt) {
+		oldName = strings.TrimSuffix(oldFilename, newExt) + oldExt
+		// TODO: should really also rename the log file prior to that, which must
+		// have a currExt
+	} else {
+		return "", "", internalError(state, "old log file (%s) doesn't have %s or %s suffix",
+			oldFilename, currExt, newExt)
+	}
+	return currName, oldName, nil
+}
+
 // createNewFile attempts to create a new file and keeps adding from 'a' to 'z' to ensure it
 // doesn't open an existing file
 // TODO: can't create foo-new.plog if foo-curr.plog exists!
 func createNewFile(name, ext string) (*os.File, string, error) {
-	for i := '`'; i <= 'z'; i++ {
+	// start after the suffix of any file of the same second, even if older files were
+	// deleted, such that file names remain in chronological order
+	first := '`'
+	m, _ := filepath.Glob(name + "*")
+	for _, f := range m {
+		if c := rune(f[len(name)]); c >= first {
+			first = c + 1
+		}
+	}
+	for i := first; i <= 'z'; i++ {
 		n := name
 		if i != '`' { // '`' is just before 'a', signifies no suffix
 			n += string(i)
@@ -140,9 +277,16 @@ func createNewFile(name, ext string) (*os.File, string, error) {
 // start a new log file and use either the newExt (normal case) or the currExt (when creating the
 // very first log file since there's no preceding currExt file)
 func (fd *fileDest) startNew(useNewExt bool) error {
+	if err := fd.checkFence(); err != nil {
+		return err
+	}
+
 	// work out filename
-	date := time.Now().UTC().Format(dateFmt)
-	name := fd.basepath + date
+	seg, err := fd.newSegment()
+	if err != nil {
+		return fmt.Errorf("Cannot create new log file: %s", err.Error())
+	}
+	name := fd.basepath + seg
 	ext := currExt
 	if useNewExt {
 		ext = newExt
@@ -153,10 +297,17 @@ func (fd *fileDest) startNew(useNewExt bool) error {
 	if err != nil {
 		return fmt.Errorf("Cannot create new log file: %s", err.Error())
 	}
+	if err := fd.writeManifest(); err != nil {
+		outF.Close()
+		os.Remove(outFn)
+		return err
+	}
 	fd.log.Info("Starting new log file", "file", outF.Name())
 	fd.outputFile = outF
 	fd.outputFilename = outFn
+	fd.sum = newFileSum()
 	fd.snapOK = false
+	fd.openDirect()
 	return nil
 }
 
@@ -167,16 +318,45 @@ func (fd *fileDest) Close() {
 		}
 		fd.replayReaders = nil
 	}
+	fd.closeDirect()
 	if fd.outputFile != nil {
+		// a new log file that was never written to, typically because the replay failed,
+		// would prevent the log set from being opened again after a second failure
+		st, err := fd.outputFile.Stat()
 		fd.outputFile.Close()
+		if err == nil && st.Size() == 0 && strings.HasSuffix(fd.outputFilename, newExt) {
+			os.Remove(fd.outputFilename)
+		}
 		fd.outputFile = nil
 		fd.outputFilename = ""
 	}
+	if fd.backup != nil {
+		fd.backup.close()
+		fd.backup = nil
+	}
 	fd.basepath = ""
 }
 
+func (fd *fileDest) Capabilities() Capabilities {
+	return Capabilities{CanReplay: true, CanRotate: true}
+}
+
 func (fd *fileDest) Write(p []byte) (int, error) {
-	return fd.outputFile.Write(p)
+	fd.checkSpace()
+	var n int
+	var err error
+	if fd.direct != nil {
+		n, err = fd.direct.write(fd.outputFile, p)
+	} else {
+		n, err = fd.outputFile.Write(p)
+	}
+	if fd.sum != nil {
+		fd.sum.write(p[:n])
+	}
+	if err == nil {
+		err = fd.syncOutput()
+	}
+	return n, err
 }
 
 func (fd *fileDest) ReplayReaders() []io.ReadCloser {
@@ -188,10 +368,12 @@ func (fd *fileDest) StartRotate() error {
 	if !fd.snapOK {
 		return fmt.Errorf("Cannot rotate: initial snapshot incomplete")
 	}
+	fd.closeDirect()
 	fd.outputFile.Close()
 	fd.outputFile = nil
 	fd.oldFilename = fd.outputFilename
 	fd.outputFilename = ""
+	fd.oldSum, fd.sum = fd.sum, nil
 	return fd.startNew(true)
 }
 
@@ -200,7 +382,10 @@ func (fd *fileDest) StartRotate() error {
 // an implicit StartRotate() when the destination is initially created.
 func (fd *fileDest) EndRotate() error {
 	if fd.snapOK {
-		return fmt.Errorf("internal error: StartRotate not called")
+		return internalError(fd.state(), "StartRotate not called")
+	}
+	if err := fd.checkFence(); err != nil {
+		return err
 	}
 
 	// if we started a new log and there's no replay, then the first file has
@@ -208,22 +393,21 @@ func (fd *fileDest) EndRotate() error {
 	// current file has newExt and we need some renaming to make it currExt
 	if fd.oldFilename == "" {
 		if !strings.HasSuffix(fd.outputFilename, currExt) {
-			return fmt.Errorf(
-				"internal error: first log file (%s) should have %s suffix",
+			return internalError(fd.state(), "first log file (%s) should have %s suffix",
 				fd.outputFilename, currExt)
 		}
 		fd.snapOK = true
 		fd.log.Info("New log file now initialized")
-		return nil
+		fd.recordChecksums("", "")
+		return fd.pushBackup()
 	}
-	if !strings.HasSuffix(fd.outputFilename, newExt) {
-		return fmt.Errorf("internal error: new log file (%s) does not have %s suffix !?",
-			fd.outputFilename, newExt)
+	newName, oldName, err := rotatedNames(fd.outputFilename, fd.oldFilename, fd.state())
+	if err != nil {
+		return err
 	}
 
 	// Rename new log file
-	newName := strings.TrimSuffix(fd.outputFilename, newExt) + currExt
-	err := os.Rename(fd.outputFilename, newName)
+	err = os.Rename(fd.outputFilename, newName)
 	if err != nil {
 		return err
 	}
@@ -231,24 +415,58 @@ func (fd *fileDest) EndRotate() error {
 	fd.log.Info("New log file now initialized & renamed", "file", newName)
 
 	// Rename old file
-	var oldName string // new name for old file...
-	if strings.HasSuffix(fd.oldFilename, currExt) {
-		oldName = strings.TrimSuffix(fd.oldFilename, currExt) + oldExt
-	} else if strings.HasSuffix(fd.oldFilename, newExt) {
-		oldName = strings.TrimSuffix(fd.oldFilename, newExt) + oldExt
-		// TODO: should really also rename the log file prior to that, which must
-		// have a currExt
-	} else {
-		return fmt.Errorf("internal error: old log file (%s) doesn't have %s or %s suffix",
-			fd.oldFilename, currExt, newExt)
-	}
 	fd.log.Info("Old log file now superceded", "file", oldName)
 	err = os.Rename(fd.oldFilename, oldName)
 	if err != nil {
 		return err
 	}
+	fd.recordChecksums(fd.oldFilename, oldName)
 	fd.oldFilename = ""
 	fd.snapOK = true
+	fd.retain()
+
+	return fd.pushBackup()
+}
 
+// recordChecksums records the checksum of the snapshot of the current log file and, when a
+// rotation superseded the file prev, the checksum of that file under its -old name, see
+// Verifier. Failures are logged, they only leave files unverified.
+func (fd *fileDest) recordChecksums(prev, oldName string) {
+	if fd.sum != nil {
+		if err := fd.sum.record(fd.outputFilename); err != nil {
+			fd.log.Warn("Cannot record checksum", "file", fd.outputFilename, "err", err)
+		}
+	}
+	if oldName == "" {
+		return
+	}
+	var err error
+	if fd.oldSum != nil {
+		err = fd.oldSum.record(oldName)
+		os.Remove(prev + checksumExt)
+	} else if _, serr := os.Stat(prev + checksumExt); serr == nil {
+		// written by another process, the checksum of its snapshot remains valid
+		err = os.Rename(prev+checksumExt, oldName+checksumExt)
+	}
+	fd.oldSum = nil
+	if err != nil {
+		fd.log.Warn("Cannot record checksum", "file", oldName, "err", err)
+	}
+}
+
+// pushBackup queues the current log file, which now holds a complete snapshot, for upload to
+// the backup destination, if there is one. Backup problems are logged but not returned so
+// they don't put the log into an error state.
+func (fd *fileDest) pushBackup() error {
+	if fd.backup == nil {
+		return nil
+	}
+	stat, err := fd.outputFile.Stat()
+	if err == nil {
+		err = fd.backup.push(fd.outputFilename, stat.Size())
+	}
+	if err != nil {
+		fd.log.Warn("Cannot start backup", "file", fd.outputFilename, "err", err)
+	}
 	return nil
 }
@@ -6,6 +6,7 @@ package persist
 
 import (
 	"io"
+	"io/ioutil"
 	"os"
 
 	. "github.com/onsi/ginkgo"
@@ -43,6 +44,15 @@ var _ = Describe("NewFileDest", func() {
 		Ω(err).Should(HaveOccurred())
 		Ω(err.Error()).Should(ContainSubstring("No existing"))
 	})
+
+	It("names files in the same second in chronological order", func() {
+		name := PT + "/test-20150102-150405"
+		Ω(ioutil.WriteFile(name+"b-old.plog", nil, 0666)).ShouldNot(HaveOccurred())
+		f, n, err := createNewFile(name, newExt)
+		Ω(err).ShouldNot(HaveOccurred())
+		f.Close()
+		Ω(n).Should(Equal(name + "c-new.plog"))
+	})
 })
 
 var _ = Describe("FileDest", func() {
@@ -0,0 +1,185 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MoveLogSet moves the log set at oldpath to newpath, which may be in a different directory
+// or on a different volume and whose directory is created if necessary. Each file is copied
+// to a temporary name and verified by comparing checksums, once all files are copied they
+// are renamed to their final names and only then are the original files removed. No log
+// set may exist at newpath and the application must not have the log set open.
+func MoveLogSet(oldpath, newpath string) error {
+	files, err := LogFiles(oldpath)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no log files found at %s", oldpath)
+	}
+	if existing, err := LogFiles(newpath); err != nil {
+		return err
+	} else if len(existing) > 0 {
+		return fmt.Errorf("log files already exist at %s", newpath)
+	}
+	// the recorded checksums, the fencing token, and the type manifest move with the log
+	// set, see Verifier, WithFencing, and WithTypeManifest
+	for _, f := range files {
+		if _, err := os.Stat(f + checksumExt); err == nil {
+			files = append(files, f+checksumExt)
+		}
+	}
+	for _, ext := range []string{fenceExt, manifestExt} {
+		if _, err := os.Stat(oldpath + ext); err == nil {
+			files = append(files, oldpath+ext)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(newpath), 0777); err != nil {
+		return err
+	}
+
+	// copy all files to temporary names
+	var temps, finals []string
+	cleanup := func() {
+		for _, t := range temps {
+			os.Remove(t)
+		}
+	}
+	for _, f := range files {
+		final := newpath + strings.TrimPrefix(f, oldpath)
+		temp := final + ".tmp"
+		temps = append(temps, temp)
+		finals = append(finals, final)
+		if err := copyVerified(f, temp); err != nil {
+			cleanup()
+			return err
+		}
+	}
+
+	// switch over to the final names, this is where the new log set appears
+	for i := range temps {
+		if err := os.Rename(temps[i], finals[i]); err != nil {
+			for _, f := range finals[:i] {
+				os.Remove(f)
+			}
+			cleanup()
+			return err
+		}
+	}
+	syncDir(filepath.Dir(newpath))
+
+	// remove the old log set
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			return fmt.Errorf("log set moved but cannot remove old file: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// copyVerified copies a file, syncs the copy to disk, and verifies that the copy reads back
+// with the same checksum as the original
+func copyVerified(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(dst, h), src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot copy %s: %s", from, err.Error())
+	}
+	sum, err := fileChecksum(to)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, h.Sum(nil)) {
+		return fmt.Errorf("checksum mismatch copying %s to %s", from, to)
+	}
+	return nil
+}
+
+// fileChecksum returns the SHA-256 checksum of a file
+func fileChecksum(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// syncDir flushes a directory to disk so renames are durable, errors are ignored because
+// not all platforms support syncing directories
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// TrimLogSet removes the log files of the log set at basepath that are not needed for replay
+// while keeping the files of the most recent generations, keep being the number of
+// generations to keep including the current one, and returns the names of the files
+// removed, or that would be removed if dryRun is true. Only -old files are ever removed and
+// the log set must be healthy, see PlanRepair. The application may be running.
+func TrimLogSet(basepath string, keep int, dryRun bool) ([]string, error) {
+	if keep < 1 {
+		return nil, fmt.Errorf("must keep at least one generation")
+	}
+	replay, err := ReplayFiles(basepath)
+	if err != nil {
+		return nil, err
+	}
+	files, err := LogFiles(basepath)
+	if err != nil {
+		return nil, err
+	}
+	var old []string
+	for _, f := range files {
+		if f < replay[0] && strings.HasSuffix(f, oldExt) {
+			old = append(old, f)
+		}
+	}
+	// a delta snapshot needs the files of the generations it builds on
+	if depth := snapshotDepth(replay[0]); depth > keep-1 {
+		keep = depth + 1
+	}
+	if len(old) <= keep-1 {
+		return nil, nil
+	}
+	trim := old[:len(old)-(keep-1)]
+	if dryRun {
+		return trim, nil
+	}
+	for i, f := range trim {
+		if err := os.Remove(f); err != nil {
+			return trim[:i], err
+		}
+		os.Remove(f + checksumExt)
+	}
+	return trim, nil
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("MoveLogSet", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+
+	It("moves a log set to another directory", func() {
+		fd, err := NewFileDest(PT+"/orig", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &testLogClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		Ω(MoveLogSet(PT+"/orig", PT+"/sub/moved")).ShouldNot(HaveOccurred())
+		files, err := LogFiles(PT + "/orig")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files).Should(BeEmpty())
+
+		fd, err = NewFileDest(PT+"/sub/moved", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		lc := &testLogClient{i: 1}
+		pl, err = NewLog(fd, lc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(lc.n).Should(Equal(3))
+		pl.(*pLog).Close()
+	})
+
+	It("refuses to overwrite a log set", func() {
+		for _, bp := range []string{"/a", "/b"} {
+			fd, err := NewFileDest(PT+bp, true, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			fd.Close()
+		}
+		Ω(MoveLogSet(PT+"/a", PT+"/b")).Should(HaveOccurred())
+		Ω(MoveLogSet(PT+"/none", PT+"/c")).Should(HaveOccurred())
+	})
+
+	It("trims old generations", func() {
+		create := func(names ...string) {
+			for _, n := range names {
+				f, err := os.Create(PT + "/t" + n)
+				Ω(err).ShouldNot(HaveOccurred())
+				f.Close()
+			}
+		}
+		create("-20150101-000000-old.plog", "-20150102-000000-old.plog",
+			"-20150103-000000-old.plog", "-20150104-000000-curr.plog",
+			"-20150105-000000-new.plog")
+
+		trim, err := TrimLogSet(PT+"/t", 2, true)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(trim).Should(Equal([]string{PT + "/t-20150101-000000-old.plog",
+			PT + "/t-20150102-000000-old.plog"}))
+		files, _ := LogFiles(PT + "/t")
+		Ω(files).Should(HaveLen(5))
+
+		trim, err = TrimLogSet(PT+"/t", 1, false)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(trim).Should(HaveLen(3))
+		files, _ = LogFiles(PT + "/t")
+		Ω(files).Should(Equal([]string{PT + "/t-20150104-000000-curr.plog",
+			PT + "/t-20150105-000000-new.plog"}))
+
+		_, err = TrimLogSet(PT+"/t", 0, false)
+		Ω(err).Should(HaveOccurred())
+	})
+})
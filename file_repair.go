@@ -0,0 +1,142 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// RepairAction is a step of the repair of a log set, it renames a file
+type RepairAction struct {
+	From   string
+	To     string
+	Reason string
+}
+
+// asideExt is appended to log files that are set aside, which takes them out of the log set
+const asideExt = ".aside"
+
+// PlanRepair inspects the log set at basepath and returns the actions that bring it back
+// to a state NewFileDest can open. It returns no actions if the log set is healthy. The
+// rules, applied in order, are:
+//   - duplicate files, i.e., files with the same timestamp and suffix letter but different
+//     extensions, are copies of the same log file: the largest is kept and the others are
+//     set aside by adding a .aside extension, which takes them out of the log set
+//   - a -new file followed by a -curr file was superseded and is renamed to -old
+//   - of several -new files following the latest -curr file only the first is kept, the
+//     later ones hold incomplete snapshots of the state replayed from the first and are
+//     set aside
+//   - -curr files preceding the latest -curr file are renamed to -old
+//   - -old files following the latest -curr file are out of place and set aside
+//   - if there is no -curr file the latest -old file is promoted to -curr, or, if there
+//     is no -old file, the first -new file is, this may lose data and is a last resort
+//
+// No file is ever deleted.
+func PlanRepair(basepath string) ([]RepairAction, error) {
+	names, err := LogFiles(basepath)
+	if err != nil {
+		return nil, err
+	}
+	var actions []RepairAction
+	rename := func(from, to, reason string) {
+		actions = append(actions, RepairAction{From: from, To: to, Reason: reason})
+	}
+
+	// group files by stem, i.e., name without extension, and remove duplicates
+	exts := map[string]string{}
+	var stems []string
+	for _, n := range names {
+		stem, ext := splitExt(n)
+		if ext == "" {
+			return nil, fmt.Errorf("unexpected log file name: %s", n)
+		}
+		if prev, ok := exts[stem]; ok {
+			keep, drop := stem+prev, n
+			if fileSize(n) > fileSize(keep) {
+				keep, drop = n, keep
+				exts[stem] = ext
+			}
+			rename(drop, drop+asideExt, "duplicate of "+keep)
+			continue
+		}
+		exts[stem] = ext
+		stems = append(stems, stem)
+	}
+	sort.Strings(stems)
+
+	// find the latest -curr file and deal with the -new files
+	lastCurr := -1
+	for i, s := range stems {
+		if exts[s] == currExt {
+			lastCurr = i
+		}
+	}
+	if lastCurr < 0 {
+		promote := -1
+		for i, s := range stems {
+			if exts[s] == oldExt {
+				promote = i
+			}
+		}
+		for i, s := range stems {
+			if promote < 0 && exts[s] == newExt {
+				promote = i
+			}
+		}
+		if promote < 0 {
+			return actions, nil // no log files at all
+		}
+		s := stems[promote]
+		rename(s+exts[s], s+currExt, "no -curr file, promoted as a last resort")
+		exts[s] = currExt
+		lastCurr = promote
+	}
+	for i, s := range stems {
+		switch {
+		case i < lastCurr && exts[s] == newExt:
+			rename(s+newExt, s+oldExt, "superseded by a later -curr file")
+		case i < lastCurr && exts[s] == currExt:
+			rename(s+currExt, s+oldExt, "superseded by a later -curr file")
+		case i > lastCurr+1 && exts[s] == newExt:
+			rename(s+newExt, s+newExt+asideExt, "incomplete snapshot of an earlier -new file")
+		case i > lastCurr && exts[s] == oldExt:
+			rename(s+oldExt, s+oldExt+asideExt, "-old file following the latest -curr file")
+		}
+	}
+	return actions, nil
+}
+
+// Repair performs the actions returned by PlanRepair
+func Repair(actions []RepairAction) error {
+	for _, a := range actions {
+		if _, err := os.Stat(a.To); err == nil {
+			return fmt.Errorf("cannot rename %s: %s exists", a.From, a.To)
+		}
+		if err := os.Rename(a.From, a.To); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitExt splits a log file name into its stem and its extension, which is empty if the
+// name doesn't have one of the log file extensions
+func splitExt(name string) (string, string) {
+	for _, ext := range []string{newExt, currExt, oldExt} {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext), ext
+		}
+	}
+	return name, ""
+}
+
+func fileSize(name string) int64 {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return -1
+	}
+	return fi.Size()
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PlanRepair", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+
+	// create log files with the given names, relative to PT/r, and sizes
+	create := func(files map[string]int) {
+		for n, size := range files {
+			err := ioutil.WriteFile(PT+"/r"+n, make([]byte, size), 0660)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+	}
+
+	// repair the log set and return the resulting file names relative to PT
+	repair := func() []string {
+		actions, err := PlanRepair(PT + "/r")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(Repair(actions)).ShouldNot(HaveOccurred())
+		_, err = ReplayFiles(PT + "/r")
+		Ω(err).ShouldNot(HaveOccurred())
+		m, err := filepath.Glob(PT + "/r*")
+		Ω(err).ShouldNot(HaveOccurred())
+		for i := range m {
+			m[i] = m[i][len(PT)+2:]
+		}
+		return m
+	}
+
+	It("leaves a healthy log set alone", func() {
+		create(map[string]int{"-20150101-000000-old.plog": 1,
+			"-20150102-000000-curr.plog": 1, "-20150103-000000-new.plog": 1})
+		actions, err := PlanRepair(PT + "/r")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(actions).Should(BeEmpty())
+	})
+
+	It("renames superseded files", func() {
+		create(map[string]int{"-20150101-000000-curr.plog": 1,
+			"-20150102-000000-old.plog": 1, "-20150103-000000-new.plog": 1,
+			"-20150104-000000-curr.plog": 1, "-20150105-000000-new.plog": 1,
+			"-20150105-000000a-new.plog": 1})
+		Ω(repair()).Should(Equal([]string{"-20150101-000000-old.plog",
+			"-20150102-000000-old.plog", "-20150103-000000-old.plog",
+			"-20150104-000000-curr.plog", "-20150105-000000-new.plog",
+			"-20150105-000000a-new.plog.aside"}))
+	})
+
+	It("removes duplicates", func() {
+		create(map[string]int{"-20150101-000000-old.plog": 10,
+			"-20150101-000000-curr.plog": 5, "-20150102-000000-new.plog": 1})
+		// the old file is kept and then promoted since there is no curr file left
+		Ω(repair()).Should(Equal([]string{"-20150101-000000-curr.plog",
+			"-20150101-000000-curr.plog.aside", "-20150102-000000-new.plog"}))
+	})
+
+	It("sets aside out of place files", func() {
+		create(map[string]int{"-20150101-000000-curr.plog": 1,
+			"-20150102-000000-old.plog": 1})
+		Ω(repair()).Should(Equal([]string{"-20150101-000000-curr.plog",
+			"-20150102-000000-old.plog.aside"}))
+	})
+
+	It("promotes a file when -curr is missing", func() {
+		create(map[string]int{"-20150101-000000-new.plog": 1})
+		Ω(repair()).Should(Equal([]string{"-20150101-000000-curr.plog"}))
+	})
+})
@@ -0,0 +1,29 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import "reflect"
+
+// An EventFilter selects the events mirrored to a destination, it returns true for events
+// that must be written. It is called while holding the log's lock and must not call back
+// into the log.
+type EventFilter func(logEvent interface{}) bool
+
+// TypeFilter returns a filter that selects the events whose type matches the type of one
+// of the example events
+func TypeFilter(events ...interface{}) EventFilter {
+	types := make(map[reflect.Type]bool)
+	for _, ev := range events {
+		types[reflect.TypeOf(ev)] = true
+	}
+	return func(logEvent interface{}) bool { return types[reflect.TypeOf(logEvent)] }
+}
+
+// WithSecondaryFilter mirrors only the events selected by the filter to the secondary
+// destination, e.g., to ship only billing events to an audit sink. The generation metadata
+// is always mirrored. Like WithSecondaryCodec, this encodes each event a second time for
+// the secondary. A secondary that only receives part of the events cannot be replayed into
+// the full state, so the filter must select all the events a client of the secondary needs.
+func WithSecondaryFilter(filter EventFilter) LogOption {
+	return func(pl *pLog) { pl.secFilter = filter }
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("Secondary filter", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+
+	It("selects events by type", func() {
+		f := TypeFilter(&logEv2{})
+		Ω(f(&logEv2{A: 1})).Should(BeTrue())
+		Ω(f(&logEv1{S: "x"})).Should(BeFalse())
+		Ω(f(logEv2{A: 1})).Should(BeFalse())
+	})
+
+	It("mirrors only the selected events to the secondary", func() {
+		pd, err := NewFileDest(PT+"/primary", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(pd, &testLogClient{}, log15.Root(),
+			WithSecondaryFilter(TypeFilter(&logEv2{})))
+		Ω(err).ShouldNot(HaveOccurred())
+		sd, err := NewFileDest(PT+"/secondary", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.SetSecondaryDestination(sd)).ShouldNot(HaveOccurred())
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(2.0))
+		Ω(pl.Output(&logEv1{S: "dropped"})).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv2{A: 1, B: "mirrored"})).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+		Ω(pl.Stats()["SecondaryFiltered"]).Should(Equal(3.0))
+
+		By("replaying the secondary")
+		sd, err = NewFileDest(PT+"/secondary", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{}
+		pl, err = NewLog(sd, rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(Equal([]interface{}{
+			&logEv2{A: 56, B: "Hello Again"}, &logEv2{A: 1, B: "mirrored"}}))
+		pl.(*pLog).Close()
+
+		By("replaying the primary, which has all events")
+		pd, err = NewFileDest(PT+"/primary", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc = &recordingClient{}
+		pl, err = NewLog(pd, rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(HaveLen(5))
+		pl.(*pLog).Close()
+	})
+})
@@ -0,0 +1,155 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Follower maintains a read-only replica of a log set that another process owns, see Follow
+type Follower struct {
+	pl       *pLog
+	basepath string
+	done     string // stem of the last log file replayed in full, empty if none
+	next     string // stem of the first log file not replayed in full
+}
+
+// Follow opens the log set of a file destination at basepath in follower mode, for a
+// read-only replica in another process on the same host or on a shared volume: it replays
+// the log files a file destination would into the client, the last of which the owner is
+// still writing to, without writing anything, as WarmReplay does. Poll then replays the
+// events of each log file once the owner finalizes it, i.e., once a rotation supersedes it.
+// The replica is thus up to date as of the last rotation, see SetSizeLimit and
+// WithRotationPolicy. The client receives each entry once. The options are applied as for
+// NewLog.
+func Follow(basepath string, client LogClient, logger log15.Logger,
+	opts ...LogOption) (*Follower, error) {
+
+	names, err := ReplayFiles(basepath)
+	if err != nil {
+		return nil, err
+	}
+	pl, err := newPLog(client, logger, opts)
+	if err != nil {
+		return nil, err
+	}
+	pl.priDest = &fileDest{basepath: basepath, log: pl.log}
+	pl.replayed = make(map[uint64]int)
+	f := &Follower{pl: pl, basepath: basepath}
+	if err := f.replay(names); err != nil {
+		return nil, err
+	}
+	f.next, _ = splitExt(names[0])
+	pl.log.Info("Following log", "files", names)
+	return f, nil
+}
+
+// Poll replays the log files finalized since Follow or the previous Poll, followed by the
+// entries written so far to the files the owner is still writing to, and returns the
+// number of finalized files. It reads nothing if no file was finalized. Poll fails if the
+// owner deleted a log file before the follower finalized it, see RetainUnderUsage and
+// TrimLogSet, in which case a new follower needs to be created with a fresh client. Poll
+// must not be called concurrently.
+func (f *Follower) Poll() (int, error) {
+	names, err := LogFiles(f.basepath)
+	if err != nil {
+		return 0, err
+	}
+	var todo []string
+	for _, n := range names {
+		stem, _ := splitExt(n)
+		if stem <= f.done {
+			continue
+		}
+		if len(todo) == 0 && f.next != "" && stem != f.next {
+			return 0, fmt.Errorf("follower fell behind: %s was deleted before it was "+
+				"finalized", f.next+oldExt)
+		}
+		todo = append(todo, n)
+	}
+	finalized := 0
+	for finalized < len(todo) && hasExt(todo[finalized], oldExt) {
+		finalized++
+	}
+	if finalized == 0 {
+		return 0, nil
+	}
+	if err := f.replay(todo); err != nil {
+		return 0, err
+	}
+	f.done, _ = splitExt(todo[finalized-1])
+	if finalized < len(todo) {
+		f.next, _ = splitExt(todo[finalized])
+	} else {
+		f.next = ""
+	}
+	return finalized, nil
+}
+
+// replay replays log files, skipping the entries replayed before, the last file may still
+// be written to
+func (f *Follower) replay(names []string) error {
+	pl := f.pl
+	readers := make([]io.ReadCloser, 0, len(names))
+	defer func() {
+		for _, r := range readers {
+			r.Close()
+		}
+	}()
+	for _, n := range names {
+		r, err := openLogFile(n)
+		if err != nil {
+			return err
+		}
+		readers = append(readers, r)
+	}
+	pl.warming = true
+	pl.warm = pl.replayed
+	if err := pl.replay(readers); err != nil {
+		return err
+	}
+	// only the generations of the files still being written to are replayed again
+	var gens []uint64
+	for g := range pl.replayed {
+		gens = append(gens, g)
+	}
+	sort.Slice(gens, func(i, j int) bool { return gens[i] > gens[j] })
+	for i := 2; i < len(gens); i++ {
+		delete(pl.replayed, gens[i])
+	}
+	return nil
+}
+
+// openLogFile opens a log file, which the owner of the log may have renamed since it was
+// listed: -new files become -curr files, which become -old files
+func openLogFile(name string) (*os.File, error) {
+	stem, ext := splitExt(name)
+	exts := []string{newExt, currExt, oldExt}
+	for i := range exts {
+		if exts[i] == ext {
+			exts = exts[i:]
+			break
+		}
+	}
+	var err error
+	for _, e := range exts {
+		var f *os.File
+		if f, err = os.Open(stem + e); err == nil {
+			return f, nil
+		} else if !os.IsNotExist(err) {
+			break
+		}
+	}
+	return nil, fmt.Errorf("error opening %s: %s", name, err.Error())
+}
+
+// hasExt returns true if a log file name has the extension ext
+func hasExt(name, ext string) bool {
+	_, e := splitExt(name)
+	return e == ext
+}
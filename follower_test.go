@@ -0,0 +1,95 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// countingClient is a deltaClient that counts the events replayed
+type countingClient struct {
+	deltaClient
+	replayed int
+}
+
+func (cc *countingClient) Replay(ev interface{}) error {
+	cc.replayed++
+	return cc.deltaClient.Replay(ev)
+}
+
+var _ = Describe("Follower", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	var owner *deltaClient
+	var pl Log
+
+	BeforeEach(func() {
+		owner = &deltaClient{}
+		owner.state = map[string]interface{}{}
+		fd, err := NewFileDest(PT+"/follow", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err = NewLog(fd, owner, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+	AfterEach(func() { pl.(*pLog).Close() })
+
+	rotate := func() {
+		pl.(*pLog).Lock()
+		pl.(*pLog).rotate()
+		pl.(*pLog).Unlock()
+		Eventually(func() bool {
+			pl.(*pLog).Lock()
+			defer pl.(*pLog).Unlock()
+			return pl.(*pLog).rotating
+		}).Should(BeFalse())
+	}
+
+	It("replays the log and then the files as they're finalized", func() {
+		owner.output(pl, &keyEv{K: "a", V: 1})
+		owner.output(pl, &keyEv{K: "b", V: 1})
+		fc := &countingClient{}
+		f, err := Follow(PT+"/follow", fc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(fc.state).Should(Equal(owner.state))
+		Ω(fc.replayed).Should(Equal(2))
+
+		owner.output(pl, &keyEv{K: "a", V: 2})
+		owner.output(pl, &delEv{K: "b"})
+		Ω(f.Poll()).Should(Equal(0))
+		Ω(fc.state["a"]).Should(Equal(&keyEv{K: "a", V: 1}))
+
+		rotate()
+		owner.output(pl, &keyEv{K: "c", V: 1})
+		Ω(f.Poll()).Should(Equal(1))
+		Ω(fc.state).Should(Equal(owner.state))
+		// the entries of the first file once, the snapshot of the second and its entry
+		Ω(fc.replayed).Should(Equal(4 + 1 + 1))
+
+		rotate()
+		rotate()
+		Ω(f.Poll()).Should(Equal(2))
+		Ω(fc.state).Should(Equal(owner.state))
+		Ω(f.Poll()).Should(Equal(0))
+	})
+
+	It("fails once it falls behind", func() {
+		owner.output(pl, &keyEv{K: "a", V: 1})
+		f, err := Follow(PT+"/follow", &countingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		rotate()
+		rotate()
+		_, err = TrimLogSet(PT+"/follow", 1, false)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = f.Poll()
+		Ω(err).Should(MatchError(ContainSubstring("follower fell behind")))
+	})
+})
@@ -0,0 +1,22 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+//go:build gofuzz
+// +build gofuzz
+
+package persist
+
+import "bytes"
+
+// Fuzz is the entry point for go-fuzz, it replays the data and reports whether it was a
+// valid log stream. The native fuzz targets are in fuzz_test.go.
+func Fuzz(data []byte) int {
+	if _, err := ReplayFrom(bytes.NewReader(data), nil, fuzzClient{}); err != nil {
+		return 0
+	}
+	return 1
+}
+
+type fuzzClient struct{}
+
+func (fuzzClient) Replay(ev interface{}) error { return nil }
+func (fuzzClient) PersistAll(pl Log)           {}
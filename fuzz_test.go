@@ -0,0 +1,48 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"testing"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// fuzzSeed returns a valid log stream to seed the fuzzers with
+func fuzzSeed(f *testing.F) []byte {
+	var buf bytes.Buffer
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	pl, err := NewLog(NewWriterDest(&buf, nil), nopClient{}, log)
+	if err != nil {
+		f.Fatal(err)
+	}
+	pl.Output(&logEv1{S: "hello"})
+	pl.Output(&logEv2{A: 1, B: "more"})
+	return buf.Bytes()
+}
+
+// nopClient is a log client that accepts any event
+type nopClient struct{}
+
+func (nopClient) Replay(ev interface{}) error { return nil }
+func (nopClient) PersistAll(pl Log)           {}
+
+// FuzzReplayFrom verifies that replaying corrupt data produces errors and never panics,
+// run it using go test -fuzz FuzzReplayFrom
+func FuzzReplayFrom(f *testing.F) {
+	f.Add(fuzzSeed(f))
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ReplayFrom(bytes.NewReader(data), nil, nopClient{})
+	})
+}
+
+// FuzzReplayMeta verifies that reading the metadata record of corrupt data never panics
+func FuzzReplayMeta(f *testing.F) {
+	f.Add(fuzzSeed(f))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ReplayMeta(bytes.NewReader(data), nil)
+	})
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// HandoffMark is the last record a process writes to a log it hands off to another process,
+// see Handoff. The records that follow it are a stream of their own, written by the process
+// that took the log over. Decoders continue with that stream, the mark is never replayed.
+type HandoffMark struct {
+	Gen  uint64    // generation being written
+	Seq  uint64    // sequence number of the next event, see RecordSequenceNumbers
+	Time time.Time // when the log was handed off
+}
+
+func init() {
+	Register(&HandoffMark{})
+}
+
+// errHandedOff is the error state of a log that was handed off
+var errHandedOff = fmt.Errorf("log was handed off to another process")
+
+// handoffDest is implemented by destinations that support handing a log off to another
+// process
+type handoffDest interface {
+	// handoff flushes the records written to stable storage and closes the destination
+	handoff() error
+	// takingOver returns true if the destination appends to a log that was handed off
+	takingOver() bool
+}
+
+// Handoff hands a log off to another process for a zero-downtime restart: it waits for a
+// rotation in progress to complete, writes a HandoffMark, flushes the log file to disk, and
+// closes it. The log then fails all outputs and no longer rotates. The process taking the
+// log over opens it with a file destination created with the TakeOver option, typically by
+// attaching a Standby, and NewLog then appends to the current log file instead of writing
+// a new one with a full snapshot, such that the restart doesn't pay the cost of the snapshot
+// and, with a Standby, of the replay twice. Handoff requires a file destination and the gob
+// codec, with or without a type registry. A generation that was handed off records format
+// version 13, which versions of persist that predate handoffs refuse to replay, see
+// FormatVersion.
+func Handoff(log Log) error {
+	pl, ok := log.(*pLog)
+	if !ok {
+		return fmt.Errorf("Handoff requires a log created by NewLog")
+	}
+	hd, ok := pl.priDest.(handoffDest)
+	if !ok {
+		return fmt.Errorf("Handoff requires a file destination")
+	}
+	if _, ok := pl.codec.(gobCodec); !ok {
+		return fmt.Errorf("Handoff requires the gob codec")
+	}
+	for {
+		pl.Lock()
+		if !pl.rotating && !pl.catchingUp {
+			break
+		}
+		pl.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	defer pl.Unlock()
+
+	if err := pl.checkState(); err != nil {
+		return err
+	}
+	if err := pl.flushShards(); err != nil {
+		return err
+	}
+	pl.note(InternalHandoff, "seq", strconv.FormatUint(pl.seq, 10))
+	pl.flushNotes()
+	if err := pl.useFormat(formatHandoff); err != nil {
+		return err
+	}
+	if err := pl.encoder.Encode(&HandoffMark{Gen: pl.gen, Seq: pl.seq,
+		Time: pl.now().UTC()}); err != nil {
+		return pl.fail("handoff", err)
+	}
+	if err := hd.handoff(); err != nil {
+		return pl.fail("handoff", err)
+	}
+	pl.handedOff = true
+	pl.errState = errHandedOff
+	pl.log.Info("Handed off log", "gen", pl.gen)
+	return nil
+}
+
+// TakeOver makes a file destination append to the current log file of a log set that
+// another process handed off, see Handoff. NewLog fails if the log wasn't handed off.
+func TakeOver() FileDestOption {
+	return func(fd *fileDest) { fd.takeOver = true }
+}
+
+func (fd *fileDest) handoff() error {
+	fd.closeDirect()
+	err := fd.outputFile.Sync()
+	if cerr := fd.outputFile.Close(); err == nil {
+		err = cerr
+	}
+	fd.outputFile = nil
+	return err
+}
+
+func (fd *fileDest) takingOver() bool { return fd.takeOver }
+
+// openTakeOver opens the current log file for appending, the log set must not have a log
+// file with an incomplete snapshot, which a log that was handed off doesn't have
+func (fd *fileDest) openTakeOver(names []string) error {
+	if len(names) != 1 {
+		return fmt.Errorf("cannot take over %s: a rotation was in progress, the log "+
+			"wasn't handed off", fd.basepath)
+	}
+	f, err := os.OpenFile(names[0], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return fmt.Errorf("cannot take over %s: %s", names[0], err.Error())
+	}
+	fd.log.Info("Taking over log file", "file", names[0])
+	fd.outputFile = f
+	fd.outputFilename = names[0]
+	fd.oldFilename = ""
+	fd.snapOK = true
+	return nil
+}
+
+// takeOver completes NewLog for a log that was handed off: the records output from now on
+// are appended to the stream that follows the HandoffMark, must be called after the replay
+func (pl *pLog) takeOver() (Log, error) {
+	if pl.handoff == nil || pl.handoff.Gen != pl.gen {
+		err := fmt.Errorf("cannot take over the log, it wasn't handed off")
+		pl.errState = err
+		return nil, err
+	}
+	pl.startGeneration()
+	// the stream that follows the mark continues the generation, which was restated with
+	// the format of the handoff before the mark, see Handoff
+	pl.format = formatHandoff
+	pl.note(InternalTakeOver, "handed_off", pl.handoff.Time.Format(time.RFC3339Nano))
+	pl.flushNotes()
+	if pl.errState != nil {
+		return nil, pl.errState
+	}
+	pl.log.Info("Took over log", "gen", pl.gen)
+	pl.markReady()
+	return pl, nil
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"io"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("Handoff", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	var logOpts []LogOption
+
+	open := func(dc *countingClient, opts ...FileDestOption) (Log, error) {
+		fd, err := NewFileDest(PT+"/handoff", true, nil, opts...)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, dc, log15.Root(), append(logOpts, RecordSequenceNumbers())...)
+		if err != nil {
+			fd.Close()
+		}
+		return pl, err
+	}
+
+	// owner opens a log and outputs two events
+	owner := func() (Log, *countingClient) {
+		dc := &countingClient{}
+		pl, err := open(dc)
+		Ω(err).ShouldNot(HaveOccurred())
+		dc.output(pl, &keyEv{K: "a", V: 1})
+		dc.output(pl, &keyEv{K: "b", V: 1})
+		return pl, dc
+	}
+
+	It("lets another process take over without a snapshot", func() {
+		pl, dc := owner()
+		Ω(Handoff(pl)).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&keyEv{K: "c"})).Should(MatchError(errHandedOff))
+		Ω(pl.HealthCheck()).Should(MatchError(errHandedOff))
+		files, _ := LogFiles(PT + "/handoff")
+
+		nc := &countingClient{}
+		pl2, err := open(nc, TakeOver())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(nc.state).Should(Equal(dc.state))
+		Ω(LogFiles(PT + "/handoff")).Should(Equal(files))
+		Ω(pl2.Stats()["Generation"]).Should(Equal(1.0))
+		nc.output(pl2, &keyEv{K: "a", V: 2})
+		pl.(*pLog).Close()
+
+		By("rotating the log that was taken over")
+		pl2.(*pLog).Lock()
+		pl2.(*pLog).rotate()
+		pl2.(*pLog).Unlock()
+		Eventually(func() float64 { return pl2.Stats()["Generation"] }).Should(Equal(2.0))
+		nc.output(pl2, &keyEv{K: "c", V: 1})
+		pl2.(*pLog).Close()
+
+		rc := &countingClient{}
+		pl3, err := open(rc)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.state).Should(Equal(nc.state))
+		pl3.(*pLog).Close()
+	})
+
+	It("restates the generation with the format of the handoff", func() {
+		pl, _ := owner()
+		Ω(Handoff(pl)).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+		files, err := LogFiles(PT + "/handoff")
+		Ω(err).ShouldNot(HaveOccurred())
+		f, err := os.Open(files[len(files)-1])
+		Ω(err).ShouldNot(HaveOccurred())
+		defer f.Close()
+		var formats []int
+		dec := GobCodec.NewDecoder(f)
+		for {
+			ev, err := dec.Decode()
+			if err == io.EOF {
+				break
+			}
+			Ω(err).ShouldNot(HaveOccurred())
+			if m, ok := ev.(*GenerationMeta); ok {
+				formats = append(formats, m.Format)
+			}
+		}
+		Ω(formats).Should(Equal([]int{formatSequenced, formatHandoff}))
+
+		By("not restating it again after the take over")
+		pl2, err := open(&countingClient{}, TakeOver())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl2.Output(&keyEv{K: "c", V: 1})).ShouldNot(HaveOccurred())
+		Ω(pl2.(*pLog).format).Should(Equal(formatHandoff))
+		pl2.(*pLog).Close()
+	})
+
+	It("replays the records of both processes", func() {
+		pl, _ := owner()
+		Ω(Handoff(pl)).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+		nc := &countingClient{}
+		pl2, err := open(nc, TakeOver())
+		Ω(err).ShouldNot(HaveOccurred())
+		nc.output(pl2, &keyEv{K: "c", V: 1})
+		Ω(Handoff(pl2)).ShouldNot(HaveOccurred())
+		pl2.(*pLog).Close()
+
+		rc := &countingClient{}
+		pl3, err := open(rc, TakeOver())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.replayed).Should(Equal(3))
+		Ω(rc.state).Should(Equal(nc.state))
+		Ω(pl3.(*pLog).seq).Should(Equal(uint64(3)))
+		pl3.(*pLog).Close()
+	})
+
+	It("replays only what was written meanwhile with a standby", func() {
+		pl, dc := owner()
+		files, _ := ReplayFiles(PT + "/handoff")
+		readers := make([]io.ReadCloser, len(files))
+		for i, f := range files {
+			readers[i], _ = os.Open(f)
+		}
+		sc := &countingClient{}
+		standby, err := WarmReplay(readers, sc, log15.Root(), RecordSequenceNumbers())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(sc.replayed).Should(Equal(2))
+		dc.output(pl, &keyEv{K: "c", V: 1})
+		Ω(Handoff(pl)).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		fd, err := NewFileDest(PT+"/handoff", false, nil, TakeOver())
+		Ω(err).ShouldNot(HaveOccurred())
+		pl2, err := standby.Attach(fd)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(sc.replayed).Should(Equal(3))
+		Ω(sc.state).Should(Equal(dc.state))
+		pl2.(*pLog).Close()
+	})
+
+	It("refuses to take over a log that wasn't handed off", func() {
+		pl, _ := owner()
+		pl.(*pLog).Close()
+		files, _ := LogFiles(PT + "/handoff")
+		size := fileSize(files[0])
+		_, err := open(&countingClient{}, TakeOver())
+		Ω(err).Should(MatchError(ContainSubstring("wasn't handed off")))
+		Ω(fileSize(files[0])).Should(Equal(size))
+	})
+
+	It("hands off a log that uses a type registry", func() {
+		reg := NewTypeRegistry()
+		Ω(reg.Register("test.keyEv", &keyEv{})).ShouldNot(HaveOccurred())
+		logOpts = []LogOption{WithTypeRegistry(reg)}
+		defer func() { logOpts = nil }()
+		pl, dc := owner()
+		Ω(Handoff(pl)).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		nc := &countingClient{}
+		pl2, err := open(nc, TakeOver())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(nc.state).Should(Equal(dc.state))
+		nc.output(pl2, &keyEv{K: "c", V: 1})
+		Ω(pl2.HealthCheck()).ShouldNot(HaveOccurred())
+		pl2.(*pLog).Close()
+
+		By("replaying the records written after the handoff")
+		rc := &countingClient{}
+		pl3, err := open(rc)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.replayed).Should(Equal(3))
+		Ω(rc.state).Should(Equal(nc.state))
+		pl3.(*pLog).Close()
+	})
+})
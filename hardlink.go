@@ -0,0 +1,51 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ExportHardLink backs up a log whose primary destination is a file destination by hard
+// linking its current complete log file into dir, which must be on the same filesystem.
+// Outputs are blocked while the link is made, which takes no time and no space regardless
+// of the size of the log. It returns the path of the link and the size of the file at the
+// time of the export. Since the link shares its data with the log, the log file keeps
+// growing until the next rotation: the first size bytes hold the state at the time of the
+// export and any further bytes hold events output since, which makes the backup more
+// recent but may end in a partially written event if it's copied while the log runs.
+// The directory-per-generation layout is not supported.
+func ExportHardLink(log Log, dir string) (string, int64, error) {
+	pl, ok := log.(*pLog)
+	if !ok {
+		return "", 0, fmt.Errorf("hard link export requires a log created by NewLog")
+	}
+	pl.Lock()
+	defer pl.Unlock()
+
+	fd, ok := pl.priDest.(*fileDest)
+	if !ok {
+		return "", 0, fmt.Errorf("hard link export requires a file destination")
+	}
+	// during a rotation the previous file is complete and no longer written to
+	name := fd.outputFilename
+	if !fd.snapOK {
+		name = fd.oldFilename
+	}
+	if name == "" {
+		return "", 0, fmt.Errorf("log has no complete log file yet")
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return "", 0, err
+	}
+	link := filepath.Join(dir, filepath.Base(name))
+	if err := os.Link(name, link); err != nil {
+		return "", 0, fmt.Errorf("cannot export log file: %s", err.Error())
+	}
+	syncDir(dir)
+	pl.log.Info("Exported log file", "file", name, "link", link, "size", info.Size())
+	return link, info.Size(), nil
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("ExportHardLink", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+		os.Mkdir(PT+"/backup", 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	It("links the current log file", func() {
+		fd, err := NewFileDest(PT+"/linked", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+
+		link, size, err := ExportHardLink(pl, PT+"/backup")
+		Ω(err).ShouldNot(HaveOccurred())
+		files, _ := LogFiles(PT + "/linked")
+		Ω(link).Should(Equal(PT + "/backup/" + filepath.Base(files[0])))
+		Ω(pl.Output(&logEv1{S: "b"})).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		data, err := ioutil.ReadFile(link)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(int64(len(data))).Should(BeNumerically(">", size))
+		rc := &recordingClient{}
+		_, err = ReplayFrom(bytes.NewReader(data[:size]), nil, rc)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(Equal([]interface{}{&logEv1{S: "a"}}))
+
+		_, _, err = ExportHardLink(pl, PT+"/backup")
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("requires a file destination", func() {
+		fd, err := NewFileDest(PT+"/dirlog", true, nil, DirectoryPerGeneration())
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		_, _, err = ExportHardLink(pl, PT+"/backup")
+		Ω(err).Should(MatchError(ContainSubstring("requires a file destination")))
+		pl.(*pLog).Close()
+	})
+})
@@ -0,0 +1,90 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"math/bits"
+	"time"
+)
+
+// histSubBuckets is the number of buckets each power of two is divided into, which bounds
+// the error of the recorded values to 1/16th, i.e. about 6%
+const (
+	histSubBits    = 4
+	histSubBuckets = 1 << histSubBits
+)
+
+// histogram records values, such as durations or sizes, in log-linear buckets in the manner
+// of an HDR histogram, it uses constant memory and recording a value is cheap enough to do
+// on every output
+type histogram struct {
+	counts [(64 - histSubBits + 1) * histSubBuckets]uint64
+	total  uint64
+	max    uint64
+}
+
+// histBucket returns the index of the bucket holding a value
+func histBucket(v uint64) int {
+	if v < histSubBuckets {
+		return int(v)
+	}
+	shift := uint(bits.Len64(v) - histSubBits - 1)
+	return int(shift+1)*histSubBuckets + int(v>>shift&(histSubBuckets-1))
+}
+
+// histValue returns the highest value held by a bucket
+func histValue(b int) uint64 {
+	if b < histSubBuckets {
+		return uint64(b)
+	}
+	shift := uint(b/histSubBuckets - 1)
+	sub := uint64(b%histSubBuckets | histSubBuckets)
+	return (sub+1)<<shift - 1
+}
+
+func (h *histogram) record(v uint64) {
+	h.counts[histBucket(v)]++
+	h.total++
+	if v > h.max {
+		h.max = v
+	}
+}
+
+// recordDuration records a duration in nanoseconds
+func (h *histogram) recordDuration(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.record(uint64(d))
+}
+
+// quantile returns the value below which the fraction q of the recorded values fall
+func (h *histogram) quantile(q float64) uint64 {
+	if h.total == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(h.total) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen uint64
+	for b, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			if v := histValue(b); v < h.max {
+				return v
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+// stats adds the quantiles of the histogram to a Stats map, multiplied by scale, e.g. 1e-9
+// to report durations in seconds
+func (h *histogram) stats(stats map[string]float64, name string, scale float64) {
+	stats[name+"P50"] = float64(h.quantile(0.5)) * scale
+	stats[name+"P99"] = float64(h.quantile(0.99)) * scale
+	stats[name+"P999"] = float64(h.quantile(0.999)) * scale
+	stats[name+"Max"] = float64(h.max) * scale
+}
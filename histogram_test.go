@@ -0,0 +1,65 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("histogram", func() {
+
+	It("maps values to buckets within 1/16th", func() {
+		for _, v := range []uint64{0, 1, 15, 16, 17, 31, 32, 1000, 123456789, 1 << 40,
+			1<<64 - 1} {
+			b := histBucket(v)
+			Ω(histValue(b)).Should(BeNumerically(">=", v))
+			Ω(histValue(b) - v).Should(BeNumerically("<=", v/histSubBuckets))
+			if b > 0 {
+				Ω(histValue(b - 1)).Should(BeNumerically("<", v))
+			}
+		}
+		Ω(histBucket(1<<64 - 1)).Should(Equal(len(histogram{}.counts) - 1))
+	})
+
+	It("computes quantiles", func() {
+		var h histogram
+		Ω(h.quantile(0.5)).Should(BeZero())
+		for i := 1; i <= 1000; i++ {
+			h.recordDuration(time.Duration(i) * time.Microsecond)
+		}
+		Ω(h.quantile(0.5)).Should(BeNumerically("~", 500000, 500000/16))
+		Ω(h.quantile(0.99)).Should(BeNumerically("~", 990000, 990000/16))
+		Ω(h.quantile(1)).Should(Equal(uint64(1000000)))
+		Ω(h.max).Should(Equal(uint64(1000000)))
+	})
+
+	It("reports the latency of each phase", func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+		defer os.RemoveAll(PT)
+		fd, err := NewFileDest(PT+"/latency", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+
+		stats := pl.Stats()
+		Ω(stats["EncodeLatencyMax"]).Should(BeNumerically(">", 0))
+		Ω(stats["PrimaryWriteLatencyP50"]).Should(BeNumerically(">", 0))
+		Ω(stats).Should(HaveKeyWithValue("SecondaryWriteLatencyP99", 0.0))
+		Ω(pl.(*pLog).latSecondary.total).Should(BeZero())
+
+		sd, err := NewFileDest(PT+"/secondary", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.SetSecondaryDestination(sd)).ShouldNot(HaveOccurred())
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(2.0))
+		Ω(pl.Output(&logEv1{S: "b"})).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()["SecondaryWriteLatencyMax"]).Should(BeNumerically(">", 0))
+		pl.(*pLog).Close()
+	})
+})
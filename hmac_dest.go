@@ -0,0 +1,180 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// hmacMagic starts each authenticated segment
+const hmacMagic = "persist-hmac-sha256\n"
+
+// hmacMaxFrame is the max size of the data in a frame, well above the size of the records
+// written by the gob codec, it prevents a tampered length from causing a huge allocation
+const hmacMaxFrame = 128 << 20
+
+// NewHMACDest wraps a destination such that each segment, i.e., each stream started by a
+// rotation, is authenticated using HMAC-SHA256 with the key supplied by the application.
+// Replay verifies the authentication and fails on tampered or unauthenticated segments
+// instead of replaying them into the application state. Each write is stored as a frame
+// holding the data and a MAC that covers all preceding frames of the segment, hence
+// reordering, dropping, or splicing frames is detected as well. Note that a segment
+// truncated at a frame boundary is indistinguishable from one that ends there, like an
+// unauthenticated log that stopped being written. Tools need HMACReader to read the
+// segments of an authenticated log.
+func NewHMACDest(dest LogDestination, key []byte) LogDestination {
+	return &hmacDest{dest: dest, key: key}
+}
+
+type hmacDest struct {
+	dest    LogDestination
+	key     []byte
+	mac     []byte // MAC of the last frame written, nil at the start of a segment
+	replay  []io.ReadCloser
+	wrapped bool // replay readers have been wrapped
+}
+
+func (hd *hmacDest) Write(p []byte) (int, error) {
+	if len(p) > hmacMaxFrame {
+		return 0, fmt.Errorf("cannot authenticate a write of %d bytes, the max is %d",
+			len(p), hmacMaxFrame)
+	}
+	prev := hd.mac
+	frame := make([]byte, 0, len(hmacMagic)+4+len(p)+sha256.Size)
+	if prev == nil {
+		frame = append(frame, hmacMagic...)
+		prev = hmacStart(hd.key)
+	}
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(p)))
+	mac := frameMAC(hd.key, prev, hdr[:], p)
+	frame = append(append(append(frame, hdr[:]...), p...), mac...)
+	n, err := hd.dest.Write(frame)
+	if err == nil && n != len(frame) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		return 0, err
+	}
+	hd.mac = mac
+	return len(p), nil
+}
+
+func (hd *hmacDest) Capabilities() Capabilities { return DestCapabilities(hd.dest) }
+
+func (hd *hmacDest) ReplayReaders() []io.ReadCloser {
+	if !hd.wrapped {
+		for _, rr := range hd.dest.ReplayReaders() {
+			hd.replay = append(hd.replay, hmacReadCloser{HMACReader(rr, hd.key), rr})
+		}
+		hd.wrapped = true
+	}
+	return hd.replay
+}
+
+// StartRotate starts a new segment
+func (hd *hmacDest) StartRotate() error {
+	if err := hd.dest.StartRotate(); err != nil {
+		return err
+	}
+	hd.mac = nil
+	return nil
+}
+
+func (hd *hmacDest) EndRotate() error { return hd.dest.EndRotate() }
+
+func (hd *hmacDest) Close() { hd.dest.Close() }
+
+// hmacStart returns the MAC that precedes the first frame of a segment
+func hmacStart(key []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(hmacMagic))
+	return h.Sum(nil)
+}
+
+// frameMAC returns the MAC of a frame given the MAC of the previous frame
+func frameMAC(key, prev, hdr, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(prev)
+	h.Write(hdr)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// HMACReader returns a reader that verifies a segment written by a destination created
+// with NewHMACDest and produces the data written to it. Read fails when it encounters
+// data that is not authenticated by the key.
+func HMACReader(r io.Reader, key []byte) io.Reader {
+	return &hmacReader{r: r, key: key}
+}
+
+type hmacReader struct {
+	r    io.Reader
+	key  []byte
+	mac  []byte // MAC of the last frame read, nil before the start of the segment
+	data []byte // verified data not yet returned
+	off  int64  // offset of the next frame in the segment
+	err  error
+}
+
+func (hr *hmacReader) Read(p []byte) (int, error) {
+	for len(hr.data) == 0 {
+		if hr.err != nil {
+			return 0, hr.err
+		}
+		hr.err = hr.next()
+	}
+	n := copy(p, hr.data)
+	hr.data = hr.data[n:]
+	return n, nil
+}
+
+// next reads and verifies the next frame
+func (hr *hmacReader) next() error {
+	if hr.mac == nil {
+		magic := make([]byte, len(hmacMagic))
+		if _, err := io.ReadFull(hr.r, magic); err != nil {
+			return err // io.EOF for an empty segment
+		}
+		if string(magic) != hmacMagic {
+			return fmt.Errorf("segment is not authenticated")
+		}
+		hr.mac = hmacStart(hr.key)
+		hr.off = int64(len(hmacMagic))
+	}
+
+	var hdr [4]byte
+	if _, err := io.ReadFull(hr.r, hdr[:]); err != nil {
+		return err // io.EOF at the end of the segment
+	}
+	l := binary.BigEndian.Uint32(hdr[:])
+	if l > hmacMaxFrame {
+		return fmt.Errorf("segment failed authentication at offset %d: bad frame length",
+			hr.off)
+	}
+	frame := make([]byte, int(l)+sha256.Size)
+	if _, err := io.ReadFull(hr.r, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	mac := frameMAC(hr.key, hr.mac, hdr[:], frame[:l])
+	if !hmac.Equal(mac, frame[l:]) {
+		return fmt.Errorf("segment failed authentication at offset %d", hr.off)
+	}
+	hr.mac = mac
+	hr.data = frame[:l]
+	hr.off += int64(len(hdr) + len(frame))
+	return nil
+}
+
+// hmacReadCloser verifies what it reads and closes the underlying replay reader
+type hmacReadCloser struct {
+	io.Reader
+	io.Closer
+}
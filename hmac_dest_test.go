@@ -0,0 +1,104 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("HMACDest", func() {
+
+	key := []byte("secret")
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+
+	// writeLog writes a log with an authenticated file destination
+	writeLog := func() {
+		fd, err := NewFileDest(PT+"/auth", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{events: []interface{}{&logEv1{S: "a"}, &logEv2{A: 1}}}
+		pl, err := NewLog(NewHMACDest(fd, key), rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "b"})).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+	}
+
+	// replay replays the log with an authenticated file destination
+	replay := func(key []byte) ([]interface{}, error) {
+		fd, err := NewFileDest(PT+"/auth", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{}
+		pl, err := NewLog(NewHMACDest(fd, key), rc, log15.Root())
+		if err != nil {
+			fd.Close()
+			return nil, err
+		}
+		pl.(*pLog).Close()
+		return rc.events, nil
+	}
+
+	currFile := func() string {
+		files, err := LogFiles(PT + "/auth")
+		Ω(err).ShouldNot(HaveOccurred())
+		return files[len(files)-1]
+	}
+
+	It("replays an authenticated log", func() {
+		writeLog()
+		events, err := replay(key)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(events).Should(Equal([]interface{}{
+			&logEv1{S: "a"}, &logEv2{A: 1}, &logEv1{S: "b"}}))
+
+		By("replaying the rotated log again")
+		events, err = replay(key)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(events).Should(HaveLen(3))
+	})
+
+	It("rejects a tampered segment", func() {
+		writeLog()
+		data, err := ioutil.ReadFile(currFile())
+		Ω(err).ShouldNot(HaveOccurred())
+		data[len(data)-40] ^= 1
+		Ω(ioutil.WriteFile(currFile(), data, 0666)).ShouldNot(HaveOccurred())
+		_, err = replay(key)
+		Ω(err).Should(MatchError(ContainSubstring("segment failed authentication")))
+	})
+
+	It("rejects a segment authenticated with another key", func() {
+		writeLog()
+		_, err := replay([]byte("guess"))
+		Ω(err).Should(MatchError(ContainSubstring("segment failed authentication at offset 20")))
+	})
+
+	It("rejects an unauthenticated segment", func() {
+		fd, err := NewFileDest(PT+"/auth", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "b"})).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+		_, err = replay(key)
+		Ω(err).Should(MatchError(ContainSubstring("segment is not authenticated")))
+	})
+
+	It("lets tools read authenticated segments", func() {
+		writeLog()
+		f, err := os.Open(currFile())
+		Ω(err).ShouldNot(HaveOccurred())
+		defer f.Close()
+		rc := &recordingClient{}
+		n, err := ReplayFrom(HMACReader(f, key), nil, rc)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(n).Should(Equal(3))
+	})
+})
@@ -0,0 +1,435 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// HTTP servers can't append to or rename objects, so the HTTP destination writes each log
+// generation as a sequence of immutable chunk objects <prefix>-<gen>-<chunk>.plog followed
+// by a <prefix>-<gen>.done marker object once the generation has a complete snapshot.
+const (
+	httpChunkFmt  = "%s-%08d-%06d.plog"
+	httpDoneFmt   = "%s-%08d.done"
+	httpChunkSize = 1024 * 1024 // default size at which a chunk is uploaded
+)
+
+type httpDest struct {
+	dirURL        string // URL of the "directory", ends in a slash
+	prefix        string // object name prefix
+	client        *http.Client
+	replayReaders []io.ReadCloser
+	gen           int          // current generation
+	chunk         int          // next chunk to upload in the current generation
+	chunkSize     int          // size at which a chunk is uploaded
+	buf           bytes.Buffer // data not yet uploaded
+	snapOK        bool         // true when the initial snapshot is completed
+	log           log15.Logger
+}
+
+// NewHTTPDest creates or opens a log set stored on a plain HTTP server, such as nginx with
+// WebDAV or a MinIO gateway. The baseURL consists of the URL of a directory followed by an
+// object name prefix, e.g., http://backup.example.com/logs/myapp. The server must support PUT,
+// GET and DELETE on objects and a GET on the directory must list the objects it contains,
+// either as a JSON array of names or of objects with a "name" field (nginx's
+// autoindex_format json), as an S3 ListBucketResult, e.g. a MinIO bucket with a public
+// read-write policy, whose pages are followed, or as plain text with one name per line. The
+// objects of the generations that precede the current one are deleted at the end of each
+// rotation.
+//
+// Output is buffered and uploaded in chunks, which means that data written since the last
+// chunk was uploaded is lost if the process crashes. Chunks are uploaded when the buffer
+// reaches 1MB, at each rotation, and when the destination is closed.
+func NewHTTPDest(baseURL string, create bool, client *http.Client,
+	log log15.Logger) (LogDestination, error) {
+
+	if log == nil {
+		log = log15.Root()
+	}
+	log = log.New("url", baseURL, "dest", "http")
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	slash := strings.LastIndex(baseURL, "/")
+	prefix := baseURL[slash+1:]
+	if slash < 0 || prefix == "" || strings.ContainsAny(prefix, "*?[\\.") {
+		return nil, fmt.Errorf(
+			"baseURL must end in a prefix without '*', '?', '[', '\\' or '.'")
+	}
+	hd := &httpDest{dirURL: baseURL[:slash+1], prefix: prefix, client: client,
+		chunkSize: httpChunkSize, log: log}
+
+	chunks, done, err := hd.list()
+	if err != nil {
+		return nil, err
+	}
+
+	// find the most recent complete generation, we need to replay it and any generation
+	// that follows it
+	curr := -1
+	for g := range done {
+		if g > curr {
+			curr = g
+		}
+	}
+	last := curr
+	for g := range chunks {
+		if g > last {
+			last = g
+		}
+	}
+	switch {
+	case curr < 0 && last >= 0:
+		return nil, fmt.Errorf("Cannot determine current log generation at %s", baseURL)
+	case curr < 0 && !create:
+		return nil, fmt.Errorf("No existing log found at %s", baseURL)
+	case curr < 0:
+		log.Info("No existing log found, creating a new one")
+	default:
+		for g := curr; g <= last; g++ {
+			hd.replayReaders = append(hd.replayReaders, &httpChunkReader{
+				hd: hd, gen: g, chunks: chunks[g]})
+		}
+		log.Info("Opening existing log", "curr_gen", curr, "last_gen", last)
+	}
+	hd.gen = last + 1
+	return hd, nil
+}
+
+// list returns the chunk numbers present for each generation and the set of generations
+// that have a done marker
+func (hd *httpDest) list() (map[int][]int, map[int]bool, error) {
+	var names []string
+	for query := ""; ; {
+		page, next, err := hd.listPage(query)
+		if err != nil {
+			return nil, nil, err
+		}
+		names = append(names, page...)
+		if next == "" {
+			break
+		}
+		query = next
+	}
+
+	chunks := make(map[int][]int)
+	done := make(map[int]bool)
+	for _, name := range names {
+		if !strings.HasPrefix(name, hd.prefix+"-") {
+			continue
+		}
+		var g, c int
+		rest := name[len(hd.prefix)+1:]
+		if n, _ := fmt.Sscanf(rest, "%08d-%06d.plog", &g, &c); n == 2 &&
+			name == fmt.Sprintf(httpChunkFmt, hd.prefix, g, c) {
+			chunks[g] = append(chunks[g], c)
+		} else if n, _ := fmt.Sscanf(rest, "%08d.done", &g); n == 1 &&
+			name == fmt.Sprintf(httpDoneFmt, hd.prefix, g) {
+			done[g] = true
+		}
+	}
+	for _, c := range chunks {
+		sort.Ints(c)
+	}
+	return chunks, done, nil
+}
+
+// listPage fetches one page of the directory listing, query selects the page, "" for the
+// first one, see parseListing
+func (hd *httpDest) listPage(query string) ([]string, string, error) {
+	resp, err := hd.client.Get(hd.dirURL + query)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot list %s: %s", hd.dirURL, err.Error())
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot list %s: %s", hd.dirURL, err.Error())
+	}
+	if resp.StatusCode != 200 {
+		return nil, "", fmt.Errorf("cannot list %s: %s", hd.dirURL, resp.Status)
+	}
+	names, next := parseListing(body)
+	return names, next, nil
+}
+
+// parseListing extracts object names from a directory listing, it also returns the query
+// string that fetches the next page of a truncated S3 listing, "" if there is none
+func parseListing(body []byte) ([]string, string) {
+	var names []string
+	if json.Unmarshal(body, &names) == nil {
+		return names, ""
+	}
+	var entries []struct{ Name string }
+	if json.Unmarshal(body, &entries) == nil {
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+		return names, ""
+	}
+	var bucket struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []struct{ Key string }
+		IsTruncated           bool
+		NextContinuationToken string // ListObjectsV2
+		NextMarker            string // ListObjects, only set when a delimiter is used
+	}
+	if xml.Unmarshal(body, &bucket) == nil {
+		for _, c := range bucket.Contents {
+			names = append(names, c.Key)
+		}
+		if !bucket.IsTruncated {
+			return names, ""
+		}
+		q := url.Values{}
+		if bucket.NextContinuationToken != "" {
+			q.Set("list-type", "2")
+			q.Set("continuation-token", bucket.NextContinuationToken)
+		} else if bucket.NextMarker != "" {
+			q.Set("marker", bucket.NextMarker)
+		} else if len(names) > 0 {
+			q.Set("marker", names[len(names)-1])
+		} else {
+			return names, ""
+		}
+		return names, "?" + q.Encode()
+	}
+	s := bufio.NewScanner(bytes.NewReader(body))
+	for s.Scan() {
+		if n := strings.TrimSpace(s.Text()); n != "" {
+			names = append(names, n)
+		}
+	}
+	return names, ""
+}
+
+// put uploads an object, the upload is abandoned when ctx is done
+func (hd *httpDest) put(ctx context.Context, name string, data []byte) error {
+	req, err := http.NewRequest("PUT", hd.dirURL+name, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp, err := hd.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("PUT %s: %s", req.URL, resp.Status)
+	}
+	return nil
+}
+
+// remove deletes an object, one that doesn't exist is considered deleted
+func (hd *httpDest) remove(name string) error {
+	req, err := http.NewRequest("DELETE", hd.dirURL+name, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := hd.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound &&
+		(resp.StatusCode < 200 || resp.StatusCode > 299) {
+		return fmt.Errorf("DELETE %s: %s", req.URL, resp.Status)
+	}
+	return nil
+}
+
+// purgePrevious deletes the chunks and done markers of the generations that precede the
+// current one, the done markers last, see generationPurger
+func (hd *httpDest) purgePrevious() error {
+	chunks, done, err := hd.list()
+	if err != nil {
+		return err
+	}
+	for g, cs := range chunks {
+		for _, c := range cs {
+			if g >= hd.gen {
+				break
+			}
+			if err := hd.remove(fmt.Sprintf(httpChunkFmt, hd.prefix, g, c)); err != nil {
+				return err
+			}
+		}
+	}
+	for g := range done {
+		if g >= hd.gen {
+			continue
+		}
+		if err := hd.remove(fmt.Sprintf(httpDoneFmt, hd.prefix, g)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush uploads any buffered data as the next chunk of the current generation
+func (hd *httpDest) flush() error {
+	return hd.flushContext(context.Background())
+}
+
+// flushContext is flush with an upload that's abandoned when ctx is done
+func (hd *httpDest) flushContext(ctx context.Context) error {
+	if hd.buf.Len() == 0 {
+		return nil
+	}
+	name := fmt.Sprintf(httpChunkFmt, hd.prefix, hd.gen, hd.chunk)
+	if err := hd.put(ctx, name, hd.buf.Bytes()); err != nil {
+		return err
+	}
+	hd.buf.Reset()
+	hd.chunk++
+	return nil
+}
+
+func (hd *httpDest) Write(p []byte) (int, error) {
+	hd.buf.Write(p)
+	if hd.buf.Len() >= hd.chunkSize {
+		if err := hd.flush(); err != nil {
+			// the data remains buffered, the next write or rotation retries the upload
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// WriteContext is Write with an upload that's abandoned when ctx is done, in which case p
+// is removed from the buffer so it's not part of the chunk uploaded next
+func (hd *httpDest) WriteContext(ctx context.Context, p []byte) (int, error) {
+	hd.buf.Write(p)
+	if hd.buf.Len() >= hd.chunkSize {
+		if err := hd.flushContext(ctx); err != nil {
+			if ctx.Err() != nil {
+				hd.buf.Truncate(hd.buf.Len() - len(p))
+				return 0, ctx.Err()
+			}
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+func (hd *httpDest) Capabilities() Capabilities {
+	return Capabilities{CanReplay: true, CanRotate: true}
+}
+
+func (hd *httpDest) ReplayReaders() []io.ReadCloser {
+	return hd.replayReaders
+}
+
+// StartRotate is called by persist in order to start a new log generation.
+func (hd *httpDest) StartRotate() error {
+	if !hd.snapOK {
+		return fmt.Errorf("Cannot rotate: initial snapshot incomplete")
+	}
+	if err := hd.flush(); err != nil {
+		return err
+	}
+	hd.gen++
+	hd.chunk = 0
+	hd.snapOK = false
+	return nil
+}
+
+// EndRotate is called by persist in order to signal the completion of the initial snapshot
+// on the new log generation, it uploads the buffered data and the generation's done marker
+// and deletes the previous generations.
+func (hd *httpDest) EndRotate() error {
+	if hd.snapOK {
+		return internalError([]interface{}{"url", hd.dirURL + hd.prefix, "gen", hd.gen,
+			"chunk", hd.chunk}, "StartRotate not called")
+	}
+	if err := hd.flush(); err != nil {
+		return err
+	}
+	done := fmt.Sprintf(httpDoneFmt, hd.prefix, hd.gen)
+	if err := hd.put(context.Background(), done, nil); err != nil {
+		return err
+	}
+	hd.snapOK = true
+	hd.log.Info("New log generation now initialized", "gen", hd.gen)
+	if err := hd.purgePrevious(); err != nil {
+		// not fatal, we'll try again at the end of the next rotation
+		hd.log.Warn("Cannot delete previous generations", "err", err)
+	}
+	return nil
+}
+
+func (hd *httpDest) Close() {
+	for _, rr := range hd.replayReaders {
+		rr.Close()
+	}
+	hd.replayReaders = nil
+	if err := hd.flush(); err != nil {
+		hd.log.Crit("Cannot upload final chunk", "gen", hd.gen, "chunk", hd.chunk,
+			"err", err)
+	}
+}
+
+// httpChunkReader reads all the chunks of a generation in sequence, fetching one chunk
+// at a time
+type httpChunkReader struct {
+	hd     *httpDest
+	gen    int
+	chunks []int         // chunks that remain to be read
+	body   io.ReadCloser // body of chunk being read
+}
+
+func (hr *httpChunkReader) Read(p []byte) (int, error) {
+	for {
+		if hr.body == nil {
+			if len(hr.chunks) == 0 {
+				return 0, io.EOF
+			}
+			url := hr.hd.dirURL + fmt.Sprintf(httpChunkFmt, hr.hd.prefix, hr.gen,
+				hr.chunks[0])
+			resp, err := hr.hd.client.Get(url)
+			if err != nil {
+				return 0, err
+			}
+			if resp.StatusCode != 200 {
+				resp.Body.Close()
+				return 0, fmt.Errorf("GET %s: %s", url, resp.Status)
+			}
+			hr.body = resp.Body
+			hr.chunks = hr.chunks[1:]
+		}
+		n, err := hr.body.Read(p)
+		if err == io.EOF {
+			hr.body.Close()
+			hr.body = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (hr *httpChunkReader) Close() error {
+	hr.chunks = nil
+	if hr.body != nil {
+		hr.body.Close()
+		hr.body = nil
+	}
+	return nil
+}
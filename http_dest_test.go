@@ -0,0 +1,193 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// in-memory HTTP object server used for testing
+type testObjectServer struct {
+	objects map[string][]byte
+	page    int // lists pages of that many objects S3-style if > 0
+	sync.Mutex
+}
+
+func (ts *testObjectServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ts.Lock()
+	defer ts.Unlock()
+	name := strings.TrimPrefix(r.URL.Path, "/logs/")
+	switch {
+	case r.Method == "PUT":
+		ts.objects[name], _ = ioutil.ReadAll(r.Body)
+	case r.Method == "DELETE":
+		delete(ts.objects, name)
+	case name == "" && ts.page > 0:
+		ts.listPage(w, r.URL.Query().Get("continuation-token"))
+	case name == "":
+		names := []string{}
+		for n := range ts.objects {
+			names = append(names, n)
+		}
+		json.NewEncoder(w).Encode(names)
+	case ts.objects[name] != nil:
+		w.Write(ts.objects[name])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// listPage lists the objects following the token as an S3 ListObjectsV2 page
+func (ts *testObjectServer) listPage(w http.ResponseWriter, token string) {
+	names := []string{}
+	for n := range ts.objects {
+		if n > token {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	fmt.Fprint(w, "<ListBucketResult>")
+	if len(names) > ts.page {
+		names = names[:ts.page]
+		fmt.Fprintf(w, "<IsTruncated>true</IsTruncated>"+
+			"<NextContinuationToken>%s</NextContinuationToken>", names[len(names)-1])
+	}
+	for _, n := range names {
+		fmt.Fprintf(w, "<Contents><Key>%s</Key></Contents>", n)
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+var _ = Describe("HTTPDest", func() {
+	var ts *testObjectServer
+	var srv *httptest.Server
+
+	BeforeEach(func() {
+		ts = &testObjectServer{objects: make(map[string][]byte)}
+		srv = httptest.NewServer(ts)
+	})
+	AfterEach(func() { srv.Close() })
+
+	readAll := func(hd LogDestination) []string {
+		var res []string
+		for _, rr := range hd.ReplayReaders() {
+			buf, err := ioutil.ReadAll(rr)
+			Ω(err).ShouldNot(HaveOccurred())
+			res = append(res, string(buf))
+		}
+		return res
+	}
+
+	It("does not create a log without create=true", func() {
+		_, err := NewHTTPDest(srv.URL+"/logs/app", false, nil, nil)
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("No existing"))
+	})
+
+	It("parses S3 bucket listings", func() {
+		listing := `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>logs</Name>
+<Contents><Key>app-00000000-000000.plog</Key><Size>11</Size></Contents>
+<Contents><Key>app-00000000.done</Key><Size>0</Size></Contents></ListBucketResult>`
+		Ω(parseListing([]byte(listing))).Should(Equal([]string{
+			"app-00000000-000000.plog", "app-00000000.done"}))
+		Ω(parseListing([]byte("a\nb\n"))).Should(Equal([]string{"a", "b"}))
+
+		truncated := `<ListBucketResult><IsTruncated>true</IsTruncated>
+<Contents><Key>app-00000000-000000.plog</Key></Contents></ListBucketResult>`
+		names, next := parseListing([]byte(truncated))
+		Ω(names).Should(Equal([]string{"app-00000000-000000.plog"}))
+		Ω(next).Should(Equal("?marker=app-00000000-000000.plog"))
+	})
+
+	It("follows listing pages and deletes previous generations", func() {
+		ts.page = 1
+		hd, err := NewHTTPDest(srv.URL+"/logs/app", true, nil, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		hd.(*httpDest).chunkSize = 4
+		for i := 0; i < 3; i++ {
+			if i > 0 {
+				Ω(hd.StartRotate()).ShouldNot(HaveOccurred())
+			}
+			hd.Write([]byte(fmt.Sprintf("Generation %d", i)))
+			Ω(hd.EndRotate()).ShouldNot(HaveOccurred())
+		}
+		hd.Close()
+		for name := range ts.objects {
+			Ω(name).Should(HavePrefix("app-00000002"))
+		}
+		Ω(len(ts.objects)).Should(BeNumerically(">", ts.page))
+
+		hd, err = NewHTTPDest(srv.URL+"/logs/app", false, nil, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(readAll(hd)).Should(Equal([]string{"Generation 2"}))
+		hd.Close()
+	})
+
+	It("replays the current and the incomplete generation", func() {
+		hd, err := NewHTTPDest(srv.URL+"/logs/app", true, nil, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		hd.(*httpDest).chunkSize = 8
+		hd.Write([]byte("Hello World"))
+		Ω(hd.EndRotate()).ShouldNot(HaveOccurred())
+		hd.Write([]byte("Hello Again"))
+		hd.Write([]byte("!"))
+		Ω(hd.StartRotate()).ShouldNot(HaveOccurred())
+		hd.Write([]byte("Snapshot"))
+		hd.Close()
+		Ω(ts.objects).Should(HaveKey("app-00000000-000002.plog"))
+
+		hd, err = NewHTTPDest(srv.URL+"/logs/app", false, nil, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(readAll(hd)).Should(Equal([]string{"Hello WorldHello Again!", "Snapshot"}))
+		Ω(hd.EndRotate()).ShouldNot(HaveOccurred())
+		hd.Close()
+
+		hd, err = NewHTTPDest(srv.URL+"/logs/app", false, nil, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(readAll(hd)).Should(Equal([]string{""}))
+		hd.Close()
+	})
+	It("abandons an upload when the context is done", func() {
+		var stalled int32 = 1
+		ssrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "PUT" && atomic.LoadInt32(&stalled) == 1 {
+				ioutil.ReadAll(r.Body) // the server notices the client leaving after that
+				<-r.Context().Done()
+				return
+			}
+			ts.ServeHTTP(w, r)
+		}))
+		defer ssrv.Close()
+		hd, err := NewHTTPDest(ssrv.URL+"/logs/app", true, nil, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		hd.(*httpDest).chunkSize = 8
+		cw := hd.(ContextWriter)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		n, err := cw.WriteContext(ctx, []byte("Hello World"))
+		Ω(err).Should(Equal(context.DeadlineExceeded))
+		Ω(n).Should(BeZero())
+
+		atomic.StoreInt32(&stalled, 0)
+		_, err = cw.WriteContext(context.Background(), []byte("Hello Again"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(hd.EndRotate()).ShouldNot(HaveOccurred())
+		hd.Close()
+		chunk := fmt.Sprintf(httpChunkFmt, "app", hd.(*httpDest).gen, 0)
+		Ω(string(ts.objects[chunk])).Should(Equal("Hello Again"))
+	})
+})
@@ -0,0 +1,83 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+// idempotencyWindow is the default number of idempotency keys remembered by replay
+const idempotencyWindow = 10000
+
+// IdempotentEvent is implemented by events that record an operation which must only be
+// applied once, IdempotencyKey returns the key identifying the operation. Replay skips an
+// event whose key it has already seen among the most recent keys, see
+// WithIdempotencyWindow, which protects clients from the repeats that at-least-once
+// delivery by network destinations introduces. The keys of events output using OutputNS
+// are scoped to their namespace.
+type IdempotentEvent interface {
+	IdempotencyKey() string
+}
+
+// WithIdempotencyWindow sets the number of idempotency keys replay remembers to detect
+// repeated events, a repeat that comes after more distinct keys than that is replayed
+// again. The default is 10000, 0 disables the detection. Stats reports the number of
+// events skipped as DuplicatesSkipped.
+func WithIdempotencyWindow(n int) LogOption {
+	return func(pl *pLog) { pl.idemWindow = n }
+}
+
+// keyWindow remembers the most recent distinct keys up to a limit
+type keyWindow struct {
+	seen map[string]bool
+	ring []string // keys in the order they were first seen
+	next int      // position in ring of the next key
+}
+
+func newKeyWindow(limit int) *keyWindow {
+	return &keyWindow{seen: make(map[string]bool, limit), ring: make([]string, limit)}
+}
+
+// add records a key, it returns false if the key is already in the window
+func (kw *keyWindow) add(key string) bool {
+	if kw.seen[key] {
+		return false
+	}
+	if old := kw.ring[kw.next]; len(kw.seen) == len(kw.ring) {
+		delete(kw.seen, old)
+	}
+	kw.seen[key] = true
+	kw.ring[kw.next] = key
+	kw.next = (kw.next + 1) % len(kw.ring)
+	return true
+}
+
+// idempotencyKey returns the idempotency key of an event, scoped to its namespace
+func idempotencyKey(logEvent interface{}) (string, bool) {
+	ns, ev := Namespace(logEvent)
+	ie, ok := ev.(IdempotentEvent)
+	if !ok {
+		return "", false
+	}
+	if ns == "" {
+		return ie.IdempotencyKey(), true
+	}
+	return ns + "\x00" + ie.IdempotencyKey(), true
+}
+
+// dedupeDecoder skips the idempotent events whose key is in the window
+type dedupeDecoder struct {
+	Decoder
+	window *keyWindow
+	pl     *pLog
+}
+
+func (dd dedupeDecoder) Decode() (interface{}, error) {
+	for {
+		ev, err := dd.Decoder.Decode()
+		if err != nil {
+			return ev, err
+		}
+		if key, ok := idempotencyKey(ev); ok && !dd.window.add(key) {
+			dd.pl.duplicates++
+			continue
+		}
+		return ev, nil
+	}
+}
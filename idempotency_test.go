@@ -0,0 +1,79 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// operation event type
+type opEv struct {
+	ID string
+}
+
+func (oe *opEv) IdempotencyKey() string { return oe.ID }
+
+func init() {
+	Register(&opEv{})
+}
+
+var _ = Describe("Idempotency keys", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	// write outputs events, including repeats, to a new log
+	write := func(events ...interface{}) {
+		fd, err := NewFileDest(PT+"/idem", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		for _, ev := range events {
+			Ω(pl.Output(ev)).ShouldNot(HaveOccurred())
+		}
+		pl.(*pLog).Close()
+	}
+
+	// replay replays the log and returns the events and the number of duplicates skipped
+	replay := func(opts ...LogOption) ([]interface{}, float64) {
+		fd, err := NewFileDest(PT+"/idem", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{}
+		pl, err := NewLog(fd, rc, log15.Root(), opts...)
+		Ω(err).ShouldNot(HaveOccurred())
+		dups := pl.Stats()["DuplicatesSkipped"]
+		pl.(*pLog).Close()
+		return rc.events, dups
+	}
+
+	It("skips repeated events", func() {
+		write(&opEv{ID: "1"}, &opEv{ID: "2"}, &opEv{ID: "1"}, &logEv1{S: "a"},
+			&logEv1{S: "a"}, &NamespacedEvent{NS: "t", Event: &opEv{ID: "1"}})
+		events, dups := replay()
+		Ω(events).Should(Equal([]interface{}{&opEv{ID: "1"}, &opEv{ID: "2"},
+			&logEv1{S: "a"}, &logEv1{S: "a"},
+			&NamespacedEvent{NS: "t", Event: &opEv{ID: "1"}}}))
+		Ω(dups).Should(Equal(1.0))
+	})
+
+	It("only remembers the most recent keys", func() {
+		write(&opEv{ID: "1"}, &opEv{ID: "2"}, &opEv{ID: "3"}, &opEv{ID: "1"},
+			&opEv{ID: "3"})
+		events, dups := replay(WithIdempotencyWindow(2))
+		Ω(events).Should(Equal([]interface{}{&opEv{ID: "1"}, &opEv{ID: "2"},
+			&opEv{ID: "3"}, &opEv{ID: "1"}}))
+		Ω(dups).Should(Equal(1.0))
+
+		By("replaying all the events of the new snapshot when disabled")
+		events, dups = replay(WithIdempotencyWindow(0))
+		Ω(events).Should(HaveLen(4))
+		Ω(dups).Should(BeZero())
+	})
+})
@@ -0,0 +1,19 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+// Package integration holds the end-to-end tests of persist's destinations against real
+// backends: the file destination on a local disk, and the HTTP destination on an nginx
+// WebDAV server and on a MinIO bucket. The tests take each log set through cycles of writes,
+// rotations, clean restarts, and crashes of the writing process, which is killed at random
+// points, and verify that the replay restores the state. They are opt-in as they need the
+// servers, which docker-compose.yml in this directory provides:
+//
+//	docker-compose -f integration/docker-compose.yml up -d
+//	go test -tags integration ./integration/
+//
+// PERSIST_WEBDAV_URL and PERSIST_MINIO_URL point the tests at other servers, they default
+// to http://localhost:8080/logs/ and http://localhost:9000/persist/. PERSIST_BACKENDS
+// restricts the backends tested, e.g. "file,webdav", by default all are tested and a backend
+// that can't be reached fails the tests. The destinations that use a client interface, e.g.
+// SFTP and Redis, are covered by the unit tests with fake clients since persist doesn't
+// depend on any client library.
+package integration
@@ -0,0 +1,27 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"os"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rightscale/persist"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+func TestIntegration(t *testing.T) {
+	persist.Strict(true)
+	// the test binary doubles as the writing process the tests crash
+	if os.Getenv(backendEnv) != "" {
+		os.Exit(runWriter())
+	}
+	log15.Root().SetHandler(log15.StreamHandler(GinkgoWriter, log15.TerminalFormat()))
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "integration")
+}
@@ -0,0 +1,350 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rightscale/persist"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// environment of the writing process, see runWriter
+const (
+	backendEnv  = "PERSIST_IT_BACKEND"  // backend to write to
+	locationEnv = "PERSIST_IT_LOCATION" // location of the log set in the backend
+	createEnv   = "PERSIST_IT_CREATE"   // non-empty to create the log set
+	countEnv    = "PERSIST_IT_COUNT"    // number of events to write
+)
+
+// sizeLimit makes the logs rotate every few dozen events
+const sizeLimit = 4096
+
+// backend is a kind of destination and the server it writes to
+type backend struct {
+	name string
+	// location returns where the log set id is stored, a base path or URL
+	location func(id string) string
+	open     func(location string, create bool) (persist.LogDestination, error)
+	// durable is true if the events are stored once Output returns, such that they
+	// survive a crash of the writing process
+	durable bool
+}
+
+var fileDir string // directory of the file destinations, shared with the writing process
+
+var backends = []backend{
+	{
+		name:     "file",
+		location: func(id string) string { return filepath.Join(fileDir, id) },
+		open: func(location string, create bool) (persist.LogDestination, error) {
+			return persist.NewFileDest(location, create, nil)
+		},
+		durable: true,
+	},
+	{
+		name:     "webdav",
+		location: func(id string) string { return env("PERSIST_WEBDAV_URL", webdavURL) + id },
+		open:     openHTTP,
+	},
+	{
+		name:     "minio",
+		location: func(id string) string { return env("PERSIST_MINIO_URL", minioURL) + id },
+		open:     openHTTP,
+	},
+}
+
+const (
+	webdavURL = "http://localhost:8080/logs/"
+	minioURL  = "http://localhost:9000/persist/"
+)
+
+func openHTTP(location string, create bool) (persist.LogDestination, error) {
+	return persist.NewHTTPDest(location, create, nil, nil)
+}
+
+func env(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func findBackend(name string) *backend {
+	for i := range backends {
+		if backends[i].name == name {
+			return &backends[i]
+		}
+	}
+	return nil
+}
+
+// setEvent adds a number to the state of a setClient
+type setEvent struct {
+	N   int
+	Pad string // makes the log grow faster
+}
+
+func init() {
+	persist.Register(&setEvent{})
+}
+
+// setClient is a log client whose state is a set of numbers, the writing process adds
+// them in increasing order hence a consistent state is the numbers below some bound
+type setClient struct {
+	mu  sync.Mutex
+	set map[int]bool
+}
+
+func (sc *setClient) Replay(ev interface{}) error {
+	se, ok := ev.(*setEvent)
+	if !ok {
+		return fmt.Errorf("unexpected event %T", ev)
+	}
+	sc.mu.Lock()
+	sc.set[se.N] = true
+	sc.mu.Unlock()
+	return nil
+}
+
+func (sc *setClient) PersistAll(pl persist.Log) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	numbers := make([]int, 0, len(sc.set))
+	for n := range sc.set {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	for _, n := range numbers {
+		pl.Output(&setEvent{N: n, Pad: strings.Repeat("p", 40)})
+	}
+}
+
+// add adds n to the set and outputs it
+func (sc *setClient) add(pl persist.Log, n int) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.set[n] = true
+	return pl.Output(&setEvent{N: n, Pad: strings.Repeat("p", 40)})
+}
+
+// bound returns the number of elements if the set is made of the numbers below it, -1
+// otherwise
+func (sc *setClient) bound() int {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for n := range sc.set {
+		if n < 0 || n >= len(sc.set) {
+			return -1
+		}
+	}
+	return len(sc.set)
+}
+
+// openedLog is a log and its destination
+type openedLog struct {
+	persist.Log
+	dest persist.LogDestination
+	done uint64 // last complete generation
+}
+
+// openLog opens the log set at location and replays it into client
+func openLog(b *backend, location string, create bool, client *setClient) (*openedLog, error) {
+	dest, err := b.open(location, create)
+	if err != nil {
+		return nil, err
+	}
+	ol := &openedLog{dest: dest}
+	pl, err := persist.NewLog(dest, client, log15.Root(),
+		persist.OnRotate(func(gen uint64) { atomic.StoreUint64(&ol.done, gen) }))
+	if err != nil {
+		dest.Close()
+		return nil, err
+	}
+	pl.SetSizeLimit(sizeLimit)
+	ol.Log = pl
+	return ol, nil
+}
+
+// close waits for the rotations to complete and closes the destination, which uploads the
+// data buffered by HTTP destinations. A rotation may be about to start when the last one
+// completes, hence the generations must remain complete for a while.
+func (ol *openedLog) close() {
+	idle := time.Time{}
+	for {
+		if float64(atomic.LoadUint64(&ol.done)) < ol.Stats()["Generation"] {
+			idle = time.Time{}
+		} else if idle.IsZero() {
+			idle = time.Now()
+		} else if time.Since(idle) > 20*time.Millisecond {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ol.dest.Close()
+}
+
+// runWriter is the writing process: it opens the log set, continues the sequence of numbers
+// where the replay left off, and reports each number whose output returned on stdout
+func runWriter() int {
+	log15.Root().SetHandler(log15.DiscardHandler())
+	b := findBackend(os.Getenv(backendEnv))
+	count, _ := strconv.Atoi(os.Getenv(countEnv))
+	client := &setClient{set: make(map[int]bool)}
+	ol, err := openLog(b, os.Getenv(locationEnv), os.Getenv(createEnv) != "", client)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	start := client.bound()
+	if start < 0 {
+		fmt.Fprintln(os.Stderr, "inconsistent state replayed")
+		return 1
+	}
+	fmt.Printf("start %d\n", start)
+	for n := start; n < start+count; n++ {
+		if err := client.add(ol, n); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("ack %d\n", n+1)
+	}
+	ol.close()
+	return 0
+}
+
+// writer is a writing process
+type writer struct {
+	cmd   *exec.Cmd
+	out   *bufio.Scanner
+	start int // numbers in the state it replayed
+	acked int // numbers whose output returned
+}
+
+// startWriter starts a process that writes count numbers to the log set at location
+func startWriter(b *backend, location string, create bool, count int) *writer {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestIntegration$")
+	cmd.Env = append(os.Environ(), backendEnv+"="+b.name, locationEnv+"="+location,
+		countEnv+"="+strconv.Itoa(count))
+	if create {
+		cmd.Env = append(cmd.Env, createEnv+"=1")
+	}
+	cmd.Stderr = GinkgoWriter
+	stdout, err := cmd.StdoutPipe()
+	Ω(err).ShouldNot(HaveOccurred())
+	Ω(cmd.Start()).ShouldNot(HaveOccurred())
+	w := &writer{cmd: cmd, out: bufio.NewScanner(stdout), start: -1}
+	Ω(w.next()).Should(BeTrue(), "the writer did not start")
+	Ω(w.start).Should(BeNumerically(">=", 0))
+	return w
+}
+
+// next reads the next report of the writer, it returns false once the writer exited
+func (w *writer) next() bool {
+	if !w.out.Scan() {
+		return false
+	}
+	if f := strings.Fields(w.out.Text()); len(f) == 2 {
+		n, _ := strconv.Atoi(f[1])
+		switch f[0] {
+		case "start":
+			w.start, w.acked = n, n
+		case "ack":
+			w.acked = n
+		}
+	}
+	return true
+}
+
+// verify replays the log set at location and checks that its state is consistent and
+// holds at least min numbers and at most max, it returns the number it holds
+func verify(b *backend, location string, min, max int) int {
+	client := &setClient{set: make(map[int]bool)}
+	ol, err := openLog(b, location, false, client)
+	Ω(err).ShouldNot(HaveOccurred())
+	ol.close()
+	n := client.bound()
+	Ω(n).Should(BeNumerically(">=", 0), "the replayed state is inconsistent")
+	Ω(n).Should(BeNumerically(">=", min))
+	Ω(n).Should(BeNumerically("<=", max))
+	return n
+}
+
+var _ = BeforeSuite(func() {
+	var err error
+	fileDir, err = ioutil.TempDir("", "persist-integration")
+	Ω(err).ShouldNot(HaveOccurred())
+})
+
+var _ = AfterSuite(func() { os.RemoveAll(fileDir) })
+
+var _ = Describe("Destinations", func() {
+	tested := strings.Split(env("PERSIST_BACKENDS", "file,webdav,minio"), ",")
+
+	for _, name := range tested {
+		b := findBackend(strings.TrimSpace(name))
+		if b == nil {
+			panic(fmt.Sprintf("unknown backend %q in PERSIST_BACKENDS", name))
+		}
+
+		Describe(b.name, func() {
+			var location string
+
+			BeforeEach(func() {
+				location = b.location(fmt.Sprintf("it%d", time.Now().UnixNano()))
+			})
+
+			It("replays the log across clean restarts", func() {
+				total := 0
+				for i := 0; i < 3; i++ {
+					w := startWriter(b, location, i == 0, 200)
+					Ω(w.start).Should(Equal(total))
+					for w.next() {
+					}
+					Ω(w.cmd.Wait()).ShouldNot(HaveOccurred())
+					Ω(w.acked).Should(Equal(total + 200))
+					total = verify(b, location, w.acked, w.acked)
+				}
+			})
+
+			It("recovers from crashes of the writing process", func() {
+				rnd := rand.New(rand.NewSource(GinkgoRandomSeed()))
+				total := 0
+				for i := 0; i < 5; i++ {
+					w := startWriter(b, location, i == 0, 1000)
+					// the replay may lose the numbers not stored when the writer crashed
+					Ω(w.start).Should(Equal(total))
+					target := w.start + 1 + rnd.Intn(300)
+					for w.acked < target && w.next() {
+					}
+					w.cmd.Process.Kill()
+					for w.next() {
+					}
+					w.cmd.Wait()
+					min := w.start
+					if b.durable {
+						min = w.acked
+					}
+					total = verify(b, location, min, w.start+1000)
+				}
+			})
+		})
+	}
+})
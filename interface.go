@@ -23,7 +23,8 @@ type LogClient interface {
 
 	// PersistAll is called by the persistence layer in order to enumerate all live resources
 	// and persist them by making calls to Log.Write().
-	// (If PersistAll encounters an error it's time to panic.)
+	// (If PersistAll encounters an error it's time to panic, which puts the log into error
+	// state until it's reopened.)
 	// PersistAll can run in parallel with new updates to resources however the application
 	// must ensure that calls to Log.Write() are in the same order as PersistAll's reads
 	// and other update's writes.
@@ -44,7 +45,13 @@ type Log interface {
 	// 10MB
 	SetSizeLimit(bytes int)
 
-	// AddDestination adds additional destinations to the Log (not yet implemented)
+	// SetSecondaryDestination adds a secondary destination to the Log. This causes a log
+	// rotation such that the secondary starts out with a full snapshot, unless the snapshot
+	// is written in the background, see WithBackgroundSecondarySnapshot. The secondary is not
+	// used for replay and errors writing to it do not affect the primary destination: the
+	// secondary stops receiving events until the next rotation re-syncs it and the error is
+	// reflected in Stats. A secondary that cannot rotate (see Capabilities) stops receiving
+	// events at the first rotation after it has been added.
 	SetSecondaryDestination(dest LogDestination) error
 
 	// HealthCheck returns any persistent error encountered in persist that prevents it
@@ -52,6 +59,8 @@ type Log interface {
 	// the same error. If the problem is fixed the error will eventually go away again and
 	// the log will be "repaired" by doing a rotation. The intent of the HealthCheck call
 	// is for the application to be able to reject requests early if the logging is broken.
+	// It also returns an error while the free space of the primary destination is below
+	// its critical watermark, see FreeSpaceWatermarks, even though writes still succeed.
 	HealthCheck() error
 
 	// Stats returns a list of implementation dependent statistics as name->value
@@ -61,7 +70,25 @@ type Log interface {
 // Register a type being written to the log, this must be called for each type passed
 // to Write and for any type expected in an interface type inside an event. This calls
 // gob.Register() internally, please see the gob docs
-func Register(value interface{}) { gob.Register(value) }
+func Register(value interface{}) {
+	gob.Register(value)
+	registered.Register(gobName(value), value)
+}
+
+// RegisterNamed registers a type like Register but under an explicit name, which is what
+// identifies the type in log files instead of the Go package path and type name, such
+// that moving or renaming the type doesn't prevent the replay of existing logs. The name
+// must not change once logs have been written with it. This calls gob.RegisterName().
+func RegisterNamed(name string, value interface{}) {
+	gob.RegisterName(name, value)
+	registered.Register(name, value)
+}
+
+// KeyedEvent is implemented by events that pertain to a single resource, EventKey returns
+// the key identifying the resource. It allows tools to select the events of one resource.
+type KeyedEvent interface {
+	EventKey() string
+}
 
 // A log destination represents something the persist layer can write log entries to, and then
 // replay them in the future. A "New" function is expected to exist for each type of log
@@ -83,3 +110,28 @@ type LogDestination interface {
 	// Close ends the entire log writing and offers a way to cleanly flush and close
 	Close()
 }
+
+// Capabilities describes what a log destination is able to do, it allows persist to validate
+// its configuration and adapt its behavior to the destinations it writes to.
+type Capabilities struct {
+	CanReplay    bool // ReplayReaders returns the previously written log
+	CanRotate    bool // StartRotate starts a fresh stream, else only one stream can be written
+	DurableSync  bool // data is on stable storage when Write returns
+	WriteOnly    bool // the destination can never be read back, it can only be a secondary
+	SnapshotOnly bool // only the snapshots are written, not the events output in between
+}
+
+// CapableDestination is implemented by log destinations that declare their capabilities.
+// Destinations that don't implement it are assumed to be able to replay and rotate.
+type CapableDestination interface {
+	LogDestination
+	Capabilities() Capabilities
+}
+
+// DestCapabilities returns the capabilities of a log destination
+func DestCapabilities(dest LogDestination) Capabilities {
+	if cd, ok := dest.(CapableDestination); ok {
+		return cd.Capabilities()
+	}
+	return Capabilities{CanReplay: true, CanRotate: true}
+}
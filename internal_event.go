@@ -0,0 +1,78 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"time"
+)
+
+// InternalEvent is a record of a milestone of the persistence layer itself, such as a
+// rotation or the failure of the secondary destination, which persist writes into the log
+// when RecordInternalEvents is used. This way the history of the persistence layer travels
+// with the data, e.g., for forensic analysis using the plog tool. Internal events are not
+// passed to the client on replay.
+type InternalEvent struct {
+	Kind  string            // what happened, see the Internal* constants
+	Time  time.Time         // when it happened
+	Gen   uint64            // generation being written when it happened
+	Attrs map[string]string // details, depending on the kind
+}
+
+// Kinds of internal events
+const (
+	InternalRotationStart     = "rotation-start"      // last record of a rotated generation
+	InternalRotationEnd       = "rotation-end"        // snapshot of the generation is complete
+	InternalRecovery          = "recovery"            // replayed in recovery mode, RecoverTypes
+	InternalDowngrade         = "downgrade"           // replayed a newer format, ForceDowngrade
+	InternalSecondaryFailed   = "secondary-failed"    // secondary stopped receiving events
+	InternalSecondaryCaughtUp = "secondary-caught-up" // secondary is in sync again
+	InternalHandoff           = "handoff"             // log handed off to another process
+	InternalTakeOver          = "take-over"           // log taken over after a handoff
+)
+
+func init() {
+	Register(&InternalEvent{})
+}
+
+// RecordInternalEvents makes persist write InternalEvent records into the log. Generations
+// containing them are recorded with format version 2, which older versions of persist
+// refuse to open.
+func RecordInternalEvents() LogOption {
+	return func(pl *pLog) { pl.internal = true }
+}
+
+// note queues an internal event, which is written at the next safe point, i.e., once the
+// encoders are not in use, must be called while holding the pl.Lock(). The attributes are
+// given as key-value pairs.
+func (pl *pLog) note(kind string, attrs ...string) {
+	pl.trace(kind, 0, noteDetail(attrs))
+	if !pl.internal {
+		return
+	}
+	ev := &InternalEvent{Kind: kind, Time: pl.now().UTC(), Gen: pl.gen}
+	if len(attrs) > 0 {
+		ev.Attrs = make(map[string]string)
+		for i := 0; i+1 < len(attrs); i += 2 {
+			ev.Attrs[attrs[i]] = attrs[i+1]
+		}
+	}
+	pl.notes = append(pl.notes, ev)
+}
+
+// flushNotes writes the queued internal events, must be called while holding the pl.Lock()
+func (pl *pLog) flushNotes() {
+	// writing may queue more events, e.g., if the secondary fails
+	for len(pl.notes) > 0 && pl.errState == nil {
+		ev := pl.notes[0]
+		pl.notes = pl.notes[1:]
+		if err := pl.encoder.Encode(ev); err != nil {
+			pl.fail("encode", err)
+		} else if pl.secEnc != nil && pl.secSynced && !pl.secCaps.SnapshotOnly {
+			// internal events bypass the secondary's filter, like the metadata
+			if err := pl.secEnc.Encode(ev); err != nil {
+				pl.secondaryError("Write", err)
+			}
+		}
+	}
+	pl.notes = nil
+}
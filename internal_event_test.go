@@ -0,0 +1,121 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"io"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("InternalEvent", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+
+	// internalEvents returns the kinds of the internal events in each file of a log set and
+	// the format version of each file
+	internalEvents := func(basepath string) ([][]string, []int) {
+		files, err := LogFiles(basepath)
+		Ω(err).ShouldNot(HaveOccurred())
+		var kinds [][]string
+		var formats []int
+		for _, file := range files {
+			f, err := os.Open(file)
+			Ω(err).ShouldNot(HaveOccurred())
+			dec := GobCodec.NewDecoder(f)
+			var k []string
+			for {
+				ev, err := dec.Decode()
+				if err == io.EOF {
+					break
+				}
+				Ω(err).ShouldNot(HaveOccurred())
+				switch ev := ev.(type) {
+				case *GenerationMeta:
+					formats = append(formats, ev.Format)
+				case *InternalEvent:
+					k = append(k, ev.Kind)
+				}
+			}
+			f.Close()
+			kinds = append(kinds, k)
+		}
+		return kinds, formats
+	}
+
+	It("records rotations in the log", func() {
+		fd, err := NewFileDest(PT+"/internal", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{events: []interface{}{&logEv1{S: "a"}}}
+		pl, err := NewLog(fd, rc, log15.Root(), RecordInternalEvents())
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.SetSizeLimit(10)
+		Ω(pl.Output(&logEv1{S: "trigger a rotation"})).ShouldNot(HaveOccurred())
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(2.0))
+		pl.(*pLog).Close()
+
+		kinds, formats := internalEvents(PT + "/internal")
+		Ω(kinds).Should(Equal([][]string{
+			{InternalRotationEnd, InternalRotationStart},
+			{InternalRotationEnd},
+		}))
+		Ω(formats).Should(Equal([]int{2, 2}))
+
+		By("replaying the log without passing them to the client")
+		fd, err = NewFileDest(PT+"/internal", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc = &recordingClient{}
+		pl, err = NewLog(fd, rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(Equal([]interface{}{&logEv1{S: "a"}}))
+		pl.(*pLog).Close()
+	})
+
+	It("records recovery and secondary failures", func() {
+		fd, err := NewFileDest(PT+"/internal", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		By("recovering the log")
+		fd, err = NewFileDest(PT+"/internal", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		var stats RecoveryStats
+		pl, err = NewLog(fd, &recordingClient{}, log15.Root(), RecordInternalEvents(),
+			RecoverTypes(&stats), WithSecondaryRetry(time.Millisecond))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		By("failing and catching up the secondary")
+		sd, err := NewFileDest(PT+"/secondary", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		fsd := &flakyDest{LogDestination: sd}
+		Ω(pl.SetSecondaryDestination(fsd)).ShouldNot(HaveOccurred())
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(3.0))
+		Eventually(func() bool {
+			pl.(*pLog).Lock()
+			defer pl.(*pLog).Unlock()
+			return pl.(*pLog).rotating
+		}).Should(BeFalse())
+		fsd.setDown(true)
+		Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		fsd.setDown(false)
+		time.Sleep(5 * time.Millisecond)
+		Ω(pl.Output(&logEv1{S: "b"})).ShouldNot(HaveOccurred())
+		Eventually(func() float64 { return pl.Stats()["SecondaryCatchUps"] }).Should(Equal(1.0))
+		pl.(*pLog).Close()
+
+		kinds, _ := internalEvents(PT + "/internal")
+		Ω(kinds[len(kinds)-1]).Should(Equal([]string{InternalRotationEnd,
+			InternalSecondaryFailed, InternalSecondaryCaughtUp}))
+		Ω(kinds[len(kinds)-2]).Should(Equal([]string{InternalRecovery, InternalRotationEnd,
+			InternalRotationStart}))
+	})
+})
@@ -0,0 +1,120 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// CommandRecord journals a command handled by the application, see OutputCommand. It's
+// written in the same transaction as the events the command produced and is never replayed
+// to the client.
+type CommandRecord struct {
+	ID      string // correlation ID of the command, e.g., a request ID
+	Command interface{}
+}
+
+func init() {
+	Register(&CommandRecord{})
+}
+
+// JournalCommands makes OutputCommand journal the commands along with the events they
+// produce, which allows a command to be re-executed, e.g., by a candidate build of the
+// application, and the events it produces to be compared, see ReadJournal. The commands
+// are part of the history of the log and not of its snapshots, the journal of a log file
+// holds the commands handled during its generation. A generation that journals commands
+// records format version 12, which versions of persist that predate JournalCommands refuse
+// to replay, see FormatVersion.
+func JournalCommands() LogOption {
+	return func(pl *pLog) { pl.journal = true }
+}
+
+// OutputCommand outputs the events fn stages as the result of a command, as one
+// transaction, see Txn. If the log journals commands, see JournalCommands, the command
+// is written along with its correlation ID at the start of the transaction. The type of the
+// command must be registered using Register.
+func OutputCommand(log Log, id string, cmd interface{}, fn func(w TxnWriter) error) error {
+	pl, ok := log.(*pLog)
+	if !ok || !pl.journal {
+		return Txn(log, fn)
+	}
+	events, err := stageTxn(fn)
+	if err != nil {
+		return err
+	}
+	events = append([]interface{}{&CommandRecord{ID: id, Command: cmd}}, events...)
+	return pl.outputTxn(events, false)
+}
+
+// JournalEntry is a command read from a journal and the events it produced
+type JournalEntry struct {
+	ID      string
+	Command interface{}
+	Events  []interface{}
+}
+
+// ReadJournal reads the commands journaled in a stream of log events, such as a log file,
+// and the events each one produced, using the codec, which defaults to GobCodec if nil
+func ReadJournal(r io.Reader, codec Codec) ([]JournalEntry, error) {
+	if codec == nil {
+		codec = GobCodec
+	}
+	dec := withSequence(codec.NewDecoder(r))
+	var entries []JournalEntry
+	for {
+		ev, err := dec.Decode()
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return entries, fmt.Errorf("decode failed after %d commands: %s", len(entries),
+				err.Error())
+		}
+		cr, ok := ev.(*CommandRecord)
+		if !ok {
+			continue
+		}
+		// the events of the command's transaction are held by the decoder
+		entry := JournalEntry{ID: cr.ID, Command: cr.Command}
+		for n := len(dec.done); n > 0; n-- {
+			ev, err := dec.Decode()
+			if err != nil {
+				return entries, err
+			}
+			entry.Events = append(entry.Events, ev)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// JournalMismatch describes a command whose re-execution didn't produce the journaled
+// events, see ReExecute
+type JournalMismatch struct {
+	ID       string
+	Command  interface{}
+	Recorded []interface{} // events in the journal
+	Produced []interface{} // events produced by the re-execution
+	Err      error         // error returned by the re-execution, if any
+}
+
+// ReExecute executes the journaled commands in order using exec, which typically calls the
+// command handler of a candidate build, and returns the commands whose events differ from
+// the journaled ones, as compared by reflect.DeepEqual. For the comparison to be
+// meaningful exec must start from the state the log had before the first command, e.g.,
+// by replaying the snapshot of the log file's generation, and be deterministic.
+func ReExecute(entries []JournalEntry,
+	exec func(cmd interface{}) ([]interface{}, error)) []JournalMismatch {
+
+	var res []JournalMismatch
+	for _, e := range entries {
+		produced, err := exec(e.Command)
+		same := len(produced) == 0 && len(e.Events) == 0 ||
+			reflect.DeepEqual(produced, e.Events)
+		if err != nil || !same {
+			res = append(res, JournalMismatch{ID: e.ID, Command: e.Command,
+				Recorded: e.Events, Produced: produced, Err: err})
+		}
+	}
+	return res
+}
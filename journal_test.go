@@ -0,0 +1,114 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// command type
+type depositCmd struct {
+	Account string
+	Amount  int
+}
+
+func init() {
+	Register(&depositCmd{})
+}
+
+// deposit is a deterministic command handler
+func deposit(cmd interface{}) ([]interface{}, error) {
+	c := cmd.(*depositCmd)
+	if c.Amount == 0 {
+		return nil, nil
+	}
+	return []interface{}{&logEv1{S: c.Account}, &logEv2{A: c.Amount}}, nil
+}
+
+var _ = Describe("Command journal", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	// handle outputs the events produced by a command
+	handle := func(pl Log, id string, cmd interface{}) {
+		err := OutputCommand(pl, id, cmd, func(w TxnWriter) error {
+			events, err := deposit(cmd)
+			for _, ev := range events {
+				w.Output(ev)
+			}
+			return err
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+	}
+
+	// journal reads the journal of the current log file
+	journal := func() []JournalEntry {
+		files, err := LogFiles(PT + "/journal")
+		Ω(err).ShouldNot(HaveOccurred())
+		f, err := os.Open(files[len(files)-1])
+		Ω(err).ShouldNot(HaveOccurred())
+		defer f.Close()
+		entries, err := ReadJournal(f, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		return entries
+	}
+
+	It("journals commands with the events they produce", func() {
+		fd, err := NewFileDest(PT+"/journal", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root(), JournalCommands())
+		Ω(err).ShouldNot(HaveOccurred())
+		handle(pl, "req-1", &depositCmd{Account: "a", Amount: 5})
+		Ω(pl.Output(&logEv1{S: "other"})).ShouldNot(HaveOccurred())
+		handle(pl, "req-2", &depositCmd{Account: "b"})
+		pl.(*pLog).Close()
+
+		entries := journal()
+		Ω(entries).Should(Equal([]JournalEntry{
+			{ID: "req-1", Command: &depositCmd{Account: "a", Amount: 5},
+				Events: []interface{}{&logEv1{S: "a"}, &logEv2{A: 5}}},
+			{ID: "req-2", Command: &depositCmd{Account: "b"}},
+		}))
+
+		By("re-executing the commands")
+		Ω(ReExecute(entries, deposit)).Should(BeEmpty())
+		mismatches := ReExecute(entries, func(cmd interface{}) ([]interface{}, error) {
+			if cmd.(*depositCmd).Account == "b" {
+				return nil, fmt.Errorf("regression")
+			}
+			return deposit(cmd)
+		})
+		Ω(mismatches).Should(HaveLen(1))
+		Ω(mismatches[0].ID).Should(Equal("req-2"))
+		Ω(mismatches[0].Err).Should(MatchError("regression"))
+
+		By("not replaying the commands")
+		fd, err = NewFileDest(PT+"/journal", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{}
+		pl, err = NewLog(fd, rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(Equal([]interface{}{&logEv1{S: "a"}, &logEv2{A: 5},
+			&logEv1{S: "other"}}))
+		pl.(*pLog).Close()
+	})
+
+	It("only writes the events without JournalCommands", func() {
+		fd, err := NewFileDest(PT+"/journal", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		handle(pl, "req-1", &depositCmd{Account: "a", Amount: 5})
+		pl.(*pLog).Close()
+		Ω(journal()).Should(BeEmpty())
+	})
+})
@@ -0,0 +1,119 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// JSONCodec returns a codec that writes each event as a line of JSON holding the name of
+// the event's type in the registry and its value, such that log files can be inspected
+// with standard tools and read by consumers that aren't written in Go, e.g.
+//
+//	{"type":"acme.Widget","seq":12,"event":{"X":1}}
+//
+// The seq, ns, and ann members hold the sequence number, namespace, and annotations of the
+// event, if any. The registry identifies the types of all the events, see TypeRegistry. The
+// values are encoded using encoding/json, hence only exported fields are written and fields
+// of interface type, such as the commands of JournalCommands, are replayed as generic JSON
+// values. The codec doesn't apply DecodeLimits.
+func JSONCodec(reg *TypeRegistry) Codec {
+	return jsonCodec{reg: reg}
+}
+
+type jsonCodec struct {
+	reg *TypeRegistry
+}
+
+// jsonRecord is a line written by the JSON codec
+type jsonRecord struct {
+	Type  string            `json:"type"`
+	Seq   *uint64           `json:"seq,omitempty"`
+	NS    string            `json:"ns,omitempty"`
+	Ann   map[string]string `json:"ann,omitempty"`
+	Event json.RawMessage   `json:"event"`
+}
+
+func (jc jsonCodec) NewEncoder(w io.Writer) Encoder {
+	return jsonEncoder{w: w, reg: jc.reg}
+}
+
+func (jc jsonCodec) NewDecoder(r io.Reader) Decoder {
+	return jsonDecoder{dec: json.NewDecoder(r), reg: jc.reg}
+}
+
+type jsonEncoder struct {
+	w   io.Writer
+	reg *TypeRegistry
+}
+
+func (je jsonEncoder) Encode(logEvent interface{}) error {
+	var rec jsonRecord
+	if se, ok := logEvent.(*SequencedEvent); ok {
+		seq := se.Seq
+		rec.Seq, logEvent = &seq, se.Event
+	}
+	if ne, ok := logEvent.(*NamespacedEvent); ok {
+		rec.NS, rec.Ann, logEvent = ne.NS, ne.Annotations, ne.Event
+	}
+	name, ok := je.reg.name(reflect.TypeOf(logEvent))
+	if !ok {
+		return fmt.Errorf("type %T is not in the log's type registry", logEvent)
+	}
+	rec.Type = name
+	var err error
+	if rec.Event, err = json.Marshal(logEvent); err != nil {
+		return err
+	}
+	line, err := json.Marshal(&rec)
+	if err != nil {
+		return err
+	}
+	// a single write keeps the record whole, see Codec
+	_, err = je.w.Write(append(line, '\n'))
+	return err
+}
+
+type jsonDecoder struct {
+	dec *json.Decoder
+	reg *TypeRegistry
+}
+
+func (jd jsonDecoder) Decode() (interface{}, error) {
+	var rec jsonRecord
+	if err := jd.dec.Decode(&rec); err != nil {
+		return nil, err
+	}
+	t, ok := jd.reg.lookup(rec.Type)
+	if !ok {
+		return nil, fmt.Errorf("type %q is not in the log's type registry", rec.Type)
+	}
+	var v reflect.Value
+	if t.Kind() == reflect.Ptr {
+		v = reflect.New(t.Elem())
+	} else {
+		v = reflect.New(t)
+	}
+	if err := json.Unmarshal(rec.Event, v.Interface()); err != nil {
+		return nil, fmt.Errorf("cannot decode %s event: %s", rec.Type, err.Error())
+	}
+	if t.Kind() != reflect.Ptr {
+		v = v.Elem()
+	}
+	ev := v.Interface()
+	if rec.NS != "" || rec.Ann != nil {
+		ev = &NamespacedEvent{NS: rec.NS, Event: ev, Annotations: rec.Ann}
+	}
+	if rec.Seq != nil {
+		return &SequencedEvent{Seq: *rec.Seq, Event: ev}, nil
+	}
+	return ev, nil
+}
+
+// frameDecoder returns a decoder of the events of a shard frame, see ParallelSnapshot
+func (jd jsonDecoder) frameDecoder(r io.Reader) Decoder {
+	return jsonDecoder{dec: json.NewDecoder(r), reg: jd.reg}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("JSONCodec", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	reg := NewTypeRegistry()
+	Ω(reg.Register("test.ev1", &logEv1{})).ShouldNot(HaveOccurred())
+	Ω(reg.Register("test.ev2", logEv2{})).ShouldNot(HaveOccurred())
+	codec := JSONCodec(reg)
+
+	It("writes log files as lines of JSON that replay", func() {
+		fd, err := NewFileDest(PT+"/json", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{events: []interface{}{&logEv1{S: "a"}}}
+		pl, err := NewLog(fd, rc, log15.Root(), WithCodec(codec), RecordSequenceNumbers())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(OutputNS(pl, "t1", logEv2{A: 1, B: "b"})).ShouldNot(HaveOccurred())
+		Ω(Annotate(pl, map[string]string{"subsystem": "billing"}, &logEv1{S: "c"})).
+			ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		files, err := LogFiles(PT + "/json")
+		Ω(err).ShouldNot(HaveOccurred())
+		data, err := os.ReadFile(files[0])
+		Ω(err).ShouldNot(HaveOccurred())
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		var types []string
+		for _, l := range lines {
+			var rec map[string]interface{}
+			Ω(json.Unmarshal([]byte(l), &rec)).ShouldNot(HaveOccurred())
+			types = append(types, rec["type"].(string))
+		}
+		Ω(types[0]).Should(Equal("persist.GenerationMeta"))
+		Ω(types).Should(ContainElement("test.ev2"))
+		Ω(lines[len(lines)-2]).Should(MatchJSON(
+			`{"type":"test.ev2","seq":1,"ns":"t1","event":{"A":1,"B":"b"}}`))
+		Ω(lines[len(lines)-1]).Should(MatchJSON(`{"type":"test.ev1","seq":2,` +
+			`"ann":{"subsystem":"billing"},"event":{"S":"c"}}`))
+
+		fd, err = NewFileDest(PT+"/json", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc = &recordingClient{}
+		pl, err = NewLog(fd, rc, log15.Root(), WithCodec(codec), RecordSequenceNumbers(),
+			ReplayAnnotations())
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+		Ω(rc.events).Should(Equal([]interface{}{&logEv1{S: "a"},
+			&NamespacedEvent{NS: "t1", Event: logEv2{A: 1, B: "b"}},
+			&NamespacedEvent{Event: &logEv1{S: "c"},
+				Annotations: map[string]string{"subsystem": "billing"}}}))
+	})
+
+	It("requires registered types", func() {
+		var buf bytes.Buffer
+		enc := codec.NewEncoder(&buf)
+		Ω(enc.Encode(&namedEv{})).Should(MatchError(ContainSubstring(
+			"is not in the log's type registry")))
+		buf.WriteString(`{"type":"test.gone","event":{}}` + "\n")
+		_, err := codec.NewDecoder(&buf).Decode()
+		Ω(err).Should(MatchError(`type "test.gone" is not in the log's type registry`))
+	})
+})
@@ -0,0 +1,63 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+// Package kvstate provides a generic persist.LogClient that maintains the state of a log
+// as a map from resource key to the latest event for the resource. It works with any
+// application whose events implement persist.KeyedEvent and where the latest event of a
+// resource describes the full resource, which makes it useful for tooling that needs the
+// state of a log without the application's own client, such as plog diff.
+package kvstate
+
+import (
+	"sort"
+
+	"github.com/rightscale/persist"
+)
+
+// Deletion is implemented by keyed events that may signal the deletion of their resource
+type Deletion interface {
+	IsDeletion() bool
+}
+
+// State is a LogClient holding the latest event for each resource
+type State struct {
+	Items   map[string]interface{} // latest event by resource key
+	Unkeyed int                    // number of replayed events without key, which are ignored
+}
+
+// New returns an empty state
+func New() *State {
+	return &State{Items: make(map[string]interface{})}
+}
+
+// Replay records an event as the latest for its resource, or removes the resource if the
+// event is a deletion
+func (s *State) Replay(ev interface{}) error {
+	ke, ok := ev.(persist.KeyedEvent)
+	if !ok {
+		s.Unkeyed++
+		return nil
+	}
+	if d, ok := ev.(Deletion); ok && d.IsDeletion() {
+		delete(s.Items, ke.EventKey())
+	} else {
+		s.Items[ke.EventKey()] = ev
+	}
+	return nil
+}
+
+// PersistAll outputs the latest event of each resource in key order
+func (s *State) PersistAll(pl persist.Log) {
+	for _, k := range s.Keys() {
+		pl.Output(s.Items[k])
+	}
+}
+
+// Keys returns the resource keys in sorted order
+func (s *State) Keys() []string {
+	keys := make([]string, 0, len(s.Items))
+	for k := range s.Items {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,15 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package kvstate
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestKVState(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "kvstate")
+}
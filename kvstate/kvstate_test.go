@@ -0,0 +1,63 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package kvstate
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rightscale/persist"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+type putEv struct {
+	K, V string
+}
+
+func (p *putEv) EventKey() string { return p.K }
+
+type delEv struct {
+	K string
+}
+
+func (d *delEv) EventKey() string { return d.K }
+func (d *delEv) IsDeletion() bool { return true }
+
+type otherEv struct{}
+
+func init() {
+	persist.Register(&putEv{})
+	persist.Register(&delEv{})
+	persist.Register(&otherEv{})
+}
+
+var _ = Describe("State", func() {
+
+	It("keeps the latest event of each resource", func() {
+		s := New()
+		Ω(s.Replay(&putEv{K: "a", V: "1"})).ShouldNot(HaveOccurred())
+		Ω(s.Replay(&putEv{K: "b", V: "1"})).ShouldNot(HaveOccurred())
+		Ω(s.Replay(&putEv{K: "a", V: "2"})).ShouldNot(HaveOccurred())
+		Ω(s.Replay(&delEv{K: "b"})).ShouldNot(HaveOccurred())
+		Ω(s.Replay(&otherEv{})).ShouldNot(HaveOccurred())
+		Ω(s.Items).Should(Equal(map[string]interface{}{"a": &putEv{K: "a", V: "2"}}))
+		Ω(s.Unkeyed).Should(Equal(1))
+	})
+
+	It("persists its state", func() {
+		var buf bytes.Buffer
+		s := New()
+		s.Replay(&putEv{K: "b", V: "1"})
+		s.Replay(&putEv{K: "a", V: "1"})
+		pl, err := persist.NewLog(persist.NewWriterDest(&buf, nil), s, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl).ShouldNot(BeNil())
+
+		s2 := New()
+		n, err := persist.ReplayFrom(&buf, nil, s2)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(n).Should(Equal(2))
+		Ω(s2.Items).Should(Equal(s.Items))
+	})
+})
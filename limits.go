@@ -0,0 +1,282 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// DecodeLimits bounds the resources the gob codec spends decoding a log stream such that a
+// tampered or corrupted log cannot cause unbounded memory allocation during replay. A zero
+// field means no limit.
+type DecodeLimits struct {
+	MaxRecordSize int // max size of a gob message, which holds an event or a type definition
+	MaxTypes      int // max number of type definitions in a stream
+	MaxDepth      int // max nesting depth of a decoded event, see below
+}
+
+// defaultDecodeLimits are the limits enforced by GobCodec, they are generous enough for
+// any sane log
+var defaultDecodeLimits = DecodeLimits{MaxRecordSize: 64 << 20, MaxTypes: 10000,
+	MaxDepth: 1000}
+
+// GobCodecWithLimits returns a gob codec that enforces the limits when decoding. The size
+// and types limits are checked on the gob framing as the stream is read, i.e., before gob
+// allocates anything for a message. The nesting depth counts pointers, interfaces, structs,
+// slices, arrays, and maps, and is checked once an event is decoded. The limits are not
+// checked when encoding.
+func GobCodecWithLimits(limits DecodeLimits) Codec {
+	return gobCodec{limits: limits}
+}
+
+// WithDecodeLimits sets the limits enforced when replaying a log using the gob codec, which
+// replace the limits of GobCodec. See GobCodecWithLimits. NewLog fails if the log uses
+// another codec, see WithCodec.
+func WithDecodeLimits(limits DecodeLimits) LogOption {
+	return func(pl *pLog) { pl.decodeLimits = &limits }
+}
+
+// limitError is produced when a stream exceeds a decoding limit, there is no point trying
+// to decode further
+type limitError struct{ msg string }
+
+func (le limitError) Error() string { return le.msg }
+
+func isLimitError(err error) bool {
+	_, ok := err.(limitError)
+	return ok
+}
+
+// framing states of the limitReader
+const (
+	inCount     = iota // byte count that starts a message
+	inTypeID           // type id that starts the message body
+	inDelta            // field delta of an interface value
+	inNameLen          // length of the name of the concrete type of an interface value
+	inName             // name of the concrete type of an interface value
+	inNextID           // type id following the name, negative for a type definition
+	inBody             // rest of the message body
+	inFastCount        // length of a fast record, see appendFast
+)
+
+// gobInterfaceID is the gob type id of interface values, which is how events are sent
+const gobInterfaceID = 8
+
+// limitReader follows the gob framing of the stream it passes on to the gob decoder and
+// fails before a message exceeding the limits gets to the decoder. Gob messages consist of
+// a byte count followed by the message body, which starts with a type id that is negative
+// for type definitions. Quirk: the first type definition needed by an interface value is
+// sent within the message carrying the interface value, right after the name of its
+// concrete type, which is why the reader looks into those. Type definitions of interface
+// values nested within events are not counted. Fast records, which start with a 0 byte
+// count, are limited like messages. The reader is an io.ByteReader so gob
+// doesn't read ahead of what it needs, which tools rely on to report offsets.
+type limitReader struct {
+	r      byteReader
+	limits DecodeLimits
+	state  int
+	uint   uint64 // unsigned integer being read
+	left   int    // bytes left to read in a multi-byte unsigned integer, 0 at its start
+	body   uint64 // bytes left in the message body
+	name   uint64 // bytes left in the concrete type name
+	types  int    // type definitions seen
+	err    error
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func newLimitReader(r io.Reader, limits DecodeLimits) *limitReader {
+	lr := &limitReader{limits: limits}
+	if br, ok := r.(byteReader); ok {
+		lr.r = br
+	} else {
+		lr.r = bufio.NewReader(r)
+	}
+	return lr
+}
+
+func (lr *limitReader) Read(p []byte) (int, error) {
+	if lr.err != nil {
+		return 0, lr.err
+	}
+	n, err := lr.r.Read(p)
+	for i := 0; i < n && lr.err == nil; i++ {
+		if lr.state == inBody && lr.body > 1 {
+			// skip as much of the body as we can, leaving the last byte to scan
+			skip := uint64(n - i)
+			if skip > lr.body-1 {
+				skip = lr.body - 1
+			}
+			lr.body -= skip
+			i += int(skip) - 1
+			continue
+		}
+		lr.scan(p[i])
+	}
+	if lr.err != nil {
+		return 0, lr.err // don't let the decoder see any of it
+	}
+	return n, err
+}
+
+func (lr *limitReader) ReadByte() (byte, error) {
+	if lr.err != nil {
+		return 0, lr.err
+	}
+	b, err := lr.r.ReadByte()
+	if err != nil {
+		return b, err
+	}
+	if lr.scan(b); lr.err != nil {
+		return 0, lr.err
+	}
+	return b, nil
+}
+
+// scan processes one byte of the stream
+func (lr *limitReader) scan(b byte) {
+	framing := lr.state == inCount || lr.state == inFastCount
+	if !framing {
+		lr.body--
+	}
+	switch lr.state {
+	case inBody:
+	case inName:
+		if lr.name--; lr.name == 0 {
+			lr.state = inNextID
+		}
+	default:
+		if lr.scanUint(b) {
+			lr.gotUint()
+		}
+	}
+	if !framing && lr.body == 0 {
+		lr.state = inCount
+		lr.left = 0
+	}
+}
+
+// scanUint processes one byte of an unsigned integer and returns true once it's complete,
+// gob unsigned integers are either a single byte < 128 or the negated number of bytes that
+// follow in big-endian order
+func (lr *limitReader) scanUint(b byte) bool {
+	switch {
+	case lr.left == 0 && b < 0x80:
+		lr.uint = uint64(b)
+		return true
+	case lr.left == 0:
+		lr.left = 256 - int(b)
+		lr.uint = 0
+		if lr.left > 8 {
+			lr.err = limitError{"corrupt gob stream: invalid integer"}
+		}
+		return false
+	default:
+		lr.uint = lr.uint<<8 | uint64(b)
+		lr.left--
+		return lr.left == 0
+	}
+}
+
+// gotUint processes a complete unsigned integer, type ids are signed integers, which gob
+// sends as unsigned integers with the sign in the low bit
+func (lr *limitReader) gotUint() {
+	switch lr.state {
+	case inCount, inFastCount:
+		max := lr.limits.MaxRecordSize
+		if max > 0 && lr.uint > uint64(max) {
+			lr.err = limitError{fmt.Sprintf(
+				"gob message of %d bytes exceeds the limit of %d bytes", lr.uint, max)}
+		} else if lr.uint == 0 && lr.state == inCount {
+			lr.state = inFastCount
+		} else if lr.uint == 0 {
+			lr.err = limitError{"corrupt gob stream: empty fast record"}
+		} else if lr.state == inFastCount {
+			lr.body = lr.uint
+			lr.state = inBody
+		} else {
+			lr.body = lr.uint
+			lr.state = inTypeID
+		}
+	case inTypeID:
+		lr.state = inBody
+		if lr.uint&1 == 1 {
+			lr.typeDef()
+		} else if lr.uint == 2*gobInterfaceID {
+			lr.state = inDelta
+		}
+	case inDelta:
+		lr.state = inNameLen
+	case inNameLen:
+		lr.state = inBody // a nil interface value has an empty name
+		if lr.uint > 0 {
+			lr.name = lr.uint
+			lr.state = inName
+		}
+	case inNextID:
+		lr.state = inBody
+		if lr.uint&1 == 1 {
+			lr.typeDef()
+		}
+	}
+}
+
+// typeDef counts a type definition
+func (lr *limitReader) typeDef() {
+	lr.types++
+	if max := lr.limits.MaxTypes; max > 0 && lr.types > max {
+		lr.err = limitError{fmt.Sprintf("stream has more than %d type definitions", max)}
+	}
+}
+
+// tooDeep returns true if v nests more than max levels deep
+func tooDeep(v reflect.Value, max int) bool {
+	if !v.IsValid() || !nests(v.Type()) {
+		return false
+	}
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		return false
+	}
+	if max == 0 {
+		return true
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return tooDeep(v.Elem(), max-1)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if tooDeep(v.Field(i), max-1) {
+				return true
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len() && nests(v.Type().Elem()); i++ {
+			if tooDeep(v.Index(i), max-1) {
+				return true
+			}
+		}
+	case reflect.Map:
+		for it := v.MapRange(); it.Next(); {
+			if tooDeep(it.Key(), max-1) || tooDeep(it.Value(), max-1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nests returns true for types whose values may contain more levels
+func nests(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Struct, reflect.Slice, reflect.Array,
+		reflect.Map:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// event type with an unbounded nesting depth
+type nestEv struct {
+	Next *nestEv
+}
+
+// event type whose struct field needs a type definition of its own
+type wrapEv struct {
+	L logEv2
+}
+
+func init() {
+	Register(&nestEv{})
+	Register(&wrapEv{})
+}
+
+func nested(depth int) *nestEv {
+	var ev *nestEv
+	for i := 0; i < depth; i++ {
+		ev = &nestEv{Next: ev}
+	}
+	return ev
+}
+
+var _ = Describe("DecodeLimits", func() {
+
+	encode := func(events ...interface{}) []byte {
+		var buf bytes.Buffer
+		enc := GobCodec.NewEncoder(&buf)
+		for _, ev := range events {
+			Ω(enc.Encode(ev)).ShouldNot(HaveOccurred())
+		}
+		return buf.Bytes()
+	}
+
+	decodeAll := func(codec Codec, data []byte) ([]interface{}, error) {
+		dec := codec.NewDecoder(bytes.NewReader(data))
+		var events []interface{}
+		for {
+			ev, err := dec.Decode()
+			if err == io.EOF {
+				return events, nil
+			} else if err != nil {
+				return events, err
+			}
+			events = append(events, ev)
+		}
+	}
+
+	It("limits the size of records", func() {
+		data := encode(&logEv1{S: "small"}, &logEv1{S: strings.Repeat("x", 2000)})
+		events, err := decodeAll(GobCodecWithLimits(DecodeLimits{MaxRecordSize: 1000}), data)
+		Ω(err).Should(MatchError(ContainSubstring("exceeds the limit of 1000 bytes")))
+		Ω(events).Should(Equal([]interface{}{&logEv1{S: "small"}}))
+
+		events, err = decodeAll(GobCodecWithLimits(DecodeLimits{}), data)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(events).Should(HaveLen(2))
+	})
+
+	It("rejects a forged record size before allocating", func() {
+		// a ~2GB byte count followed by garbage
+		data := []byte{0xfc, 0x7f, 0xff, 0xff, 0xff, 1, 2, 3}
+		_, err := decodeAll(GobCodec, data)
+		Ω(err).Should(MatchError(ContainSubstring("exceeds the limit of 67108864 bytes")))
+	})
+
+	It("rejects an invalid byte count", func() {
+		_, err := decodeAll(GobCodec, []byte{0xf0, 1, 2, 3})
+		Ω(err).Should(MatchError(ContainSubstring("invalid integer")))
+	})
+
+	It("limits the number of type definitions", func() {
+		data := encode(&logEv1{S: "a"}, &logEv2{A: 1}, &logEv1{S: "b"}, nested(1))
+		events, err := decodeAll(GobCodecWithLimits(DecodeLimits{MaxTypes: 2}), data)
+		Ω(err).Should(MatchError("stream has more than 2 type definitions"))
+		Ω(events).Should(HaveLen(3))
+
+		By("counting the type definitions sent in messages of their own")
+		data = encode(nested(1), &wrapEv{L: logEv2{A: 1}})
+		events, err = decodeAll(GobCodecWithLimits(DecodeLimits{MaxTypes: 2}), data)
+		Ω(err).Should(MatchError("stream has more than 2 type definitions"))
+		Ω(events).Should(HaveLen(1))
+		events, err = decodeAll(GobCodecWithLimits(DecodeLimits{MaxTypes: 3}), data)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(events).Should(HaveLen(2))
+	})
+
+	It("limits the nesting depth of events", func() {
+		data := encode(nested(5), nested(50), &logEv1{S: "after"})
+		dec := GobCodecWithLimits(DecodeLimits{MaxDepth: 20}).NewDecoder(
+			bytes.NewReader(data))
+		_, err := dec.Decode()
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = dec.Decode()
+		Ω(err).Should(MatchError("*persist.nestEv event nests more than 20 levels deep"))
+		ev, err := dec.Decode()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ev).Should(Equal(&logEv1{S: "after"}))
+		Ω(tooDeep(reflect.ValueOf(nil), 1)).Should(BeFalse())
+	})
+
+	It("applies to the replay of a log", func() {
+		data := encode(&logEv1{S: strings.Repeat("x", 2000)})
+		replay := func(opts ...LogOption) error {
+			rd := NewWriterDest(ioutil.Discard,
+				[]io.ReadCloser{ioutil.NopCloser(bytes.NewReader(data))})
+			_, err := NewLog(rd, &recordingClient{}, log15.Root(), opts...)
+			return err
+		}
+		Ω(replay()).ShouldNot(HaveOccurred())
+		Ω(replay(WithDecodeLimits(DecodeLimits{MaxRecordSize: 1000}))).Should(
+			MatchError(ContainSubstring("exceeds the limit of 1000 bytes")))
+	})
+})
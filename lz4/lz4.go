@@ -0,0 +1,203 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+// Package lz4 provides a persist.Compressor using LZ4 block compression, for use with
+// persist.CompressedCodec, e.g.
+//
+//	persist.WithCodec(persist.CompressedCodec(persist.GobCodec, lz4.Compressor{}))
+//
+// It's a self-contained implementation of the LZ4 block format that favors speed over
+// ratio, as the reference implementation's fast mode does. Compressing runs at several
+// hundred MB/s, i.e., a record of a few hundred bytes takes a few hundred nanoseconds, see
+// the benchmarks. Each compressed record is the uvarint length of the uncompressed data
+// followed by a standard LZ4 block.
+package lz4
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sync"
+)
+
+// Compressor compresses records using LZ4 block compression
+type Compressor struct{}
+
+// parameters of the LZ4 block format
+const (
+	minMatch  = 4     // shortest match
+	mfLimit   = 12    // no match starts within the last 12 bytes of a block
+	lastLits  = 5     // the last 5 bytes of a block are literals
+	maxOffset = 65535 // farthest match
+	hashLog   = 14    // size of the table of recent positions
+	minLog    = 6     // size of the table for the smallest blocks
+)
+
+// tables holds the tables of recent positions, a block only clears and uses as much of one
+// as its size calls for, see tableLog
+var tables = sync.Pool{New: func() interface{} { return new([1 << hashLog]int32) }}
+
+// tableLog returns the log of the size of the table of recent positions for a block of n
+// bytes, the smallest power of two that holds a position per byte within bounds
+func tableLog(n int) uint {
+	log := uint(bits.Len(uint(n - 1)))
+	if log < minLog {
+		return minLog
+	} else if log > hashLog {
+		return hashLog
+	}
+	return log
+}
+
+// errCorrupt is returned when decompressing data that isn't a valid compressed record
+var errCorrupt = errors.New("lz4: corrupt compressed data")
+
+// Name identifies the compression in the streams written by persist.CompressedCodec
+func (Compressor) Name() string { return "lz4" }
+
+// Compress appends the compressed src to dst, which may be nil, and returns it
+func (Compressor) Compress(dst, src []byte) []byte {
+	var hdr [binary.MaxVarintLen64]byte
+	dst = append(dst, hdr[:binary.PutUvarint(hdr[:], uint64(len(src)))]...)
+	return compressBlock(dst, src)
+}
+
+// Decompress returns the decompressed src, using dst if it's large enough
+func (Compressor) Decompress(dst, src []byte) ([]byte, error) {
+	n, k := binary.Uvarint(src)
+	// each byte of a block yields at most 255 bytes of data
+	if k <= 0 || n > uint64(len(src)-k)*255+lastLits {
+		return nil, errCorrupt
+	}
+	if uint64(cap(dst)) < n {
+		dst = make([]byte, 0, n)
+	}
+	return decompressBlock(dst[:0], src[k:], int(n))
+}
+
+// compressBlock appends the LZ4 block of src to dst, it finds matches using a table of the
+// last position at which each hash of 4 bytes was seen and extends them greedily
+func compressBlock(dst, src []byte) []byte {
+	anchor := 0 // start of the literals not yet written
+	if len(src) > mfLimit {
+		log := tableLog(len(src))
+		pooled := tables.Get().(*[1 << hashLog]int32)
+		defer tables.Put(pooled)
+		table := pooled[:1<<log] // positions + 1, 0 for none
+		for i := range table {
+			table[i] = 0
+		}
+		for i, limit := 0, len(src)-mfLimit; i < limit; {
+			seq := binary.LittleEndian.Uint32(src[i:])
+			h := (seq * 2654435761) >> (32 - log)
+			ref := int(table[h]) - 1
+			table[h] = int32(i + 1)
+			if ref < 0 || i-ref > maxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+				i++
+				continue
+			}
+			end := i + minMatch
+			for end < len(src)-lastLits && src[end] == src[ref+end-i] {
+				end++
+			}
+			dst = appendSequence(dst, src[anchor:i], i-ref, end-i)
+			i, anchor = end, end
+		}
+	}
+	// the last sequence only has literals
+	lits := src[anchor:]
+	dst = append(dst, lengthToken(len(lits))<<4)
+	dst = appendLength(dst, len(lits))
+	return append(dst, lits...)
+}
+
+// appendSequence appends a sequence of literals followed by a match
+func appendSequence(dst, lits []byte, offset, length int) []byte {
+	dst = append(dst, lengthToken(len(lits))<<4|lengthToken(length-minMatch))
+	dst = appendLength(dst, len(lits))
+	dst = append(dst, lits...)
+	dst = append(dst, byte(offset), byte(offset>>8))
+	return appendLength(dst, length-minMatch)
+}
+
+// lengthToken returns the 4 bits of a length held by the token of a sequence
+func lengthToken(n int) byte {
+	if n < 15 {
+		return byte(n)
+	}
+	return 15
+}
+
+// appendLength appends the bytes that follow the token for a length of 15 or more
+func appendLength(dst []byte, n int) []byte {
+	if n < 15 {
+		return dst
+	}
+	for n -= 15; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+// decompressBlock appends the n bytes of data held by the LZ4 block src to dst, whose
+// capacity must allow for them
+func decompressBlock(dst, src []byte, n int) ([]byte, error) {
+	i, lits, length, ok := 0, 0, 0, false
+	for {
+		if i >= len(src) {
+			return nil, errCorrupt
+		}
+		token := src[i]
+		i++
+		lits, i, ok = readLength(src, i, int(token>>4))
+		if !ok || lits > len(src)-i || lits > n-len(dst) {
+			return nil, errCorrupt
+		}
+		dst = append(dst, src[i:i+lits]...)
+		i += lits
+		if i == len(src) {
+			break // the last sequence has no match
+		}
+		if i+2 > len(src) {
+			return nil, errCorrupt
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		length, i, ok = readLength(src, i, int(token&15))
+		length += minMatch
+		if !ok || offset == 0 || offset > len(dst) || length > n-len(dst) {
+			return nil, errCorrupt
+		}
+		start := len(dst) - offset
+		if offset >= length {
+			dst = append(dst, dst[start:start+length]...)
+		} else {
+			// the match overlaps the bytes it produces, e.g. a run of the same byte
+			for j := 0; j < length; j++ {
+				dst = append(dst, dst[start+j])
+			}
+		}
+	}
+	if len(dst) != n {
+		return nil, errCorrupt
+	}
+	return dst, nil
+}
+
+// readLength reads the bytes that follow the token for a length whose 4 bits in the token
+// are n, it returns the length and the index of the byte that follows
+func readLength(src []byte, i, n int) (int, int, bool) {
+	if n < 15 {
+		return n, i, true
+	}
+	for {
+		if i >= len(src) {
+			return 0, i, false
+		}
+		b := src[i]
+		i++
+		n += int(b)
+		if b != 255 {
+			return n, i, true
+		}
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package lz4
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// benchRecord returns a record of about n bytes that compresses like a log event
+func benchRecord(n int) []byte {
+	var sb strings.Builder
+	for i := 0; sb.Len() < n; i++ {
+		fmt.Fprintf(&sb, "resource %d state running owner ops-%d ", i, i%7)
+	}
+	return []byte(sb.String()[:n])
+}
+
+// benchCompress compresses a record of n bytes into a reused buffer
+func benchCompress(b *testing.B, n int) {
+	src := benchRecord(n)
+	var dst []byte
+	b.SetBytes(int64(n))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dst = Compressor{}.Compress(dst[:0], src)
+	}
+}
+
+// benchCopy copies a record of n bytes into a reused buffer, what compressing is measured
+// against
+func benchCopy(b *testing.B, n int) {
+	src := benchRecord(n)
+	var dst []byte
+	b.SetBytes(int64(n))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dst = append(dst[:0], src...)
+	}
+}
+
+func BenchmarkCompress200(b *testing.B) { benchCompress(b, 200) }
+func BenchmarkCompress4K(b *testing.B)  { benchCompress(b, 4<<10) }
+func BenchmarkCompress64K(b *testing.B) { benchCompress(b, 64<<10) }
+
+func BenchmarkCopy200(b *testing.B) { benchCopy(b, 200) }
+func BenchmarkCopy4K(b *testing.B)  { benchCopy(b, 4<<10) }
+func BenchmarkCopy64K(b *testing.B) { benchCopy(b, 64<<10) }
@@ -0,0 +1,15 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package lz4
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestLZ4(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "lz4")
+}
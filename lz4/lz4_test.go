@@ -0,0 +1,106 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package lz4
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rightscale/persist"
+)
+
+type lz4Ev struct {
+	S string
+	N int
+}
+
+func init() {
+	persist.Register(&lz4Ev{})
+}
+
+// recordingClient keeps the replayed events
+type recordingClient struct {
+	events []interface{}
+}
+
+func (rc *recordingClient) Replay(ev interface{}) error {
+	rc.events = append(rc.events, ev)
+	return nil
+}
+
+func (rc *recordingClient) PersistAll(pl persist.Log) {}
+
+var _ = Describe("Compressor", func() {
+
+	c := Compressor{}
+
+	roundTrip := func(data []byte) []byte {
+		comp := c.Compress(nil, data)
+		out, err := c.Decompress(nil, comp)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(out).Should(Equal(data[:len(data):len(data)]))
+		return comp
+	}
+
+	It("round-trips data of all shapes", func() {
+		rnd := rand.New(rand.NewSource(1))
+		random := make([]byte, 100000)
+		rnd.Read(random)
+		inputs := [][]byte{{}, []byte("a"), []byte("short record"),
+			bytes.Repeat([]byte{'x'}, 13), bytes.Repeat([]byte{'x'}, 100000), random,
+			[]byte(strings.Repeat("a rather compressible record, ", 1000))}
+		// literal and match lengths around the 15 and 270 boundaries of the format
+		for _, n := range []int{14, 15, 16, 269, 270, 271, 524, 525} {
+			data := append(append([]byte{}, random[:n]...), bytes.Repeat([]byte("ab"), n)...)
+			inputs = append(inputs, append(data, random[n:n+20]...))
+		}
+		for _, data := range inputs {
+			roundTrip(data)
+		}
+	})
+
+	It("compresses repetitive data", func() {
+		data := []byte(strings.Repeat("a rather compressible record, ", 1000))
+		Ω(len(roundTrip(data))).Should(BeNumerically("<", len(data)/20))
+	})
+
+	It("decompresses into the buffer it's given", func() {
+		data := []byte(strings.Repeat("buffer ", 100))
+		buf := make([]byte, 1000)
+		out, err := c.Decompress(buf, c.Compress(nil, data))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(out).Should(Equal(data))
+		Ω(&out[0]).Should(Equal(&buf[0]))
+	})
+
+	It("rejects corrupt data", func() {
+		comp := c.Compress(nil, []byte(strings.Repeat("corrupt me ", 100)))
+		for _, bad := range [][]byte{nil, {0x80}, comp[:len(comp)-1],
+			append([]byte{0xff, 0xff, 0xff, 0xff, 0x0f}, comp[2:]...),
+			append(append([]byte{}, comp...), 0)} {
+			_, err := c.Decompress(nil, bad)
+			Ω(err).Should(HaveOccurred())
+		}
+	})
+
+	It("compresses the records of a persist log", func() {
+		codec := persist.CompressedCodec(persist.GobCodec, c)
+		var buf bytes.Buffer
+		enc := codec.NewEncoder(&buf)
+		var events []interface{}
+		for i := 0; i < 10; i++ {
+			ev := &lz4Ev{S: strings.Repeat("resource ", 20+i), N: i}
+			events = append(events, ev)
+			Ω(enc.Encode(ev)).ShouldNot(HaveOccurred())
+		}
+		Ω(buf.String()).ShouldNot(ContainSubstring("resource resource"))
+		rc := &recordingClient{}
+		n, err := persist.ReplayFrom(&buf, codec, rc)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(n).Should(Equal(10))
+		Ω(rc.events).Should(Equal(events))
+	})
+})
@@ -0,0 +1,145 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// manifestExt is appended to the basepath to name the type manifest, see WithTypeManifest
+const manifestExt = "-types.json"
+
+// registered holds the types registered using Register and RegisterNamed under the names
+// gob knows them by, since gob's registry cannot be listed
+var registered = &TypeRegistry{byName: map[string]reflect.Type{},
+	byType: map[reflect.Type]string{}}
+
+// gobName returns the name under which gob.Register registers the type of value
+func gobName(value interface{}) string {
+	t := reflect.TypeOf(value)
+	if t.Name() == "" {
+		return t.String() // e.g. *pkg.Event, which is how gob names pointer types
+	} else if t.PkgPath() == "" {
+		return t.Name()
+	}
+	return t.PkgPath() + "." + t.Name()
+}
+
+// ManifestEntry describes an event type in a type manifest, see WriteTypeManifest
+type ManifestEntry struct {
+	Name        string `json:"name"`        // name identifying the type in log files
+	GoType      string `json:"go_type"`     // Go type, e.g. *main.Widget
+	Schema      string `json:"schema"`      // fields that are encoded, see schemaOf
+	Fingerprint string `json:"fingerprint"` // hash of the schema
+}
+
+// WriteTypeManifest writes the manifest of the event types registered using Register and
+// RegisterNamed to w, as one JSON ManifestEntry per line in the order of their names, such
+// that offline tools that don't embed the types can identify the events of a log, using
+// the names, and partially parse them, using the schemas, which list the exported fields,
+// which are those encoded, and their types. The fingerprint of a schema changes whenever
+// the schema does. See WithTypeManifest to store the manifest alongside the log files.
+func WriteTypeManifest(w io.Writer) error {
+	return registered.WriteManifest(w)
+}
+
+// WriteManifest writes the manifest of the types in the registry to w, see
+// WriteTypeManifest
+func (tr *TypeRegistry) WriteManifest(w io.Writer) error {
+	tr.mu.RLock()
+	types := make(map[string]reflect.Type, len(tr.byName))
+	names := make([]string, 0, len(tr.byName))
+	for n, t := range tr.byName {
+		types[n] = t
+		names = append(names, n)
+	}
+	tr.mu.RUnlock()
+	sort.Strings(names)
+
+	enc := json.NewEncoder(w)
+	for _, n := range names {
+		t := types[n]
+		schema := schemaOf(t, map[reflect.Type]bool{})
+		sum := sha256.Sum256([]byte(schema))
+		e := ManifestEntry{Name: n, GoType: t.String(), Schema: schema,
+			Fingerprint: hex.EncodeToString(sum[:8])}
+		if err := enc.Encode(&e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaOf describes the structure of a type as gob encodes it, i.e. with the exported
+// fields of structs, named types are expanded once and referred to by name within
+// themselves
+func schemaOf(t reflect.Type, seen map[reflect.Type]bool) string {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return "*" + schemaOf(t.Elem(), seen)
+	case reflect.Slice:
+		return "[]" + schemaOf(t.Elem(), seen)
+	case reflect.Array:
+		return fmt.Sprintf("[%d]%s", t.Len(), schemaOf(t.Elem(), seen))
+	case reflect.Map:
+		return "map[" + schemaOf(t.Key(), seen) + "]" + schemaOf(t.Elem(), seen)
+	case reflect.Struct:
+		if t.Name() != "" && seen[t] {
+			return t.String()
+		}
+		seen[t] = true
+		var fields []string
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.PkgPath == "" { // exported
+				fields = append(fields, f.Name+" "+schemaOf(f.Type, seen))
+			}
+		}
+		return "struct{" + strings.Join(fields, "; ") + "}"
+	}
+	return t.Kind().String()
+}
+
+// WithTypeManifest makes a file destination store the type manifest of reg, or of the types
+// registered using Register and RegisterNamed if reg is nil, in the <basepath>-types.json
+// file whenever it starts a log file, see WriteTypeManifest. MoveLogSet moves the manifest
+// along with the log files.
+func WithTypeManifest(reg *TypeRegistry) FileDestOption {
+	return func(fd *fileDest) {
+		if reg == nil {
+			reg = registered
+		}
+		fd.manifest = reg
+	}
+}
+
+// writeManifest replaces the type manifest of the log set, see WithTypeManifest
+func (fd *fileDest) writeManifest() error {
+	if fd.manifest == nil {
+		return nil
+	}
+	tmp := fd.basepath + manifestExt + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("cannot write type manifest: %s", err.Error())
+	}
+	err = fd.manifest.WriteManifest(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, fd.basepath+manifestExt)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot write type manifest: %s", err.Error())
+	}
+	return nil
+}
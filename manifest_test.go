@@ -0,0 +1,96 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// readManifest returns the entries of a type manifest by name
+func readManifest(data []byte) map[string]ManifestEntry {
+	entries := make(map[string]ManifestEntry)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		var e ManifestEntry
+		Ω(json.Unmarshal(sc.Bytes(), &e)).ShouldNot(HaveOccurred())
+		entries[e.Name] = e
+	}
+	return entries
+}
+
+type treeEv struct {
+	Name     string
+	Children []*treeEv
+	weight   int
+}
+
+var _ = Describe("Type manifest", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	It("lists the registered types with their schemas", func() {
+		var buf bytes.Buffer
+		Ω(WriteTypeManifest(&buf)).ShouldNot(HaveOccurred())
+		entries := readManifest(buf.Bytes())
+		Ω(entries).Should(HaveKey("acme.Widget"))
+		Ω(entries["acme.Widget"].GoType).Should(Equal("*persist.namedEv"))
+		Ω(entries["acme.Widget"].Schema).Should(Equal("*struct{X int}"))
+		Ω(entries).Should(HaveKey("*persist.logEv2"))
+		Ω(entries["*persist.logEv2"].Schema).Should(Equal("*struct{A int; B string}"))
+		Ω(entries["*persist.logEv2"].Fingerprint).Should(HaveLen(16))
+		Ω(entries["*persist.logEv2"].Fingerprint).ShouldNot(
+			Equal(entries["acme.Widget"].Fingerprint))
+
+		By("writing the manifest of a registry")
+		reg := NewTypeRegistry()
+		Ω(reg.Register("tree", &treeEv{})).ShouldNot(HaveOccurred())
+		buf.Reset()
+		Ω(reg.WriteManifest(&buf)).ShouldNot(HaveOccurred())
+		entries = readManifest(buf.Bytes())
+		Ω(entries).Should(HaveKey("persist.GenerationMeta"))
+		Ω(entries).ShouldNot(HaveKey("acme.Widget"))
+		Ω(entries["tree"].Schema).Should(Equal(
+			"*struct{Name string; Children []*persist.treeEv}"))
+	})
+
+	It("stores the manifest alongside the log files and moves it", func() {
+		reg := NewTypeRegistry()
+		Ω(reg.Register("tree", &treeEv{})).ShouldNot(HaveOccurred())
+		fd, err := NewFileDest(PT+"/man", true, nil, WithTypeManifest(reg))
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{events: []interface{}{&treeEv{Name: "r"}}},
+			log15.Root(), WithTypeRegistry(reg))
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+		data, err := os.ReadFile(PT + "/man" + manifestExt)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(readManifest(data)).Should(HaveKey("tree"))
+
+		Ω(MoveLogSet(PT+"/man", PT+"/moved")).ShouldNot(HaveOccurred())
+		_, err = os.Stat(PT + "/moved" + manifestExt)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = os.Stat(PT + "/man" + manifestExt)
+		Ω(os.IsNotExist(err)).Should(BeTrue())
+
+		By("writing the global registrations by default")
+		fd, err = NewFileDest(PT+"/global", true, nil, WithTypeManifest(nil))
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err = NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+		data, err = os.ReadFile(PT + "/global" + manifestExt)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(readManifest(data)).Should(HaveKey("acme.Widget"))
+	})
+})
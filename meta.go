@@ -0,0 +1,238 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// FormatVersion is the latest version of the log format this version of persist reads and
+// writes, the version of each generation is recorded in its metadata record. Versions are
+// incremented by changes that older versions of persist cannot read correctly, which then
+// refuse to open such logs. Each generation records the lowest version describing its
+// content so older versions of persist can read it whenever possible.
+const FormatVersion = 14
+
+// log format versions, each one may use the features of the previous ones
+const (
+	formatGob            = 1  // gob events preceded by a metadata record
+	formatInternalEvents = 2  // adds InternalEvent records, see RecordInternalEvents
+	formatSequenced      = 3  // adds SequencedEvent records, see RecordSequenceNumbers
+	formatDelta          = 4  // adds delta snapshots, see WithDeltaSnapshots
+	formatRegistry       = 5  // adds streams of registry headers, see WithTypeRegistry
+	formatTxn            = 6  // adds TxnBegin and TxnCommit records, see Txn
+	formatShards         = 7  // adds ShardFrame records, see ParallelSnapshot
+	formatBlobs          = 8  // adds BlobStart, BlobChunk and BlobEnd records, see PersistBlob
+	formatNamespaces     = 9  // adds NamespacedEvent records, see OutputNS and Annotate
+	formatErase          = 10 // adds Tombstone records, see Erase
+	formatVoided         = 11 // adds the voided records of the events dropped by OutputCtx
+	formatJournal        = 12 // adds CommandRecord records, see JournalCommands
+	formatHandoff        = 13 // adds HandoffMark records, see Handoff
+	formatFast           = 14 // adds fast records, see FastEvent
+)
+
+// GenerationMeta is a metadata record persist writes at the start of each log generation,
+// i.e., at the start of each stream, in order to help with forensic analysis of old log
+// files. It is not passed to the client on replay.
+type GenerationMeta struct {
+	Gen      uint64            // generation number, incremented by each rotation
+	Format   int               // log format version, 0 for logs that predate versioning
+	Seq      uint64            // sequence number of the first event, see RecordSequenceNumbers
+	App      string            // application name, defaults to the executable's name
+	Version  string            // application binary version
+	Hostname string            // host on which the generation was written
+	Start    time.Time         // time at which the generation was started
+	Extra    map[string]string // application-defined fields
+	Epoch    uint64            // latest epoch of the log's coordinated rotations, see Coordinator
+	Cut      bool              // the generation was started by the rotation of Epoch
+
+	Sequenced bool // the events are numbered, implied by format version 3
+}
+
+// sequenced returns true if the events of the generation are numbered, see
+// RecordSequenceNumbers
+func (m *GenerationMeta) sequenced() bool {
+	return m.Format == formatSequenced || m.Format > formatSequenced && m.Sequenced
+}
+
+func init() {
+	Register(&GenerationMeta{})
+}
+
+// WithMeta sets the application name, version, and application-defined fields recorded
+// in the metadata record at the start of each log generation. An empty app leaves the
+// default, which is the name of the executable.
+func WithMeta(app, version string, extra map[string]string) LogOption {
+	return func(pl *pLog) {
+		if app != "" {
+			pl.meta.App = app
+		}
+		pl.meta.Version = version
+		pl.meta.Extra = extra
+	}
+}
+
+// WithHostname sets the hostname recorded in the metadata record, which defaults to the
+// name of the host, e.g., to produce reproducible log files in tests
+func WithHostname(hostname string) LogOption {
+	return func(pl *pLog) { pl.meta.Hostname = hostname }
+}
+
+// WithClock sets the function persist uses to get the current time for the data it records,
+// such as the start time of generations, which defaults to time.Now
+func WithClock(now func() time.Time) LogOption {
+	return func(pl *pLog) { pl.now = now }
+}
+
+// OnRotate sets a function called each time a generation is complete, i.e., once the
+// snapshot at its start has been written, including the initial snapshot made by NewLog.
+// It receives the generation number and allows the application to tag external artifacts
+// with the generation they correspond to. It is called without holding any lock.
+func OnRotate(hook func(gen uint64)) LogOption {
+	return func(pl *pLog) { pl.onRotate = hook }
+}
+
+// ForceDowngrade allows NewLog to open a log written in a newer format than FormatVersion,
+// which it otherwise refuses to do so as not to corrupt the log by appending to it in an
+// older format. This is meant for operators rolling back a deployment: the events are
+// replayed on a best-effort basis and the snapshot that follows rewrites the log in the
+// current format, dropping anything this version of persist does not understand. Use
+// ForceDowngradeFiles as well when opening the log with NewFileDest.
+func ForceDowngrade() LogOption {
+	return func(pl *pLog) { pl.downgrade = true }
+}
+
+// checkFormat returns an error if a generation was written in a format newer than
+// FormatVersion, unless the downgrade is forced
+func checkFormat(m *GenerationMeta, force bool, log log15.Logger) error {
+	if m.Format <= FormatVersion {
+		return nil
+	}
+	if force {
+		log.Warn("Forcing downgrade of log written in a newer format", "gen", m.Gen,
+			"format", m.Format, "supported", FormatVersion)
+		return nil
+	}
+	return fmt.Errorf("log generation %d was written in format version %d, which requires "+
+		"a newer version of persist (this one supports up to version %d), use "+
+		"ForceDowngrade to open it anyway", m.Gen, m.Format, FormatVersion)
+}
+
+// defaultMeta returns the metadata recorded if the application doesn't provide any
+func defaultMeta() GenerationMeta {
+	host, _ := os.Hostname()
+	return GenerationMeta{App: filepath.Base(os.Args[0]), Hostname: host}
+}
+
+// writeMeta writes the metadata record at the start of a fresh stream
+func (pl *pLog) writeMeta(enc Encoder) error {
+	m := pl.meta
+	m.Gen = pl.gen
+	m.Format = pl.streamFormat()
+	if pl.sequence {
+		m.Seq = pl.seq
+		m.Sequenced = true
+	}
+	m.Start = pl.now().UTC()
+	m.Epoch, m.Cut = pl.epoch, pl.cut
+	pl.format = m.Format
+	return enc.Encode(&m)
+}
+
+// streamFormat returns the format version of a fresh stream: the highest version of the
+// features the log is configured with and of those it has used so far, see useFormat
+func (pl *pLog) streamFormat() int {
+	f := formatGob
+	if pl.internal {
+		f = formatInternalEvents
+	}
+	if pl.sequence {
+		f = formatSequenced
+	}
+	if pl.deltaMax > 0 {
+		f = formatDelta
+	}
+	if gc, ok := pl.codec.(gobCodec); ok && gc.reg != nil {
+		f = formatRegistry
+	}
+	if pl.usedFormat > f {
+		f = pl.usedFormat
+	}
+	return f
+}
+
+// useFormat must be called before writing records of a feature that requires format
+// version f. If the current generation recorded an older version its metadata is restated
+// with version f, such that older versions of persist refuse the rest of the stream, and
+// the generations that follow record version f from their start. Must be called while
+// holding the pl.Lock()
+func (pl *pLog) useFormat(f int) error {
+	if f > pl.usedFormat {
+		pl.usedFormat = f
+	}
+	if f <= pl.format {
+		return nil
+	}
+	if err := pl.writeMeta(pl.encoder); err != nil {
+		return pl.fail("encode", err)
+	}
+	if pl.secEnc != nil && pl.secSynced {
+		if err := pl.writeMeta(pl.secEnc); err != nil {
+			pl.secondaryError("Write", err)
+		}
+	}
+	return nil
+}
+
+// eventFormat returns the format version required by the records of a log event, see
+// useFormat
+func eventFormat(logEvent interface{}) int {
+	switch e := logEvent.(type) {
+	case *NamespacedEvent:
+		if f := eventFormat(e.Event); f > formatNamespaces {
+			return f
+		}
+		return formatNamespaces
+	case *Tombstone:
+		return formatErase
+	case *CommandRecord:
+		return formatJournal
+	case FastEvent:
+		return formatFast
+	}
+	return formatGob
+}
+
+// ReplayMeta reads the metadata record at the start of a log stream, such as a log file,
+// using the codec, which defaults to GobCodec if nil. It returns nil if the stream has no
+// metadata record, e.g., because it was written by an older version of persist.
+func ReplayMeta(r io.Reader, codec Codec) (*GenerationMeta, error) {
+	if codec == nil {
+		codec = GobCodec
+	}
+	ev, err := codec.NewDecoder(r).Decode()
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	m, _ := ev.(*GenerationMeta)
+	return m, nil
+}
+
+// isInternal returns true if a decoded event is a record persist writes for itself, i.e.,
+// a metadata record, an internal event, a journaled command, or a delta snapshot record
+func isInternal(ev interface{}) bool {
+	switch ev.(type) {
+	case *GenerationMeta, *InternalEvent, *CommandRecord, *DeltaSnapshot, *SnapshotEnd,
+		*deltaRemoval, *BlobStart, *BlobChunk, *BlobEnd:
+		return true
+	}
+	return false
+}
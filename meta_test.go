@@ -0,0 +1,280 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("GenerationMeta", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+
+	It("records metadata at the start of each generation", func() {
+		fd, err := NewFileDest(PT+"/meta", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &testLogClient{}, log15.Root(),
+			WithMeta("myapp", "1.2.3", map[string]string{"region": "us-east"}))
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		files, err := filepath.Glob(PT + "/meta-*" + currExt)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files).Should(HaveLen(1))
+		f, err := os.Open(files[0])
+		Ω(err).ShouldNot(HaveOccurred())
+		defer f.Close()
+		m, err := ReplayMeta(f, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(m).ShouldNot(BeNil())
+		Ω(m.App).Should(Equal("myapp"))
+		Ω(m.Format).Should(Equal(1))
+		Ω(m.Version).Should(Equal("1.2.3"))
+		Ω(m.Extra).Should(Equal(map[string]string{"region": "us-east"}))
+		host, _ := os.Hostname()
+		Ω(m.Hostname).Should(Equal(host))
+		Ω(m.Start.IsZero()).Should(BeFalse())
+
+		By("not passing the metadata to the client")
+		fd, err = NewFileDest(PT+"/meta", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		lc := &testLogClient{i: 1}
+		pl, err = NewLog(fd, lc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(lc.n).Should(Equal(3))
+		pl.(*pLog).Close()
+	})
+
+	It("returns nil for streams without metadata", func() {
+		var buf bytes.Buffer
+		Ω(GobCodec.NewEncoder(&buf).Encode(&logEv1{S: "old"})).ShouldNot(HaveOccurred())
+		m, err := ReplayMeta(&buf, GobCodec)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(m).Should(BeNil())
+
+		m, err = ReplayMeta(&bytes.Buffer{}, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(m).Should(BeNil())
+	})
+
+	It("numbers generations", func() {
+		var gens []uint64
+		var mu sync.Mutex
+		hook := OnRotate(func(gen uint64) {
+			mu.Lock()
+			gens = append(gens, gen)
+			mu.Unlock()
+		})
+		fd, err := NewFileDest(PT+"/gen", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &testLogClient{}, log15.Root(), hook)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()["Generation"]).Should(Equal(1.0))
+		pl.SetSizeLimit(10)
+		Ω(pl.Output(&logEv1{S: "rotate"})).ShouldNot(HaveOccurred())
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(2.0))
+		pl.(*pLog).Close()
+
+		By("reopening the log")
+		fd, err = NewFileDest(PT+"/gen", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err = NewLog(fd, &testLogClient{i: 1}, log15.Root(), hook)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()["Generation"]).Should(Equal(3.0))
+		pl.(*pLog).Close()
+		mu.Lock()
+		Ω(gens).Should(Equal([]uint64{1, 2, 3}))
+		mu.Unlock()
+
+		files, err := ReplayFiles(PT + "/gen")
+		Ω(err).ShouldNot(HaveOccurred())
+		f, err := os.Open(files[len(files)-1])
+		Ω(err).ShouldNot(HaveOccurred())
+		defer f.Close()
+		m, err := ReplayMeta(f, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(m.Gen).Should(Equal(uint64(3)))
+	})
+
+	It("refuses to open a log written in a newer format", func() {
+		name := PT + "/future-20150101-000000" + currExt
+		f, err := os.Create(name)
+		Ω(err).ShouldNot(HaveOccurred())
+		enc := GobCodec.NewEncoder(f)
+		Ω(enc.Encode(&GenerationMeta{Gen: 7, Format: FormatVersion + 1})).ShouldNot(HaveOccurred())
+		Ω(enc.Encode(&logEv1{S: "from the future"})).ShouldNot(HaveOccurred())
+		f.Close()
+
+		By("opening the files")
+		_, err = NewFileDest(PT+"/future", false, nil)
+		Ω(err).Should(MatchError(ContainSubstring(
+			fmt.Sprintf("format version %d", FormatVersion+1))))
+		Ω(err).Should(MatchError(ContainSubstring(
+			fmt.Sprintf("supports up to version %d", FormatVersion))))
+		files, _ := LogFiles(PT + "/future")
+		Ω(files).Should(Equal([]string{name}))
+
+		By("replaying the log")
+		fd, err := NewFileDest(PT+"/future", false, nil, ForceDowngradeFiles())
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).Should(MatchError(ContainSubstring(
+			fmt.Sprintf("format version %d", FormatVersion+1))))
+		fd.Close()
+
+		By("forcing the downgrade")
+		fd, err = NewFileDest(PT+"/future", false, nil, ForceDowngradeFiles())
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{}
+		pl, err := NewLog(fd, rc, log15.Root(), ForceDowngrade())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(Equal([]interface{}{&logEv1{S: "from the future"}}))
+		pl.(*pLog).Close()
+		fd, err = NewFileDest(PT+"/future", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		fd.Close()
+	})
+
+	// formats returns the format versions of the metadata records of the current log file
+	formats := func(basepath string) []int {
+		files, err := ReplayFiles(basepath)
+		Ω(err).ShouldNot(HaveOccurred())
+		f, err := os.Open(files[len(files)-1])
+		Ω(err).ShouldNot(HaveOccurred())
+		defer f.Close()
+		var res []int
+		dec := GobCodec.NewDecoder(f)
+		for {
+			ev, err := dec.Decode()
+			if err == io.EOF {
+				return res
+			}
+			Ω(err).ShouldNot(HaveOccurred())
+			if m, ok := ev.(*GenerationMeta); ok {
+				res = append(res, m.Format)
+			}
+		}
+	}
+
+	It("records the format version of the features a generation uses", func() {
+		fd, err := NewFileDest(PT+"/formats", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{events: []interface{}{&logEv1{S: "a"}}}
+		pl, err := NewLog(fd, rc, log15.Root(), RecordSequenceNumbers(),
+			WithDeltaSnapshots(2))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "b"})).ShouldNot(HaveOccurred())
+		Ω(formats(PT + "/formats")).Should(Equal([]int{formatDelta}))
+
+		By("restating the generation when a feature of a newer format is used")
+		Ω(Txn(pl, func(w TxnWriter) error {
+			w.Output(&logEv1{S: "c"})
+			return w.Output(&logEv1{S: "d"})
+		})).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "e"})).ShouldNot(HaveOccurred())
+		Ω(formats(PT + "/formats")).Should(Equal([]int{formatDelta, formatTxn}))
+		pl.(*pLog).Close()
+
+		By("replaying the restated generation")
+		fd, err = NewFileDest(PT+"/formats", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc = &recordingClient{}
+		pl, err = NewLog(fd, rc, log15.Root(), RecordSequenceNumbers())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(Equal([]interface{}{&logEv1{S: "a"}, &logEv1{S: "b"},
+			&logEv1{S: "c"}, &logEv1{S: "d"}, &logEv1{S: "e"}}))
+
+		By("recording the newer format from the start of the next generation")
+		Ω(Txn(pl, func(w TxnWriter) error {
+			w.Output(&logEv1{S: "f"})
+			return w.Output(&logEv1{S: "g"})
+		})).ShouldNot(HaveOccurred())
+		Ω(formats(PT + "/formats")).Should(Equal([]int{formatSequenced, formatTxn}))
+		pl.(*pLog).Lock()
+		pl.(*pLog).rotate()
+		pl.(*pLog).Unlock()
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(3.0))
+		pl.(*pLog).Close()
+		Ω(formats(PT + "/formats")).Should(Equal([]int{formatTxn}))
+	})
+
+	It("restates the generation when a record type of a newer format is written", func() {
+		cases := []struct {
+			name   string
+			format int
+			output func(pl Log) error
+		}{
+			{"namespaced event", formatNamespaces, func(pl Log) error {
+				return OutputNS(pl, "tenant", &logEv1{S: "b"})
+			}},
+			{"namespaced events in a transaction", formatNamespaces, func(pl Log) error {
+				return Txn(pl, func(w TxnWriter) error {
+					w.Output(&NamespacedEvent{NS: "tenant", Event: &logEv1{S: "b"}})
+					return w.Output(&NamespacedEvent{NS: "tenant", Event: &logEv1{S: "c"}})
+				})
+			}},
+			{"tombstone", formatErase, func(pl Log) error {
+				return pl.Output(&Tombstone{Key: "b"})
+			}},
+			{"namespaced tombstone", formatErase, func(pl Log) error {
+				return OutputNS(pl, "tenant", &Tombstone{Key: "b"})
+			}},
+			{"voided record", formatVoided, func(pl Log) error {
+				sd := pl.(*pLog).priDest.(*stallDest)
+				sd.stalled = true
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+				defer cancel()
+				if err := OutputCtx(ctx, pl, &logEv1{S: "b"}); err != ctx.Err() {
+					return fmt.Errorf("the event wasn't dropped: %v", err)
+				}
+				sd.stalled = false
+				return pl.Output(&logEv1{S: "c"})
+			}},
+			{"journaled command", formatJournal, func(pl Log) error {
+				return OutputCommand(pl, "id", &logEv2{A: 1}, func(w TxnWriter) error {
+					return w.Output(&logEv1{S: "b"})
+				})
+			}},
+			{"fast event", formatFast, func(pl Log) error {
+				return pl.Output(&fastEv{K: "b"})
+			}},
+		}
+		for i, c := range cases {
+			By(c.name)
+			basepath := fmt.Sprintf("%s/records%d", PT, i)
+			fd, err := NewFileDest(basepath, true, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			pl, err := NewLog(&stallDest{LogDestination: fd}, &recordingClient{}, log15.Root(),
+				JournalCommands())
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+			Ω(c.output(pl)).ShouldNot(HaveOccurred())
+			Ω(formats(basepath)).Should(Equal([]int{formatGob, c.format}))
+			pl.(*pLog).Close()
+
+			fd, err = NewFileDest(basepath, false, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			rc := &recordingClient{}
+			pl, err = NewLog(fd, rc, log15.Root())
+			Ω(err).ShouldNot(HaveOccurred())
+			for _, ev := range rc.events {
+				Ω(ev).ShouldNot(BeAssignableToTypeOf(&GenerationMeta{}))
+			}
+			pl.(*pLog).Close()
+		}
+	})
+})
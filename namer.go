@@ -0,0 +1,108 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Namer chooses the names of the log files of a file destination, see WithNamer. A log
+// file is named after the basepath, followed by a segment name, which the namer chooses,
+// and by a suffix that tracks the state of the file, e.g. -curr.plog, which it doesn't.
+type Namer interface {
+	// SegmentName returns the segment name of a new log file started at time t, given the
+	// segment name of the most recent log file of the set, "" if there is none. It must
+	// start with '-', must not contain '*', '?', '[', '\', '.', or '/', and must not sort
+	// before prev, such that the log files sort in chronological order. A name equal to
+	// prev, or a prefix of it, gets a suffix letter, as files started in the same second do.
+	SegmentName(prev string, t time.Time) string
+}
+
+// defaultNamer names log files the way NewFileDest always has, e.g. -20150102-150405
+var defaultNamer = TimestampNamer("", "20060102-150405")
+
+// WithNamer makes a file destination name new log files using n instead of a timestamp,
+// such that the files conform to the conventions of existing log management tooling. The
+// files already in the log set keep their names, a namer given to an existing log set
+// must thus produce names that sort after them. It is not supported with
+// DirectoryPerGeneration.
+func WithNamer(n Namer) FileDestOption {
+	return func(fd *fileDest) { fd.namer = n }
+}
+
+// TimestampNamer returns a namer whose segment names are a dash, the prefix, and the UTC
+// time at which the file is started formatted using layout, see time.Format, which must
+// sort chronologically, e.g. "20060102T150405Z".
+func TimestampNamer(prefix, layout string) Namer {
+	return &timestampNamer{prefix: prefix, layout: layout}
+}
+
+type timestampNamer struct {
+	prefix string
+	layout string
+}
+
+func (tn *timestampNamer) SegmentName(prev string, t time.Time) string {
+	return "-" + tn.prefix + t.UTC().Format(tn.layout)
+}
+
+// SequenceNamer returns a namer whose segment names are a dash, the prefix, and a sequence
+// number zero-padded to width digits, e.g. -seg-000042 for SequenceNamer("seg-", 6). The
+// first file is numbered 1 and each file is numbered one more than the previous one, whose
+// number is parsed from its name. A number with more than width digits is preceded by a
+// letter counting the extra digits, a for one, b for two, etc., such that the names keep
+// sorting in order, e.g. -seg-999999 is followed by -seg-a1000000.
+func SequenceNamer(prefix string, width int) Namer {
+	if width < 1 {
+		width = 1
+	}
+	return &sequenceNamer{prefix: prefix, width: width}
+}
+
+type sequenceNamer struct {
+	prefix string
+	width  int
+}
+
+func (sn *sequenceNamer) SegmentName(prev string, t time.Time) string {
+	digits := strings.TrimPrefix(prev, "-"+sn.prefix)
+	digits = strings.TrimLeft(digits, "abcdefghijklmnopqrstuvwxyz") // extra digits letter
+	if i := strings.IndexFunc(digits, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		digits = digits[:i]
+	}
+	seq, _ := strconv.ParseUint(digits, 10, 64) // 0 if there's no previous file
+	num := fmt.Sprintf("%0*d", sn.width, seq+1)
+	if extra := len(num) - sn.width; extra > 0 {
+		num = string(rune('a'+extra-1)) + num
+	}
+	return "-" + sn.prefix + num
+}
+
+// newSegment returns the segment name of the next log file and checks it, see Namer
+func (fd *fileDest) newSegment() (string, error) {
+	namer := fd.namer
+	if namer == nil {
+		namer = defaultNamer
+	}
+	names, err := LogFiles(fd.basepath)
+	if err != nil {
+		return "", err
+	}
+	var prev string
+	if len(names) > 0 {
+		prev, _ = splitExt(names[len(names)-1])
+		prev = strings.TrimPrefix(prev, fd.basepath)
+	}
+	seg := namer.SegmentName(prev, time.Now())
+	if !strings.HasPrefix(seg, "-") || strings.ContainsAny(seg, "*?[\\./") {
+		return "", fmt.Errorf("invalid log file segment name %q", seg)
+	}
+	if seg < prev && !strings.HasPrefix(prev, seg) {
+		return "", fmt.Errorf("log file segment name %q sorts before %q, the previous one",
+			seg, prev)
+	}
+	return seg, nil
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("Namer", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	events := []interface{}{&logEv1{S: "a"}, &logEv2{A: 1}}
+
+	open := func(create bool, opts ...FileDestOption) (Log, *recordingClient) {
+		fd, err := NewFileDest(PT+"/named", create, nil, opts...)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{}
+		if create {
+			rc.events = events
+		}
+		pl, err := NewLog(fd, rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		return pl, rc
+	}
+
+	rotate := func(pl Log) {
+		gen := pl.Stats()["Generation"]
+		pl.(*pLog).Lock()
+		pl.(*pLog).rotate()
+		pl.(*pLog).Unlock()
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(gen + 1))
+	}
+
+	It("names log files using sequence numbers", func() {
+		pl, _ := open(true, WithNamer(SequenceNamer("seg-", 6)))
+		rotate(pl)
+		pl.(*pLog).Close()
+		Ω(LogFiles(PT + "/named")).Should(Equal([]string{
+			PT + "/named-seg-000001-old.plog", PT + "/named-seg-000002-curr.plog"}))
+
+		By("continuing the sequence when reopening the log set")
+		pl, rc := open(false, WithNamer(SequenceNamer("seg-", 6)))
+		pl.(*pLog).Close()
+		Ω(rc.events).Should(Equal(events))
+		Ω(ReplayFiles(PT + "/named")).Should(Equal([]string{
+			PT + "/named-seg-000003-curr.plog"}))
+	})
+
+	It("keeps sequence numbers in order when they outgrow the width", func() {
+		sn := SequenceNamer("s", 1)
+		Ω(sn.SegmentName("-s9", time.Time{})).Should(Equal("-sa10"))
+		Ω(sn.SegmentName("-sa99", time.Time{})).Should(Equal("-sb100"))
+		pl, _ := open(true, WithNamer(sn))
+		for i := 0; i < 10; i++ {
+			rotate(pl)
+		}
+		pl.(*pLog).Close()
+		files, err := LogFiles(PT + "/named")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files).Should(HaveLen(11))
+		Ω(files[8:]).Should(Equal([]string{PT + "/named-s9-old.plog",
+			PT + "/named-sa10-old.plog", PT + "/named-sa11-curr.plog"}))
+
+		pl, rc := open(false, WithNamer(sn))
+		pl.(*pLog).Close()
+		Ω(rc.events).Should(Equal(events))
+		Ω(ReplayFiles(PT + "/named")).Should(Equal([]string{PT + "/named-sa12-curr.plog"}))
+	})
+
+	It("names log files using a timestamp layout", func() {
+		t := time.Date(2015, 1, 2, 15, 4, 5, 0, time.FixedZone("PST", -8*3600))
+		Ω(TimestampNamer("app-", "20060102T150405Z").SegmentName("", t)).Should(
+			Equal("-app-20150102T230405Z"))
+		pl, _ := open(true, WithNamer(TimestampNamer("app-", "20060102T150405Z")))
+		rotate(pl)
+		pl.(*pLog).Close()
+		files, err := LogFiles(PT + "/named")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files).Should(HaveLen(2))
+		for _, f := range files {
+			Ω(f).Should(MatchRegexp(`/named-app-\d{8}T\d{6}Z[a-z]?-(old|curr)\.plog$`))
+		}
+	})
+
+	It("refuses names that do not sort after the existing files", func() {
+		pl, _ := open(true)
+		pl.(*pLog).Close()
+		_, err := NewFileDest(PT+"/named", false, nil, WithNamer(SequenceNamer("0", 4)))
+		Ω(err).Should(MatchError(ContainSubstring(`"-00001" sorts before`)))
+		_, err = NewFileDest(PT+"/named", false, nil, WithNamer(TimestampNamer("v1.", "2006")))
+		Ω(err).Should(MatchError(ContainSubstring("invalid log file segment name")))
+	})
+})
@@ -0,0 +1,69 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+// NamespacedEvent wraps an event output using OutputNS with the namespace it belongs to,
+// e.g. a tenant, and an event output using Annotate with its annotations. Replay passes it
+// to the client as is, see Namespace, unless it only holds annotations that aren't replayed.
+type NamespacedEvent struct {
+	NS          string
+	Event       interface{}
+	Annotations map[string]string // see Annotate
+}
+
+func init() {
+	Register(&NamespacedEvent{})
+}
+
+// OutputNS outputs an event that belongs to a namespace, such as a tenant, which allows a
+// single log to hold the events of several tenants and to replay or extract them
+// separately, see ReplayNamespaces and the -ns option of plog grep. Events output using
+// Output, or using OutputNS with an empty namespace, belong to the empty namespace. Like
+// Output, it may be called from PersistAll. A generation that contains namespaced events
+// records format version 9, which versions of persist that predate them refuse to replay,
+// see FormatVersion.
+func OutputNS(log Log, ns string, logEvent interface{}) error {
+	if ns == "" {
+		return log.Output(logEvent)
+	}
+	return log.Output(&NamespacedEvent{NS: ns, Event: logEvent})
+}
+
+// Namespace returns the namespace of a replayed event and the event itself, unwrapped if
+// it was output using OutputNS
+func Namespace(logEvent interface{}) (string, interface{}) {
+	if ne, ok := logEvent.(*NamespacedEvent); ok {
+		return ne.NS, ne.Event
+	}
+	return "", logEvent
+}
+
+// A NamespaceFilter selects namespaces, it returns true for the namespaces to keep
+type NamespaceFilter func(ns string) bool
+
+// ReplayNamespaces makes the log replay only the events of the namespaces selected by the
+// filter, which is also called for the empty namespace. Since the snapshot written when the log is
+// opened only holds the state rebuilt from the events replayed, this also erases the events
+// of the other namespaces from the log's current generation, the log files of the previous
+// generations still hold them until they are deleted, see TrimLogSet.
+func ReplayNamespaces(keep NamespaceFilter) LogOption {
+	return func(pl *pLog) { pl.nsKeep = keep }
+}
+
+// nsDecoder skips the events of the namespaces that are not replayed
+type nsDecoder struct {
+	Decoder
+	keep NamespaceFilter
+}
+
+func (nd nsDecoder) Decode() (interface{}, error) {
+	for {
+		ev, err := nd.Decoder.Decode()
+		if err != nil || isInternal(ev) {
+			return ev, err
+		}
+		if ns, _ := Namespace(ev); nd.keep(ns) {
+			return ev, nil
+		}
+	}
+}
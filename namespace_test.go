@@ -0,0 +1,100 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// nsClient snapshots events in the namespaces they were replayed from
+type nsClient struct {
+	recordingClient
+}
+
+func (nc *nsClient) PersistAll(pl Log) {
+	for _, ev := range nc.events {
+		ns, ev := Namespace(ev)
+		Ω(OutputNS(pl, ns, ev)).ShouldNot(HaveOccurred())
+	}
+}
+
+var _ = Describe("Namespaces", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	// open opens the log set at PT/ns and returns the events replayed
+	open := func(opts ...LogOption) []interface{} {
+		fd, err := NewFileDest(PT+"/ns", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		nc := &nsClient{}
+		pl, err := NewLog(fd, nc, log15.Root(), opts...)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+		return nc.events
+	}
+
+	BeforeEach(func() {
+		fd, err := NewFileDest(PT+"/ns", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &nsClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "shared"})).ShouldNot(HaveOccurred())
+		Ω(OutputNS(pl, "acme", &logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		Ω(OutputNS(pl, "initech", &logEv1{S: "i"})).ShouldNot(HaveOccurred())
+		Ω(OutputNS(pl, "", &logEv1{S: "none"})).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+	})
+
+	It("replays events with their namespace", func() {
+		events := open()
+		Ω(events).Should(Equal([]interface{}{&logEv1{S: "shared"},
+			&NamespacedEvent{NS: "acme", Event: &logEv1{S: "a"}},
+			&NamespacedEvent{NS: "initech", Event: &logEv1{S: "i"}},
+			&logEv1{S: "none"}}))
+		ns, ev := Namespace(events[1])
+		Ω(ns).Should(Equal("acme"))
+		Ω(ev).Should(Equal(&logEv1{S: "a"}))
+		ns, ev = Namespace(events[0])
+		Ω(ns).Should(Equal(""))
+		Ω(ev).Should(Equal(&logEv1{S: "shared"}))
+	})
+
+	It("erases the namespaces that are not replayed", func() {
+		events := open(ReplayNamespaces(func(ns string) bool { return ns != "acme" }))
+		Ω(events).Should(HaveLen(3))
+		Ω(events[1]).Should(Equal(&NamespacedEvent{NS: "initech", Event: &logEv1{S: "i"}}))
+
+		By("reopening without a filter")
+		events = open()
+		Ω(events).Should(HaveLen(3))
+		for _, ev := range events {
+			ns, _ := Namespace(ev)
+			Ω(ns).ShouldNot(Equal("acme"))
+		}
+	})
+
+	It("records namespaces in the registry header", func() {
+		reg := NewTypeRegistry()
+		Ω(reg.Register("ev1", &logEv1{})).ShouldNot(HaveOccurred())
+		var buf bytes.Buffer
+		enc := GobCodecWithRegistry(reg).NewEncoder(&buf)
+		Ω(enc.Encode(&SequencedEvent{Seq: 0, Event: &NamespacedEvent{NS: "acme",
+			Event: &logEv1{S: "a"}}})).ShouldNot(HaveOccurred())
+		Ω(enc.Encode(&SequencedEvent{Seq: 1, Event: &logEv1{S: "b"}})).
+			ShouldNot(HaveOccurred())
+		rc := &recordingClient{}
+		_, err := ReplayFrom(&buf, GobCodecWithRegistry(reg), rc)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(Equal([]interface{}{
+			&NamespacedEvent{NS: "acme", Event: &logEv1{S: "a"}}, &logEv1{S: "b"}}))
+	})
+})
@@ -19,6 +19,10 @@ func NewNoopDest(log log15.Logger) (LogDestination, error) {
 
 func (nd *noopDest) Close() {}
 
+func (nd *noopDest) Capabilities() Capabilities {
+	return Capabilities{CanRotate: true}
+}
+
 func (nd *noopDest) Write(p []byte) (int, error) {
 	return len(p), nil
 }
@@ -0,0 +1,140 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"sort"
+)
+
+// kindOrder orders the events of snapshots by kind, see SnapshotOrder
+type kindOrder struct {
+	kind func(logEvent interface{}) string
+	deps map[string][]string // kinds that must precede each kind
+	rank map[string]int      // length of the longest chain of kinds preceding a kind
+	err  error               // the order has a cycle
+	held []*shardWriter      // events held back by rank, nil when none are
+	keys map[resKey]bool     // resources of the events held back
+}
+
+// SnapshotOrder declares a partial order of event kinds that persist enforces within
+// snapshots, such that Replay never sees, say, an attachment before the creation of the
+// resource it's attached to. The kind function returns the kind of an event, deps lists
+// for each kind the kinds whose events must precede its events, e.g.,
+// {"attach": {"create"}}. Snapshot events whose kind has predecessors are held back in
+// memory and written at the end of the snapshot, in order, as shard frames, see
+// ParallelSnapshot. They're written earlier if an event output concurrently with the
+// snapshot may update one of their resources, i.e., if it has the key of one of them or
+// isn't a KeyedEvent, so the order is guaranteed for the resources that aren't updated
+// while the snapshot is being written, and always for the snapshot NewLog writes. The
+// events of transactions aren't held back. NewLog fails if the order has a cycle.
+func SnapshotOrder(kind func(logEvent interface{}) string,
+	deps map[string][]string) LogOption {
+
+	return func(pl *pLog) {
+		ko := &kindOrder{kind: kind, deps: deps, rank: make(map[string]int)}
+		kinds := make([]string, 0, len(deps))
+		for k := range deps {
+			kinds = append(kinds, k)
+		}
+		sort.Strings(kinds) // report the same cycle each time
+		for _, k := range kinds {
+			if _, err := ko.rankOf(k, nil); err != nil {
+				ko.err = err
+				break
+			}
+		}
+		pl.order = ko
+	}
+}
+
+// rankOf computes the rank of a kind, path holds the kinds being ranked to detect cycles
+func (ko *kindOrder) rankOf(k string, path []string) (int, error) {
+	if r, ok := ko.rank[k]; ok {
+		return r, nil
+	}
+	for _, p := range path {
+		if p == k {
+			return 0, fmt.Errorf("snapshot order has a cycle: %v", append(path, k))
+		}
+	}
+	r := 0
+	for _, d := range ko.deps[k] {
+		dr, err := ko.rankOf(d, append(path, k))
+		if err != nil {
+			return 0, err
+		}
+		if dr+1 > r {
+			r = dr + 1
+		}
+	}
+	ko.rank[k] = r
+	return r, nil
+}
+
+// holdSnapshot holds back a snapshot event whose kind has predecessors, it returns true
+// if the event was held back or dropped, must be called while holding the pl.Lock()
+func (pl *pLog) holdSnapshot(logEvent interface{}, snapshot bool) (bool, error) {
+	ko := pl.order
+	if ko == nil || !snapshot && pl.opened {
+		return false, nil
+	}
+	_, ev := Namespace(logEvent)
+	r := ko.rank[ko.kind(ev)]
+	if r == 0 {
+		return false, nil
+	}
+	if pl.skipSnapshot(logEvent) {
+		return true, nil
+	}
+	for len(ko.held) < r {
+		ko.held = append(ko.held, &shardWriter{pl: pl, shard: len(ko.held) + 1})
+	}
+	sw := ko.held[r-1]
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.enc == nil {
+		sw.enc = pl.codec.NewEncoder(&sw.buf)
+	}
+	if err := sw.enc.Encode(logEvent); err != nil {
+		return true, pl.fail("encode", err)
+	}
+	sw.events = append(sw.events, logEvent)
+	if k, ok := deltaKey(logEvent); ok {
+		if ko.keys == nil {
+			ko.keys = make(map[resKey]bool)
+		}
+		ko.keys[k] = true
+	}
+	return true, nil
+}
+
+// flushHeld writes the snapshot events held back, in order, before the live event that
+// is being output if it may update one of their resources, or unconditionally if it's
+// nil, must be called while holding the pl.Lock()
+func (pl *pLog) flushHeld(logEvent interface{}) error {
+	ko := pl.order
+	if ko == nil || len(ko.held) == 0 {
+		return nil
+	}
+	if logEvent != nil {
+		if k, ok := deltaKey(logEvent); ok && !ko.keys[k] {
+			return nil
+		}
+	}
+	for _, sw := range ko.held {
+		if err := pl.flushShard(sw); err != nil {
+			return err
+		}
+	}
+	ko.held, ko.keys = nil, nil
+	return nil
+}
+
+// dropHeld drops the events held back by a snapshot that didn't complete, must be called
+// while holding the pl.Lock()
+func (pl *pLog) dropHeld() {
+	if pl.order != nil {
+		pl.order.held, pl.order.keys = nil, nil
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// events of resources that are created and then attached to one another
+type (
+	createEv struct{ K string }
+	attachEv struct{ K, To string }
+)
+
+func (ce *createEv) EventKey() string { return ce.K }
+func (ae *attachEv) EventKey() string { return ae.K }
+
+func init() {
+	Register(&createEv{})
+	Register(&attachEv{})
+}
+
+func eventKind(ev interface{}) string {
+	switch ev.(type) {
+	case *createEv:
+		return "create"
+	case *attachEv:
+		return "attach"
+	}
+	return ""
+}
+
+// client whose PersistAll outputs the attachments first, live is called in the middle of
+// the rotations' snapshots
+type attachingClient struct {
+	recordingClient
+	live func()
+}
+
+func (ac *attachingClient) PersistAll(pl Log) {
+	Ω(pl.Output(&attachEv{K: "a", To: "b"})).ShouldNot(HaveOccurred())
+	if _, ok := pl.(snapshotLog); ok && ac.live != nil {
+		ac.live()
+	}
+	Ω(pl.Output(&createEv{K: "a"})).ShouldNot(HaveOccurred())
+	Ω(pl.Output(&createEv{K: "b"})).ShouldNot(HaveOccurred())
+}
+
+var _ = Describe("SnapshotOrder", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	order := SnapshotOrder(eventKind, map[string][]string{"attach": {"create"}})
+
+	open := func(lc LogClient) Log {
+		fd, err := NewFileDest(PT+"/order", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, lc, log15.Root(), order, RecordSequenceNumbers())
+		Ω(err).ShouldNot(HaveOccurred())
+		return pl
+	}
+
+	replay := func() []interface{} {
+		rc := &recordingClient{}
+		open(rc).(*pLog).Close()
+		return rc.events
+	}
+
+	rotate := func(pl Log) {
+		gen := pl.Stats()["Generation"]
+		pl.(*pLog).Lock()
+		pl.(*pLog).rotate()
+		pl.(*pLog).Unlock()
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(gen + 1))
+	}
+
+	It("orders the snapshot NewLog writes", func() {
+		open(&attachingClient{}).(*pLog).Close()
+		Ω(replay()).Should(Equal([]interface{}{&createEv{K: "a"}, &createEv{K: "b"},
+			&attachEv{K: "a", To: "b"}}))
+	})
+
+	It("orders the snapshots of rotations around unrelated updates", func() {
+		ac := &attachingClient{}
+		pl := open(ac)
+		ac.live = func() { Ω(pl.Output(&createEv{K: "c"})).ShouldNot(HaveOccurred()) }
+		rotate(pl)
+		pl.(*pLog).Close()
+		Ω(replay()).Should(Equal([]interface{}{&createEv{K: "c"}, &createEv{K: "a"},
+			&createEv{K: "b"}, &attachEv{K: "a", To: "b"}}))
+	})
+
+	It("writes held events before an update of their resource", func() {
+		ac := &attachingClient{}
+		pl := open(ac)
+		ac.live = func() { Ω(pl.Output(&attachEv{K: "a", To: "c"})).ShouldNot(HaveOccurred()) }
+		rotate(pl)
+		pl.(*pLog).Close()
+		Ω(replay()).Should(Equal([]interface{}{&attachEv{K: "a", To: "b"},
+			&attachEv{K: "a", To: "c"}, &createEv{K: "a"}, &createEv{K: "b"}}))
+	})
+
+	It("rejects cycles", func() {
+		fd, err := NewFileDest(PT+"/order", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer fd.Close()
+		_, err = NewLog(fd, &recordingClient{}, log15.Root(), SnapshotOrder(eventKind,
+			map[string][]string{"attach": {"create"}, "create": {"attach"}}))
+		Ω(err).Should(MatchError("snapshot order has a cycle: [attach create attach]"))
+	})
+})
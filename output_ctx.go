@@ -0,0 +1,99 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import "context"
+
+// A ContextWriter is a LogDestination whose writes can be abandoned when a context is done,
+// see OutputCtx. WriteContext must write all of p or none of it: if it returns the error of
+// a done context, p must not be part of the log.
+type ContextWriter interface {
+	WriteContext(ctx context.Context, p []byte) (int, error)
+}
+
+// voidedRecord precedes a record dropped by OutputCtx, decoders skip both
+type voidedRecord struct {
+	Err string // why the record was dropped
+}
+
+func init() {
+	Register(&voidedRecord{})
+}
+
+// correlationKey is the context key of correlation IDs, see WithCorrelationID
+type correlationKey struct{}
+
+// WithCorrelationID returns a context carrying a correlation ID, such as the ID of the
+// request that triggered an output, which lets persistence failures be tied back to the
+// request: OutputCtx adds it as correlation_id to persist's own error and critical log
+// lines, and records it in the OpError of a failure that puts the log into error state.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// CorrelationID returns the correlation ID carried by the context, empty if it has none
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// logCtx returns the context of the output in progress to add to log lines, i.e., its
+// correlation ID, must be called while holding the pl.Lock()
+func (pl *pLog) logCtx(ctx ...interface{}) []interface{} {
+	if pl.correlation != "" {
+		ctx = append(ctx, "correlation_id", pl.correlation)
+	}
+	return ctx
+}
+
+// OutputCtx outputs an event like Log.Output but gives up when the context is done, which
+// keeps a stalled destination from blocking the caller indefinitely. If the primary
+// destination is a ContextWriter, OutputCtx returns the context's error, e.g.
+// context.DeadlineExceeded, when the context is done while the write is blocked, the event
+// is then dropped as a whole and the log remains healthy. Otherwise only the time spent
+// before the write is bounded. OutputCtx doesn't interrupt an Output that holds the log's
+// lock, but it returns the context's error without writing anything if the context is
+// done by the time it gets the lock. Stats reports the number of events dropped as
+// DroppedOutputs. A generation that dropped events records format version 11, which
+// versions of persist that predate OutputCtx refuse to replay, see FormatVersion. See
+// WithCorrelationID to tie failures back to the caller.
+func OutputCtx(ctx context.Context, log Log, logEvent interface{}) error {
+	pl, ok := log.(*pLog)
+	if !ok {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return log.Output(logEvent)
+	}
+	return pl.output(ctx, logEvent, false)
+}
+
+// writeStaged writes the record staged by OutputCtx, it returns true if the record was
+// dropped because the context was done before the primary destination accepted it, in
+// which case its sequence number is reused by the next event
+func (pl *pLog) writeStaged() (bool, error) {
+	ctx, rec := pl.outCtx, pl.staged
+	pl.outCtx, pl.staged = nil, nil
+	_, err := pl.writeDests(ctx, rec)
+	if err == nil || err != ctx.Err() {
+		return false, err
+	}
+	if pl.sequence {
+		pl.seq-- // before a restated metadata record
+	}
+	// the encoder's state includes the record, e.g., the definitions of the types it
+	// introduces, so it's written before the next one, preceded by a marker that voids it
+	// and, the first time, by a metadata record restating the generation's format
+	pl.outCtx = ctx
+	merr := pl.useFormat(formatVoided)
+	if merr == nil {
+		merr = pl.encoder.Encode(&voidedRecord{Err: err.Error()})
+	}
+	marker := pl.staged
+	pl.outCtx, pl.staged = nil, nil
+	if merr != nil {
+		return false, pl.fail("encode", merr)
+	}
+	pl.voided = append(append(pl.voided, marker...), rec...)
+	return true, err
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// stallDest is a destination whose context-aware writes block until the context is done
+// while it's stalled
+type stallDest struct {
+	LogDestination
+	stalled bool
+}
+
+func (sd *stallDest) WriteContext(ctx context.Context, p []byte) (int, error) {
+	if sd.stalled {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+	return sd.Write(p)
+}
+
+var _ = Describe("OutputCtx", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	outputTimeout := func(pl Log, ev interface{}) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		return OutputCtx(ctx, pl, ev)
+	}
+
+	It("drops the event when the destination stalls", func() {
+		fd, err := NewFileDest(PT+"/ctx", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		sd := &stallDest{LogDestination: fd}
+		pl, err := NewLog(sd, &recordingClient{}, log15.Root(), RecordSequenceNumbers())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+
+		// the dropped events are the first of their type in the stream
+		sd.stalled = true
+		Ω(outputTimeout(pl, &logEv2{A: 1})).Should(Equal(context.DeadlineExceeded))
+		Ω(outputTimeout(pl, &NamespacedEvent{NS: "t", Event: &logEv1{S: "b"}})).
+			Should(Equal(context.DeadlineExceeded))
+		Ω(pl.HealthCheck()).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()["DroppedOutputs"]).Should(Equal(2.0))
+
+		sd.stalled = false
+		Ω(pl.Output(&logEv2{A: 2})).ShouldNot(HaveOccurred())
+		Ω(outputTimeout(pl, &NamespacedEvent{NS: "t", Event: &logEv1{S: "c"}})).
+			ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		fd, err = NewFileDest(PT+"/ctx", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{}
+		pl, err = NewLog(fd, rc, log15.Root(), RecordSequenceNumbers())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(Equal([]interface{}{&logEv1{S: "a"}, &logEv2{A: 2},
+			&NamespacedEvent{NS: "t", Event: &logEv1{S: "c"}}}))
+		pl.(*pLog).Close()
+	})
+
+	It("returns the context's error without writing when the context is done", func() {
+		fd, err := NewFileDest(PT+"/ctx", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		size := pl.Stats()["LogSize"]
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		Ω(OutputCtx(ctx, pl, &logEv1{S: "a"})).Should(Equal(context.Canceled))
+		Ω(pl.Stats()["LogSize"]).Should(Equal(size))
+		Ω(pl.Stats()["DroppedOutputs"]).Should(BeZero())
+
+		By("writing to destinations that cannot abandon writes")
+		Ω(OutputCtx(context.Background(), pl, &logEv1{S: "b"})).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()["LogSize"]).Should(BeNumerically(">", size))
+		pl.(*pLog).Close()
+	})
+
+	It("forgets the dropped events when the log rotates", func() {
+		fd, err := NewFileDest(PT+"/ctx", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		sd := &stallDest{LogDestination: fd}
+		rc := &recordingClient{events: []interface{}{&logEv1{S: "a"}}}
+		pl, err := NewLog(sd, rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		sd.stalled = true
+		Ω(outputTimeout(pl, &logEv2{A: 1})).Should(Equal(context.DeadlineExceeded))
+		sd.stalled = false
+		pl.(*pLog).Lock()
+		pl.(*pLog).rotate()
+		pl.(*pLog).Unlock()
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(2.0))
+		Ω(pl.Output(&logEv2{A: 2})).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		fd, err = NewFileDest(PT+"/ctx", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc = &recordingClient{}
+		pl, err = NewLog(fd, rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(Equal([]interface{}{&logEv1{S: "a"}, &logEv2{A: 2}}))
+		pl.(*pLog).Close()
+	})
+
+	It("ties failures to the correlation ID of the output", func() {
+		var mu sync.Mutex
+		correlated := map[string]string{}
+		logger := log15.New()
+		logger.SetHandler(log15.FuncHandler(func(r *log15.Record) error {
+			mu.Lock()
+			defer mu.Unlock()
+			for i := 0; i+1 < len(r.Ctx); i += 2 {
+				if r.Ctx[i] == "correlation_id" {
+					correlated[r.Ctx[i+1].(string)] = r.Msg
+				}
+			}
+			return nil
+		}))
+		fd, err := NewFileDest(PT+"/ctx", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		dest := &flakyDest{LogDestination: fd}
+		pl, err := NewLog(dest, &recordingClient{}, logger)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer pl.(*pLog).Close()
+		ctx := WithCorrelationID(context.Background(), "req-1")
+		Ω(CorrelationID(ctx)).Should(Equal("req-1"))
+		Ω(OutputCtx(ctx, pl, &logEv1{S: "a"})).ShouldNot(HaveOccurred())
+
+		dest.setDown(true)
+		ctx = WithCorrelationID(context.Background(), "req-2")
+		err = OutputCtx(ctx, pl, &logEv1{S: "b"})
+		Ω(err).Should(BeAssignableToTypeOf(&OpError{}))
+		Ω(err.(*OpError).Correlation).Should(Equal("req-2"))
+		Ω(pl.HealthCheck()).Should(MatchError(ContainSubstring("for correlation ID req-2")))
+
+		ctx = WithCorrelationID(context.Background(), "req-3")
+		Ω(OutputCtx(ctx, pl, &logEv1{S: "c"})).Should(Equal(err))
+		Ω(pl.Output(&logEv1{S: "d"})).Should(Equal(err))
+		mu.Lock()
+		defer mu.Unlock()
+		Ω(correlated).Should(HaveKey("req-3"))
+		Ω(correlated["req-3"]).Should(ContainSubstring("for correlation ID req-2"))
+		Ω(correlated).ShouldNot(HaveKey("req-1"))
+	})
+})
@@ -7,9 +7,11 @@
 package persist
 
 import (
-	"encoding/gob"
+	"context"
 	"fmt"
 	"io"
+	"runtime/debug"
+	"strconv"
 	"sync"
 	"time"
 
@@ -17,21 +19,133 @@ import (
 )
 
 type pLog struct {
-	client     LogClient // client which we make callbacks
-	size       int       // size used to decide when to rotate
-	sizeLimit  int       // size limit when to rotate
-	sizeReplay int       // size of the initial replay
-	objects    uint64    // number of objects output, purely for stats
-	encoder    *gob.Encoder
-	priDest    LogDestination // primary dest, where we initially replay from
-	secDest    LogDestination // secondary dest, no replay and OK if "down"
-	rotating   bool           // avoid concurrent rotations
-	errState   error
-	log        log15.Logger
+	client       LogClient // client which we make callbacks
+	size         int       // size used to decide when to rotate
+	sizeLimit    int       // size limit when to rotate
+	sizeReplay   int       // size of the initial replay
+	objects      uint64    // number of objects output, purely for stats
+	codec        Codec
+	typeReg      *TypeRegistry  // registry of the gob codec, see WithTypeRegistry
+	decodeLimits *DecodeLimits  // limits of the gob codec, see WithDecodeLimits
+	recovery     *typeAllowlist // replay only allowed types, see RecoverTypes
+	meta         GenerationMeta // metadata written at the start of each generation
+	now          func() time.Time
+	gen          uint64           // current generation number
+	onRotate     func(gen uint64) // called when a generation is complete
+	onReady      func()           // called once the log is ready, see OnReady
+	ready        chan struct{}    // closed once the log is ready, see Ready
+	downgrade    bool             // replay logs written in a newer format, see ForceDowngrade
+	downgraded   int              // newest format replayed when forcing a downgrade
+	format       int              // format version of the current generation, see useFormat
+	usedFormat   int              // highest format version of the features used, see useFormat
+	resume       *ResumeToken     // where to resume a failed replay, see ResumeReplay
+	warming      bool             // replaying logs still being written to, see WarmReplay
+	warm         map[uint64]int   // entries per generation replayed by a Standby
+	nsKeep       NamespaceFilter  // namespaces replayed, nil for all, see ReplayNamespaces
+	replayAnn    bool             // replay the annotations of events, see ReplayAnnotations
+	erased       map[string]bool  // keys to drop from the next snapshot, see Erase
+	erasing      map[string]bool  // keys dropped from the snapshot being written
+	ttls         eventTTLs        // TTL of event types in snapshots, see WithTTL
+	expired      uint64           // number of expired events omitted from snapshots
+	policy       RotationPolicy   // additional rotation trigger, see WithRotationPolicy
+	interval     time.Duration    // age of a generation that triggers a rotation, 0 for none
+	maxAge       time.Duration    // age of a generation that is unhealthy, see WarnGenerationAge
+	forceAge     bool             // rotate generations older than maxAge
+	ageTimer     *time.Timer      // checks the age of the current generation, nil if none
+	ageChecks    uint64           // identifies the current age check
+	genStart     time.Time        // time at which the current generation started
+	genSeq       uint64           // sequence number of the first event of the generation
+	snapEvents   int              // events in the snapshot of the current generation
+	liveEvents   int              // events output since the snapshot
+	replayRate   float64          // events per second replayed, 0 if not measured
+	replayed     map[uint64]int   // entries per generation replayed, nil if not tracked
+	internal     bool             // write internal events, see RecordInternalEvents
+	sequence     bool             // number the events, see RecordSequenceNumbers
+	seq          uint64           // sequence number of the next event
+	notes        []*InternalEvent // internal events waiting to be written, see note
+	outCtx       context.Context  // context of the record being staged by OutputCtx
+	staged       []byte           // record staged by OutputCtx, see writeStaged
+	voided       []byte           // records dropped by OutputCtx, written before the next one
+	dropped      uint64           // number of events dropped by OutputCtx, for stats
+	txns         uint64           // number of transactions written, identifies the next one
+	journal      bool             // journal commands, see JournalCommands
+	idemWindow   int              // idempotency keys remembered by replay, 0 for none
+	duplicates   uint64           // number of repeated events skipped by replay, for stats
+	tails        []*tailIterator  // iterators receiving the events output, see Tail
+	tailCond     *sync.Cond       // signals the iterators waiting for events
+	tailEvents   int              // events an iterator may fall behind, see WithTailLimits
+	tailBytes    int              // bytes an iterator may fall behind, see WithTailLimits
+	tailCatchUps int              // iterators that fell behind and read the files again
+	deltaMax     int              // consecutive delta snapshots, see WithDeltaSnapshots
+	deltaDepth   int              // delta snapshots chained by the current generation
+	changed      map[resKey]bool  // resources output during the generation, nil if unknown
+	deltaKeys    map[resKey]bool  // resources of the delta snapshot, true until written
+	shards       []*shardWriter   // writers of a parallel snapshot, see ParallelSnapshot
+	snapRate     float64          // snapshot bytes per second, see WithSnapshotRateLimit
+	snapBytes    int              // bytes of the snapshot written by the current generation
+	throttled    time.Duration    // total time snapshot outputs were delayed, for stats
+	throttling   bool             // the snapshot of the current generation is being delayed
+	traced       *traceRing       // recent operations, see WithTrace
+	handoff      *HandoffMark     // mark ending the replayed log, nil if not handed off
+	handedOff    bool             // the log was handed off to another process, see Handoff
+	priOpts      []FileDestOption // options for the primary dest, see PrimaryOptions
+	runtimeOpt   bool             // set by the options Reconfigure accepts, see runtimeOption
+	pool         *EventPool       // events released by the client, see WithEventPool
+	segments     []SegmentReplay  // segments read by the last replay, see ReplayedSegments
+	encoder      Encoder
+	priDest      LogDestination // primary dest, where we initially replay from
+	priCaps      Capabilities   // capabilities of the primary dest
+	secDest      LogDestination // secondary dest, no replay and OK if "down"
+	secCaps      Capabilities   // capabilities of the secondary dest
+	secNew       bool           // secondary has not yet been through a rotation
+	secSynced    bool           // secondary is receiving the current stream
+	secErr       error          // last error encountered on the secondary dest
+	secEnc       Encoder        // secondary's own stream, nil if it shares the primary's
+	secCodec     Codec          // codec of the secondary, nil to share the primary's stream
+	secFilter    EventFilter    // events mirrored to the secondary, nil for all
+	secFiltered  uint64         // number of events filtered out for the secondary, for stats
+	secRetry     time.Duration  // wait after a secondary failure before catching up, 0 disables
+	secRetryAt   time.Time      // time at which the secondary catch-up is due
+	catchingUp   bool           // a catch-up snapshot is being written to the secondary
+	catchUps     uint64         // number of completed catch-ups, purely for stats
+	secAsync     bool           // snapshot new secondaries without a rotation
+	rotating     bool           // avoid concurrent rotations
+	rotation     uint64         // incremented for each rotation, identifies abandoned ones
+	deadline     time.Duration  // time after which a rotation is abandoned, 0 for none
+	priTimeout   time.Duration  // time after which a primary write is abandoned, 0 for none
+	secTimeout   time.Duration  // time after which a secondary write is abandoned, 0 for none
+	latEncode    histogram      // time spent encoding events, see Stats
+	latPrimary   histogram      // time spent writing events to the primary dest
+	latSecondary histogram      // time spent writing events to the secondary dest
+	writePri     time.Duration  // time spent writing the current event to the primary dest
+	writeSec     time.Duration  // time spent writing the current event to the secondary dest
+	wroteSec     bool           // the current event was written to the secondary dest
+	writeBytes   int            // size of the current event written to the primary dest
+	sizes        eventSizes     // sizes of the events of the current generation
+	amp          ampCounters    // write amplification, for stats
+	opened       bool           // NewLog has completed, later outputs are application events
+	legacy       legacyCounter  // legacy records replayed, see Resnapshot
+	dups         *dupFilter     // drops duplicate events, see DropConsecutiveDuplicates
+	order        *kindOrder     // order of snapshot events, see SnapshotOrder
+	correlation  string         // correlation ID of the output in progress, see WithCorrelationID
+	epoch        uint64         // latest epoch of coordinated rotations, see Coordinator
+	cut          bool           // the stream being started is the cut of epoch
+	spoolPath    string         // spool file of the events output in error state, if any
+	spoolMax     int64          // maximum size of the spool file, see WithOverflowSpool
+	spooled      *overflowSpool // nil until an event is spooled
+	errState     error
+	errLogged    bool // errState was logged, see checkState
+	log          log15.Logger
 	sync.Mutex
 }
 
-// Return some statistics about the logging
+// Return some statistics about the logging. The latencies of Output are broken down into
+// the time spent encoding an event and writing it to each destination, the P50, P99, P999,
+// and Max of each are reported in seconds since the log was created. The same quantiles of
+// the encoded size of events are reported in bytes since the last rotation. The write
+// amplification is the ratio of the bytes written to all destinations, including snapshots
+// and secondary mirrors, to the bytes of the events output by the application, it's
+// reported since the log was created, for the current generation, and for the last one.
 func (pl *pLog) Stats() map[string]float64 {
 	pl.Lock()
 	defer pl.Unlock()
@@ -40,19 +154,78 @@ func (pl *pLog) Stats() map[string]float64 {
 	stats["LogSizeReplay"] = float64(pl.sizeReplay)
 	stats["LogSize"] = float64(pl.size + pl.sizeReplay)
 	stats["LogSizeLimit"] = float64(pl.sizeLimit)
+	stats["LogRotationInterval"] = pl.interval.Seconds()
+	if pl.pool != nil {
+		stats["ReplayEventsReused"] = float64(pl.pool.Reused())
+	}
 	stats["ObjectOutputRate"] = float64(pl.objects)
 	stats["ErrorState"] = 0.0
 	if pl.errState != nil {
 		stats["ErrorState"] = 1.0
 	}
+	stats["Generation"] = float64(pl.gen)
+	stats["Epoch"] = float64(pl.epoch)
+	stats["GenerationAge"] = pl.now().Sub(pl.genStart).Seconds()
+	stats["SecondaryCatchUps"] = float64(pl.catchUps)
+	stats["SecondaryFiltered"] = float64(pl.secFiltered)
+	stats["SecondaryErrorState"] = 0.0
+	if pl.secErr != nil {
+		stats["SecondaryErrorState"] = 1.0
+	}
+	stats["PrimaryHealthWarning"] = 0.0
+	if hw, ok := pl.priDest.(healthWarner); ok && hw.healthWarning() != nil {
+		stats["PrimaryHealthWarning"] = 1.0
+	}
+	if cb, ok := pl.priDest.(circuitBreaker); ok {
+		stats["PrimaryCircuitState"] = float64(cb.circuitState())
+	}
+	if cb, ok := pl.secDest.(circuitBreaker); ok {
+		stats["SecondaryCircuitState"] = float64(cb.circuitState())
+	}
+	if sm, ok := pl.priDest.(spaceMonitor); ok {
+		if free, level, ok := sm.freeSpace(); ok {
+			stats["PrimaryFreeSpace"] = free
+			stats["PrimaryFreeSpaceLevel"] = float64(level)
+		}
+	}
+	pl.latEncode.stats(stats, "EncodeLatency", 1e-9)
+	pl.latPrimary.stats(stats, "PrimaryWriteLatency", 1e-9)
+	pl.latSecondary.stats(stats, "SecondaryWriteLatency", 1e-9)
+	pl.sizes.hist.stats(stats, "EventSize", 1)
+	pl.amp.stats(stats)
+	stats["ErasePending"] = float64(len(pl.erased) + len(pl.erasing))
+	stats["ExpiredEvents"] = float64(pl.expired)
+	if pl.dups != nil {
+		stats["DuplicatesDropped"] = float64(pl.dups.dropped)
+	}
+	stats["LegacyRecords"] = float64(pl.legacy.records)
+	stats["ReplayRate"] = pl.replayRate
+	replayStats(pl.segments, stats)
+	stats["ProjectedReplayTime"] = pl.rotationState().ReplayTime().Seconds()
+	stats["DroppedOutputs"] = float64(pl.dropped)
+	stats["DuplicatesSkipped"] = float64(pl.duplicates)
+	stats["TailCatchUps"] = float64(pl.tailCatchUps)
+	stats["DeltaDepth"] = float64(pl.deltaDepth)
+	stats["SnapshotRateLimit"] = pl.snapRate
+	stats["SnapshotThrottled"] = 0.0
+	if pl.throttling && pl.rotating {
+		stats["SnapshotThrottled"] = 1.0
+	}
+	stats["SnapshotThrottleTime"] = pl.throttled.Seconds()
+	if pl.spooled != nil {
+		stats["SpooledEvents"] = float64(pl.spooled.events)
+	}
 	return stats
 }
 
+// errClosed is the error state of a log that was closed
+var errClosed = fmt.Errorf("log was closed")
+
 // Close the log for test purposes
 func (pl *pLog) Close() {
 	for {
 		pl.Lock()
-		if !pl.rotating {
+		if !pl.rotating && !pl.catchingUp {
 			break
 		}
 		pl.Unlock()
@@ -63,6 +236,14 @@ func (pl *pLog) Close() {
 	if pl.secDest != nil {
 		pl.secDest.Close()
 	}
+	if pl.errState == nil {
+		pl.errState = errClosed
+	}
+	if pl.ageTimer != nil {
+		pl.ageTimer.Stop()
+		pl.ageTimer = nil
+	}
+	pl.closeSpool()
 	pl.Unlock()
 }
 
@@ -70,204 +251,973 @@ func (pl *pLog) Close() {
 // addition to the initial size produced by the initial snapshot, i.e., it doesn't count that
 func (pl *pLog) SetSizeLimit(bytes int) { pl.sizeLimit = bytes }
 
-// HealthCheck returns nil if everything is OK and an error if the log is in an error state
-func (pl *pLog) HealthCheck() error { return pl.errState }
-
-// hack...
-var pLogError bool
+// HealthCheck returns nil if everything is OK and an error if the log is in an error state,
+// the free space of the primary destination is below its critical watermark, or the log
+// hasn't rotated for too long, see WarnGenerationAge. An error state is permanent, e.g. after
+// PersistAll panicked, the application must close the log and open it again with NewLog.
+func (pl *pLog) HealthCheck() error {
+	pl.Lock()
+	defer pl.Unlock()
+	if pl.errState != nil {
+		return pl.errState
+	}
+	if err := pl.ageError(); err != nil {
+		return err
+	}
+	if sm, ok := pl.priDest.(spaceMonitor); ok {
+		if _, level, ok := sm.freeSpace(); ok && level == spaceCritical {
+			return sm.spaceError()
+		}
+	}
+	return nil
+}
 
 // Output a log entry
 func (pl *pLog) Output(logEvent interface{}) error {
+	return pl.output(nil, logEvent, false)
+}
+
+// output a log entry, snapshot is true for entries output by PersistAll during a rotation,
+// ctx is nil unless the entry is output by OutputCtx
+func (pl *pLog) output(ctx context.Context, logEvent interface{}, snapshot bool) error {
 	pl.Lock()
 	defer pl.Unlock()
+	if ctx != nil {
+		pl.correlation = CorrelationID(ctx)
+		defer func() { pl.correlation = "" }()
+	}
 
 	//pl.log.Debug("persist.Output", "ev", logEvent)
 
+	if err := pl.checkState(); err != nil {
+		if !snapshot {
+			return pl.spool(logEvent, err)
+		}
+		return err
+	}
+	if err := pl.flushShards(); err != nil {
+		return err
+	}
+	if held, err := pl.holdSnapshot(logEvent, snapshot); held || err != nil {
+		return err
+	} else if !snapshot && pl.opened {
+		if err := pl.flushHeld(logEvent); err != nil {
+			return err
+		}
+		if pl.isDuplicate(logEvent) {
+			return nil
+		}
+	}
+	if ctx != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	if err := pl.encodeEvent(ctx, logEvent, snapshot); err != nil {
+		return err
+	}
+	pl.dups.written()
+	pl.outputDone()
+	return nil
+}
+
+// checkState returns an error if the log cannot output events, must be called while holding
+// the pl.Lock()
+func (pl *pLog) checkState() error {
 	if pl.errState != nil {
-		if !pLogError {
-			pl.log.Crit("Persistence log in error state: " +
-				pl.errState.Error())
-			pLogError = true
+		if !pl.errLogged {
+			pl.log.Crit("Persistence log in error state: "+
+				pl.errState.Error(), pl.logCtx()...)
+			pl.errLogged = true
 		}
 		return pl.errState
 	}
-	pLogError = false
 	if pl.encoder == nil {
 		return fmt.Errorf("uninitialized persistence log (nil encoder)")
 	}
-	// perverse stuff: we need to slap the event into an interface{} so gob later allows
-	// us to decode into an interface{}
+	return nil
+}
+
+// encodeEvent encodes a log entry into the primary's stream and the secondary's own stream,
+// staging it if ctx is not nil, see OutputCtx, must be called while holding the pl.Lock()
+func (pl *pLog) encodeEvent(ctx context.Context, logEvent interface{}, snapshot bool) error {
+	// until NewLog completes all outputs are part of its snapshot
+	if (snapshot || !pl.opened) && pl.skipSnapshot(logEvent) {
+		return nil
+	}
+	// a restated metadata record isn't part of the record OutputCtx may drop
+	if err := pl.useFormat(eventFormat(logEvent)); err != nil {
+		return err
+	}
+	if !snapshot && pl.opened {
+		pl.trackErase(logEvent)
+		pl.trackDelta(logEvent)
+	}
+	pl.outCtx = ctx
 	pl.objects += 1
-	var t interface{} = logEvent
-	err := pl.encoder.Encode(&t)
+	if snapshot || !pl.opened {
+		pl.snapEvents++
+		pl.dups.reset()
+	} else {
+		pl.liveEvents++
+	}
+	pl.writePri, pl.writeSec, pl.wroteSec, pl.writeBytes = 0, 0, false, 0
+	start := time.Now()
+	var err error
+	if pl.sequence {
+		err = pl.encoder.Encode(&SequencedEvent{Seq: pl.seq, Event: logEvent})
+		pl.seq++
+	} else {
+		err = pl.encoder.Encode(logEvent)
+	}
+	if ctx != nil && err != nil {
+		pl.outCtx, pl.staged = nil, nil
+	} else if ctx != nil {
+		var dropped bool
+		if dropped, err = pl.writeStaged(); dropped {
+			pl.dropped++
+			pl.objects--
+			pl.liveEvents--
+			return err
+		}
+	}
 	if err != nil {
-		pl.errState = err
-	} else if !pl.rotating && pl.size > pl.sizeLimit {
+		return pl.fail("encode", err)
+	}
+	pl.latEncode.recordDuration(time.Since(start) - pl.writePri - pl.writeSec)
+	pl.latPrimary.recordDuration(pl.writePri)
+	if !snapshot && pl.opened {
+		pl.amp.event(pl.writeBytes)
+	} else if snapshot {
+		pl.snapBytes += pl.writeBytes
+	}
+	if pl.sequence {
+		pl.sizes.record(logEvent, pl.writeBytes, pl.seq-1)
+	} else {
+		pl.sizes.record(logEvent, pl.writeBytes, pl.objects)
+	}
+	if pl.secEnc != nil && pl.secSynced && (snapshot || !pl.secCaps.SnapshotOnly) {
+		start = time.Now()
+		pl.encodeSecondary(logEvent)
+		pl.writeSec += time.Since(start)
+		pl.wroteSec = true
+	}
+	if pl.wroteSec {
+		pl.latSecondary.recordDuration(pl.writeSec)
+	}
+	if len(pl.tails) > 0 {
+		pl.pushTails(pl.seq-1, logEvent, pl.writeBytes)
+	}
+	return nil
+}
+
+// skipSnapshot returns true if a snapshot event must be dropped because it's been erased,
+// it has expired, or it's unchanged since the previous snapshot, see WithDeltaSnapshots
+func (pl *pLog) skipSnapshot(logEvent interface{}) bool {
+	return pl.isErased(logEvent) || pl.isExpired(logEvent) ||
+		pl.deltaKeys != nil && !pl.inDelta(logEvent)
+}
+
+// outputDone writes pending internal events and starts a rotation or a catch-up if one is
+// due, must be called while holding the pl.Lock()
+func (pl *pLog) outputDone() {
+	pl.flushNotes()
+	if !pl.rotating && pl.rotationDue() {
 		pl.rotate()
+	} else if pl.catchUpDue() {
+		pl.catchingUp = true
+		go pl.catchUp()
 	}
-	return err
 }
 
+// SetSecondaryDestination adds a secondary destination to the log. This causes a rotation
+// so the secondary receives a full snapshot before it receives any further events, unless
+// the snapshot is written in the background, see WithBackgroundSecondarySnapshot.
 func (pl *pLog) SetSecondaryDestination(dest LogDestination) error {
+	if err := DestPreflight(dest); err != nil {
+		return fmt.Errorf("secondary destination failed its preflight check: %s",
+			err.Error())
+	}
 	pl.Lock()
 	defer pl.Unlock()
 
-	return fmt.Errorf("not implemented yet!")
+	if pl.secDest != nil {
+		return fmt.Errorf("secondary destination is already set")
+	}
+	if !pl.priCaps.CanRotate && !pl.secAsync {
+		return fmt.Errorf("primary destination cannot rotate to snapshot to a secondary")
+	}
+	pl.secDest = dest
+	pl.secCaps = DestCapabilities(dest)
+	pl.secNew = true
+	pl.secSynced = false
+	pl.secErr = nil
+	if !pl.secAsync {
+		pl.rotate()
+	} else if !pl.rotating && !pl.handedOff {
+		// a rotation in progress starts the snapshot once it's done
+		pl.catchingUp = true
+		go pl.catchUp()
+	}
+	return nil
+}
+
+// secondaryError records an error on the secondary destination, which stops receiving
+// events until it's caught up or the next rotation, must be called while holding the pl.Lock()
+func (pl *pLog) secondaryError(op string, err error) {
+	pl.log.Error("Secondary destination failed", pl.logCtx("op", op, "err", err)...)
+	pl.note(InternalSecondaryFailed, "op", op, "err", err.Error())
+	pl.secErr = err
+	pl.secSynced = false
+	pl.secRetryAt = time.Now().Add(pl.secRetry)
+}
+
+// catchUpDue returns true if the secondary destination failed, has since had time to come
+// back, and can be caught up without a rotation, must be called while holding the pl.Lock()
+func (pl *pLog) catchUpDue() bool {
+	return pl.secDest != nil && pl.secErr != nil && !pl.secSynced && !pl.secNew &&
+		pl.secRetry > 0 && !pl.rotating && !pl.catchingUp &&
+		!time.Now().Before(pl.secRetryAt) && pl.secCaps.CanRotate
+}
 
-	/*
-		if pl.secDest != nil {
-			return fmt.Errorf("secondary destination is already set")
+// catchUp brings a secondary destination that missed events back in sync, or a new one up
+// to date, by writing a snapshot to it alone: the secondary starts a fresh stream with its
+// own encoder while the primary continues its current generation undisturbed. The two
+// streams converge again at the next rotation.
+func (pl *pLog) catchUp() {
+	pl.Lock()
+	defer pl.Unlock()
+	initial := pl.secNew
+	if initial {
+		// a new destination is implicitly started, it just needs the snapshot
+		pl.log.Info("Persist: snapshotting new secondary destination", "gen", pl.gen)
+		pl.secNew = false
+	} else {
+		pl.log.Info("Persist: catching up secondary destination", "gen", pl.gen)
+		if err := pl.secDest.StartRotate(); err != nil {
+			pl.secondaryError("StartRotate", err)
+			pl.catchingUp = false
+			return
 		}
-		pl.secDest = dest
+	}
+	pl.secSynced = true
+	if err := pl.startSecondaryStream(); err != nil {
+		pl.secondaryError("Write", err)
+		pl.catchingUp = false
+		return
+	}
 
-		return pl.rotate()
-	*/
+	// the snapshot goes only to the secondary, live events go to both destinations
+	pl.Unlock()
+	err := callSafely("PersistAll", func() { pl.client.PersistAll(catchUpLog{pl}) })
+	pl.Lock()
+	pl.catchingUp = false
+	if err != nil {
+		pl.secondaryError("PersistAll", err)
+	} else if pl.secSynced {
+		if err := pl.secDest.EndRotate(); err != nil {
+			pl.secondaryError("EndRotate", err)
+		} else if initial {
+			pl.log.Info("New secondary destination has its snapshot", "gen", pl.gen)
+		} else {
+			pl.secErr = nil
+			pl.catchUps++
+			pl.log.Info("Secondary destination caught up", "gen", pl.gen)
+			pl.note(InternalSecondaryCaughtUp)
+		}
+	}
+	pl.flushNotes()
+	// rotations are held off while catching up
+	if pl.errState == nil && pl.rotationDue() {
+		pl.rotate()
+	}
+}
+
+// startSecondaryStream starts a stream for the secondary destination that is separate from
+// the primary's, using the secondary's codec if it has one, must be called while holding
+// the pl.Lock()
+func (pl *pLog) startSecondaryStream() error {
+	codec := pl.secCodec
+	if codec == nil {
+		codec = pl.codec
+	}
+	pl.secEnc = codec.NewEncoder(secondaryWriter{pl: pl, dest: pl.secDest})
+	return pl.writeMeta(pl.secEnc)
+}
+
+// ownSecondaryStream returns true if the secondary needs a stream of its own rather than
+// the bytes written to the primary
+func (pl *pLog) ownSecondaryStream() bool {
+	return pl.secCodec != nil || pl.secFilter != nil || pl.secCaps.SnapshotOnly
+}
+
+// encodeSecondary encodes an event into the secondary's own stream unless it's filtered
+// out, must be called while holding the pl.Lock()
+func (pl *pLog) encodeSecondary(logEvent interface{}) {
+	if pl.secFilter != nil && !pl.secFilter(logEvent) {
+		pl.secFiltered++
+		return
+	}
+	if err := pl.secEnc.Encode(logEvent); err != nil {
+		pl.secondaryError("Write", err)
+	}
+}
+
+// snapshotLog is the Log passed to PersistAll during a rotation, it distinguishes the
+// snapshot from the events output concurrently for snapshot-only destinations
+type snapshotLog struct {
+	*pLog
+}
+
+func (sl snapshotLog) Output(logEvent interface{}) error {
+	err := sl.pLog.output(nil, logEvent, true)
+	sl.pLog.throttleSnapshot()
+	return err
+}
+
+// catchUpLog is the Log passed to PersistAll while catching up a secondary destination,
+// it outputs the snapshot to the secondary's stream only
+type catchUpLog struct {
+	*pLog
+}
+
+func (cl catchUpLog) Output(logEvent interface{}) error {
+	pl := cl.pLog
+	pl.Lock()
+	defer pl.Unlock()
+	if pl.errState != nil {
+		return pl.errState
+	}
+	if !pl.secSynced {
+		return nil // the secondary failed again, the next catch-up starts over
+	}
+	if pl.isExpired(logEvent) {
+		return nil
+	}
+	pl.encodeSecondary(logEvent)
+	return nil
+}
+
+// secondaryWriter writes the secondary's own stream, see startSecondaryStream
+type secondaryWriter struct {
+	pl   *pLog
+	dest LogDestination
+}
+
+func (sw secondaryWriter) Write(p []byte) (int, error) {
+	n, err := writeDest(nil, sw.dest, sw.pl.secTimeout, p)
+	sw.pl.amp.wrote(n)
+	if err == nil && n != len(p) {
+		err = io.ErrShortWrite
+	}
+	return n, err
 }
 
 // perform a log rotation, must be called while holding the pl.Lock()
 func (pl *pLog) rotate() {
-	if pl.rotating {
+	if pl.rotating || pl.catchingUp || pl.handedOff {
 		return
 	}
 	pl.rotating = true
+	pl.rotation++
 	pl.log.Info("Persist: starting rotation")
-	go pl.finishRotate()
+	pl.runRotation(false)
+}
+
+// runRotation completes the rotation in progress in the background, started is true if its
+// fresh stream was already started, see startRotation, must be called while holding the
+// pl.Lock()
+func (pl *pLog) runRotation(started bool) {
+	n := pl.rotation
+	if pl.deadline > 0 {
+		timer := time.AfterFunc(pl.deadline, func() { pl.abandonRotation(n) })
+		go func() {
+			pl.finishRotate(n, started)
+			timer.Stop()
+		}()
+	} else {
+		go pl.finishRotate(n, started)
+	}
 }
 
-func (pl *pLog) finishRotate() {
-	// tell all log destinations to start a rotation
+// abandonRotation abandons rotation n if it's still in progress, which puts the log into
+// error state and unblocks Close
+func (pl *pLog) abandonRotation(n uint64) {
 	pl.Lock()
 	defer pl.Unlock()
-	pl.size = 0
-	pl.sizeReplay = 0
-	err := pl.priDest.StartRotate()
-	if pl.secDest != nil {
-		pl.secDest.StartRotate() // TODO: record error
+	if !pl.rotating || pl.rotation != n {
+		return
 	}
-	if err != nil {
-		pl.errState = err
+	pl.fail("rotate", fmt.Errorf("rotation did not complete within %s", pl.deadline))
+	pl.log.Crit("Rotation stuck, abandoning it", "err", pl.errState,
+		"hint", "PersistAll has not returned, send SIGQUIT to dump the goroutine stacks")
+	pl.rotating = false
+	pl.rotation++
+}
+
+func (pl *pLog) finishRotate(n uint64, started bool) {
+	// the rotation hook runs once the lock has been released
+	var doneGen uint64
+	defer func() {
+		if doneGen > 0 && pl.onRotate != nil {
+			pl.onRotate(doneGen)
+		}
+	}()
+
+	pl.Lock()
+	defer pl.Unlock()
+	if !started && !pl.startRotation() {
 		return
 	}
-	// we need a new encoder 'cause we start a fresh stream
-	pl.encoder = gob.NewEncoder(pl)
 
 	// now create a full snapshot, relinquish the lock while doing that 'cause otherwise
 	// we end up with deadlocks since PersistAll will end up calling pl.Output()
 	pl.Unlock()
-	pl.client.PersistAll(pl)
+	err := callSafely("PersistAll", func() { pl.client.PersistAll(snapshotLog{pl}) })
 	pl.Lock()
+	if pl.rotation != n {
+		// the rotation was abandoned, the snapshot is incomplete and must not be used
+		pl.log.Warn("Abandoned rotation finished")
+		return
+	}
+	if err != nil {
+		// leave the destinations mid-rotation: the fresh stream holds the events output
+		// while the snapshot ran, which the replay of a reopened log reads after the
+		// previous stream, so it cannot be dropped, and the log stays in error state
+		pl.log.Crit("Rotation aborted", "err", err)
+		pl.fail("snapshot", err)
+		pl.dropHeld()
+		pl.rotating = false
+		return
+	}
+	if err := pl.flushHeld(nil); err != nil {
+		pl.rotating = false
+		return
+	}
+	if err := pl.endSnapshot(); err != nil {
+		pl.rotating = false
+		return
+	}
 
 	// tell all log destinations that we're done with the rotation
 	err = pl.priDest.EndRotate()
-	if pl.secDest != nil {
-		pl.secDest.EndRotate() // TODO: record error
+	if pl.secDest != nil && pl.secSynced {
+		if serr := pl.secDest.EndRotate(); serr != nil {
+			pl.secondaryError("EndRotate", serr)
+		} else {
+			pl.secErr = nil
+		}
 	}
 	pl.rotating = false
 	if err != nil {
 		pl.log.Crit("Finished rotation with error",
 			"replay_size", pl.sizeReplay, "err", err)
-		pl.errState = err
+		pl.fail("rotate", err)
 	} else {
-		pl.log.Info("Finished rotation", "replay_size", pl.sizeReplay)
+		pl.log.Info("Finished rotation", "replay_size", pl.sizeReplay, "gen", pl.gen)
+		pl.note(InternalRotationEnd, "replay_size", strconv.Itoa(pl.sizeReplay))
+		pl.flushNotes()
+		pl.finishErase()
+		pl.legacy.records = 0 // the replayed logs are gone
+		doneGen = pl.gen
+		if pl.secDest != nil && pl.secNew && pl.secAsync {
+			// secondary was added while rotating, it needs a snapshot of its own
+			pl.catchingUp = true
+			go pl.catchUp()
+		} else if pl.secDest != nil && pl.secNew {
+			// secondary was added while rotating, it needs a rotation of its own
+			pl.rotate()
+		}
 	}
 	return
 }
 
-// replay a log file
-func (pl *pLog) replay() (err error) {
-	for i, rr := range pl.priDest.ReplayReaders() {
-		pl.log.Info("Starting replay", "log_num", i+1)
-		dec := gob.NewDecoder(rr)
-		// iterate reading one log entry after another until EOF is reached
-		count := 0
-		for {
-			var ev interface{}
-			err := dec.Decode(&ev)
-			if err == io.EOF {
-				break // done replaying
+// startRotation tells all log destinations to start a rotation and writes the start of the
+// fresh stream, it returns false if the rotation ended, must be called while holding the
+// pl.Lock()
+func (pl *pLog) startRotation() bool {
+	pl.note(InternalRotationStart)
+	pl.flushNotes()
+	pl.size = 0
+	pl.sizeReplay = 0
+	err := pl.priDest.StartRotate()
+	pl.secEnc = nil // the secondary shares the fresh stream again, unless it has its own
+	if pl.secDest != nil && pl.secNew {
+		// a new destination is implicitly started, it just needs the snapshot
+		pl.secNew = false
+		pl.secSynced = true
+	} else if pl.secDest != nil && !pl.secCaps.CanRotate {
+		pl.secondaryError("StartRotate", fmt.Errorf("destination cannot rotate"))
+	} else if pl.secDest != nil {
+		if serr := pl.secDest.StartRotate(); serr != nil {
+			pl.secondaryError("StartRotate", serr)
+		} else {
+			pl.secSynced = true
+		}
+	}
+	if err != nil {
+		pl.fail("rotate", err)
+		pl.rotating = false
+		return false
+	}
+	// we need a new encoder 'cause we start a fresh stream
+	pl.encoder = pl.codec.NewEncoder(pl)
+	pl.voided = nil // the dropped records belong to the previous stream
+	pl.gen++
+	pl.sizes = eventSizes{}
+	pl.amp.rotated()
+	pl.startErase()
+	pl.startGeneration()
+	if err := pl.writeMeta(pl.encoder); err != nil {
+		pl.fail("rotate", err)
+		pl.rotating = false
+		return false
+	}
+	if err := pl.startSnapshot(true); err != nil {
+		pl.rotating = false
+		return false
+	}
+	if pl.ownSecondaryStream() && pl.secSynced {
+		if err := pl.startSecondaryStream(); err != nil {
+			pl.secondaryError("Write", err)
+		}
+	}
+	pl.flushNotes()
+	return true
+}
+
+// replay the logs read from the readers
+func (pl *pLog) replay(readers []io.ReadCloser) (err error) {
+	if pl.resume != nil && pl.resume.Log >= len(readers) {
+		return fmt.Errorf("cannot resume replay in log %d, there are only %d logs",
+			pl.resume.Log+1, len(readers))
+	}
+	var prev *seqDecoder
+	var window *keyWindow
+	if pl.idemWindow > 0 {
+		window = newKeyWindow(pl.idemWindow)
+	}
+	start, total := time.Now(), 0
+	pl.segments = nil
+	for i, rr := range readers {
+		rc := &resumeClient{LogClient: pl.client}
+		var gen uint64
+		if pl.resume != nil && i < pl.resume.Log {
+			pl.log.Info("Skipping replay", "log_num", i+1)
+			rr.Close()
+			continue
+		} else if pl.resume != nil && i == pl.resume.Log {
+			pl.log.Info("Resuming replay", "log_num", i+1, "entries", pl.resume.Entries)
+			rc.skip = pl.resume.Entries
+		} else {
+			pl.log.Info("Starting replay", "log_num", i+1)
+		}
+		cr := newCountingReader(rr)
+		sd := withSequence(pl.codec.NewDecoder(cr))
+		pl.usePool(sd)
+		dd := &deltaDecoder{Decoder: pl.replayDecoder(sd, window), pl: pl, window: window,
+			chain: i == 0}
+		var dec Decoder = dd
+		var tail *tailDecoder
+		if pl.warming && i == len(readers)-1 {
+			tail = &tailDecoder{Decoder: dec}
+			dec = tail
+		}
+		started := false
+		count, err := replayStream(dec, rc, func(m *GenerationMeta) error {
+			// a generation restated mid-stream with a newer format doesn't start a stream,
+			// see useFormat
+			if !started {
+				started = true
+				gen = m.Gen
+				if prev != nil {
+					if err := checkChain(prev, sd); err != nil {
+						return err
+					}
+				}
+				if pl.resume != nil && i == pl.resume.Log {
+					if err := checkResume(pl.resume, m); err != nil {
+						return err
+					}
+				}
+				if pl.warm != nil {
+					if err := pl.skipWarm(m, i == 0, rc); err != nil {
+						return err
+					}
+				}
+				if m.Gen > pl.gen {
+					pl.gen = m.Gen
+				}
+				if m.Epoch > pl.epoch {
+					pl.epoch = m.Epoch
+				}
 			}
-			if err != nil {
-				pl.log.Debug("replay decode failed", "err", err, "log_num", i+1,
-					"count", count)
-				return fmt.Errorf("replay decode failed in log %d after %d entries: %s",
-					i+1, count, err.Error())
+			if m.Format > FormatVersion && m.Format > pl.downgraded {
+				pl.downgraded = m.Format
 			}
-			//pl.log.Debug("replay decoded", "ev", ev)
+			return checkFormat(m, pl.downgrade, pl.log)
+		})
+		dd.close()
+		if err != nil {
+			pl.log.Debug("replay failed", "err", err, "log_num", i+1, "count", count)
+			return &ReplayError{Token: ResumeToken{Log: i, Gen: gen, Entries: rc.done},
+				err: &OpError{Op: "replay", Segment: readerName(rr), Offset: cr.n,
+					Gen: gen, Err: err}}
+		}
+		if tail != nil && tail.err != nil {
+			pl.log.Info("Warm replay stopped at incomplete entry", "log_num", i+1,
+				"count", count, "err", tail.err)
+		}
+		if pl.replayed != nil {
+			pl.replayed[gen] = rc.done
+		}
+		if sd.sync {
+			pl.seq = sd.next
+		}
+		pl.trace("replay", int(cr.n), fmt.Sprintf("%s entries=%d", readerName(rr), count))
+		pl.segments = append(pl.segments,
+			SegmentReplay{Segment: readerName(rr), Bytes: cr.n, Events: rc.used})
+		prev = sd
+		pl.handoff = sd.handoff
+		total += count
+		rr.Close()
+	}
+	pl.measureReplay(total, time.Since(start))
+	pl.log.Debug("Ending replay", "logs", len(readers))
+	if pl.recovery != nil {
+		st := pl.recovery.stats
+		pl.log.Warn("Replayed log in recovery mode", "replayed", st.Replayed,
+			"skipped", st.Skipped, "undecodable", st.Undecodable)
+	}
+	return nil
+}
+
+// replayDecoder wraps the decoder of a replayed stream with the decoders that filter and
+// track its events
+func (pl *pLog) replayDecoder(sd *seqDecoder, window *keyWindow) Decoder {
+	var dec Decoder = sd
+	if pl.recovery != nil {
+		dec = pl.recovery.decoder(dec, pl.log)
+	}
+	if pl.nsKeep != nil {
+		dec = nsDecoder{Decoder: dec, keep: pl.nsKeep}
+	}
+	dec = eraseDecoder{Decoder: dec, pl: pl}
+	if window != nil {
+		dec = dedupeDecoder{Decoder: dec, window: window, pl: pl}
+	}
+	dec = legacyDecoder{Decoder: dec, lc: &pl.legacy}
+	if !pl.replayAnn {
+		dec = annotationDecoder{Decoder: dec}
+	}
+	return dec
+}
+
+// replayStream iterates reading one log entry after another until EOF is reached and
+// passes each one to the client, it returns the number of entries replayed. Metadata
+// records are passed to onMeta instead, if not nil, which may abort the replay.
+func replayStream(dec Decoder, client LogClient,
+	onMeta func(*GenerationMeta) error) (int, error) {
+
+	count := 0
+	for {
+		ev, err := dec.Decode()
+		if err == io.EOF {
+			return count, nil // done replaying
+		}
+		if err != nil {
+			return count, fmt.Errorf("decode failed after %d entries: %s",
+				count, err.Error())
+		}
+		if m, ok := ev.(*GenerationMeta); ok {
+			if onMeta != nil {
+				if err := onMeta(m); err != nil {
+					return count, err
+				}
+			}
+			continue // metadata is not for the client
+		}
+		if bs, ok := ev.(*BlobStart); ok {
 			count += 1
-			err = pl.client.Replay(ev)
-			if err != nil {
-				return fmt.Errorf("replay failed on entry %d: %s", count, err.Error())
+			if err := replayBlob(dec, client, bs); err != nil {
+				return count, fmt.Errorf("replay failed on entry %d: %s", count,
+					err.Error())
 			}
+			continue
+		}
+		if isInternal(ev) {
+			continue // neither are internal events
+		}
+		count += 1
+		if perr := callSafely("Replay", func() { err = client.Replay(ev) }); perr != nil {
+			err = perr
+		}
+		if err != nil {
+			return count, fmt.Errorf("replay failed on entry %d: %s", count, err.Error())
 		}
-		rr.Close()
 	}
-	pl.log.Debug("Ending replay", "logs", len(pl.priDest.ReplayReaders()))
+}
+
+// callSafely calls a client callback and converts a panic into an error carrying the stack
+// trace so a client bug doesn't bring down the process, the operation fails instead
+func callSafely(callback string, f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s panicked: %v\n%s", callback, r, debug.Stack())
+		}
+	}()
+	f()
 	return nil
 }
 
-// Write is called by the gob encoder and needs to write the bytes to all destinations
+// ReplayFrom replays a stream of log events read from r into the client. The stream
+// must consist of a single log generation, such as a log file or a backup of one, and a
+// nil codec defaults to GobCodec. ReplayFrom doesn't require a log destination or
+// a Log, which makes it suitable for tooling and disaster-recovery scripts. It returns
+// the number of events replayed.
+func ReplayFrom(r io.Reader, codec Codec, client LogClient) (int, error) {
+	if codec == nil {
+		codec = GobCodec
+	}
+	return replayStream(withSequence(codec.NewDecoder(r)), client, nil)
+}
+
+// Write is called by the encoder and needs to write the bytes to all destinations, while
+// OutputCtx stages the bytes so they can be written in one go, see writeStaged
 func (pl *pLog) Write(p []byte) (int, error) {
 	if pl.errState != nil {
 		return 0, pl.errState // in error state don't move!
 	}
+	if pl.outCtx != nil {
+		pl.staged = append(pl.staged, p...)
+		return len(p), nil
+	}
+	return pl.writeDests(nil, p)
+}
 
-	// track size for log rotation, initial snapshot doesn't count towards limit
+// writeDests writes p to the primary destination, preceded by the records voided by
+// OutputCtx, and mirrors it to the secondary. If ctx is not nil and the primary is a
+// ContextWriter the write is abandoned when ctx is done, in which case it returns the
+// context's error without putting the log into error state.
+func (pl *pLog) writeDests(ctx context.Context, p []byte) (int, error) {
 	l := len(p)
+	if len(pl.voided) > 0 {
+		p = append(append(make([]byte, 0, len(pl.voided)+l), pl.voided...), p...)
+	}
+
+	// write to primary destination
+	start := time.Now()
+	n, err := writeDest(ctx, pl.priDest, pl.priTimeout, p)
+	if _, ok := pl.priDest.(ContextWriter); ok && err != nil && ctx != nil && ctx.Err() != nil {
+		pl.writePri += time.Since(start)
+		return 0, ctx.Err()
+	}
+	pl.writePri += time.Since(start)
+
+	// track size for log rotation, initial snapshot doesn't count towards limit
 	if !pl.rotating {
 		pl.size += len(p)
 	} else {
 		pl.sizeReplay += len(p)
 	}
-
-	// write to primary destination
-	n, err := pl.priDest.Write(p)
-	if n != l || err != nil {
-		pl.errState = err
-		return n, err
+	pl.amp.wrote(n)
+	pl.trace("write", n, "")
+	if n != len(p) || err != nil {
+		if err == nil {
+			err = io.ErrShortWrite
+		}
+		return n, pl.fail("write", err)
 	}
+	pl.writeBytes += l
+	pl.voided = nil
 
-	// write to secondary destination
-	if pl.secDest != nil {
-		pl.secDest.Write(p) // TODO: record error
+	// write to secondary destination, unless it has its own stream
+	if pl.secDest != nil && pl.secSynced && pl.secEnc == nil && !pl.ownSecondaryStream() {
+		start = time.Now()
+		sn, serr := writeDest(nil, pl.secDest, pl.secTimeout, p)
+		pl.writeSec += time.Since(start)
+		pl.amp.wrote(sn)
+		pl.wroteSec = true
+		if serr != nil || sn != len(p) {
+			if serr == nil {
+				serr = io.ErrShortWrite
+			}
+			pl.secondaryError("Write", serr)
+		}
 	}
 
-	return n, nil
+	return l, nil
 }
 
-// NewLog reopens an existing log, replays all log entries, and then prepares to append
-// to it. The call to NewLog completes once any necessary replay has completed.
-func NewLog(priDest LogDestination, client LogClient, logger log15.Logger) (Log, error) {
+// LogOption configures optional behavior of a Log when passed to NewLog
+type LogOption func(pl *pLog)
+
+// WithRotationDeadline sets the time after which a rotation whose snapshot has not completed
+// is abandoned, which typically happens when PersistAll hangs due to a client bug. The log
+// then goes into error state and Close no longer waits for the rotation. By default
+// rotations have no deadline.
+func WithRotationDeadline(d time.Duration) LogOption {
+	return runtimeOption(func(pl *pLog) { pl.deadline = d })
+}
+
+// WithSecondaryCodec makes the secondary destination use its own codec, for example to
+// produce an audit trail humans can read while the primary uses gob. Each event is then
+// encoded once per codec instead of the primary's encoded bytes being written to both
+// destinations, which costs extra CPU.
+func WithSecondaryCodec(codec Codec) LogOption {
+	return func(pl *pLog) { pl.secCodec = codec }
+}
+
+// WithBackgroundSecondarySnapshot makes SetSecondaryDestination write the snapshot of the new
+// secondary destination in the background, the way a failed secondary is caught up, rather
+// than rotate the primary: the primary continues its current generation and the secondary
+// gets a stream of its own, with its own encoder, until the next rotation. The primary then
+// doesn't need to be able to rotate.
+func WithBackgroundSecondarySnapshot() LogOption {
+	return func(pl *pLog) { pl.secAsync = true }
+}
+
+// WithSecondaryRetry sets how long to wait after a secondary destination fails before
+// catching it up with a snapshot of its own, which doesn't rotate the primary. The catch-up
+// is attempted when an event is output after the wait. A zero duration disables catch-ups,
+// leaving the secondary out of sync until the next rotation. The default is 30 seconds.
+func WithSecondaryRetry(d time.Duration) LogOption {
+	return runtimeOption(func(pl *pLog) { pl.secRetry = d })
+}
+
+// newPLog creates a log that has no destination yet and applies the options
+func newPLog(client LogClient, logger log15.Logger, opts []LogOption) (*pLog, error) {
 	pl := &pLog{
 		client:    client,
 		sizeLimit: 1024 * 1024, // 1MB default
-		priDest:   priDest,
+		secRetry:  30 * time.Second,
+		codec:     GobCodec,
+		meta:      defaultMeta(),
+		now:       time.Now,
 		log:       logger.New("start", time.Now()),
+		ready:     make(chan struct{}),
+	}
+	pl.idemWindow = idempotencyWindow
+	pl.tailEvents = tailLimit
+	for _, opt := range opts {
+		opt(pl)
+	}
+	if err := pl.resolveCodec(); err != nil {
+		return nil, err
+	}
+	return pl, nil
+}
+
+// NewLog reopens an existing log, replays all log entries, and then prepares to append
+// to it. The call to NewLog completes once any necessary replay has completed.
+// The primary destination must not be write-only and if it cannot rotate the log is
+// never rotated, i.e., the size limit is ignored. Options are applied before the replay.
+// The preflight check of the primary destination, see PreflightDestination, runs first.
+func NewLog(priDest LogDestination, client LogClient, logger log15.Logger,
+	opts ...LogOption) (Log, error) {
+
+	caps := DestCapabilities(priDest)
+	if caps.WriteOnly {
+		return nil, fmt.Errorf("write-only destination cannot be the primary destination")
+	}
+	if caps.SnapshotOnly {
+		return nil, fmt.Errorf("snapshot-only destination cannot be the primary destination")
 	}
-	pl.encoder = gob.NewEncoder(pl)
+	pl, err := newPLog(client, logger, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := pl.checkTTLs(); err != nil {
+		return nil, err
+	}
+	if pl.order != nil && pl.order.err != nil {
+		return nil, pl.order.err
+	}
+	if _, ok := priDest.(generationReader); pl.deltaMax > 0 && !ok {
+		return nil, fmt.Errorf("delta snapshots require a destination that can read " +
+			"previous generations")
+	}
+	if err := DestPreflight(priDest); err != nil {
+		return nil, fmt.Errorf("primary destination failed its preflight check: %s",
+			err.Error())
+	}
+	pl.priDest = priDest
+	pl.priCaps = caps
+	if err := pl.applyPrimaryOptions(); err != nil {
+		return nil, err
+	}
+	pl.encoder = pl.codec.NewEncoder(pl)
 
 	pl.log.Debug("Starting replay")
-	err := pl.replay()
+	err = pl.replay(priDest.ReplayReaders())
 	if err != nil {
+		if _, ok := err.(*ReplayError); !ok {
+			err = &OpError{Op: "replay", Offset: -1, Err: err}
+		}
 		pl.errState = err
 		return nil, err
 	}
 	pl.log.Info("Replay done")
+	if hd, ok := priDest.(handoffDest); ok && hd.takingOver() {
+		return pl.takeOver()
+	}
+	if err := pl.replaySpool(); err != nil {
+		pl.errState = err
+		return nil, err
+	}
 
-	// now create a full snapshot
+	// now create a full snapshot, which starts a new generation
+	pl.gen++
+	pl.startErase()
+	pl.startGeneration()
+	if err := pl.writeMeta(pl.encoder); err != nil {
+		return nil, pl.fail("snapshot", err)
+	}
+	if err := pl.startSnapshot(false); err != nil {
+		return nil, err
+	}
+	if st := pl.recovery; st != nil {
+		pl.note(InternalRecovery, "replayed", strconv.Itoa(st.stats.Replayed),
+			"skipped", fmt.Sprint(st.stats.Skipped),
+			"undecodable", strconv.Itoa(st.stats.Undecodable))
+	}
+	if pl.downgraded > 0 {
+		pl.note(InternalDowngrade, "from", strconv.Itoa(pl.downgraded),
+			"to", strconv.Itoa(FormatVersion))
+	}
+	pl.flushNotes()
 	pl.log.Debug("Starting snapshot")
 	pl.rotating = true
-	pl.client.PersistAll(pl)
+	err = callSafely("PersistAll", func() { pl.client.PersistAll(pl) })
 	pl.rotating = false
+	if err != nil {
+		pl.log.Crit("Snapshot failed", "err", err)
+		return nil, pl.fail("snapshot", err)
+	}
+	if pl.errState != nil {
+		return nil, pl.errState // e.g. closed by PersistAll
+	}
+	if err := pl.flushHeld(nil); err != nil {
+		return nil, err
+	}
+	if err := pl.endSnapshot(); err != nil {
+		return nil, err
+	}
 	pl.log.Info("Snapshot done")
 
-	// tell all log destinations that we're done with the rotation
+	// tell the log destination that we're done with the rotation
 	err = pl.priDest.EndRotate()
-	if pl.secDest != nil {
-		pl.secDest.EndRotate() // TODO: record error
-	}
 	if err != nil {
-		pl.errState = err
-		return nil, err
+		return nil, pl.fail("snapshot", err)
+	}
+	pl.note(InternalRotationEnd, "replay_size", strconv.Itoa(pl.sizeReplay))
+	pl.flushNotes()
+	pl.finishErase()
+	pl.removeSpool()
+	pl.legacy.records = 0 // the replayed logs are gone
+	if pl.onRotate != nil {
+		pl.onRotate(pl.gen)
 	}
+	pl.markReady()
 	return pl, err
 }
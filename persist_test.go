@@ -5,8 +5,12 @@ package persist
 // Omega: Alt+937
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -179,4 +183,327 @@ var _ = Describe("NewLog", func() {
 
 	})
 
+	It("verifies a secondary destination", func() {
+		By("starting a new log")
+		pl, _ := startNewLog(0, false)
+		sd, err := NewFileDest(PT+"/second", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.SetSecondaryDestination(sd)).ShouldNot(HaveOccurred())
+		Ω(pl.SetSecondaryDestination(sd)).Should(HaveOccurred())
+		pl.(*pLog).Close()
+		Ω(pl.Stats()["SecondaryErrorState"]).Should(Equal(0.0))
+
+		By("replaying the secondary")
+		fd, err := NewFileDest(PT+"/second", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		logClient := testLogClient{i: 1}
+		pl, err = NewLog(fd, &logClient, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(logClient.n).Should(Equal(3))
+		pl.(*pLog).Close()
+	})
+
+})
+
+var _ = Describe("ReplayFrom", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+
+	It("replays a log file without a destination", func() {
+		fd, err := NewFileDest(PT+"/replayfrom", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &testLogClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		files, err := filepath.Glob(PT + "/replayfrom-*" + currExt)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files).Should(HaveLen(1))
+		f, err := os.Open(files[0])
+		Ω(err).ShouldNot(HaveOccurred())
+		defer f.Close()
+
+		logClient := testLogClient{i: 1}
+		n, err := ReplayFrom(f, nil, &logClient)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(n).Should(Equal(3))
+		Ω(logClient.n).Should(Equal(3))
+	})
+
+	It("reports a truncated stream", func() {
+		var buf bytes.Buffer
+		enc := GobCodec.NewEncoder(&buf)
+		Ω(enc.Encode(&logEv1{S: "hello world #0!"})).ShouldNot(HaveOccurred())
+		Ω(enc.Encode(&logEv2{A: 55, B: "Hello Again"})).ShouldNot(HaveOccurred())
+		data := buf.Bytes()
+
+		n, err := ReplayFrom(bytes.NewReader(data[:len(data)-3]), GobCodec,
+			&testLogClient{})
+		Ω(err).Should(HaveOccurred())
+		Ω(n).Should(Equal(1))
+	})
+
+})
+
+// log client that panics in Replay or PersistAll
+type panicClient struct {
+	replay   bool // panic in Replay
+	persist  int  // panic in the nth call to PersistAll, 0 for never
+	calls    int
+	live     Log // log to output a live event to before PersistAll panics, if any
+	replayed []interface{}
+}
+
+func (pc *panicClient) Replay(ev interface{}) error {
+	if pc.replay {
+		panic("replay bug")
+	}
+	pc.replayed = append(pc.replayed, ev)
+	return nil
+}
+
+func (pc *panicClient) PersistAll(pl Log) {
+	pc.calls++
+	pl.Output(&logEv1{S: "data"})
+	if pc.calls == pc.persist {
+		if pc.live != nil {
+			pc.live.Output(&logEv1{S: "live"})
+		}
+		panic("persist bug")
+	}
+}
+
+var _ = Describe("Panic containment", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+
+	It("converts a panic in PersistAll during NewLog into an error", func() {
+		fd, err := NewFileDest(PT+"/panic", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer fd.Close()
+		pl, err := NewLog(fd, &panicClient{persist: 1}, log15.Root())
+		Ω(pl).Should(BeNil())
+		Ω(err).Should(MatchError(ContainSubstring("PersistAll panicked: persist bug")))
+		Ω(err.Error()).Should(ContainSubstring("goroutine"))
+	})
+
+	It("converts a panic in Replay into an error", func() {
+		fd, err := NewFileDest(PT+"/panic", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &panicClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		fd, err = NewFileDest(PT+"/panic", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer fd.Close()
+		pl, err = NewLog(fd, &panicClient{replay: true}, log15.Root())
+		Ω(pl).Should(BeNil())
+		Ω(err).Should(MatchError(ContainSubstring("Replay panicked: replay bug")))
+	})
+
+	It("aborts a rotation when PersistAll panics", func() {
+		fd, err := NewFileDest(PT+"/panic", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pc := &panicClient{persist: 2}
+		pl, err := NewLog(fd, pc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		pc.live = pl
+		pl.SetSizeLimit(10)
+		Ω(pl.Output(&logEv1{S: "trigger a rotation"})).ShouldNot(HaveOccurred())
+		Eventually(pl.HealthCheck).Should(MatchError(ContainSubstring("persist bug")))
+		Ω(pl.Output(&logEv1{S: "refused"})).Should(HaveOccurred())
+		Ω(pl.HealthCheck()).Should(HaveOccurred())
+		pl.(*pLog).Close()
+
+		By("replaying the log, including the event output during the failed snapshot")
+		files, err := LogFiles(PT + "/panic")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files).Should(HaveLen(2))
+		Ω(files[1]).Should(HaveSuffix(newExt))
+		fd, err = NewFileDest(PT+"/panic", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pc = &panicClient{}
+		pl, err = NewLog(fd, pc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pc.replayed).Should(ContainElement(&logEv1{S: "live"}))
+		Ω(pc.replayed).ShouldNot(ContainElement(&logEv1{S: "refused"}))
+		Ω(pl.HealthCheck()).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+	})
+})
+
+// log client whose PersistAll hangs after the first call until released
+type hangingClient struct {
+	calls   int
+	release chan struct{}
+}
+
+func (hc *hangingClient) Replay(ev interface{}) error { return nil }
+
+func (hc *hangingClient) PersistAll(pl Log) {
+	hc.calls++
+	if hc.calls > 1 {
+		<-hc.release
+	}
+	pl.Output(&logEv1{S: "data"})
+}
+
+var _ = Describe("Rotation deadline", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+
+	It("abandons a stuck rotation", func() {
+		fd, err := NewFileDest(PT+"/stuck", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		hc := &hangingClient{release: make(chan struct{})}
+		pl, err := NewLog(fd, hc, log15.Root(), WithRotationDeadline(20*time.Millisecond))
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.SetSizeLimit(10)
+		Ω(pl.Output(&logEv1{S: "trigger a rotation"})).ShouldNot(HaveOccurred())
+		Eventually(pl.HealthCheck).Should(MatchError(ContainSubstring("did not complete")))
+		pl.(*pLog).Close()
+
+		By("letting the stuck rotation finish")
+		close(hc.release)
+		Consistently(func() []string {
+			m, _ := filepath.Glob(PT + "/stuck-*" + newExt)
+			return m
+		}, 50*time.Millisecond).Should(HaveLen(1))
+	})
+})
+
+// destination that fails all operations while it's down
+type flakyDest struct {
+	LogDestination
+	down bool
+	sync.Mutex
+}
+
+func (fd *flakyDest) setDown(down bool) {
+	fd.Lock()
+	defer fd.Unlock()
+	fd.down = down
+}
+
+func (fd *flakyDest) err() error {
+	fd.Lock()
+	defer fd.Unlock()
+	if fd.down {
+		return fmt.Errorf("destination is down")
+	}
+	return nil
+}
+
+func (fd *flakyDest) Write(p []byte) (int, error) {
+	if err := fd.err(); err != nil {
+		return 0, err
+	}
+	return fd.LogDestination.Write(p)
+}
+
+func (fd *flakyDest) StartRotate() error {
+	if err := fd.err(); err != nil {
+		return err
+	}
+	return fd.LogDestination.StartRotate()
+}
+
+var _ = Describe("Secondary catch-up", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+
+	stat := func(pl Log, name string) func() float64 {
+		return func() float64 { return pl.Stats()[name] }
+	}
+
+	It("snapshots into a recovered secondary without rotating the primary", func() {
+		pd, err := NewFileDest(PT+"/primary", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{events: []interface{}{&logEv1{S: "a"}, &logEv1{S: "b"}}}
+		pl, err := NewLog(pd, rc, log15.Root(), WithSecondaryRetry(time.Millisecond))
+		Ω(err).ShouldNot(HaveOccurred())
+		sd, err := NewFileDest(PT+"/secondary", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		fsd := &flakyDest{LogDestination: sd}
+		Ω(pl.SetSecondaryDestination(fsd)).ShouldNot(HaveOccurred())
+		Eventually(stat(pl, "Generation")).Should(Equal(2.0))
+		Eventually(func() bool {
+			pl.(*pLog).Lock()
+			defer pl.(*pLog).Unlock()
+			return pl.(*pLog).rotating
+		}).Should(BeFalse())
+
+		By("taking the secondary down")
+		fsd.setDown(true)
+		Ω(pl.Output(&logEv1{S: "c"})).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()["SecondaryErrorState"]).Should(Equal(1.0))
+
+		By("bringing the secondary back")
+		fsd.setDown(false)
+		time.Sleep(5 * time.Millisecond)
+		Ω(pl.Output(&logEv1{S: "d"})).ShouldNot(HaveOccurred())
+		Eventually(stat(pl, "SecondaryCatchUps")).Should(Equal(1.0))
+		Ω(pl.Stats()["SecondaryErrorState"]).Should(Equal(0.0))
+		Ω(pl.Output(&logEv1{S: "e"})).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()["Generation"]).Should(Equal(2.0))
+		pl.(*pLog).Close()
+
+		By("replaying the secondary")
+		sd, err = NewFileDest(PT+"/secondary", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		src := &recordingClient{}
+		pl, err = NewLog(sd, src, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(src.events).Should(Equal([]interface{}{
+			&logEv1{S: "a"}, &logEv1{S: "b"}, &logEv1{S: "e"}}))
+		pl.(*pLog).Close()
+
+		By("replaying the primary")
+		pd, err = NewFileDest(PT+"/primary", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		prc := &recordingClient{}
+		pl, err = NewLog(pd, prc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(prc.events).Should(Equal([]interface{}{&logEv1{S: "a"}, &logEv1{S: "b"},
+			&logEv1{S: "c"}, &logEv1{S: "d"}, &logEv1{S: "e"}}))
+		pl.(*pLog).Close()
+	})
+
+	It("snapshots into a new secondary in the background", func() {
+		var pri, sec bytes.Buffer
+		rc := &recordingClient{events: []interface{}{&logEv1{S: "a"}, &logEv1{S: "b"}}}
+		pl, err := NewLog(NewWriterDest(&pri, nil), rc, log15.Root(),
+			WithBackgroundSecondarySnapshot())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.SetSecondaryDestination(NewWriterDest(&sec, nil))).ShouldNot(HaveOccurred())
+		Eventually(func() bool {
+			pl.(*pLog).Lock()
+			defer pl.(*pLog).Unlock()
+			return pl.(*pLog).catchingUp
+		}).Should(BeFalse())
+		Ω(pl.Output(&logEv1{S: "c"})).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()["Generation"]).Should(Equal(1.0))
+		Ω(pl.Stats()["SecondaryErrorState"]).Should(Equal(0.0))
+		Ω(pl.Stats()["SecondaryCatchUps"]).Should(Equal(0.0))
+		pl.(*pLog).Close()
+
+		src := &recordingClient{}
+		_, err = ReplayFrom(&sec, nil, src)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(src.events).Should(Equal([]interface{}{
+			&logEv1{S: "a"}, &logEv1{S: "b"}, &logEv1{S: "c"}}))
+	})
 })
@@ -0,0 +1,83 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persisttest
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rightscale/persist"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Golden log files are log files checked into a repository as test fixtures in order to lock
+// down the backward compatibility of an application's event schemas: a release generates a
+// golden file with WriteGolden, which is checked in, and the tests of all later releases
+// replay it using ReplayGolden or GoldenLogSet and verify the resulting state.
+
+// GoldenTime is the time recorded in golden log files
+var GoldenTime = time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// goldenLogName is the name of the log file within the log set created by GoldenLogSet
+const goldenLogName = "-20150101-000000-curr.plog"
+
+// UpdateGolden is true if the PERSIST_UPDATE_GOLDEN environment variable is set, tests can
+// use it to decide whether to regenerate golden files
+var UpdateGolden = os.Getenv("PERSIST_UPDATE_GOLDEN") != ""
+
+// WriteGolden writes the events to a golden log file at path, the same events always produce
+// the same file. The log file contains a snapshot as written by persist, using a fixed time
+// and hostname in the metadata record.
+func WriteGolden(path string, events ...interface{}) error {
+	var buf bytes.Buffer
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	_, err := persist.NewLog(persist.NewWriterDest(&buf, nil),
+		&Recorder{Snapshot: events}, log,
+		persist.WithMeta("golden", "", nil),
+		persist.WithHostname("golden"),
+		persist.WithClock(func() time.Time { return GoldenTime }))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// ReplayGolden replays a golden log file into the client and returns the number of events
+// replayed
+func ReplayGolden(path string, client persist.LogClient) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return persist.ReplayFrom(f, nil, client)
+}
+
+// GoldenLogSet copies a golden log file into a log set in dir such that it can be opened
+// using persist.NewFileDest, which exercises the full replay path, and returns the basepath
+// of the log set. The golden file itself is never modified.
+func GoldenLogSet(path, dir string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	basepath := filepath.Join(dir, "golden")
+	dst, err := os.OpenFile(basepath+goldenLogName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return basepath, err
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persisttest
+
+import (
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rightscale/persist"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("Golden", func() {
+
+	const golden = "testdata/golden-v1.plog"
+	events := []interface{}{&testEv{1}, &testEv{2}}
+
+	BeforeEach(func() {
+		if UpdateGolden {
+			Ω(WriteGolden(golden, events...)).ShouldNot(HaveOccurred())
+		}
+	})
+
+	It("replays the checked in golden file", func() {
+		rec := &Recorder{}
+		n, err := ReplayGolden(golden, rec)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(n).Should(Equal(2))
+		Ω(rec.Replayed()).Should(Equal(events))
+	})
+
+	It("writes deterministic files", func() {
+		dir, err := ioutil.TempDir("", "golden")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		Ω(WriteGolden(dir+"/a.plog", events...)).ShouldNot(HaveOccurred())
+		Ω(WriteGolden(dir+"/b.plog", events...)).ShouldNot(HaveOccurred())
+		a, _ := ioutil.ReadFile(dir + "/a.plog")
+		b, _ := ioutil.ReadFile(dir + "/b.plog")
+		Ω(a).Should(Equal(b))
+	})
+
+	It("opens the golden file as a log set", func() {
+		dir, err := ioutil.TempDir("", "golden")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		basepath, err := GoldenLogSet(golden, dir)
+		Ω(err).ShouldNot(HaveOccurred())
+		fd, err := persist.NewFileDest(basepath, false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer fd.Close()
+		rec := &Recorder{}
+		_, err = persist.NewLog(fd, rec, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rec.Replayed()).Should(Equal(events))
+	})
+})
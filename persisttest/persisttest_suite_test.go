@@ -0,0 +1,17 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persisttest
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+func TestPersistTest(t *testing.T) {
+	log15.Root().SetHandler(log15.StreamHandler(GinkgoWriter, log15.TerminalFormat()))
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "persisttest")
+}
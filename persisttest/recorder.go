@@ -0,0 +1,105 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+// Package persisttest provides utilities for testing applications that use persist.
+package persisttest
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/rightscale/persist"
+)
+
+// Call is an invocation of a LogClient method recorded by a Recorder
+type Call struct {
+	Method string      // "Replay" or "PersistAll"
+	Type   string      // type of the replayed event, as printed by %T
+	Event  interface{} // replayed event, nil for PersistAll
+}
+
+// Recorder is a LogClient that records all the calls persist makes into a trace, which
+// allows tests to assert exactly what persist feeds the application, for example after
+// crafting log files in a particular state. On PersistAll it outputs Snapshot or, if
+// Snapshot is nil, all the events it has replayed, such that the log content survives
+// a reopen.
+type Recorder struct {
+	Snapshot  []interface{}              // events output by PersistAll
+	ReplayErr func(ev interface{}) error // optional, produces the result of Replay
+	mu        sync.Mutex
+	trace     []Call
+	replayed  []interface{}
+}
+
+// Replay records the event and returns the result of ReplayErr, if set
+func (r *Recorder) Replay(ev interface{}) error {
+	r.mu.Lock()
+	r.trace = append(r.trace, Call{Method: "Replay", Type: fmt.Sprintf("%T", ev), Event: ev})
+	r.replayed = append(r.replayed, ev)
+	r.mu.Unlock()
+	if r.ReplayErr != nil {
+		return r.ReplayErr(ev)
+	}
+	return nil
+}
+
+// PersistAll records the call and outputs the snapshot
+func (r *Recorder) PersistAll(pl persist.Log) {
+	r.mu.Lock()
+	r.trace = append(r.trace, Call{Method: "PersistAll"})
+	events := r.Snapshot
+	if events == nil {
+		events = append([]interface{}(nil), r.replayed...)
+	}
+	r.mu.Unlock()
+	for _, ev := range events {
+		pl.Output(ev)
+	}
+}
+
+// Trace returns the calls recorded so far in order
+func (r *Recorder) Trace() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Call(nil), r.trace...)
+}
+
+// Replayed returns the events replayed so far in order
+func (r *Recorder) Replayed() []interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]interface{}(nil), r.replayed...)
+}
+
+// Count returns the number of calls of a method, "Replay" or "PersistAll"
+func (r *Recorder) Count(method string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, c := range r.trace {
+		if c.Method == method {
+			n++
+		}
+	}
+	return n
+}
+
+// TypeCounts returns the number of replayed events by type
+func (r *Recorder) TypeCounts() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts := make(map[string]int)
+	for _, c := range r.trace {
+		if c.Method == "Replay" {
+			counts[c.Type]++
+		}
+	}
+	return counts
+}
+
+// Reset clears the trace and the replayed events, e.g., before reopening a log
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.trace = nil
+	r.replayed = nil
+}
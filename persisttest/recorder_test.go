@@ -0,0 +1,60 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persisttest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rightscale/persist"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+type testEv struct {
+	N int
+}
+
+func init() {
+	persist.Register(&testEv{})
+}
+
+var _ = Describe("Recorder", func() {
+
+	It("records what persist feeds the client", func() {
+		var buf bytes.Buffer
+		rec := &Recorder{Snapshot: []interface{}{&testEv{1}, &testEv{2}}}
+		pl, err := persist.NewLog(persist.NewWriterDest(&buf, nil), rec, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&testEv{3})).ShouldNot(HaveOccurred())
+		Ω(rec.Trace()).Should(Equal([]Call{{Method: "PersistAll"}}))
+
+		By("replaying the log")
+		rec = &Recorder{}
+		_, err = persist.NewLog(persist.NewWriterDest(ioutil.Discard,
+			[]io.ReadCloser{ioutil.NopCloser(&buf)}), rec, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rec.Count("Replay")).Should(Equal(3))
+		Ω(rec.Count("PersistAll")).Should(Equal(1))
+		Ω(rec.TypeCounts()).Should(Equal(map[string]int{"*persisttest.testEv": 3}))
+		Ω(rec.Replayed()).Should(Equal([]interface{}{&testEv{1}, &testEv{2}, &testEv{3}}))
+		Ω(rec.Trace()[3]).Should(Equal(Call{Method: "PersistAll"}))
+
+		rec.Reset()
+		Ω(rec.Trace()).Should(BeEmpty())
+	})
+
+	It("produces replay errors", func() {
+		var buf bytes.Buffer
+		_, err := persist.NewLog(persist.NewWriterDest(&buf, nil),
+			&Recorder{Snapshot: []interface{}{&testEv{1}}}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		rec := &Recorder{ReplayErr: func(ev interface{}) error { return fmt.Errorf("boom") }}
+		_, err = persist.ReplayFrom(&buf, nil, rec)
+		Ω(err).Should(MatchError(ContainSubstring("boom")))
+		Ω(rec.Count("Replay")).Should(Equal(1))
+	})
+})
@@ -0,0 +1,70 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package plog
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rightscale/persist"
+)
+
+func init() {
+	commands["archive"] = &command{
+		usage: "<basepath> <bundle>",
+		help:  "write a log set to a single archive bundle with checksums",
+		run:   runArchive,
+	}
+	commands["unarchive"] = &command{
+		usage: "<bundle> <basepath>",
+		help:  "restore an archive bundle as a new log set",
+		run:   runUnarchive,
+	}
+}
+
+func runArchive(fs *flag.FlagSet, args []string, out io.Writer) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("expected a basepath and a bundle")
+	}
+	f, err := os.OpenFile(fs.Arg(1), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660)
+	if err != nil {
+		return err
+	}
+	err = persist.Archive(fs.Arg(0), f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fs.Arg(1))
+	}
+	return err
+}
+
+func runUnarchive(fs *flag.FlagSet, args []string, out io.Writer) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("expected a bundle and a basepath")
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	files, err := persist.Unarchive(f, fs.Arg(1))
+	for _, name := range files {
+		fmt.Fprintf(out, "restored %s\n", name)
+	}
+	return err
+}
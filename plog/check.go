@@ -0,0 +1,43 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package plog
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/rightscale/persist"
+)
+
+func init() {
+	commands["check"] = &command{
+		usage: "<basepath>",
+		help:  "check that a log set can be opened, print the result as JSON",
+		run:   runCheck,
+	}
+}
+
+func runCheck(fs *flag.FlagSet, args []string, out io.Writer) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected a basepath")
+	}
+	res, err := persist.SelfCheck(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%s\n", buf)
+	if !res.OK {
+		return fmt.Errorf("%d problems found", len(res.Problems))
+	}
+	return nil
+}
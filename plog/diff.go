@@ -0,0 +1,192 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package plog
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/rightscale/persist"
+	"github.com/rightscale/persist/kvstate"
+)
+
+func init() {
+	commands["diff"] = &command{
+		usage: "<old basepath|file.plog> <new basepath|file.plog>",
+		help:  "print the differences between the states of two log generations",
+		run:   runDiff,
+	}
+}
+
+// StateClient is a log client that rebuilds the state of a log from its events and exposes
+// it as a map from resource key to resource for comparison
+type StateClient interface {
+	persist.LogClient
+	State() map[string]interface{}
+}
+
+// newStateClient creates the client used to rebuild states, see SetStateClient
+var newStateClient = func() StateClient { return kvState{s: kvstate.New()} }
+
+// SetStateClient sets the function creating the client that rebuilds the state of a log
+// for diff. The default uses kvstate, which requires events to implement
+// persist.KeyedEvent. An application whose events don't fit kvstate provides its own.
+func SetStateClient(f func() StateClient) { newStateClient = f }
+
+// kvState adapts kvstate to the StateClient interface
+type kvState struct{ s *kvstate.State }
+
+func (kv kvState) Replay(ev interface{}) error   { return kv.s.Replay(ev) }
+func (kv kvState) PersistAll(pl persist.Log)     { kv.s.PersistAll(pl) }
+func (kv kvState) State() map[string]interface{} { return kv.s.Items }
+
+// Change is a difference between two states. For an added resource Old is nil and for a
+// removed resource New is nil, otherwise Path is the location of the change within the
+// resource, using the resource's JSON representation, and Old and New the values there.
+type Change struct {
+	Key  string
+	Path string
+	Old  interface{}
+	New  interface{}
+}
+
+// Diff compares two states and returns the changes in key order
+func Diff(oldState, newState map[string]interface{}) []Change {
+	keys := make(map[string]bool)
+	for k := range oldState {
+		keys[k] = true
+	}
+	for k := range newState {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var changes []Change
+	for _, k := range sorted {
+		o, inOld := oldState[k]
+		n, inNew := newState[k]
+		switch {
+		case !inOld:
+			changes = append(changes, Change{Key: k, New: n})
+		case !inNew:
+			changes = append(changes, Change{Key: k, Old: o})
+		default:
+			changes = diffValues(changes, k, "", toGeneric(o), toGeneric(n))
+		}
+	}
+	return changes
+}
+
+// toGeneric converts a value to its JSON representation as maps, slices, and scalars
+func toGeneric(v interface{}) interface{} {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%#v", v)
+	}
+	var g interface{}
+	json.Unmarshal(buf, &g)
+	return g
+}
+
+// diffValues appends the differences between two generic values to changes
+func diffValues(changes []Change, key, path string, o, n interface{}) []Change {
+	om, oOK := o.(map[string]interface{})
+	nm, nOK := n.(map[string]interface{})
+	if oOK && nOK {
+		fields := make(map[string]bool)
+		for f := range om {
+			fields[f] = true
+		}
+		for f := range nm {
+			fields[f] = true
+		}
+		sorted := make([]string, 0, len(fields))
+		for f := range fields {
+			sorted = append(sorted, f)
+		}
+		sort.Strings(sorted)
+		for _, f := range sorted {
+			changes = diffValues(changes, key, path+"."+f, om[f], nm[f])
+		}
+		return changes
+	}
+	if !reflect.DeepEqual(o, n) {
+		if path == "" {
+			path = "."
+		}
+		changes = append(changes, Change{Key: key, Path: path, Old: o, New: n})
+	}
+	return changes
+}
+
+// replayState rebuilds the state of a log file or of the current generation of a log set
+func replayState(src string) (map[string]interface{}, error) {
+	files := []string{src}
+	if !strings.HasSuffix(src, ".plog") {
+		var err error
+		if files, err = persist.ReplayFiles(src); err != nil {
+			return nil, err
+		}
+	}
+	client := newStateClient()
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		_, err = persist.ReplayFrom(f, nil, client)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err.Error())
+		}
+	}
+	return client.State(), nil
+}
+
+func runDiff(fs *flag.FlagSet, args []string, out io.Writer) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("expected two logs to compare")
+	}
+	oldState, err := replayState(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	newState, err := replayState(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	for _, c := range Diff(oldState, newState) {
+		switch {
+		case c.Path == "" && c.Old == nil:
+			fmt.Fprintf(out, "+ %s: %s\n", c.Key, jsonString(c.New))
+		case c.Path == "":
+			fmt.Fprintf(out, "- %s: %s\n", c.Key, jsonString(c.Old))
+		default:
+			fmt.Fprintf(out, "~ %s %s: %s -> %s\n", c.Key, c.Path, jsonString(c.Old),
+				jsonString(c.New))
+		}
+	}
+	return nil
+}
+
+func jsonString(v interface{}) string {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%#v", v)
+	}
+	return string(buf)
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package plog
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("diff", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+
+	It("compares states", func() {
+		changes := Diff(
+			map[string]interface{}{"a": &userEv{Name: "a", Quota: 1}, "b": &userEv{Name: "b"}},
+			map[string]interface{}{"a": &userEv{Name: "a", Quota: 2}, "c": &userEv{Name: "c"}})
+		Ω(changes).Should(Equal([]Change{
+			{Key: "a", Path: ".Quota", Old: 1.0, New: 2.0},
+			{Key: "b", Old: &userEv{Name: "b"}},
+			{Key: "c", New: &userEv{Name: "c"}},
+		}))
+	})
+
+	It("compares a log file to a log set", func() {
+		writeLog(PT+"/old", &userEv{Name: "a", Quota: 1}, &userEv{Name: "b"})
+		files, err := filepath.Glob(PT + "/old*.plog")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files).Should(HaveLen(1))
+
+		pl := writeLog(PT+"/new", &userEv{Name: "a", Quota: 1}, &userEv{Name: "b"})
+		Ω(pl.Output(&userEv{Name: "a", Quota: 5})).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&userEv{Name: "c"})).ShouldNot(HaveOccurred())
+
+		code, stdout, stderr := run("diff", files[0], PT+"/new")
+		Ω(stderr).Should(BeEmpty())
+		Ω(code).Should(Equal(0))
+		Ω(stdout).Should(Equal("~ a .Quota: 1 -> 5\n+ c: {\"Name\":\"c\",\"Quota\":0}\n"))
+	})
+})
@@ -0,0 +1,23 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package plog
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+// FuzzScan verifies that scanning corrupt log files never panics nor loops, run it using
+// go test -fuzz FuzzScan
+func FuzzScan(f *testing.F) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	for _, ev := range []interface{}{&userEv{Name: "a"}, &deleteEv{Name: "a"}} {
+		enc.Encode(&ev)
+	}
+	f.Add(buf.Bytes())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		scan(bytes.NewReader(data), func(ev *event) error { return nil })
+	})
+}
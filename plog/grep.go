@@ -0,0 +1,94 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package plog
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rightscale/persist"
+)
+
+func init() {
+	commands["grep"] = &command{
+		usage: "-type <type> [-key <key>] [-ns <ns>] [-ann <k>=<v>] <basepath|file.plog>...",
+		help:  "print the events of a given type and resource key as JSON",
+		run:   runGrep,
+	}
+}
+
+// grepMatch is the JSON output for each matching event
+type grepMatch struct {
+	File  string      `json:"file"`
+	Type  string      `json:"type"`
+	NS    string      `json:"ns,omitempty"`
+	Key   string      `json:"key,omitempty"`
+	Event interface{} `json:"event"`
+
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+func runGrep(fs *flag.FlagSet, args []string, out io.Writer) error {
+	typ := fs.String("type", "", "event type, e.g. *main.Foo, main.Foo, or Foo")
+	key := fs.String("key", "", "resource key, see persist.KeyedEvent")
+	ns := fs.String("ns", "", "namespace, see persist.OutputNS, none for all")
+	ann := fs.String("ann", "", "annotation, e.g. subsystem=billing, see persist.Annotate")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *typ == "" {
+		return fmt.Errorf("-type is required")
+	}
+	annSet := *ann != ""
+	kv := strings.SplitN(*ann, "=", 2)
+	if annSet && len(kv) != 2 {
+		return fmt.Errorf("-ann must be of the form <key>=<value>")
+	}
+	files, err := logFiles(fs.Args())
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(out)
+	for _, f := range files {
+		err := scanFile(f, func(ev *event) error {
+			if ev.Err != nil || !typeMatches(ev.Type, *typ) {
+				return nil
+			}
+			if *ns != "" && ev.NS != *ns {
+				return nil
+			}
+			if v, ok := ev.Ann[kv[0]]; annSet && (!ok || v != kv[1]) {
+				return nil
+			}
+			m := grepMatch{File: f, Type: ev.Type, NS: ev.NS, Event: ev.Value,
+				Annotations: ev.Ann}
+			if ke, ok := ev.Value.(persist.KeyedEvent); ok {
+				m.Key = ke.EventKey()
+			}
+			if *key != "" && m.Key != *key {
+				return nil
+			}
+			return enc.Encode(&m)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// typeMatches returns true if a type name matches a pattern, the pattern may omit the
+// pointer and the package, e.g. "*main.Foo" matches "*main.Foo", "main.Foo", and "Foo"
+func typeMatches(name, pattern string) bool {
+	if name == pattern {
+		return true
+	}
+	name = strings.TrimPrefix(name, "*")
+	if name == pattern {
+		return true
+	}
+	return name[strings.LastIndex(name, ".")+1:] == pattern
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package plog
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rightscale/persist"
+)
+
+var _ = Describe("grep", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+
+	// grep runs the grep command and decodes the JSON output
+	grep := func(args ...string) []grepMatch {
+		code, stdout, stderr := run(append([]string{"grep"}, args...)...)
+		Ω(stderr).Should(BeEmpty())
+		Ω(code).Should(Equal(0))
+		var res []grepMatch
+		for _, l := range strings.Split(strings.TrimSpace(stdout), "\n") {
+			if l == "" {
+				continue
+			}
+			var m grepMatch
+			Ω(json.Unmarshal([]byte(l), &m)).ShouldNot(HaveOccurred())
+			res = append(res, m)
+		}
+		return res
+	}
+
+	It("selects events by type and key", func() {
+		pl := writeLog(PT+"/grep", &userEv{Name: "a", Quota: 1}, &userEv{Name: "b"},
+			&deleteEv{Name: "a"})
+		Ω(pl.Output(&userEv{Name: "a", Quota: 2})).ShouldNot(HaveOccurred())
+
+		Ω(grep("-type", "userEv", PT+"/grep")).Should(HaveLen(3))
+		Ω(grep("-type", "*plog.deleteEv", PT+"/grep")).Should(HaveLen(1))
+		Ω(grep("-type", "plog.nothing", PT+"/grep")).Should(BeEmpty())
+
+		res := grep("-type", "plog.userEv", "-key", "a", PT+"/grep")
+		Ω(res).Should(HaveLen(2))
+		Ω(res[0].Key).Should(Equal("a"))
+		Ω(res[1].Event).Should(Equal(map[string]interface{}{"Name": "a", "Quota": 2.0}))
+
+		// deleteEv is not keyed and thus never matches a key
+		Ω(grep("-type", "deleteEv", "-key", "a", PT+"/grep")).Should(BeEmpty())
+	})
+
+	It("selects events by namespace", func() {
+		pl := writeLog(PT+"/grep", &userEv{Name: "a"})
+		Ω(persist.OutputNS(pl, "t1", &userEv{Name: "b"})).ShouldNot(HaveOccurred())
+		Ω(persist.OutputNS(pl, "t2", &userEv{Name: "c"})).ShouldNot(HaveOccurred())
+
+		Ω(grep("-type", "userEv", PT+"/grep")).Should(HaveLen(3))
+		res := grep("-type", "userEv", "-ns", "t1", PT+"/grep")
+		Ω(res).Should(HaveLen(1))
+		Ω(res[0].NS).Should(Equal("t1"))
+		Ω(res[0].Key).Should(Equal("b"))
+		Ω(res[0].Event).Should(Equal(map[string]interface{}{"Name": "b", "Quota": 0.0}))
+	})
+
+	It("selects events by annotation", func() {
+		pl := writeLog(PT+"/grep", &userEv{Name: "a"})
+		ann := map[string]string{"subsystem": "billing"}
+		Ω(persist.Annotate(pl, ann, &userEv{Name: "b"})).ShouldNot(HaveOccurred())
+
+		Ω(grep("-type", "userEv", PT+"/grep")).Should(HaveLen(2))
+		res := grep("-type", "userEv", "-ann", "subsystem=billing", PT+"/grep")
+		Ω(res).Should(HaveLen(1))
+		Ω(res[0].Key).Should(Equal("b"))
+		Ω(res[0].Annotations).Should(Equal(ann))
+		Ω(grep("-type", "userEv", "-ann", "subsystem=auth", PT+"/grep")).Should(BeEmpty())
+
+		code, _, stderr := run("grep", "-type", "userEv", "-ann", "billing", PT+"/grep")
+		Ω(code).Should(Equal(1))
+		Ω(stderr).Should(ContainSubstring("-ann must be of the form"))
+	})
+
+	It("requires a type", func() {
+		code, _, stderr := run("grep", PT+"/grep")
+		Ω(code).Should(Equal(1))
+		Ω(stderr).Should(ContainSubstring("-type is required"))
+	})
+})
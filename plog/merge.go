@@ -0,0 +1,208 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package plog
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rightscale/persist"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+func init() {
+	commands["merge"] = &command{
+		usage: "-o <basepath> [-conflict error|first|last] <basepath|file.plog>...",
+		help:  "merge several log sets into a new log set",
+		run:   runMerge,
+	}
+}
+
+// ConflictFunc resolves a conflict when merging logs: a keyed event from one source refers to
+// a resource whose latest event, existing, comes from another source. It returns the event
+// to output to the merged log, nil to drop the incoming event, or an error to abort.
+type ConflictFunc func(key string, existing, incoming interface{}) (interface{}, error)
+
+// ConflictError aborts the merge, it is the default conflict resolution
+func ConflictError(key string, existing, incoming interface{}) (interface{}, error) {
+	return nil, fmt.Errorf("conflict on key %s", key)
+}
+
+// ConflictFirst keeps the resource of the source that is merged first
+func ConflictFirst(key string, existing, incoming interface{}) (interface{}, error) {
+	return nil, nil
+}
+
+// ConflictLast keeps the resource of the source that is merged last
+func ConflictLast(key string, existing, incoming interface{}) (interface{}, error) {
+	return incoming, nil
+}
+
+// conflictHook is the conflict resolution used by the merge command unless overridden
+var conflictHook ConflictFunc = ConflictError
+
+// SetConflictFunc sets the conflict resolution used by the merge command when no -conflict
+// flag is given, allowing an application to resolve conflicts using its own rules
+func SetConflictFunc(f ConflictFunc) { conflictHook = f }
+
+// mergeSource is a log being merged
+type mergeSource struct {
+	name  string
+	files []string
+	start time.Time // start of the generation, from its metadata record
+}
+
+// mergeClient collects the merged events and outputs them as the snapshot of the new log
+type mergeClient struct {
+	events   []interface{}
+	src      int                    // index of the source being replayed
+	owner    map[string]int         // source of the latest event of each key
+	latest   map[string]interface{} // latest event of each key
+	conflict ConflictFunc
+}
+
+func (mc *mergeClient) Replay(ev interface{}) error {
+	ke, ok := ev.(persist.KeyedEvent)
+	if !ok {
+		mc.events = append(mc.events, ev)
+		return nil
+	}
+	key := ke.EventKey()
+	if owner, ok := mc.owner[key]; ok && owner != mc.src {
+		res, err := mc.conflict(key, mc.latest[key], ev)
+		if err != nil || res == nil {
+			return err
+		}
+		ev = res
+	}
+	mc.owner[key] = mc.src
+	mc.latest[key] = ev
+	mc.events = append(mc.events, ev)
+	return nil
+}
+
+func (mc *mergeClient) PersistAll(pl persist.Log) {
+	for _, ev := range mc.events {
+		pl.Output(ev)
+	}
+}
+
+// Merge merges the current generation of several log sets or log files into a new log
+// written to out, which must not hold a log yet. Sources are merged in the order of the
+// start time of their generation, as recorded in their metadata, the events of each source
+// being merged in sequence. Keyed events that refer to a resource seen in another source
+// are passed to the conflict function, which defaults to ConflictError if nil.
+func Merge(out persist.LogDestination, sources []string, conflict ConflictFunc,
+	log log15.Logger) (persist.Log, error) {
+
+	if len(out.ReplayReaders()) > 0 {
+		return nil, fmt.Errorf("output log is not empty")
+	}
+	if conflict == nil {
+		conflict = ConflictError
+	}
+	srcs := make([]*mergeSource, len(sources))
+	for i, s := range sources {
+		ms, err := openMergeSource(s)
+		if err != nil {
+			return nil, err
+		}
+		srcs[i] = ms
+	}
+	sort.SliceStable(srcs, func(i, j int) bool { return srcs[i].start.Before(srcs[j].start) })
+
+	mc := &mergeClient{owner: map[string]int{}, latest: map[string]interface{}{},
+		conflict: conflict}
+	for i, ms := range srcs {
+		mc.src = i
+		for _, name := range ms.files {
+			f, err := os.Open(name)
+			if err != nil {
+				return nil, err
+			}
+			_, err = persist.ReplayFrom(f, nil, mc)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err.Error())
+			}
+		}
+	}
+	return persist.NewLog(out, mc, log)
+}
+
+// openMergeSource determines the files of a source and the start time of its generation
+func openMergeSource(src string) (*mergeSource, error) {
+	ms := &mergeSource{name: src, files: []string{src}}
+	if !strings.HasSuffix(src, ".plog") {
+		var err error
+		if ms.files, err = persist.ReplayFiles(src); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.Open(ms.files[0])
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	meta, err := persist.ReplayMeta(f, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", ms.files[0], err.Error())
+	}
+	if meta != nil {
+		ms.start = meta.Start
+	}
+	return ms, nil
+}
+
+func runMerge(fs *flag.FlagSet, args []string, out io.Writer) error {
+	output := fs.String("o", "", "basepath of the merged log set, which must not exist")
+	policy := fs.String("conflict", "", "conflict resolution: error, first, or last")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *output == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("an output basepath and at least one source are required")
+	}
+	conflict := conflictHook
+	switch *policy {
+	case "":
+	case "error":
+		conflict = ConflictError
+	case "first":
+		conflict = ConflictFirst
+	case "last":
+		conflict = ConflictLast
+	default:
+		return fmt.Errorf("unknown conflict resolution: %s", *policy)
+	}
+
+	if files, err := persist.LogFiles(*output); err != nil {
+		return err
+	} else if len(files) > 0 {
+		return fmt.Errorf("log files already exist at %s", *output)
+	}
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	dest, err := persist.NewFileDest(*output, true, log)
+	if err != nil {
+		return err
+	}
+	_, err = Merge(dest, fs.Args(), conflict, log)
+	dest.Close()
+	if err != nil {
+		// don't leave a partial log behind
+		files, _ := persist.LogFiles(*output)
+		for _, f := range files {
+			os.Remove(f)
+		}
+		return err
+	}
+	fmt.Fprintf(out, "merged %d sources into %s\n", fs.NArg(), *output)
+	return nil
+}
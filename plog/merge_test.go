@@ -0,0 +1,80 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package plog
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rightscale/persist"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("merge", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+		writeLog(PT+"/shard1", &userEv{Name: "a", Quota: 1}, &userEv{Name: "b", Quota: 1},
+			&deleteEv{Name: "x"})
+		writeLog(PT+"/shard2", &userEv{Name: "c", Quota: 2}, &userEv{Name: "b", Quota: 2})
+	})
+
+	// replayMerged replays the merged log and returns its events
+	replayMerged := func() []interface{} {
+		fd, err := persist.NewFileDest(PT+"/merged", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer fd.Close()
+		tc := &testClient{}
+		for _, rr := range fd.ReplayReaders() {
+			_, err := persist.ReplayFrom(rr, nil, tc)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+		return tc.events
+	}
+
+	It("merges log sets in generation order", func() {
+		code, stdout, stderr := run("merge", "-o", PT+"/merged", "-conflict", "last",
+			PT+"/shard2", PT+"/shard1")
+		Ω(stderr).Should(BeEmpty())
+		Ω(code).Should(Equal(0))
+		Ω(stdout).Should(ContainSubstring("merged 2 sources"))
+		Ω(replayMerged()).Should(Equal([]interface{}{
+			&userEv{Name: "a", Quota: 1}, &userEv{Name: "b", Quota: 1}, &deleteEv{Name: "x"},
+			&userEv{Name: "c", Quota: 2}, &userEv{Name: "b", Quota: 2}}))
+	})
+
+	It("resolves conflicts", func() {
+		code, _, _ := run("merge", "-o", PT+"/merged", "-conflict", "first",
+			PT+"/shard1", PT+"/shard2")
+		Ω(code).Should(Equal(0))
+		Ω(replayMerged()).Should(Equal([]interface{}{
+			&userEv{Name: "a", Quota: 1}, &userEv{Name: "b", Quota: 1}, &deleteEv{Name: "x"},
+			&userEv{Name: "c", Quota: 2}}))
+	})
+
+	It("calls the conflict hook", func() {
+		var keys []string
+		fd, err := persist.NewFileDest(PT+"/merged", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = Merge(fd, []string{PT + "/shard1", PT + "/shard2"},
+			func(key string, existing, incoming interface{}) (interface{}, error) {
+				keys = append(keys, key)
+				return &userEv{Name: key, Quota: 3}, nil
+			}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		fd.Close()
+		Ω(keys).Should(Equal([]string{"b"}))
+		Ω(replayMerged()).Should(ContainElement(&userEv{Name: "b", Quota: 3}))
+	})
+
+	It("aborts on conflicts by default", func() {
+		code, _, stderr := run("merge", "-o", PT+"/merged", PT+"/shard1", PT+"/shard2")
+		Ω(code).Should(Equal(1))
+		Ω(stderr).Should(ContainSubstring("conflict on key b"))
+		files, err := persist.LogFiles(PT + "/merged")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files).Should(BeEmpty())
+	})
+})
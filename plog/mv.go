@@ -0,0 +1,34 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package plog
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/rightscale/persist"
+)
+
+func init() {
+	commands["mv"] = &command{
+		usage: "<old basepath> <new basepath>",
+		help:  "move or rename a log set, the application must be stopped",
+		run:   runMv,
+	}
+}
+
+func runMv(fs *flag.FlagSet, args []string, out io.Writer) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("expected the old and the new basepath")
+	}
+	if err := persist.MoveLogSet(fs.Arg(0), fs.Arg(1)); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "moved %s to %s\n", fs.Arg(0), fs.Arg(1))
+	return nil
+}
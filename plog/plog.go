@@ -0,0 +1,93 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+// Package plog implements command line tools to inspect persist log files. The tools decode
+// log events and thus require the application's event types to be registered, which is
+// why an application typically builds its own tool by registering its types and calling
+// Main:
+//
+//	func main() {
+//		myapp.RegisterLogTypes()
+//		os.Exit(plog.Main(os.Args[1:], os.Stdout, os.Stderr))
+//	}
+//
+// The cmd/plog command is such a tool without any application types. It can still report
+// the composition of a log because events of unregistered types are tallied by type name.
+package plog
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/rightscale/persist"
+)
+
+// a command implemented by the tool
+type command struct {
+	usage string // argument synopsis
+	help  string // one-line description
+	run   func(fs *flag.FlagSet, args []string, out io.Writer) error
+}
+
+var commands = map[string]*command{}
+
+// Main runs the tool with the command line arguments (without the program name), writing
+// results to stdout and errors to stderr, and returns the process exit code
+func Main(args []string, stdout, stderr io.Writer) int {
+	if len(args) < 1 || commands[args[0]] == nil {
+		usage(stderr)
+		return 2
+	}
+	cmd := commands[args[0]]
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: plog %s %s\n", args[0], cmd.usage)
+		fs.PrintDefaults()
+	}
+	if err := cmd.run(fs, args[1:], stdout); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintf(stderr, "plog %s: %s\n", args[0], err.Error())
+		}
+		return 1
+	}
+	return 0
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: plog <command> [arguments]\n\ncommands:\n")
+	var names []string
+	for n := range commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Fprintf(w, "  %-10s %s\n", n, commands[n].help)
+	}
+}
+
+// logFiles expands the arguments into a list of log files: arguments ending in .plog are
+// files while anything else is the basepath of a log set
+func logFiles(args []string) ([]string, error) {
+	var files []string
+	for _, a := range args {
+		if strings.HasSuffix(a, ".plog") {
+			files = append(files, a)
+			continue
+		}
+		m, err := persist.LogFiles(a)
+		if err != nil {
+			return nil, err
+		}
+		if len(m) == 0 {
+			return nil, fmt.Errorf("no log files found at %s", a)
+		}
+		files = append(files, m...)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no log files specified")
+	}
+	return files, nil
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package plog
+
+import (
+	"bytes"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rightscale/persist"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// directory where the tests write log files
+const PT = "/tmp/plog_test"
+
+// event types written to the test logs
+type userEv struct {
+	Name  string
+	Quota int
+}
+type deleteEv struct {
+	Name string
+}
+
+func (u *userEv) EventKey() string { return u.Name }
+
+func init() {
+	persist.Register(&userEv{})
+	persist.Register(&deleteEv{})
+}
+
+// log client that persists a fixed set of events
+type testClient struct {
+	events []interface{}
+}
+
+func (tc *testClient) Replay(ev interface{}) error {
+	tc.events = append(tc.events, ev)
+	return nil
+}
+
+func (tc *testClient) PersistAll(pl persist.Log) {
+	for _, ev := range tc.events {
+		Ω(pl.Output(ev)).ShouldNot(HaveOccurred())
+	}
+}
+
+// writeLog creates a log set at basepath holding the events and returns the log
+func writeLog(basepath string, events ...interface{}) persist.Log {
+	fd, err := persist.NewFileDest(basepath, true, nil)
+	Ω(err).ShouldNot(HaveOccurred())
+	pl, err := persist.NewLog(fd, &testClient{events: events}, log15.Root(),
+		persist.WithMeta("plogtest", "0.1", nil))
+	Ω(err).ShouldNot(HaveOccurred())
+	return pl
+}
+
+// run runs the tool and returns its exit code and output
+func run(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := Main(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+var _ = Describe("Main", func() {
+
+	It("prints usage", func() {
+		code, _, stderr := run()
+		Ω(code).Should(Equal(2))
+		Ω(stderr).Should(ContainSubstring("stats"))
+
+		code, _, _ = run("nosuchcommand")
+		Ω(code).Should(Equal(2))
+	})
+
+	It("reports missing log files", func() {
+		os.RemoveAll(PT)
+		code, _, stderr := run("stats", PT+"/none")
+		Ω(code).Should(Equal(1))
+		Ω(stderr).Should(ContainSubstring("no log files found"))
+	})
+})
@@ -0,0 +1,118 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package plog
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+
+	"github.com/rightscale/persist"
+)
+
+// event is a log event as seen by the tools
+type event struct {
+	Type  string      // type name, known even if the event cannot be decoded
+	NS    string      // namespace, see persist.OutputNS
+	Size  int64       // bytes in the log, including any type definitions preceding it
+	Value interface{} // decoded event, nil if Err is set
+	Err   error       // decoding error
+
+	Ann map[string]string // annotations, see persist.Annotate
+}
+
+// countingReader counts the bytes read, it implements io.ByteReader so the gob decoder
+// doesn't add buffering of its own and the count reflects what has been decoded
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.n++
+	}
+	return b, err
+}
+
+// unregistered extracts the type name from the error gob produces for unregistered types
+var unregistered = regexp.MustCompile(`name not registered for interface: "(.*)"`)
+
+// orphanValue matches the error gob produces when decoding the value part of an event
+// whose type could not be decoded: the first time gob sends an event of a given type the
+// value follows the type definition in a separate message, which is left behind when
+// the type name is not registered
+var orphanValue = regexp.MustCompile(`can only be decoded from remote interface type`)
+
+// scan decodes all events in a log stream and calls fn for each one. Events that fail to
+// decode are passed to fn with Err set and scanning continues. Scanning stops at the end of
+// the stream, when fn returns an error, or if the stream is corrupt or truncated, in which
+// case an error is returned.
+func scan(r io.Reader, fn func(ev *event) error) error {
+	cr := &countingReader{r: bufio.NewReader(r)}
+	dec := persist.GobCodec.NewDecoder(cr)
+	var prev *event // event not yet passed to fn, it may have an orphaned value
+	var scanErr error
+	for {
+		start := cr.n
+		v, err := dec.Decode()
+		if err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			scanErr = fmt.Errorf("truncated at offset %d", start)
+			break
+		} else if err != nil && cr.n == start {
+			scanErr = fmt.Errorf("corrupt at offset %d: %s", start, err.Error())
+			break
+		}
+		if err != nil && prev != nil && prev.Err != nil && orphanValue.MatchString(err.Error()) {
+			prev.Size += cr.n - start
+			continue
+		}
+		ev := &event{Size: cr.n - start, Value: v, Err: err}
+		if err == nil {
+			ev.Ann = persist.Annotations(v)
+			ev.NS, ev.Value = persist.Namespace(v)
+			v = ev.Value
+			ev.Type = fmt.Sprintf("%T", v)
+		} else if m := unregistered.FindStringSubmatch(err.Error()); m != nil {
+			ev.Type = m[1]
+		} else {
+			ev.Type = "<undecodable>"
+		}
+		if prev != nil {
+			if err := fn(prev); err != nil {
+				return err
+			}
+		}
+		prev = ev
+	}
+	if prev != nil {
+		if err := fn(prev); err != nil {
+			return err
+		}
+	}
+	return scanErr
+}
+
+// scanFile scans a log file, see scan
+func scanFile(name string, fn func(ev *event) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := scan(f, fn); err != nil {
+		return fmt.Errorf("%s: %s", name, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package plog
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rightscale/persist"
+)
+
+func init() {
+	commands["stats"] = &command{
+		usage: "<basepath|file.plog>...",
+		help:  "print per-file and per-type statistics of log sets",
+		run:   runStats,
+	}
+}
+
+// typeStats tallies the events of one type
+type typeStats struct {
+	name   string
+	count  int
+	bytes  int64
+	failed int // events that could not be decoded
+}
+
+// fileStats tallies the events of one log file
+type fileStats struct {
+	name   string
+	meta   *persist.GenerationMeta
+	count  int
+	bytes  int64
+	types  map[string]*typeStats
+	errMsg string // error that stopped the scan
+}
+
+func runStats(fs *flag.FlagSet, args []string, out io.Writer) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	files, err := logFiles(fs.Args())
+	if err != nil {
+		return err
+	}
+	total := &fileStats{name: "TOTAL", types: map[string]*typeStats{}}
+	for _, f := range files {
+		st := fileStatsOf(f)
+		printStats(out, st)
+		total.count += st.count
+		total.bytes += st.bytes
+		for _, ts := range st.types {
+			tt := total.types[ts.name]
+			if tt == nil {
+				tt = &typeStats{name: ts.name}
+				total.types[ts.name] = tt
+			}
+			tt.count += ts.count
+			tt.bytes += ts.bytes
+			tt.failed += ts.failed
+		}
+	}
+	if len(files) > 1 {
+		printStats(out, total)
+	}
+	return nil
+}
+
+// fileStatsOf scans a log file and tallies its events, scanning errors are recorded in
+// the stats so the remaining files can still be reported on
+func fileStatsOf(name string) *fileStats {
+	st := &fileStats{name: name, types: map[string]*typeStats{}}
+	err := scanFile(name, func(ev *event) error {
+		if m, ok := ev.Value.(*persist.GenerationMeta); ok {
+			st.meta = m
+		}
+		st.count++
+		st.bytes += ev.Size
+		ts := st.types[ev.Type]
+		if ts == nil {
+			ts = &typeStats{name: ev.Type}
+			st.types[ev.Type] = ts
+		}
+		ts.count++
+		ts.bytes += ev.Size
+		if ev.Err != nil {
+			ts.failed++
+		}
+		return nil
+	})
+	if err != nil {
+		st.errMsg = err.Error()
+	}
+	return st
+}
+
+func printStats(out io.Writer, st *fileStats) {
+	fmt.Fprintf(out, "%s: %d events, %d bytes\n", st.name, st.count, st.bytes)
+	if m := st.meta; m != nil {
+		fmt.Fprintf(out, "  gen=%d format=%d app=%s version=%s host=%s start=%s\n", m.Gen,
+			m.Format, m.App, m.Version, m.Hostname, m.Start.Format(time.RFC3339))
+		var keys []string
+		for k := range m.Extra {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(out, "  %s=%s\n", k, m.Extra[k])
+		}
+	}
+	var types []*typeStats
+	for _, ts := range st.types {
+		types = append(types, ts)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].name < types[j].name })
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "  EVENTS\tBYTES\tUNDECODABLE\tTYPE\n")
+	for _, ts := range types {
+		fmt.Fprintf(tw, "  %d\t%d\t%d\t%s\n", ts.count, ts.bytes, ts.failed, ts.name)
+	}
+	tw.Flush()
+	if st.errMsg != "" {
+		fmt.Fprintf(out, "  error: %s\n", st.errMsg)
+	}
+}
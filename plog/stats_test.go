@@ -0,0 +1,78 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package plog
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("stats", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+
+	It("tallies events per type", func() {
+		pl := writeLog(PT+"/stats", &userEv{Name: "a", Quota: 1}, &userEv{Name: "b"},
+			&deleteEv{Name: "a"})
+		Ω(pl.Output(&deleteEv{Name: "b"})).ShouldNot(HaveOccurred())
+
+		code, stdout, stderr := run("stats", PT+"/stats")
+		Ω(stderr).Should(BeEmpty())
+		Ω(code).Should(Equal(0))
+		Ω(stdout).Should(ContainSubstring("5 events"))
+		Ω(stdout).Should(ContainSubstring("app=plogtest version=0.1"))
+		Ω(stdout).Should(MatchRegexp(`2 +\d+ +0 +\*plog.userEv`))
+		Ω(stdout).Should(MatchRegexp(`2 +\d+ +0 +\*plog.deleteEv`))
+		Ω(stdout).Should(MatchRegexp(`1 +\d+ +0 +\*persist.GenerationMeta`))
+	})
+
+	It("reports truncated files", func() {
+		writeLog(PT+"/trunc", &userEv{Name: "a"}, &userEv{Name: "b"})
+		files, err := filepath.Glob(PT + "/trunc*.plog")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files).Should(HaveLen(1))
+		fi, err := os.Stat(files[0])
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(os.Truncate(files[0], fi.Size()-2)).ShouldNot(HaveOccurred())
+
+		code, stdout, _ := run("stats", files[0])
+		Ω(code).Should(Equal(0))
+		Ω(stdout).Should(ContainSubstring("2 events"))
+		Ω(stdout).Should(ContainSubstring("error: " + files[0] + ": truncated at offset"))
+	})
+
+	It("tallies events of unregistered types by name", func() {
+		// produce a stream whose type name is unknown by renaming the type in the data
+		var buf bytes.Buffer
+		enc := gob.NewEncoder(&buf)
+		for i := 0; i < 3; i++ {
+			var ev interface{} = &userEv{Name: "x", Quota: i}
+			Ω(enc.Encode(&ev)).ShouldNot(HaveOccurred())
+		}
+		size := buf.Len()
+		data := bytes.Replace(buf.Bytes(), []byte("*plog.userEv"), []byte("*plog.otherE"), -1)
+
+		var evs []*event
+		err := scan(bytes.NewReader(data), func(ev *event) error {
+			evs = append(evs, ev)
+			return nil
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(evs).Should(HaveLen(3))
+		var total int64
+		for _, ev := range evs {
+			Ω(ev.Type).Should(Equal("*plog.otherE"))
+			Ω(ev.Err).Should(HaveOccurred())
+			total += ev.Size
+		}
+		Ω(total).Should(Equal(int64(size)))
+	})
+})
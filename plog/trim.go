@@ -0,0 +1,40 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package plog
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/rightscale/persist"
+)
+
+func init() {
+	commands["trim"] = &command{
+		usage: "[-keep-generations N] [-n] <basepath>",
+		help:  "remove log files not needed for replay",
+		run:   runTrim,
+	}
+}
+
+func runTrim(fs *flag.FlagSet, args []string, out io.Writer) error {
+	keep := fs.Int("keep-generations", 1, "generations to keep, including the current one")
+	dryRun := fs.Bool("n", false, "dry run, only print the files that would be removed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected a basepath")
+	}
+	trim, err := persist.TrimLogSet(fs.Arg(0), *keep, *dryRun)
+	for _, f := range trim {
+		if *dryRun {
+			fmt.Fprintf(out, "would remove %s\n", f)
+		} else {
+			fmt.Fprintf(out, "removed %s\n", f)
+		}
+	}
+	return err
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package plog
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rightscale/persist"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+func init() {
+	commands["verify"] = &command{
+		usage: "[-interval duration] <basepath>",
+		help:  "verify the recorded checksums of log files, once or periodically",
+		run:   runVerify,
+	}
+}
+
+func runVerify(fs *flag.FlagSet, args []string, out io.Writer) error {
+	interval := fs.Duration("interval", 0, "verify periodically instead of once")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected a basepath")
+	}
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+	v := persist.NewVerifier(fs.Arg(0), *interval, func(file string, err error) {
+		fmt.Fprintf(out, "%s: CORRUPT: %s\n", time.Now().UTC().Format(time.RFC3339),
+			err.Error())
+	}, log)
+	for {
+		n, err := v.VerifyOnce()
+		if *interval == 0 {
+			if err == nil {
+				fmt.Fprintf(out, "%d log files verified\n", n)
+			}
+			return err
+		}
+		if err != nil {
+			fmt.Fprintf(out, "%s: %s\n", time.Now().UTC().Format(time.RFC3339), err.Error())
+		}
+		time.Sleep(*interval)
+	}
+}
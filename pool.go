@@ -0,0 +1,90 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"reflect"
+	"sync"
+)
+
+// EventPool recycles the events decoded by a replay to spare the garbage collector the
+// millions of short-lived events a large log replays, see WithEventPool. A client that
+// applies each event to its state by copying what it needs, rather than keeping the event,
+// passes the event to ReleaseEvent once done with it and the decoder reuses its memory
+// for a later event of the same type. The pool holds at most its budget of bytes,
+// counting the struct of each event but not what it points to.
+type EventPool struct {
+	mu     sync.Mutex
+	budget int
+	bytes  int                              // size of the events held
+	free   map[reflect.Type][]reflect.Value // released events by pointer type
+	reused uint64                           // number of events decoded into released ones
+}
+
+// NewEventPool returns a pool that holds at most budget bytes of released events
+func NewEventPool(budget int) *EventPool {
+	return &EventPool{budget: budget, free: map[reflect.Type][]reflect.Value{}}
+}
+
+// ReleaseEvent returns an event replayed into the client to the pool, the client must not
+// use the event or anything it points to afterwards. Only pointers to structs are pooled,
+// other events are left to the garbage collector, as are events beyond the pool's budget.
+// ReleaseEvent may be called concurrently with the replay.
+func (ep *EventPool) ReleaseEvent(ev interface{}) {
+	if ne, ok := ev.(*NamespacedEvent); ok {
+		ev = ne.Event
+	}
+	v := reflect.ValueOf(ev)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return
+	}
+	size := int(v.Type().Elem().Size())
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if ep.bytes+size > ep.budget {
+		return
+	}
+	// gob leaves the fields missing from the stream untouched, and zeroing also lets go of
+	// what the event points to
+	v.Elem().Set(reflect.Zero(v.Type().Elem()))
+	ep.free[v.Type()] = append(ep.free[v.Type()], v)
+	ep.bytes += size
+}
+
+// Reused returns the number of events decoded into released events
+func (ep *EventPool) Reused() uint64 {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return ep.reused
+}
+
+// get returns a zeroed event of pointer type t, allocating it if none was released
+func (ep *EventPool) get(t reflect.Type) reflect.Value {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	free := ep.free[t]
+	if len(free) == 0 {
+		return reflect.New(t.Elem())
+	}
+	v := free[len(free)-1]
+	free[len(free)-1] = reflect.Value{}
+	ep.free[t] = free[:len(free)-1]
+	ep.bytes -= int(t.Elem().Size())
+	ep.reused++
+	return v
+}
+
+// WithEventPool makes the replay decode events into those the client released to the pool,
+// see EventPool. Pooling requires a TypeRegistry, see WithTypeRegistry, events decoded
+// using gob's global registry are always allocated. Stats reports the number of events
+// decoded into released ones as ReplayEventsReused.
+func WithEventPool(pool *EventPool) LogOption {
+	return func(pl *pLog) { pl.pool = pool }
+}
+
+// usePool makes the decoder of a replayed stream decode into the log's pool, if any
+func (pl *pLog) usePool(sd *seqDecoder) {
+	if rd, ok := sd.Decoder.(*registryDecoder); ok && pl.pool != nil {
+		rd.pool = pl.pool
+	}
+}
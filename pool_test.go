@@ -0,0 +1,92 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+	"reflect"
+	"unsafe"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// poolEv is an event with a field that's omitted from the stream when it's zero
+type poolEv struct {
+	K string
+	V int
+}
+
+// releasingClient keeps copies of the events replayed and releases them to a pool
+type releasingClient struct {
+	pool   *EventPool
+	state  map[string]int
+	output []interface{}
+}
+
+func (rc *releasingClient) Replay(ev interface{}) error {
+	pe := ev.(*poolEv)
+	rc.state[pe.K] = pe.V
+	rc.pool.ReleaseEvent(ev)
+	return nil
+}
+
+func (rc *releasingClient) PersistAll(pl Log) {
+	for _, ev := range rc.output {
+		pl.Output(ev)
+	}
+}
+
+var _ = Describe("EventPool", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	It("decodes the replay into the events released", func() {
+		reg := NewTypeRegistry()
+		Ω(reg.Register("pool", &poolEv{})).ShouldNot(HaveOccurred())
+		fd, err := NewFileDest(PT+"/pool", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &releasingClient{output: []interface{}{&poolEv{K: "a", V: 1},
+			&poolEv{K: "b"}, &poolEv{K: "c", V: 3}}}
+		pl, err := NewLog(fd, rc, log15.Root(), WithTypeRegistry(reg))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&poolEv{K: "d", V: 4})).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		fd, err = NewFileDest(PT+"/pool", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pool := NewEventPool(1024)
+		rc = &releasingClient{pool: pool, state: map[string]int{}}
+		pl, err = NewLog(fd, rc, log15.Root(), WithTypeRegistry(reg), WithEventPool(pool))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.state).Should(Equal(map[string]int{"a": 1, "b": 0, "c": 3, "d": 4}))
+		Ω(pool.Reused()).Should(Equal(uint64(3)))
+		Ω(pl.Stats()["ReplayEventsReused"]).Should(Equal(3.0))
+		pl.(*pLog).Close()
+	})
+
+	It("holds events up to its budget", func() {
+		size := int(unsafe.Sizeof(poolEv{}))
+		pool := NewEventPool(2 * size)
+		events := []*poolEv{{K: "a", V: 1}, {K: "b", V: 2}, {K: "c", V: 3}}
+		for _, ev := range events {
+			pool.ReleaseEvent(ev)
+		}
+		pool.ReleaseEvent(poolEv{K: "not a pointer"})
+		Ω(pool.bytes).Should(Equal(2 * size))
+		Ω(*events[0]).Should(BeZero())
+		Ω(*events[2]).Should(Equal(poolEv{K: "c", V: 3}))
+
+		t := reflect.TypeOf(&poolEv{})
+		Ω(pool.get(t).Interface()).Should(BeIdenticalTo(events[1]))
+		Ω(pool.get(t).Interface()).Should(BeIdenticalTo(events[0]))
+		Ω(pool.get(t).Interface()).Should(Equal(&poolEv{}))
+		Ω(pool.bytes).Should(BeZero())
+		Ω(pool.Reused()).Should(Equal(uint64(2)))
+	})
+})
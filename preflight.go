@@ -0,0 +1,96 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// preflightMaxUsage is the disk usage above which the preflight check of a file destination
+// fails, leaving too little space for the snapshot NewLog writes
+const preflightMaxUsage = 0.99
+
+// PreflightDestination is implemented by log destinations that can check their
+// configuration, e.g. credentials, permissions, free space, and connectivity. NewLog runs
+// the check before the replay and SetSecondaryDestination before the rotation such that a
+// misconfiguration is reported right away rather than after minutes of replay.
+type PreflightDestination interface {
+	LogDestination
+	Preflight() error
+}
+
+// DestPreflight runs the preflight check of a log destination, it returns nil if the
+// destination doesn't implement PreflightDestination
+func DestPreflight(dest LogDestination) error {
+	if pd, ok := dest.(PreflightDestination); ok {
+		return pd.Preflight()
+	}
+	return nil
+}
+
+// Preflight checks that the directory of the log files can be written and that its
+// filesystem isn't full
+func (fd *fileDest) Preflight() error {
+	dir := filepath.Dir(fd.basepath)
+	f, err := ioutil.TempFile(dir, filepath.Base(fd.basepath)+"-preflight")
+	if err != nil {
+		return fmt.Errorf("cannot create files in %s, check that it exists and that the "+
+			"process has write permission: %s", dir, err.Error())
+	}
+	_, err = f.Write([]byte{0})
+	f.Close()
+	os.Remove(f.Name())
+	if err != nil {
+		return fmt.Errorf("cannot write to %s, check the filesystem: %s", dir, err.Error())
+	}
+
+	usage := fd.usage
+	if usage == nil {
+		usage = diskUsage
+	}
+	// platforms without disk usage support skip the check
+	if u, err := usage(dir); err == nil && u >= preflightMaxUsage {
+		return fmt.Errorf("filesystem holding %s is %.1f%% full, free some space before "+
+			"opening the log", dir, u*100)
+	}
+	return nil
+}
+
+// Preflight checks that the server can still be reached and lists the log files
+func (sd *sftpDest) Preflight() error {
+	if _, err := sd.list(); err != nil {
+		return fmt.Errorf("%s, check the connection and the permissions of the SFTP user",
+			err.Error())
+	}
+	return nil
+}
+
+// Preflight checks that the objects of the log set can be listed, which requires the
+// server to be reachable and the client to be authorized
+func (hd *httpDest) Preflight() error {
+	if _, _, err := hd.list(); err != nil {
+		return fmt.Errorf("cannot list %s%s, check the URL and the client's credentials: %s",
+			hd.dirURL, hd.prefix, err.Error())
+	}
+	return nil
+}
+
+// Preflight checks that the store is reachable and lists the generations of the log
+func (rd *recordDest) Preflight() error {
+	if _, _, err := rd.store.generations(); err != nil {
+		return fmt.Errorf("cannot list the generations of the log, check the store's "+
+			"address and credentials: %s", err.Error())
+	}
+	return nil
+}
+
+func (hd *hmacDest) Preflight() error { return DestPreflight(hd.dest) }
+
+func (bd *blockDest) Preflight() error { return DestPreflight(bd.dest) }
+
+func (sd snapshotOnlyDest) Preflight() error { return DestPreflight(sd.LogDestination) }
+
+func (cb *breakerDest) Preflight() error { return DestPreflight(cb.dest) }
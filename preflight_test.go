@@ -0,0 +1,79 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("Preflight", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	full := func(string) (float64, error) { return 0.995, nil }
+
+	It("passes for a writable directory with free space", func() {
+		fd, err := NewFileDest(PT+"/pf", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		fd.(*fileDest).usage = func(string) (float64, error) { return 0.5, nil }
+		Ω(DestPreflight(fd)).ShouldNot(HaveOccurred())
+		probes, _ := filepath.Glob(PT + "/pf-preflight*")
+		Ω(probes).Should(BeEmpty())
+		fd.Close()
+	})
+
+	It("fails NewLog before the replay when the filesystem is full", func() {
+		fd, err := NewFileDest(PT+"/pf", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		fd, err = NewFileDest(PT+"/pf", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		fd.(*fileDest).usage = full
+		rc := &recordingClient{}
+		_, err = NewLog(fd, rc, log15.Root())
+		Ω(err).Should(MatchError(ContainSubstring("primary destination failed its preflight")))
+		Ω(err.Error()).Should(ContainSubstring("99.5% full"))
+		Ω(rc.events).Should(BeEmpty())
+		fd.Close()
+	})
+
+	It("fails NewLog when the directory cannot be written", func() {
+		os.Mkdir(PT+"/gone", 0777)
+		fd, err := NewFileDest(PT+"/gone/pf", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(os.RemoveAll(PT + "/gone")).ShouldNot(HaveOccurred())
+		_, err = NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).Should(MatchError(ContainSubstring("cannot create files in " + PT + "/gone")))
+		fd.Close()
+	})
+
+	It("rejects a secondary destination that fails its check", func() {
+		fd, err := NewFileDest(PT+"/pri", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		sd, err := NewFileDest(PT+"/sec", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		sd.(*fileDest).usage = full
+
+		err = pl.SetSecondaryDestination(NewSnapshotOnlyDest(NewHMACDest(sd, []byte("k"))))
+		Ω(err).Should(MatchError(ContainSubstring("secondary destination failed")))
+		Ω(pl.Stats()["Generation"]).Should(Equal(1.0))
+		Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+		sd.Close()
+	})
+})
@@ -0,0 +1,265 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+// Package projection maintains named projections over the events of a persist log, i.e.,
+// states computed by reducing the events one after the other, such as an index or a
+// report. A Manager follows the log using persist's Tail, checkpoints the state of
+// each projection to a directory and resumes from the checkpoints after a restart. It
+// rebuilds a projection from the snapshot of the log's current generation when its
+// checkpoint is missing, belongs to a different version of the projection, or is ahead of
+// the log, as well as when the events since the checkpoints are no longer in the log.
+//
+// Since persist logs hold the state of resources rather than changes, and each rotation
+// writes the state of all resources again, the events a reducer receives repeat the state
+// of resources, and reducers must treat each event as the latest state of its resource,
+// e.g., by indexing it by key rather than by counting events.
+package projection
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/rightscale/persist"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// checkpointEvery is the default number of events after which a projection is checkpointed
+const checkpointEvery = 1000
+
+// A Reducer returns the state of a projection after an event, it may modify the state it's
+// passed and return it. Reducers are called by a single goroutine.
+type Reducer func(state interface{}, ev interface{}) interface{}
+
+// Projection describes a projection to a Manager
+type Projection struct {
+	Name    string             // identifies the projection, used to name its checkpoint file
+	Version int                // a new version discards the checkpoint, e.g., after a fix
+	Init    func() interface{} // returns the state before the first event, nil for nil
+	Reduce  Reducer
+}
+
+// checkpoint is the content of a checkpoint file, the type of the state must be
+// registered using persist.Register
+type checkpoint struct {
+	Version int
+	Seq     uint64 // sequence number of the next event to reduce
+	State   interface{}
+}
+
+// projState is a registered projection and its current state
+type projState struct {
+	Projection
+	state   interface{}
+	next    uint64 // sequence number of the next event to reduce
+	pending int    // events reduced since the last checkpoint
+}
+
+// Manager maintains projections over a log
+type Manager struct {
+	dir    string
+	every  int
+	projs  []*projState
+	it     persist.Iterator
+	done   chan struct{} // closed when the goroutine following the log exits
+	err    error         // error that stopped the projections
+	logger log15.Logger
+	sync.Mutex
+}
+
+// New returns a manager that keeps the checkpoints of its projections in dir, which must
+// exist and must not be shared with another manager, the logger defaults to log15.Root()
+func New(dir string, logger log15.Logger) *Manager {
+	if logger == nil {
+		logger = log15.Root()
+	}
+	return &Manager{dir: dir, every: checkpointEvery, logger: logger.New("dir", dir)}
+}
+
+// SetCheckpointInterval sets the number of events after which a projection is checkpointed,
+// the default is 1000. It must be called before Start.
+func (m *Manager) SetCheckpointInterval(events int) { m.every = events }
+
+// Register adds a projection, it must be called before Start
+func (m *Manager) Register(p Projection) error {
+	if p.Name == "" || p.Reduce == nil {
+		return fmt.Errorf("a projection needs a name and a reducer")
+	}
+	for _, ps := range m.projs {
+		if ps.Name == p.Name {
+			return fmt.Errorf("projection %q is already registered", p.Name)
+		}
+	}
+	m.projs = append(m.projs, &projState{Projection: p})
+	return nil
+}
+
+// Start loads the checkpoints and follows the log, which must record sequence numbers,
+// see persist.RecordSequenceNumbers, and be written to a file destination, see persist.Tail.
+func (m *Manager) Start(log persist.Log) error {
+	first, next, err := persist.SequenceRange(log)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	if m.it != nil {
+		return fmt.Errorf("projections already started")
+	}
+	from := next
+	for _, ps := range m.projs {
+		if err := m.load(ps, next); err != nil {
+			m.logger.Warn("Rebuilding projection", "name", ps.Name, "reason", err)
+			ps.reset(first)
+		}
+		if ps.next < from {
+			from = ps.next
+		}
+	}
+	it, err := persist.Tail(log, from)
+	if err != nil {
+		m.logger.Warn("Rebuilding all projections", "reason", err)
+		for _, ps := range m.projs {
+			ps.reset(first)
+		}
+		if it, err = persist.Tail(log, first); err != nil {
+			return err
+		}
+	}
+	m.it, m.done, m.err = it, make(chan struct{}), nil
+	go m.run(it, m.done)
+	return nil
+}
+
+// Stop stops following the log and checkpoints the projections
+func (m *Manager) Stop() error {
+	m.Lock()
+	it, done := m.it, m.done
+	m.it = nil
+	m.Unlock()
+	if it == nil {
+		return fmt.Errorf("projections not started")
+	}
+	it.Close()
+	<-done
+
+	m.Lock()
+	defer m.Unlock()
+	for _, ps := range m.projs {
+		if err := m.save(ps); err != nil {
+			return err
+		}
+	}
+	return m.err
+}
+
+// View calls fn with the current state of a projection and the sequence number of the
+// next event it will reduce, fn must not retain the state, which the reducer may modify.
+// It returns the error that stopped the projections, if any.
+func (m *Manager) View(name string, fn func(state interface{}, next uint64)) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, ps := range m.projs {
+		if ps.Name == name {
+			fn(ps.state, ps.next)
+			return m.err
+		}
+	}
+	return fmt.Errorf("projection %q is not registered", name)
+}
+
+// run reduces the events returned by the iterator until it's closed
+func (m *Manager) run(it persist.Iterator, done chan struct{}) {
+	defer close(done)
+	for {
+		seq, ev, err := it.Next()
+		if err == io.EOF {
+			return
+		}
+		m.Lock()
+		if err != nil {
+			m.logger.Crit("Projections stopped", "err", err)
+			m.err = err
+			m.Unlock()
+			return
+		}
+		for _, ps := range m.projs {
+			if seq < ps.next {
+				continue
+			}
+			ps.state = ps.Reduce(ps.state, ev)
+			ps.next = seq + 1
+			ps.pending++
+			if ps.pending >= m.every {
+				if err := m.save(ps); err != nil {
+					m.logger.Error("Cannot checkpoint projection", "name", ps.Name,
+						"err", err)
+				}
+			}
+		}
+		m.Unlock()
+	}
+}
+
+// reset discards the state of a projection so it's rebuilt from the event numbered seq
+func (ps *projState) reset(seq uint64) {
+	ps.state, ps.next, ps.pending = nil, seq, 0
+	if ps.Init != nil {
+		ps.state = ps.Init()
+	}
+}
+
+// path returns the name of the checkpoint file of a projection
+func (m *Manager) path(ps *projState) string {
+	return filepath.Join(m.dir, ps.Name+".checkpoint")
+}
+
+// load restores a projection from its checkpoint, it returns an error if the checkpoint
+// cannot be used, next is the sequence number of the next event output to the log
+func (m *Manager) load(ps *projState, next uint64) error {
+	f, err := os.Open(m.path(ps))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var cp checkpoint
+	if err := gob.NewDecoder(f).Decode(&cp); err != nil {
+		return fmt.Errorf("cannot read checkpoint: %s", err.Error())
+	}
+	if cp.Version != ps.Version {
+		return fmt.Errorf("checkpoint of version %d", cp.Version)
+	}
+	if cp.Seq > next {
+		return fmt.Errorf("checkpoint at event %d is ahead of the log at %d", cp.Seq, next)
+	}
+	ps.state, ps.next, ps.pending = cp.State, cp.Seq, 0
+	return nil
+}
+
+// save writes the checkpoint of a projection, replacing the previous one atomically
+func (m *Manager) save(ps *projState) error {
+	tmp := m.path(ps) + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	cp := checkpoint{Version: ps.Version, Seq: ps.next, State: ps.state}
+	err = gob.NewEncoder(f).Encode(&cp)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, m.path(ps))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot checkpoint projection %q: %s", ps.Name, err.Error())
+	}
+	ps.pending = 0
+	return nil
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package projection
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rightscale/persist"
+	"github.com/rightscale/persist/kvstate"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+type setEv struct {
+	K, V string
+}
+
+func (s *setEv) EventKey() string { return s.K }
+
+func init() {
+	persist.Register(&setEv{})
+	persist.Register(map[string]string{})
+}
+
+const PT = "/tmp/projection-test"
+
+// values holds the latest value of each key
+var values = Projection{
+	Name: "values",
+	Init: func() interface{} { return map[string]string{} },
+	Reduce: func(state interface{}, ev interface{}) interface{} {
+		if s, ok := ev.(*setEv); ok {
+			state.(map[string]string)[s.K] = s.V
+		}
+		return state
+	},
+}
+
+// events counts the events reduced, which tells a resumed projection from a rebuilt one
+func events(version int) Projection {
+	return Projection{
+		Name:    "events",
+		Version: version,
+		Init:    func() interface{} { return 0 },
+		Reduce:  func(state interface{}, ev interface{}) interface{} { return state.(int) + 1 },
+	}
+}
+
+var _ = Describe("Manager", func() {
+
+	var dests []persist.LogDestination
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.MkdirAll(PT+"/checkpoints", 0777)
+		dests = nil
+	})
+	AfterEach(func() {
+		for _, d := range dests {
+			d.Close()
+		}
+		os.RemoveAll(PT)
+	})
+
+	openLog := func(create bool) persist.Log {
+		fd, err := persist.NewFileDest(PT+"/log", create, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		dests = append(dests, fd)
+		pl, err := persist.NewLog(fd, kvstate.New(), log15.Root(),
+			persist.RecordSequenceNumbers())
+		Ω(err).ShouldNot(HaveOccurred())
+		return pl
+	}
+
+	start := func(pl persist.Log, ps ...Projection) *Manager {
+		m := New(PT+"/checkpoints", nil)
+		for _, p := range ps {
+			Ω(m.Register(p)).ShouldNot(HaveOccurred())
+		}
+		Ω(m.Start(pl)).ShouldNot(HaveOccurred())
+		return m
+	}
+
+	view := func(m *Manager, name string) interface{} {
+		var res interface{}
+		Ω(m.View(name, func(state interface{}, next uint64) {
+			if v, ok := state.(map[string]string); ok {
+				c := map[string]string{}
+				for k, s := range v {
+					c[k] = s
+				}
+				state = c
+			}
+			res = state
+		})).ShouldNot(HaveOccurred())
+		return res
+	}
+
+	// run writes three events and stops the projections
+	run := func() {
+		pl := openLog(true)
+		Ω(pl.Output(&setEv{K: "a", V: "1"})).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&setEv{K: "b", V: "1"})).ShouldNot(HaveOccurred())
+		m := start(pl, values, events(0))
+		Ω(pl.Output(&setEv{K: "a", V: "2"})).ShouldNot(HaveOccurred())
+		Eventually(func() interface{} { return view(m, "events") }).Should(Equal(3))
+		Ω(view(m, "values")).Should(Equal(map[string]string{"a": "2", "b": "1"}))
+		Ω(m.Stop()).ShouldNot(HaveOccurred())
+	}
+
+	It("resumes projections from their checkpoints", func() {
+		run()
+		Ω(PT + "/checkpoints/values.checkpoint").Should(BeAnExistingFile())
+
+		// the new generation's snapshot repeats a and b
+		pl := openLog(false)
+		m := start(pl, values, events(0))
+		Ω(pl.Output(&setEv{K: "c", V: "1"})).ShouldNot(HaveOccurred())
+		Eventually(func() interface{} { return view(m, "events") }).Should(Equal(6))
+		Ω(view(m, "values")).Should(Equal(map[string]string{"a": "2", "b": "1", "c": "1"}))
+		Ω(m.Stop()).ShouldNot(HaveOccurred())
+	})
+
+	It("rebuilds a projection whose version changed", func() {
+		run()
+		pl := openLog(false)
+		m := start(pl, values, events(1))
+		Ω(pl.Output(&setEv{K: "c", V: "1"})).ShouldNot(HaveOccurred())
+		Eventually(func() interface{} { return view(m, "events") }).Should(Equal(3))
+		Ω(view(m, "values")).Should(Equal(map[string]string{"a": "2", "b": "1", "c": "1"}))
+		Ω(m.Stop()).ShouldNot(HaveOccurred())
+	})
+
+	It("rebuilds projections whose checkpoint is ahead of the log", func() {
+		run()
+		for _, d := range dests {
+			d.Close()
+		}
+		dests = nil
+		files, _ := persist.LogFiles(PT + "/log")
+		for _, f := range files {
+			os.Remove(f)
+		}
+		pl := openLog(true)
+		m := start(pl, values, events(0))
+		Ω(pl.Output(&setEv{K: "c", V: "1"})).ShouldNot(HaveOccurred())
+		Eventually(func() interface{} { return view(m, "events") }).Should(Equal(1))
+		Ω(view(m, "values")).Should(Equal(map[string]string{"c": "1"}))
+		Ω(m.Stop()).ShouldNot(HaveOccurred())
+	})
+
+	It("rejects projections without a name", func() {
+		m := New(PT+"/checkpoints", nil)
+		Ω(m.Register(Projection{Reduce: values.Reduce})).Should(HaveOccurred())
+		Ω(m.Register(values)).ShouldNot(HaveOccurred())
+		Ω(m.Register(values)).Should(HaveOccurred())
+	})
+})
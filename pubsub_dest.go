@@ -0,0 +1,72 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"io"
+	"strconv"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// PubSubPublisher is the subset of a Google Cloud Pub/Sub topic used by the Pub/Sub
+// destination. Publish must only return once the message has been accepted by the service,
+// with the cloud.google.com/go/pubsub client this means waiting on the PublishResult.
+type PubSubPublisher interface {
+	Publish(data []byte, attributes map[string]string) error
+}
+
+type pubsubDest struct {
+	pub PubSubPublisher
+	gen uint64 // generation, incremented at each rotation
+	seq uint64 // sequence number of the next message in the generation
+	log log15.Logger
+}
+
+// NewPubSubDest returns a write-only destination that publishes each record written to
+// the log as a Pub/Sub message so downstream consumers can follow the stream of mutations.
+// Each message has a "gen" attribute, which changes at each rotation when a fresh stream
+// starts with a full snapshot, and a "seq" attribute numbering the messages within the
+// generation. A consumer must decode the messages of a generation in seq order using a
+// single decoder, e.g., by publishing with an ordering key. The destination is write-only,
+// it cannot replay and NewLog refuses to use it as primary destination.
+func NewPubSubDest(pub PubSubPublisher, log log15.Logger) (LogDestination, error) {
+	if log == nil {
+		log = log15.Root()
+	}
+	return &pubsubDest{pub: pub, log: log.New("dest", "pubsub")}, nil
+}
+
+func (pd *pubsubDest) Write(p []byte) (int, error) {
+	// the publisher may hang on to the data, so it gets its own copy
+	data := make([]byte, len(p))
+	copy(data, p)
+	err := pd.pub.Publish(data, map[string]string{
+		"gen": strconv.FormatUint(pd.gen, 10),
+		"seq": strconv.FormatUint(pd.seq, 10),
+	})
+	if err != nil {
+		return 0, err
+	}
+	pd.seq++
+	return len(p), nil
+}
+
+func (pd *pubsubDest) Capabilities() Capabilities {
+	return Capabilities{CanRotate: true, DurableSync: true, WriteOnly: true}
+}
+
+// ReplayReaders always returns nil, a Pub/Sub destination cannot replay
+func (pd *pubsubDest) ReplayReaders() []io.ReadCloser { return nil }
+
+// StartRotate is called by persist in order to start a new stream, which starts a new
+// generation of messages.
+func (pd *pubsubDest) StartRotate() error {
+	pd.gen++
+	pd.seq = 0
+	return nil
+}
+
+func (pd *pubsubDest) EndRotate() error { return nil }
+
+func (pd *pubsubDest) Close() {}
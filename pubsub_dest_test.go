@@ -0,0 +1,67 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Pub/Sub topic used for testing
+type testTopic struct {
+	data  [][]byte
+	attrs []map[string]string
+}
+
+func (tt *testTopic) Publish(data []byte, attributes map[string]string) error {
+	tt.data = append(tt.data, data)
+	tt.attrs = append(tt.attrs, attributes)
+	return nil
+}
+
+var _ = Describe("PubSubDest", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	It("mirrors the log as a secondary destination", func() {
+		fd, err := NewFileDest(PT+"/newfile", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &testLogClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		tt := &testTopic{}
+		pd, err := NewPubSubDest(tt, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pd.ReplayReaders()).Should(BeNil())
+		Ω(pl.SetSecondaryDestination(pd)).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		Ω(tt.attrs[0]).Should(Equal(map[string]string{"gen": "0", "seq": "0"}))
+		dec := gob.NewDecoder(bytes.NewReader(bytes.Join(tt.data, nil)))
+		var ev interface{}
+		Ω(dec.Decode(&ev)).ShouldNot(HaveOccurred())
+		Ω(ev).Should(BeAssignableToTypeOf(&GenerationMeta{}))
+		ev = nil
+		Ω(dec.Decode(&ev)).ShouldNot(HaveOccurred())
+		Ω(ev).Should(Equal(&logEv1{S: "hello world #1!"}))
+	})
+
+	It("cannot be the primary destination", func() {
+		pd, err := NewPubSubDest(&testTopic{}, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(DestCapabilities(pd).WriteOnly).Should(BeTrue())
+		pl, err := NewLog(pd, &testLogClient{}, log15.Root())
+		Ω(pl).Should(BeNil())
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("write-only"))
+	})
+})
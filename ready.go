@@ -0,0 +1,35 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+// OnReady sets a function called once the log is ready, i.e., once the replay and the initial
+// snapshot written by PersistAll have completed and outputs are application events. It is
+// called before NewLog returns, without holding any lock, and allows an application to gate
+// accepting writes on persistence being ready from code that doesn't wait for NewLog.
+func OnReady(hook func()) LogOption {
+	return func(pl *pLog) { pl.onReady = hook }
+}
+
+// Ready returns a channel that is closed once the log is ready, see OnReady. NewLog currently
+// only returns logs that are ready, waiting on the channel instead of relying on that allows
+// code handed a log to gate on readiness regardless of how the log was opened.
+func Ready(log Log) <-chan struct{} {
+	pl, ok := log.(*pLog)
+	if !ok {
+		// other implementations of Log have no notion of readiness
+		ch := make(chan struct{})
+		close(ch)
+		return ch
+	}
+	return pl.ready
+}
+
+// markReady records that NewLog has completed, later outputs are application events
+func (pl *pLog) markReady() {
+	pl.opened = true
+	close(pl.ready)
+	pl.armAgeCheck()
+	if pl.onReady != nil {
+		pl.onReady()
+	}
+}
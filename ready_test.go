@@ -0,0 +1,62 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// client that records whether the log was ready when PersistAll was called
+type readyClient struct {
+	recordingClient
+	snapshots       int
+	readyInSnapshot bool
+}
+
+func (rc *readyClient) PersistAll(pl Log) {
+	select {
+	case <-Ready(pl):
+		rc.readyInSnapshot = true
+	default:
+	}
+	rc.recordingClient.PersistAll(pl)
+	rc.snapshots++
+}
+
+var _ = Describe("Ready", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	It("signals once the initial snapshot completes", func() {
+		fd, err := NewFileDest(PT+"/ready", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &readyClient{recordingClient: recordingClient{
+			events: []interface{}{&logEv1{S: "a"}}}}
+		calls, snapshots := 0, 0
+		pl, err := NewLog(fd, rc, log15.Root(), OnReady(func() {
+			calls++
+			snapshots = rc.snapshots
+		}))
+		Ω(err).ShouldNot(HaveOccurred())
+		defer pl.(*pLog).Close()
+		Ω(rc.readyInSnapshot).Should(BeFalse())
+		Ω(calls).Should(Equal(1))
+		Ω(snapshots).Should(Equal(1))
+		Ω(Ready(pl)).Should(BeClosed())
+
+		By("not signaling again on rotations")
+		pl.(*pLog).Lock()
+		pl.(*pLog).rotate()
+		pl.(*pLog).Unlock()
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(2.0))
+		Ω(calls).Should(Equal(1))
+	})
+})
@@ -0,0 +1,175 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// WithSizeLimit sets the log size limit at which a rotation occurs, as SetSizeLimit does
+func WithSizeLimit(bytes int) LogOption {
+	return runtimeOption(func(pl *pLog) { pl.sizeLimit = bytes })
+}
+
+// WithRotationInterval rotates the log once its current generation is older than d, in
+// addition to the size limit and rotation policy. As with a RotationPolicy the age is checked
+// when an event is output, so an idle log doesn't rotate. A zero duration, the default,
+// disables the interval. Stats reports the interval as LogRotationInterval, in seconds.
+func WithRotationInterval(d time.Duration) LogOption {
+	return runtimeOption(func(pl *pLog) { pl.interval = d })
+}
+
+// PrimaryOptions applies options to the primary destination, which must be a file
+// destination. It's meant for Reconfigure, to change RetainUnderUsage, FreeSpaceWatermarks,
+// and SyncInterval at runtime. Options that take effect when the files are opened, such as
+// TakeOver, must be passed to NewFileDest instead.
+func PrimaryOptions(opts ...FileDestOption) LogOption {
+	return runtimeOption(func(pl *pLog) { pl.priOpts = append(pl.priOpts, opts...) })
+}
+
+// SyncInterval makes a file destination sync the log file to disk when an event is written
+// more than d after the previous sync, bounding how much a machine crash can lose, and a
+// negative d syncs after every write. A zero d, the default, leaves it to the OS to flush
+// the file, the log then survives crashes of the process but not of the machine.
+func SyncInterval(d time.Duration) FileDestOption {
+	return runtimeFileOption(func(fd *fileDest) { fd.syncEvery = d })
+}
+
+// syncOutput syncs the log file if the sync interval elapsed, see SyncInterval
+func (fd *fileDest) syncOutput() error {
+	if fd.syncEvery == 0 {
+		return nil
+	}
+	now := time.Now()
+	if fd.syncEvery > 0 && now.Sub(fd.synced) < fd.syncEvery {
+		return nil
+	}
+	fd.synced = now
+	return fd.outputFile.Sync()
+}
+
+// applyPrimaryOptions applies the options collected by PrimaryOptions, must be called while
+// holding the lock
+func (pl *pLog) applyPrimaryOptions() error {
+	opts := pl.priOpts
+	pl.priOpts = nil
+	if len(opts) == 0 {
+		return nil
+	}
+	fd, ok := pl.priDest.(*fileDest)
+	if !ok {
+		return fmt.Errorf("PrimaryOptions requires a file destination")
+	}
+	for _, opt := range opts {
+		opt(fd)
+	}
+	fd.spaceChecked = time.Time{} // apply new watermarks on the next write
+	return nil
+}
+
+// runtimeOption marks an option that Reconfigure can apply to a running log
+func runtimeOption(opt LogOption) LogOption {
+	return func(pl *pLog) {
+		opt(pl)
+		pl.runtimeOpt = true
+	}
+}
+
+// runtimeFileOption marks a file destination option that PrimaryOptions can apply at runtime
+func runtimeFileOption(opt FileDestOption) FileDestOption {
+	return func(fd *fileDest) {
+		opt(fd)
+		fd.runtimeOpt = true
+	}
+}
+
+// checkRuntimeOptions returns an error if one of the options cannot be applied to a running
+// log. Options are opaque functions, so each one is applied to a blank log, or destination,
+// to find out whether it's one of those marked by runtimeOption.
+func checkRuntimeOptions(opts []LogOption) error {
+	for i, opt := range opts {
+		probe := &pLog{}
+		err := callSafely("option", func() { opt(probe) })
+		if err != nil || !probe.runtimeOpt {
+			return fmt.Errorf("option %d cannot be changed at runtime, pass it to NewLog", i+1)
+		}
+		for j, fo := range probe.priOpts {
+			fd := &fileDest{}
+			err := callSafely("option", func() { fo(fd) })
+			if err != nil || !fd.runtimeOpt {
+				return fmt.Errorf("primary option %d of option %d cannot be changed at "+
+					"runtime, pass it to NewFileDest", j+1, i+1)
+			}
+		}
+	}
+	return nil
+}
+
+// Reconfigure changes the options of a log created by NewLog while it's running, which
+// avoids the replay of a restart to tune it. The options that take effect at runtime are
+// WithSizeLimit, WithRotationInterval, WithRotationPolicy, WithRotationDeadline,
+// WithSnapshotRateLimit, WithSecondaryRetry, WithWriteDeadlines, WarnGenerationAge, and
+// PrimaryOptions with RetainUnderUsage, FreeSpaceWatermarks, or SyncInterval. Any other
+// option is refused with an error and none of the options are applied then. The changes
+// apply from the next event output, a rotation in progress completes with the options it
+// started with except for the snapshot rate limit.
+func Reconfigure(log Log, opts ...LogOption) error {
+	pl, ok := log.(*pLog)
+	if !ok {
+		return fmt.Errorf("Reconfigure requires a log created by NewLog")
+	}
+	if err := checkRuntimeOptions(opts); err != nil {
+		return err
+	}
+	pl.Lock()
+	defer pl.Unlock()
+	for _, opt := range opts {
+		opt(pl)
+	}
+	if err := pl.applyPrimaryOptions(); err != nil {
+		return err
+	}
+	pl.armAgeCheck()
+	pl.trace("reconfigure", 0, "")
+	pl.log.Info("Reconfigured log", "sizeLimit", pl.sizeLimit, "interval", pl.interval)
+	return nil
+}
+
+// ReconfigureOnSignal reconfigures a log each time the process receives one of the signals,
+// typically syscall.SIGUSR2, with the options returned by load, which usually reads them
+// from a configuration file. Errors are logged and leave the log's options as they were if
+// load fails. It returns a function that stops handling the signals.
+func ReconfigureOnSignal(log Log, load func() ([]LogOption, error),
+	sigs ...os.Signal) (stop func()) {
+
+	pl, ok := log.(*pLog)
+	if !ok || len(sigs) == 0 {
+		return func() {}
+	}
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, sigs...)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case sig := <-ch:
+				opts, err := load()
+				if err == nil {
+					err = Reconfigure(pl, opts...)
+				}
+				if err != nil {
+					pl.log.Error("Cannot reconfigure log", "signal", sig, "err", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
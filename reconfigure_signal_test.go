@@ -0,0 +1,56 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package persist
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("ReconfigureOnSignal", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	It("reloads the options on each signal", func() {
+		fd, err := NewFileDest(PT+"/signal", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		defer pl.(*pLog).Close()
+
+		limits := make(chan int, 2)
+		load := func() ([]LogOption, error) {
+			l := <-limits
+			if l < 0 {
+				return nil, fmt.Errorf("bad config")
+			}
+			return []LogOption{WithSizeLimit(l)}, nil
+		}
+		stop := ReconfigureOnSignal(pl, load, syscall.SIGUSR2)
+		defer stop()
+		limit := func() float64 { return pl.Stats()["LogSizeLimit"] }
+
+		limits <- 4096
+		Ω(syscall.Kill(os.Getpid(), syscall.SIGUSR2)).ShouldNot(HaveOccurred())
+		Eventually(limit).Should(Equal(4096.0))
+		limits <- -1
+		limits <- 8192
+		Ω(syscall.Kill(os.Getpid(), syscall.SIGUSR2)).ShouldNot(HaveOccurred())
+		Eventually(func() int { return len(limits) }).Should(Equal(1))
+		Ω(limit()).Should(Equal(4096.0))
+		Ω(syscall.Kill(os.Getpid(), syscall.SIGUSR2)).ShouldNot(HaveOccurred())
+		Eventually(limit).Should(Equal(8192.0))
+	})
+})
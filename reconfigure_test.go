@@ -0,0 +1,105 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("Reconfigure", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	var t time.Time
+	now := func() time.Time { return t }
+
+	open := func(opts ...LogOption) Log {
+		fd, err := NewFileDest(PT+"/reconf", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root(), opts...)
+		Ω(err).ShouldNot(HaveOccurred())
+		return pl
+	}
+
+	gen := func(pl Log) float64 { return pl.Stats()["Generation"] }
+
+	It("changes when the log rotates", func() {
+		t = time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+		pl := open(WithClock(now))
+		defer pl.(*pLog).Close()
+		t = t.Add(time.Hour)
+		Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		Ω(gen(pl)).Should(Equal(1.0))
+
+		Ω(Reconfigure(pl, WithRotationInterval(30*time.Minute))).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()["LogRotationInterval"]).Should(Equal(1800.0))
+		Ω(pl.Output(&logEv1{S: "b"})).ShouldNot(HaveOccurred())
+		Eventually(func() float64 { return gen(pl) }).Should(Equal(2.0))
+		Ω(pl.Output(&logEv1{S: "c"})).ShouldNot(HaveOccurred())
+		Consistently(func() float64 { return gen(pl) }).Should(Equal(2.0))
+
+		Ω(Reconfigure(pl, WithRotationInterval(0), WithSizeLimit(1))).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()["LogSizeLimit"]).Should(Equal(1.0))
+		Eventually(func() bool {
+			pl.(*pLog).Lock()
+			defer pl.(*pLog).Unlock()
+			return pl.(*pLog).rotating
+		}).Should(BeFalse())
+		Ω(pl.Output(&logEv1{S: "d"})).ShouldNot(HaveOccurred())
+		Eventually(func() float64 { return gen(pl) }).Should(Equal(3.0))
+	})
+
+	It("changes the options of the primary destination", func() {
+		pl := open()
+		defer pl.(*pLog).Close()
+		fd := pl.(*pLog).priDest.(*fileDest)
+		Ω(fd.syncEvery).Should(BeZero())
+		Ω(Reconfigure(pl, PrimaryOptions(SyncInterval(-1), RetainUnderUsage(0.8, 3)))).
+			ShouldNot(HaveOccurred())
+		Ω(fd.syncEvery).Should(Equal(time.Duration(-1)))
+		Ω(fd.keepGens).Should(Equal(3))
+		Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		Ω(fd.synced).ShouldNot(BeZero())
+
+		synced := fd.synced
+		Ω(Reconfigure(pl, PrimaryOptions(SyncInterval(time.Hour)))).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "b"})).ShouldNot(HaveOccurred())
+		Ω(fd.synced).Should(Equal(synced))
+	})
+
+	It("rejects primary options for other destinations", func() {
+		dd, err := NewFileDest(PT+"/reconf", true, nil, DirectoryPerGeneration())
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(dd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		defer pl.(*pLog).Close()
+		Ω(Reconfigure(pl, PrimaryOptions(SyncInterval(-1)))).
+			Should(MatchError(ContainSubstring("requires a file destination")))
+		Ω(Reconfigure(snapshotLog{pl.(*pLog)}, WithSizeLimit(1))).Should(HaveOccurred())
+	})
+
+	It("refuses options that cannot be changed at runtime", func() {
+		pl := open(WithSizeLimit(1000))
+		defer pl.(*pLog).Close()
+		Ω(Reconfigure(pl, WithSizeLimit(10), RecordSequenceNumbers())).
+			Should(MatchError(ContainSubstring("option 2 cannot be changed at runtime")))
+		Ω(pl.(*pLog).sizeLimit).Should(Equal(1000))
+		Ω(pl.(*pLog).sequence).Should(BeFalse())
+
+		Ω(Reconfigure(pl, PrimaryOptions(SyncInterval(-1), TakeOver()))).
+			Should(MatchError(ContainSubstring("primary option 2 of option 1")))
+		Ω(pl.(*pLog).priDest.(*fileDest).syncEvery).Should(BeZero())
+		Ω(Reconfigure(pl, WithSizeLimit(10), WarnGenerationAge(time.Hour, false))).
+			ShouldNot(HaveOccurred())
+		Ω(pl.(*pLog).sizeLimit).Should(Equal(10))
+	})
+})
@@ -0,0 +1,148 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// recordStore is implemented by storage services that hold individual records rather than
+// byte streams, such as key-value stores or databases. Records are grouped by generation,
+// a generation being the equivalent of a log file of a file destination. Each call to
+// Write on the destination produces one record, which, given that the encoder calls Write
+// once per message, means that records are never split across messages. Stores that hold
+// resources, such as open files, may implement io.Closer to release them when the
+// destination is closed.
+type recordStore interface {
+	// generations returns all the generations present in the store in increasing order
+	// and the subset of them that have a complete snapshot
+	generations() (all []uint64, complete map[uint64]bool, err error)
+	// append adds a record to a generation, seq starts at zero for each generation
+	append(gen, seq uint64, rec []byte) error
+	// records returns all the records of a generation in the order they were appended
+	records(gen uint64) ([][]byte, error)
+	// complete marks a generation as having a complete snapshot
+	complete(gen uint64) error
+	// drop removes all records of a generation
+	drop(gen uint64) error
+}
+
+// recordDest is a LogDestination that writes to a recordStore. It keeps only the current
+// generation and drops older generations once a rotation completes.
+type recordDest struct {
+	store         recordStore
+	replayReaders []io.ReadCloser
+	gen           uint64   // current generation
+	seq           uint64   // sequence number of the next record in the generation
+	old           []uint64 // older generations that can be dropped when the rotation ends
+	snapOK        bool     // true when the initial snapshot is completed
+	durable       bool     // store has written records to stable storage when append returns
+	log           log15.Logger
+}
+
+// newRecordDest opens a log in a record store, loading the records that need to be replayed
+func newRecordDest(store recordStore, create bool, log log15.Logger) (*recordDest, error) {
+	all, complete, err := store.generations()
+	if err != nil {
+		return nil, err
+	}
+	rd := &recordDest{store: store, log: log}
+
+	// find the most recent complete generation, we need to replay it and any generation
+	// that follows it
+	curr := -1
+	for i, g := range all {
+		if complete[g] {
+			curr = i
+		}
+	}
+	switch {
+	case curr < 0 && len(all) > 0:
+		return nil, fmt.Errorf("Cannot determine current log generation")
+	case curr < 0 && !create:
+		return nil, fmt.Errorf("No existing log found")
+	case curr < 0:
+		log.Info("No existing log found, creating a new one")
+	default:
+		for _, g := range all[curr:] {
+			recs, err := store.records(g)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read generation %d: %s", g, err.Error())
+			}
+			rd.replayReaders = append(rd.replayReaders,
+				ioutil.NopCloser(bytes.NewReader(bytes.Join(recs, nil))))
+		}
+		log.Info("Opening existing log", "curr_gen", all[curr], "last_gen", all[len(all)-1])
+	}
+	if len(all) > 0 {
+		rd.gen = all[len(all)-1] + 1
+	}
+	rd.old = all
+	return rd, nil
+}
+
+func (rd *recordDest) Write(p []byte) (int, error) {
+	// the store may hang on to the record, so it gets its own copy
+	rec := make([]byte, len(p))
+	copy(rec, p)
+	if err := rd.store.append(rd.gen, rd.seq, rec); err != nil {
+		return 0, err
+	}
+	rd.seq++
+	return len(p), nil
+}
+
+func (rd *recordDest) Capabilities() Capabilities {
+	return Capabilities{CanReplay: true, CanRotate: true, DurableSync: rd.durable}
+}
+
+func (rd *recordDest) ReplayReaders() []io.ReadCloser {
+	return rd.replayReaders
+}
+
+// StartRotate is called by persist in order to start a new log generation.
+func (rd *recordDest) StartRotate() error {
+	if !rd.snapOK {
+		return fmt.Errorf("Cannot rotate: initial snapshot incomplete")
+	}
+	rd.old = append(rd.old, rd.gen)
+	rd.gen++
+	rd.seq = 0
+	rd.snapOK = false
+	return nil
+}
+
+// EndRotate is called by persist in order to signal the completion of the initial snapshot
+// on the new log generation, it marks the generation as complete and drops older ones.
+func (rd *recordDest) EndRotate() error {
+	if rd.snapOK {
+		return internalError([]interface{}{"gen", rd.gen, "seq", rd.seq, "old", rd.old},
+			"StartRotate not called")
+	}
+	if err := rd.store.complete(rd.gen); err != nil {
+		return err
+	}
+	rd.snapOK = true
+	rd.log.Info("New log generation now initialized", "gen", rd.gen)
+	for len(rd.old) > 0 {
+		if err := rd.store.drop(rd.old[0]); err != nil {
+			// not fatal, we'll try again at the end of the next rotation
+			rd.log.Warn("Cannot drop old generation", "gen", rd.old[0], "err", err)
+			break
+		}
+		rd.old = rd.old[1:]
+	}
+	return nil
+}
+
+func (rd *recordDest) Close() {
+	rd.replayReaders = nil
+	if c, ok := rd.store.(io.Closer); ok {
+		c.Close()
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// RecoveryStats reports what happened to the events of a log replayed in recovery mode
+type RecoveryStats struct {
+	Replayed    int            // events passed to the client's Replay
+	Skipped     map[string]int // events skipped because their type is not allowed, by type
+	Undecodable int            // events skipped because they failed to decode
+}
+
+// maxUndecodable is the number of consecutive decode errors after which recovery gives up,
+// at that point the stream is most likely corrupt rather than holding bad events
+const maxUndecodable = 1000
+
+// RecoverTypes puts the log into recovery mode: only events whose type matches the type of
+// one of the example events are replayed, all other events are skipped and counted in
+// stats. Events that fail to decode, for example due to an incompatible change to their
+// type, are skipped as well instead of aborting the replay, which allows salvaging the
+// part of the state whose event types still decode after a bad schema change. Note that
+// the log rotates after the replay as usual, i.e., the skipped events are dropped for good
+// once the snapshot completes, so it's prudent to keep a copy of the log files.
+func RecoverTypes(stats *RecoveryStats, events ...interface{}) LogOption {
+	allowed := make(map[reflect.Type]bool)
+	for _, ev := range events {
+		allowed[reflect.TypeOf(ev)] = true
+	}
+	return func(pl *pLog) {
+		pl.recovery = &typeAllowlist{allowed: allowed, stats: stats}
+	}
+}
+
+type typeAllowlist struct {
+	allowed map[reflect.Type]bool
+	stats   *RecoveryStats
+}
+
+// decoder wraps a decoder such that it skips events that are not in the allowlist
+func (ta *typeAllowlist) decoder(dec Decoder, log log15.Logger) Decoder {
+	if ta.stats.Skipped == nil {
+		ta.stats.Skipped = make(map[string]int)
+	}
+	return &recoveryDecoder{dec: dec, ta: ta, log: log}
+}
+
+type recoveryDecoder struct {
+	dec Decoder
+	ta  *typeAllowlist
+	log log15.Logger
+}
+
+func (rd *recoveryDecoder) Decode() (interface{}, error) {
+	stats := rd.ta.stats
+	errs := 0
+	for {
+		ev, err := rd.dec.Decode()
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			return nil, err
+		case isLimitError(err):
+			return nil, err // the rest of the stream cannot be decoded
+		case err != nil:
+			errs++
+			if errs >= maxUndecodable {
+				return nil, fmt.Errorf("giving up after %d consecutive decode errors: %s",
+					errs, err.Error())
+			}
+			rd.log.Warn("Skipping undecodable event", "err", err)
+			stats.Undecodable++
+		case isInternal(ev):
+			return ev, nil // not an application event, replay skips it
+		case !rd.ta.allowed[reflect.TypeOf(ev)]:
+			errs = 0
+			stats.Skipped[fmt.Sprintf("%T", ev)]++
+		default:
+			stats.Replayed++
+			return ev, nil
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// log client that records what it replays
+type recordingClient struct {
+	events []interface{}
+}
+
+func (rc *recordingClient) Replay(ev interface{}) error {
+	rc.events = append(rc.events, ev)
+	return nil
+}
+
+func (rc *recordingClient) PersistAll(pl Log) {
+	for _, ev := range rc.events {
+		Ω(pl.Output(ev)).ShouldNot(HaveOccurred())
+	}
+}
+
+// decoder that produces a scripted sequence of events and errors
+type scriptedDecoder struct {
+	script []interface{}
+}
+
+func (sd *scriptedDecoder) Decode() (interface{}, error) {
+	if len(sd.script) == 0 {
+		return nil, io.EOF
+	}
+	ev := sd.script[0]
+	sd.script = sd.script[1:]
+	if err, ok := ev.(error); ok {
+		return nil, err
+	}
+	return ev, nil
+}
+
+var _ = Describe("RecoverTypes", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+
+	It("replays only allowed types", func() {
+		fd, err := NewFileDest(PT+"/recover", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &testLogClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv2{A: 1, B: "more"})).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		fd, err = NewFileDest(PT+"/recover", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		var stats RecoveryStats
+		rc := &recordingClient{}
+		pl, err = NewLog(fd, rc, log15.Root(), RecoverTypes(&stats, &logEv1{}))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(Equal([]interface{}{
+			&logEv1{S: "hello world #1!"}, &logEv1{S: "not again!"}}))
+		Ω(stats.Replayed).Should(Equal(2))
+		Ω(stats.Skipped).Should(Equal(map[string]int{"*persist.logEv2": 2}))
+		Ω(stats.Undecodable).Should(Equal(0))
+		pl.(*pLog).Close()
+
+		By("reopening the recovered log")
+		fd, err = NewFileDest(PT+"/recover", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc = &recordingClient{}
+		pl, err = NewLog(fd, rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(HaveLen(2))
+		pl.(*pLog).Close()
+	})
+
+	It("skips undecodable events", func() {
+		stats := RecoveryStats{}
+		ta := RecoverTypes(&stats, &logEv1{}, &logEv2{})
+		pl := &pLog{}
+		ta(pl)
+		dec := pl.recovery.decoder(&scriptedDecoder{script: []interface{}{
+			&logEv1{S: "a"}, fmt.Errorf("bad type"), &logEv2{A: 1}, "other",
+		}}, log15.Root())
+		rc := &recordingClient{}
+		n, err := replayStream(dec, rc, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(n).Should(Equal(2))
+		Ω(stats.Undecodable).Should(Equal(1))
+		Ω(stats.Skipped).Should(Equal(map[string]int{"string": 1}))
+	})
+
+	It("gives up on a corrupt stream", func() {
+		script := make([]interface{}, maxUndecodable)
+		for i := range script {
+			script[i] = fmt.Errorf("corrupt")
+		}
+		pl := &pLog{}
+		RecoverTypes(&RecoveryStats{}, &logEv1{})(pl)
+		_, err := replayStream(pl.recovery.decoder(&scriptedDecoder{script: script},
+			log15.Root()), &recordingClient{}, nil)
+		Ω(err).Should(HaveOccurred())
+	})
+})
@@ -0,0 +1,131 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// RedisStreamClient is the subset of a Redis client used by the Redis Streams destination,
+// it maps directly onto the XADD, XRANGE, and XTRIM commands and is easily implemented
+// on top of any Redis client library.
+type RedisStreamClient interface {
+	// XAdd appends an entry with an auto-generated ID to the stream
+	XAdd(stream string, values map[string]string) error
+	// XRange returns all the entries of the stream, i.e. XRANGE stream - +
+	XRange(stream string) ([]RedisStreamEntry, error)
+	// XTrimMaxLen trims the stream to the most recent maxLen entries (exact trimming)
+	XTrimMaxLen(stream string, maxLen int64) error
+}
+
+// RedisStreamEntry is an entry read from a Redis stream
+type RedisStreamEntry struct {
+	ID     string
+	Values map[string]string
+}
+
+// NewRedisDest creates or opens a log stored in a Redis stream. Each record written to the
+// log is appended to the stream as an entry with a "gen" field holding the generation number
+// and a "data" field holding the record, and a "done" entry marks the completion of each
+// generation's snapshot. When a rotation completes the stream is trimmed using MAXLEN such
+// that only the current generation remains, and replay reads the stream from the start of
+// the last complete snapshot using XRANGE.
+func NewRedisDest(client RedisStreamClient, stream string, create bool,
+	log log15.Logger) (LogDestination, error) {
+
+	if log == nil {
+		log = log15.Root()
+	}
+	log = log.New("stream", stream, "dest", "redis")
+	rs := &redisStore{client: client, stream: stream, counts: make(map[uint64]int64)}
+	rd, err := newRecordDest(rs, create, log)
+	if err != nil {
+		return nil, fmt.Errorf("redis stream %s: %s", stream, err.Error())
+	}
+	rs.entries = nil // no longer needed after replay has been loaded
+	return rd, nil
+}
+
+type redisStore struct {
+	client  RedisStreamClient
+	stream  string
+	counts  map[uint64]int64   // number of stream entries for each generation
+	entries []RedisStreamEntry // entries read at open time
+}
+
+func (rs *redisStore) generations() ([]uint64, map[uint64]bool, error) {
+	entries, err := rs.client.XRange(rs.stream)
+	if err != nil {
+		return nil, nil, err
+	}
+	var all []uint64
+	complete := make(map[uint64]bool)
+	for _, e := range entries {
+		gen, err := strconv.ParseUint(e.Values["gen"], 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("entry %s has invalid gen: %s", e.ID, err.Error())
+		}
+		if rs.counts[gen] == 0 {
+			all = append(all, gen)
+		}
+		rs.counts[gen]++
+		if _, ok := e.Values["done"]; ok {
+			complete[gen] = true
+		}
+	}
+	sort.Sort(uint64s(all))
+	rs.entries = entries
+	return all, complete, nil
+}
+
+func (rs *redisStore) append(gen, seq uint64, rec []byte) error {
+	err := rs.client.XAdd(rs.stream, map[string]string{
+		"gen": strconv.FormatUint(gen, 10), "data": string(rec)})
+	if err == nil {
+		rs.counts[gen]++
+	}
+	return err
+}
+
+func (rs *redisStore) records(gen uint64) ([][]byte, error) {
+	var recs [][]byte
+	g := strconv.FormatUint(gen, 10)
+	for _, e := range rs.entries {
+		if _, ok := e.Values["data"]; ok && e.Values["gen"] == g {
+			recs = append(recs, []byte(e.Values["data"]))
+		}
+	}
+	return recs, nil
+}
+
+func (rs *redisStore) complete(gen uint64) error {
+	err := rs.client.XAdd(rs.stream, map[string]string{
+		"gen": strconv.FormatUint(gen, 10), "done": ""})
+	if err == nil {
+		rs.counts[gen]++
+	}
+	return err
+}
+
+// drop trims the stream such that only the entries of generations after gen remain
+func (rs *redisStore) drop(gen uint64) error {
+	var keep int64
+	for g, c := range rs.counts {
+		if g > gen {
+			keep += c
+		}
+	}
+	if err := rs.client.XTrimMaxLen(rs.stream, keep); err != nil {
+		return err
+	}
+	for g := range rs.counts {
+		if g <= gen {
+			delete(rs.counts, g)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// in-memory Redis stream used for testing
+type testRedis struct {
+	id      int
+	entries []RedisStreamEntry
+}
+
+func (tr *testRedis) XAdd(stream string, values map[string]string) error {
+	tr.id++
+	tr.entries = append(tr.entries, RedisStreamEntry{ID: fmt.Sprintf("%d-0", tr.id),
+		Values: values})
+	return nil
+}
+
+func (tr *testRedis) XRange(stream string) ([]RedisStreamEntry, error) {
+	return tr.entries, nil
+}
+
+func (tr *testRedis) XTrimMaxLen(stream string, maxLen int64) error {
+	if int64(len(tr.entries)) > maxLen {
+		tr.entries = tr.entries[int64(len(tr.entries))-maxLen:]
+	}
+	return nil
+}
+
+var _ = Describe("RedisDest", func() {
+	var tr *testRedis
+
+	BeforeEach(func() { tr = &testRedis{} })
+
+	readAll := func(rd LogDestination) []string {
+		var res []string
+		for _, rr := range rd.ReplayReaders() {
+			buf, err := ioutil.ReadAll(rr)
+			Ω(err).ShouldNot(HaveOccurred())
+			res = append(res, string(buf))
+		}
+		return res
+	}
+
+	It("replays the current and the incomplete generation", func() {
+		rd, err := NewRedisDest(tr, "log", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rd.Write([]byte("Hello World"))
+		Ω(rd.EndRotate()).ShouldNot(HaveOccurred())
+		rd.Write([]byte("Hello Again"))
+		Ω(rd.StartRotate()).ShouldNot(HaveOccurred())
+		rd.Write([]byte("Snapshot"))
+		rd.Close()
+
+		rd, err = NewRedisDest(tr, "log", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(readAll(rd)).Should(Equal([]string{"Hello WorldHello Again", "Snapshot"}))
+		rd.Write([]byte("Final"))
+		Ω(rd.EndRotate()).ShouldNot(HaveOccurred())
+		rd.Write([]byte("More"))
+		rd.Close()
+
+		By("trimming the stream to the current generation")
+		Ω(tr.entries).Should(HaveLen(3))
+
+		rd, err = NewRedisDest(tr, "log", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(readAll(rd)).Should(Equal([]string{"FinalMore"}))
+		rd.Close()
+	})
+})
@@ -0,0 +1,305 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// A TypeRegistry maps the names under which events are written to a log to their types.
+// Register records event types in gob's global registry, which fails when two libraries
+// in the same process register different types under the same name. A log using a
+// TypeRegistry, see WithTypeRegistry, only knows the types registered in it, under the
+// names chosen by the caller, and writes each event as its registered name followed by
+// its value. Types held in interface fields within events are still sent by gob and
+// must be registered using Register. A log must always be replayed with a registry that
+// has the types it was written with.
+type TypeRegistry struct {
+	mu     sync.RWMutex
+	byName map[string]reflect.Type
+	byType map[reflect.Type]string
+}
+
+// NewTypeRegistry returns a registry holding persist's own records, such as
+// GenerationMeta, under names starting with "persist."
+func NewTypeRegistry() *TypeRegistry {
+	tr := &TypeRegistry{byName: map[string]reflect.Type{}, byType: map[reflect.Type]string{}}
+	tr.Register("persist.GenerationMeta", &GenerationMeta{})
+	tr.Register("persist.InternalEvent", &InternalEvent{})
+	tr.Register("persist.voidedRecord", &voidedRecord{})
+	tr.Register("persist.TxnBegin", &TxnBegin{})
+	tr.Register("persist.TxnCommit", &TxnCommit{})
+	tr.Register("persist.CommandRecord", &CommandRecord{})
+	tr.Register("persist.DeltaSnapshot", &DeltaSnapshot{})
+	tr.Register("persist.SnapshotEnd", &SnapshotEnd{})
+	tr.Register("persist.deltaRemoval", &deltaRemoval{})
+	tr.Register("persist.ShardFrame", &ShardFrame{})
+	tr.Register("persist.BlobStart", &BlobStart{})
+	tr.Register("persist.BlobChunk", &BlobChunk{})
+	tr.Register("persist.BlobEnd", &BlobEnd{})
+	tr.Register("persist.Tombstone", &Tombstone{})
+	tr.Register("persist.HandoffMark", &HandoffMark{})
+	return tr
+}
+
+// Register adds the type of value to the registry under the name, it returns an error if
+// the name or the type is already registered with a different type or name
+func (tr *TypeRegistry) Register(name string, value interface{}) error {
+	t := reflect.TypeOf(value)
+	if t == nil || name == "" {
+		return fmt.Errorf("cannot register a nil value or an empty name")
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if other, ok := tr.byName[name]; ok && other != t {
+		return fmt.Errorf("name %q is already registered for type %s", name, other)
+	}
+	if other, ok := tr.byType[t]; ok && other != name {
+		return fmt.Errorf("type %s is already registered as %q", t, other)
+	}
+	tr.byName[name] = t
+	tr.byType[t] = name
+	return nil
+}
+
+func (tr *TypeRegistry) name(t reflect.Type) (string, bool) {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	name, ok := tr.byType[t]
+	return name, ok
+}
+
+func (tr *TypeRegistry) lookup(name string) (reflect.Type, bool) {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	t, ok := tr.byName[name]
+	return t, ok
+}
+
+// lookupBytes is lookup for a name held in a byte slice
+func (tr *TypeRegistry) lookupBytes(name []byte) (reflect.Type, bool) {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	t, ok := tr.byName[string(name)]
+	return t, ok
+}
+
+// GobCodecWithRegistry returns a gob codec that identifies event types using the registry
+// instead of gob's global registry, with the decoding limits of GobCodec
+func GobCodecWithRegistry(reg *TypeRegistry) Codec {
+	return gobCodec{limits: defaultDecodeLimits, reg: reg}
+}
+
+// WithTypeRegistry makes the log identify event types using the registry, see
+// TypeRegistry. It applies to the primary's stream and the secondary's unless the latter
+// has its own codec, see WithSecondaryCodec. Log files written before the log adopted the
+// registry are replayed using gob's global registry, so their event types must remain
+// registered using Register or RegisterNamed until those files are no longer replayed.
+// Since the snapshot taken when opening the log is written using the registry, the log
+// is upgraded as soon as it's opened, without any migration step. NewLog fails if the log
+// uses a codec other than gob, see WithCodec.
+func WithTypeRegistry(reg *TypeRegistry) LogOption {
+	return func(pl *pLog) { pl.typeReg = reg }
+}
+
+// registryHeader precedes each event value in a stream written using a TypeRegistry
+type registryHeader struct {
+	Type      string // registered name of the event's type
+	Seq       uint64 // sequence number, see SequencedEvent
+	Sequenced bool
+	NS        string // namespace, see NamespacedEvent
+
+	Ann map[string]string // annotations, see Annotate
+}
+
+type registryEncoder struct {
+	enc *gob.Encoder
+	reg *TypeRegistry
+	rb  *recordBuffer
+}
+
+func (re registryEncoder) Encode(logEvent interface{}) error {
+	if ok, err := re.rb.writeFast(logEvent, re.reg.name); ok {
+		return err
+	}
+	return re.rb.flush(re.encode(logEvent))
+}
+
+// encode encodes the header and the event into the record buffer
+func (re registryEncoder) encode(logEvent interface{}) error {
+	var hdr registryHeader
+	if se, ok := logEvent.(*SequencedEvent); ok {
+		hdr.Seq, hdr.Sequenced, logEvent = se.Seq, true, se.Event
+	}
+	if ne, ok := logEvent.(*NamespacedEvent); ok && (ne.NS != "" || ne.Annotations != nil) {
+		hdr.NS, hdr.Ann, logEvent = ne.NS, ne.Annotations, ne.Event
+	}
+	name, ok := re.reg.name(reflect.TypeOf(logEvent))
+	if !ok {
+		return fmt.Errorf("type %T is not in the log's type registry", logEvent)
+	}
+	hdr.Type = name
+	if err := re.enc.Encode(&hdr); err != nil {
+		return err
+	}
+	return re.enc.Encode(logEvent)
+}
+
+type registryDecoder struct {
+	r        *bufio.Reader
+	dec      *gob.Decoder
+	reg      *TypeRegistry
+	maxDepth int
+	pool     *EventPool
+	started  bool    // the start of the stream has been inspected
+	legacy   Decoder // decoder of a stream written without registry, see isLegacyStream
+	buf      []byte  // body of the last fast record, see appendFast
+}
+
+func newRegistryDecoder(r io.Reader, reg *TypeRegistry, maxDepth int) *registryDecoder {
+	br := bufio.NewReader(r)
+	return &registryDecoder{r: br, dec: gob.NewDecoder(br), reg: reg, maxDepth: maxDepth}
+}
+
+// frameDecoder returns a decoder of the events of a shard frame, see ParallelSnapshot
+func (rd *registryDecoder) frameDecoder(r io.Reader) Decoder {
+	dec := newRegistryDecoder(r, rd.reg, rd.maxDepth)
+	dec.pool = rd.pool
+	return dec
+}
+
+// restart returns a decoder of the stream that follows a HandoffMark, which continues with
+// what the buffered reader holds
+func (rd *registryDecoder) restart() Decoder {
+	dec := newRegistryDecoder(rd.r, rd.reg, rd.maxDepth)
+	dec.pool = rd.pool
+	return dec
+}
+
+func (rd *registryDecoder) Decode() (interface{}, error) {
+	if !rd.started {
+		rd.started = true
+		if isLegacyStream(rd.r) {
+			rd.legacy = newGobDecoder(rd.r, rd.maxDepth)
+		}
+	}
+	if rd.legacy != nil {
+		return rd.legacy.Decode()
+	}
+	if b, err := rd.r.Peek(1); err == nil && b[0] == 0 {
+		return rd.decodeFast()
+	}
+	var hdr registryHeader
+	if err := rd.dec.Decode(&hdr); err != nil {
+		return nil, err
+	}
+	t, ok := rd.reg.lookup(hdr.Type)
+	if !ok {
+		// skip the value so decoding can continue with the next event
+		if err := rd.dec.DecodeValue(reflect.Value{}); err != nil {
+			return nil, eofInRecord(err)
+		}
+		return nil, fmt.Errorf("type %q is not in the log's type registry", hdr.Type)
+	}
+	v := rd.newValue(t)
+	if err := rd.dec.DecodeValue(v); err != nil {
+		return nil, eofInRecord(err)
+	}
+	ev, err := rd.event(t, v)
+	if err != nil {
+		return nil, err
+	}
+	if hdr.NS != "" || hdr.Ann != nil {
+		ev = &NamespacedEvent{NS: hdr.NS, Event: ev, Annotations: hdr.Ann}
+	}
+	if hdr.Sequenced {
+		return &SequencedEvent{Seq: hdr.Seq, Event: ev}, nil
+	}
+	return ev, nil
+}
+
+// decodeFast decodes the fast record that comes next, see appendFast
+func (rd *registryDecoder) decodeFast() (interface{}, error) {
+	if _, err := rd.r.ReadByte(); err != nil {
+		return nil, err
+	}
+	var err error
+	if rd.buf, err = readFast(rd.r, rd.buf); err != nil {
+		return nil, err
+	}
+	rec, err := parseFast(rd.buf)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := rd.reg.lookupBytes(rec.name)
+	if !ok {
+		return nil, fmt.Errorf("type %q is not in the log's type registry", rec.name)
+	}
+	v := rd.newValue(t)
+	if _, err := unmarshalFast(v, rec.data); err != nil {
+		return nil, err
+	}
+	ev, err := rd.event(t, v)
+	if err != nil {
+		return nil, err
+	}
+	return rec.wrap(ev), nil
+}
+
+// newValue returns a pointer to decode an event of type t into
+func (rd *registryDecoder) newValue(t reflect.Type) reflect.Value {
+	if t.Kind() == reflect.Ptr && rd.pool != nil {
+		return rd.pool.get(t)
+	} else if t.Kind() == reflect.Ptr {
+		return reflect.New(t.Elem())
+	}
+	return reflect.New(t)
+}
+
+// event returns the event of type t decoded into v, see newValue
+func (rd *registryDecoder) event(t reflect.Type, v reflect.Value) (interface{}, error) {
+	if t.Kind() != reflect.Ptr {
+		v = v.Elem()
+	}
+	ev := v.Interface()
+	if rd.maxDepth > 0 && tooDeep(v, rd.maxDepth) {
+		return nil, fmt.Errorf("%T event nests more than %d levels deep", ev, rd.maxDepth)
+	}
+	return ev, nil
+}
+
+// eofInRecord reports the end of the stream between the header and the value of an event
+// as a truncated stream
+func eofInRecord(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// isLegacyStream returns true if a stream starts with a gob interface value, which is how
+// events are written without a registry. A registry stream starts with the definition
+// of the header type, whose gob type id is negative, or with a fast record if it holds
+// the events of a shard frame. Log files start with a GenerationMeta, never a fast record.
+func isLegacyStream(r *bufio.Reader) bool {
+	// skip the message's byte count, a gob unsigned integer
+	b, err := r.Peek(1)
+	if err != nil || b[0] == 0 {
+		return false
+	}
+	n := 1
+	if b[0] >= 0x80 {
+		n += 256 - int(b[0])
+	}
+	b, err = r.Peek(n + 1)
+	if err != nil {
+		return false
+	}
+	// type ids are sent as unsigned integers with the sign in the low bit
+	return b[n] == 2*gobInterfaceID
+}
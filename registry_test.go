@@ -0,0 +1,149 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// event types that are deliberately not registered with Register
+type regEvA struct{ N int }
+type regEvB struct{ S string }
+
+var _ = Describe("TypeRegistry", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	It("replays logs using only the registered types", func() {
+		reg := NewTypeRegistry()
+		Ω(reg.Register("a", &regEvA{})).ShouldNot(HaveOccurred())
+		Ω(reg.Register("b", regEvB{})).ShouldNot(HaveOccurred())
+
+		fd, err := NewFileDest(PT+"/reg", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{events: []interface{}{&regEvA{N: 1}, regEvB{S: "x"}}}
+		pl, err := NewLog(fd, rc, log15.Root(), WithTypeRegistry(reg),
+			RecordSequenceNumbers(), WithDecodeLimits(DecodeLimits{MaxDepth: 10}))
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.SetSizeLimit(10)
+		Ω(pl.Output(&regEvA{N: 2})).ShouldNot(HaveOccurred())
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(2.0))
+		pl.(*pLog).Close()
+
+		fd, err = NewFileDest(PT+"/reg", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc = &recordingClient{}
+		pl, err = NewLog(fd, rc, log15.Root(), WithTypeRegistry(reg), RecordSequenceNumbers())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(Equal([]interface{}{&regEvA{N: 1}, regEvB{S: "x"}}))
+		pl.(*pLog).Close()
+	})
+
+	It("isolates registries that use the same names", func() {
+		reg1, reg2 := NewTypeRegistry(), NewTypeRegistry()
+		Ω(reg1.Register("event", &regEvA{})).ShouldNot(HaveOccurred())
+		Ω(reg2.Register("event", &regEvB{})).ShouldNot(HaveOccurred())
+
+		var buf bytes.Buffer
+		enc := GobCodecWithRegistry(reg2).NewEncoder(&buf)
+		Ω(enc.Encode(&regEvB{S: "two"})).ShouldNot(HaveOccurred())
+		rc := &recordingClient{}
+		n, err := ReplayFrom(&buf, GobCodecWithRegistry(reg2), rc)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(n).Should(Equal(1))
+		Ω(rc.events).Should(Equal([]interface{}{&regEvB{S: "two"}}))
+	})
+
+	It("rejects conflicting registrations", func() {
+		reg := NewTypeRegistry()
+		Ω(reg.Register("a", &regEvA{})).ShouldNot(HaveOccurred())
+		Ω(reg.Register("a", &regEvA{})).ShouldNot(HaveOccurred())
+		err := reg.Register("a", &regEvB{})
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring(`name "a" is already registered`))
+		err = reg.Register("a2", &regEvA{})
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring(`is already registered as "a"`))
+		Ω(reg.Register("persist.GenerationMeta", &regEvB{})).Should(HaveOccurred())
+	})
+
+	It("reports types missing from the registry", func() {
+		full, partial := NewTypeRegistry(), NewTypeRegistry()
+		Ω(full.Register("a", &regEvA{})).ShouldNot(HaveOccurred())
+		Ω(full.Register("b", &regEvB{})).ShouldNot(HaveOccurred())
+		Ω(partial.Register("a", &regEvA{})).ShouldNot(HaveOccurred())
+
+		var buf bytes.Buffer
+		enc := GobCodecWithRegistry(partial).NewEncoder(&buf)
+		err := enc.Encode(&regEvB{S: "b"})
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("*persist.regEvB is not in the log's type"))
+
+		buf.Reset()
+		enc = GobCodecWithRegistry(full).NewEncoder(&buf)
+		Ω(enc.Encode(&regEvB{S: "b"})).ShouldNot(HaveOccurred())
+		Ω(enc.Encode(&regEvA{N: 1})).ShouldNot(HaveOccurred())
+		dec := GobCodecWithRegistry(partial).NewDecoder(&buf)
+		_, err = dec.Decode()
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring(`type "b" is not in the log's type registry`))
+		ev, err := dec.Decode()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ev).Should(Equal(&regEvA{N: 1}))
+	})
+	It("replays and upgrades logs written without a registry", func() {
+		fd, err := NewFileDest(PT+"/legacy", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{events: []interface{}{&logEv1{S: "old"}}}
+		pl, err := NewLog(fd, rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		reg := NewTypeRegistry()
+		Ω(reg.Register("ev1", &logEv1{})).ShouldNot(HaveOccurred())
+		fd, err = NewFileDest(PT+"/legacy", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc = &recordingClient{}
+		pl, err = NewLog(fd, rc, log15.Root(), WithTypeRegistry(reg), RecordSequenceNumbers())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(Equal([]interface{}{&logEv1{S: "old"}}))
+		pl.(*pLog).Close()
+
+		By("checking that the log was upgraded")
+		files, err := ReplayFiles(PT + "/legacy")
+		Ω(err).ShouldNot(HaveOccurred())
+		f, err := os.Open(files[0])
+		Ω(err).ShouldNot(HaveOccurred())
+		defer f.Close()
+		m, err := ReplayMeta(f, GobCodecWithRegistry(reg))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(m.Format).Should(Equal(formatRegistry))
+		Ω(m.Sequenced).Should(BeTrue())
+		f.Seek(0, 0)
+		rc = &recordingClient{}
+		_, err = ReplayFrom(f, GobCodecWithRegistry(reg), rc)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(Equal([]interface{}{&logEv1{S: "old"}}))
+	})
+
+	It("replays streams without metadata", func() {
+		var buf bytes.Buffer
+		enc := GobCodec.NewEncoder(&buf)
+		Ω(enc.Encode(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		Ω(enc.Encode(&logEv2{A: 1})).ShouldNot(HaveOccurred())
+		rc := &recordingClient{}
+		n, err := ReplayFrom(&buf, GobCodecWithRegistry(NewTypeRegistry()), rc)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(n).Should(Equal(2))
+		Ω(rc.events).Should(Equal([]interface{}{&logEv1{S: "a"}, &logEv2{A: 1}}))
+	})
+})
@@ -0,0 +1,47 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+// SegmentReplay describes the replay of a log segment, such as a log file: the bytes read
+// compared to the events applied quantify the read amplification of the replay, which
+// compaction and retention tuning reduce. The events that are read but not applied include
+// those that were erased, repeated, or filtered out, e.g., by ReplayNamespaces, as well as
+// those skipped when resuming a replay or attaching a standby.
+type SegmentReplay struct {
+	Segment string // name of the segment, empty if the destination doesn't name it
+	Bytes   int64  // bytes read, including metadata and persist's internal records
+	Events  int    // events applied, i.e., replayed into the client
+}
+
+// BytesPerEvent returns the bytes read per event applied, 0 if no event was applied
+func (sr SegmentReplay) BytesPerEvent() float64 {
+	if sr.Events == 0 {
+		return 0
+	}
+	return float64(sr.Bytes) / float64(sr.Events)
+}
+
+// ReplayedSegments returns the segments the log replayed when it was opened, in replay
+// order. Stats reports their totals as ReplayBytesRead and ReplayEventsApplied, and the
+// bytes read per event applied as ReplayBytesPerEvent.
+func ReplayedSegments(log Log) []SegmentReplay {
+	pl, ok := log.(*pLog)
+	if !ok {
+		return nil
+	}
+	pl.Lock()
+	defer pl.Unlock()
+	return append([]SegmentReplay(nil), pl.segments...)
+}
+
+// replayStats adds the totals of the segments replayed to a Stats map
+func replayStats(segments []SegmentReplay, stats map[string]float64) {
+	var total SegmentReplay
+	for _, s := range segments {
+		total.Bytes += s.Bytes
+		total.Events += s.Events
+	}
+	stats["ReplayBytesRead"] = float64(total.Bytes)
+	stats["ReplayEventsApplied"] = float64(total.Events)
+	stats["ReplayBytesPerEvent"] = total.BytesPerEvent()
+}
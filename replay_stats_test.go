@@ -0,0 +1,51 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("Replay statistics", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	It("reports the bytes read and the events applied per segment", func() {
+		fd, err := NewFileDest(PT+"/stats", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{events: []interface{}{&logEv1{S: "a"}}},
+			log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(ReplayedSegments(pl)).Should(BeEmpty())
+		for i := 0; i < 10; i++ {
+			Ω(OutputNS(pl, "t1", &logEv2{A: i})).ShouldNot(HaveOccurred())
+			Ω(OutputNS(pl, "t2", &logEv2{A: i})).ShouldNot(HaveOccurred())
+		}
+		pl.(*pLog).Close()
+		files, err := ReplayFiles(PT + "/stats")
+		Ω(err).ShouldNot(HaveOccurred())
+		st, err := os.Stat(files[0])
+		Ω(err).ShouldNot(HaveOccurred())
+
+		fd, err = NewFileDest(PT+"/stats", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err = NewLog(fd, &recordingClient{}, log15.Root(),
+			ReplayNamespaces(func(ns string) bool { return ns != "t2" }))
+		Ω(err).ShouldNot(HaveOccurred())
+		defer pl.(*pLog).Close()
+		segs := ReplayedSegments(pl)
+		Ω(segs).Should(Equal([]SegmentReplay{
+			{Segment: files[0], Bytes: st.Size(), Events: 11}}))
+		Ω(segs[0].BytesPerEvent()).Should(Equal(float64(st.Size()) / 11))
+		Ω(pl.Stats()["ReplayBytesRead"]).Should(Equal(float64(st.Size())))
+		Ω(pl.Stats()["ReplayEventsApplied"]).Should(Equal(11.0))
+	})
+})
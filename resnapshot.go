@@ -0,0 +1,90 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// legacyCounter counts the legacy records replayed, which remain in the log until the
+// first rotation replaces the replayed logs with a snapshot, see Resnapshot
+type legacyCounter struct {
+	types   map[reflect.Type]bool // event types replaced by a migration, see LegacyTypes
+	records int                   // legacy records in the replayed logs
+}
+
+// LegacyTypes declares event types that a schema migration replaced: the application's
+// Replay still accepts them and converts them, but PersistAll outputs their replacements.
+// Replayed events of these types are counted as legacy records, see Resnapshot.
+func LegacyTypes(events ...interface{}) LogOption {
+	return func(pl *pLog) {
+		pl.legacy.types = make(map[reflect.Type]bool)
+		for _, ev := range events {
+			pl.legacy.types[reflect.TypeOf(ev)] = true
+		}
+	}
+}
+
+// Resnapshot forces a rotation, waits for it to complete, and returns the number of legacy
+// records it eliminated from the log, i.e., the replayed events whose type was declared
+// using LegacyTypes. It's meant to be run after deploying a migration, to confirm that the
+// old formats are retired from disk without a restart: the snapshot is written using the
+// event types PersistAll outputs and the log's current codec while outputs continue. The
+// snapshot NewLog writes eliminates the legacy records as well, hence they only remain
+// after a zero-downtime restart, which appends to the log taken over instead, see Handoff,
+// and until the log rotates. The replayed logs are only retired if the rotation completes,
+// Resnapshot returns an error if it fails.
+func Resnapshot(log Log) (int, error) {
+	pl, ok := log.(*pLog)
+	if !ok {
+		return 0, fmt.Errorf("Resnapshot requires a log created by NewLog")
+	}
+	if !pl.priCaps.CanRotate {
+		return 0, fmt.Errorf("Resnapshot requires a destination that can rotate")
+	}
+	for {
+		pl.Lock()
+		if !pl.rotating && !pl.catchingUp {
+			break
+		}
+		pl.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	if err := pl.checkState(); err != nil {
+		pl.Unlock()
+		return 0, err
+	}
+	legacy := pl.legacy.records
+	pl.rotate()
+	n := pl.rotation
+	pl.Unlock()
+
+	if err := pl.awaitRotation(n); err != nil {
+		return 0, err
+	}
+	pl.log.Info("Re-snapshot done", "legacy_records", legacy)
+	return legacy, nil
+}
+
+// legacyDecoder counts the legacy records of a replayed stream
+type legacyDecoder struct {
+	Decoder
+	lc *legacyCounter
+}
+
+func (ld legacyDecoder) Decode() (interface{}, error) {
+	ev, err := ld.Decoder.Decode()
+	if err != nil || ld.lc.types == nil {
+		return ev, err
+	}
+	t := ev
+	if ne, ok := ev.(*NamespacedEvent); ok {
+		t = ne.Event
+	}
+	if ld.lc.types[reflect.TypeOf(t)] {
+		ld.lc.records++
+	}
+	return ev, err
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// client that migrated from logEv1 to logEv2, it converts the former on replay
+type migratingClient struct {
+	state   []string
+	legacy  int // logEv1 events replayed
+	current int // logEv2 events replayed
+}
+
+func (mc *migratingClient) Replay(ev interface{}) error {
+	switch ev := ev.(type) {
+	case *logEv1:
+		mc.legacy++
+		mc.state = append(mc.state, ev.S)
+	case *logEv2:
+		mc.current++
+		mc.state = append(mc.state, ev.B)
+	}
+	return nil
+}
+
+func (mc *migratingClient) PersistAll(pl Log) {
+	for _, s := range mc.state {
+		Ω(pl.Output(&logEv2{B: s})).ShouldNot(HaveOccurred())
+	}
+}
+
+var _ = Describe("Resnapshot", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	open := func(mc *migratingClient, opts ...FileDestOption) Log {
+		fd, err := NewFileDest(PT+"/resnap", true, nil, opts...)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, mc, log15.Root(), LegacyTypes(&logEv1{}))
+		Ω(err).ShouldNot(HaveOccurred())
+		return pl
+	}
+
+	It("eliminates the legacy records left by a handoff", func() {
+		By("handing off a log holding legacy records")
+		pl := open(&migratingClient{})
+		Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "b"})).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv2{B: "c"})).ShouldNot(HaveOccurred())
+		Ω(Handoff(pl)).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		By("taking it over")
+		mc := &migratingClient{}
+		pl = open(mc, TakeOver())
+		Ω(mc.state).Should(Equal([]string{"a", "b", "c"}))
+		Ω(pl.Stats()["LegacyRecords"]).Should(Equal(2.0))
+
+		By("re-snapshotting")
+		Ω(Resnapshot(pl)).Should(Equal(2))
+		Ω(pl.Stats()["LegacyRecords"]).Should(Equal(0.0))
+		Ω(pl.Stats()["Generation"]).Should(Equal(2.0))
+		Ω(Resnapshot(pl)).Should(Equal(0))
+		pl.(*pLog).Close()
+
+		By("replaying only current records")
+		mc = &migratingClient{}
+		pl = open(mc)
+		Ω(mc.state).Should(Equal([]string{"a", "b", "c"}))
+		Ω(mc.legacy).Should(Equal(0))
+		Ω(pl.Stats()["LegacyRecords"]).Should(Equal(0.0))
+		pl.(*pLog).Close()
+	})
+
+	It("requires a log that can rotate", func() {
+		pl, err := NewLog(NewWriterDest(&countingWriter{}, nil), &migratingClient{},
+			log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = Resnapshot(pl)
+		Ω(err).Should(MatchError("Resnapshot requires a destination that can rotate"))
+	})
+})
@@ -0,0 +1,91 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"io"
+)
+
+// ResumeToken identifies how far a failed replay got, such that a corrected client that
+// retains the state replayed so far can resume the replay where it failed instead of
+// starting over, see ResumeReplay
+type ResumeToken struct {
+	Log     int    // index of the replay reader in which the replay failed
+	Gen     uint64 // generation of that log, used to check that the logs haven't changed
+	Entries int    // number of entries of that log the client replayed successfully
+}
+
+// ReplayError is the error returned by NewLog when a replay fails, it carries a token to
+// resume the replay at the entry that failed
+type ReplayError struct {
+	Token ResumeToken
+	err   error
+}
+
+func (e *ReplayError) Error() string {
+	return fmt.Sprintf("replay failed in log %d: %s", e.Token.Log+1, e.err.Error())
+}
+
+// Unwrap returns the OpError describing where the replay failed
+func (e *ReplayError) Unwrap() error { return e.err }
+
+// ResumeReplay makes NewLog resume a replay that failed with a ReplayError: the logs that
+// were fully replayed are skipped and so are the entries of the failed log the client
+// replayed successfully. The client must still hold the state those entries produced and
+// the destination must present the same logs, NewLog fails if the generation of the log
+// to resume doesn't match the token. The entries skipped in the failed log still need to
+// be decoded, gob streams cannot be read from the middle.
+func ResumeReplay(token ResumeToken) LogOption {
+	return func(pl *pLog) { pl.resume = &token }
+}
+
+// resumeClient wraps the client during a replay in order to skip the entries that were
+// replayed before and to count the ones that are replayed successfully
+type resumeClient struct {
+	LogClient
+	skip int // entries left to skip
+	done int // entries replayed successfully, including the skipped ones
+	used int // entries passed to the client, see SegmentReplay
+}
+
+func (rc *resumeClient) Replay(logEvent interface{}) error {
+	if rc.skip > 0 {
+		rc.skip--
+		rc.done++
+		return nil
+	}
+	if err := rc.LogClient.Replay(logEvent); err != nil {
+		return err
+	}
+	rc.done++
+	rc.used++
+	return nil
+}
+
+func (rc *resumeClient) ReplayBlob(name string, r io.Reader) error {
+	if rc.skip > 0 {
+		rc.skip--
+		rc.done++
+		return nil
+	}
+	bc, err := blobClient(rc.LogClient, name)
+	if err != nil {
+		return err
+	}
+	if err := bc.ReplayBlob(name, r); err != nil {
+		return err
+	}
+	rc.done++
+	rc.used++
+	return nil
+}
+
+// checkResume verifies that the generation of the log being resumed matches the token
+func checkResume(token *ResumeToken, m *GenerationMeta) error {
+	if m.Gen != token.Gen {
+		return fmt.Errorf("cannot resume replay: log %d is generation %d, expected %d",
+			token.Log+1, m.Gen, token.Gen)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// client that fails to replay one specific event until it's fixed
+type brokenClient struct {
+	recordingClient
+	bad string
+}
+
+func (bc *brokenClient) Replay(ev interface{}) error {
+	if e, ok := ev.(*logEv1); ok && e.S == bc.bad {
+		return fmt.Errorf("cannot handle %s", e.S)
+	}
+	return bc.recordingClient.Replay(ev)
+}
+
+var _ = Describe("ResumeReplay", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+		fd, err := NewFileDest(PT+"/resume", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		for _, s := range []string{"a", "b", "c", "d"} {
+			Ω(pl.Output(&logEv1{S: s})).ShouldNot(HaveOccurred())
+		}
+		pl.(*pLog).Close()
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	// replay the log, returning the token of the failed replay
+	failReplay := func(client LogClient) ResumeToken {
+		fd, err := NewFileDest(PT+"/resume", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = NewLog(fd, client, log15.Root())
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("replay failed in log 1"))
+		Ω(err).Should(BeAssignableToTypeOf(&ReplayError{}))
+		fd.Close()
+		return err.(*ReplayError).Token
+	}
+
+	It("resumes at the entry that failed", func() {
+		bc := &brokenClient{bad: "c"}
+		token := failReplay(bc)
+		Ω(token).Should(Equal(ResumeToken{Log: 0, Gen: 1, Entries: 2}))
+		Ω(bc.events).Should(Equal([]interface{}{&logEv1{S: "a"}, &logEv1{S: "b"}}))
+
+		By("failing again further along")
+		fd, err := NewFileDest(PT+"/resume", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		bc.bad = "d"
+		_, err = NewLog(fd, bc, log15.Root(), ResumeReplay(token))
+		Ω(err).Should(HaveOccurred())
+		fd.Close()
+		token = err.(*ReplayError).Token
+		Ω(token.Entries).Should(Equal(3))
+
+		By("completing the replay once the client is fixed")
+		fd, err = NewFileDest(PT+"/resume", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		bc.bad = ""
+		pl, err := NewLog(fd, bc, log15.Root(), ResumeReplay(token))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(bc.events).Should(Equal([]interface{}{&logEv1{S: "a"}, &logEv1{S: "b"},
+			&logEv1{S: "c"}, &logEv1{S: "d"}}))
+		pl.(*pLog).Close()
+	})
+
+	It("refuses tokens that don't match the log", func() {
+		token := failReplay(&brokenClient{bad: "c"})
+
+		fd, err := NewFileDest(PT+"/resume", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		stale := token
+		stale.Gen++
+		_, err = NewLog(fd, &recordingClient{}, log15.Root(), ResumeReplay(stale))
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("log 1 is generation 1, expected 2"))
+		fd.Close()
+
+		fd, err = NewFileDest(PT+"/resume", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		stale = token
+		stale.Log = 3
+		_, err = NewLog(fd, &recordingClient{}, log15.Root(), ResumeReplay(stale))
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("there are only 1 logs"))
+		fd.Close()
+	})
+})
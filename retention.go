@@ -0,0 +1,99 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RetainUnderUsage makes a file destination delete old log files, oldest first, at the end
+// of each rotation while the filesystem holding the log is more than maxUsage full, e.g.
+// 0.8 for 80%. The files of the keep most recent generations, including the current one,
+// are never deleted, nor are files needed for replay. If the filesystem is still too full
+// once only those remain, a warning is logged and reported by the log's Stats as
+// PrimaryHealthWarning until a later rotation brings the usage back under maxUsage. Without
+// this option old log files are kept until they are trimmed, see TrimLogSet.
+func RetainUnderUsage(maxUsage float64, keep int) FileDestOption {
+	if keep < 1 {
+		keep = 1
+	}
+	return runtimeFileOption(func(fd *fileDest) {
+		fd.maxUsage = maxUsage
+		fd.keepGens = keep
+		fd.usage = diskUsage
+	})
+}
+
+// usageFunc returns the fraction of the filesystem holding a directory that is in use
+type usageFunc func(dir string) (float64, error)
+
+// healthWarner is implemented by destinations that detect conditions that don't prevent
+// logging yet but require attention
+type healthWarner interface {
+	healthWarning() error
+}
+
+func (fd *fileDest) healthWarning() error {
+	if fd.warning != nil {
+		return fd.warning
+	}
+	return fd.spaceError()
+}
+
+// retain deletes old log files while the filesystem is too full, see RetainUnderUsage
+func (fd *fileDest) retain() {
+	if fd.usage == nil {
+		return
+	}
+	usage, err := fd.usage(filepath.Dir(fd.basepath))
+	if err != nil {
+		fd.log.Warn("Cannot determine disk usage", "err", err)
+		return
+	}
+	if usage <= fd.maxUsage {
+		fd.warning = nil
+		return
+	}
+
+	// after a rotation the current file is the only one needed for replay, unless it holds
+	// a delta snapshot, which needs the files of the generations it builds on
+	files, err := LogFiles(fd.basepath)
+	if err != nil {
+		fd.log.Warn("Cannot list log files", "err", err)
+		return
+	}
+	var old []string
+	for _, f := range files {
+		if f < fd.outputFilename && strings.HasSuffix(f, oldExt) {
+			old = append(old, f)
+		}
+	}
+	keep := fd.keepGens - 1
+	if depth := snapshotDepth(fd.outputFilename); depth > keep {
+		keep = depth
+	}
+	for len(old) > keep && usage > fd.maxUsage {
+		if err := os.Remove(old[0]); err != nil {
+			fd.log.Warn("Cannot delete old log file", "file", old[0], "err", err)
+			return
+		}
+		os.Remove(old[0] + checksumExt)
+		fd.log.Info("Deleted old log file to free disk space", "file", old[0],
+			"usage", usage)
+		old = old[1:]
+		if usage, err = fd.usage(filepath.Dir(fd.basepath)); err != nil {
+			fd.log.Warn("Cannot determine disk usage", "err", err)
+			return
+		}
+	}
+	if usage > fd.maxUsage {
+		fd.warning = fmt.Errorf("disk usage is %.1f%% with the log files of %d generations "+
+			"left, above the %.1f%% limit", usage*100, len(old)+1, fd.maxUsage*100)
+		fd.log.Warn("Disk usage remains too high", "err", fd.warning)
+	} else {
+		fd.warning = nil
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("RetainUnderUsage", func() {
+	basepath := PT + "/retained"
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	// oldFiles returns the number of old log files
+	oldFiles := func() int {
+		files, err := LogFiles(basepath)
+		Ω(err).ShouldNot(HaveOccurred())
+		n := 0
+		for _, f := range files {
+			if strings.HasSuffix(f, oldExt) {
+				n++
+			}
+		}
+		return n
+	}
+
+	// rotate forces n rotations
+	rotate := func(pl Log, n int) {
+		for i := 0; i < n; i++ {
+			gen := pl.Stats()["Generation"]
+			Ω(pl.Output(&logEv1{S: "trigger a rotation"})).ShouldNot(HaveOccurred())
+			Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(gen + 1))
+			Eventually(func() bool {
+				pl.(*pLog).Lock()
+				defer pl.(*pLog).Unlock()
+				return pl.(*pLog).rotating
+			}).Should(BeFalse())
+		}
+	}
+
+	It("deletes old files while the disk is too full", func() {
+		fd, err := NewFileDest(basepath, true, nil, RetainUnderUsage(0.5, 2))
+		Ω(err).ShouldNot(HaveOccurred())
+		// each old file takes 20% of the disk
+		fd.(*fileDest).usage = func(string) (float64, error) {
+			return 0.2 + 0.2*float64(oldFiles()), nil
+		}
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.SetSizeLimit(10)
+		rotate(pl, 4)
+		Ω(oldFiles()).Should(Equal(1))
+		Ω(pl.Stats()["PrimaryHealthWarning"]).Should(Equal(0.0))
+
+		By("warning when the generations to keep don't fit")
+		fd.(*fileDest).usage = func(string) (float64, error) { return 0.9, nil }
+		rotate(pl, 2)
+		Ω(oldFiles()).Should(Equal(1))
+		Ω(pl.Stats()["PrimaryHealthWarning"]).Should(Equal(1.0))
+		Ω(fd.(*fileDest).warning.Error()).Should(ContainSubstring("disk usage is 90.0%"))
+
+		fd.(*fileDest).usage = func(string) (float64, error) { return 0.1, nil }
+		rotate(pl, 1)
+		Ω(pl.Stats()["PrimaryHealthWarning"]).Should(Equal(0.0))
+		Ω(oldFiles()).Should(Equal(2))
+		pl.(*pLog).Close()
+	})
+
+	It("measures disk usage", func() {
+		usage, err := diskUsage(PT)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(usage).Should(BeNumerically(">", 0))
+		Ω(usage).Should(BeNumerically("<=", 1))
+	})
+})
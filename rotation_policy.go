@@ -0,0 +1,92 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import "time"
+
+// minRateEvents is the number of events NewLog must replay to measure the replay rate
+const minRateEvents = 1000
+
+// RotationState describes the current generation of a log to a RotationPolicy
+type RotationState struct {
+	Gen            uint64
+	Age            time.Duration // time since the generation started
+	SnapshotBytes  int           // size of the snapshot at the start of the generation
+	SnapshotEvents int           // events in the snapshot
+	Bytes          int           // size of the events output since the snapshot
+	Events         int           // events output since the snapshot
+	ReplayRate     float64       // events per second replayed by NewLog, 0 if not measured
+}
+
+// ReplayTime estimates the time it takes to replay the generation, it returns 0 if the
+// replay rate is unknown
+func (rs RotationState) ReplayTime() time.Duration {
+	if rs.ReplayRate <= 0 {
+		return 0
+	}
+	secs := float64(rs.SnapshotEvents+rs.Events) / rs.ReplayRate
+	return time.Duration(secs * float64(time.Second))
+}
+
+// A RotationPolicy decides when a log rotates, in addition to the size limit. It's called
+// after each event output outside of a rotation and returns true to start a rotation. It's
+// called while holding the log's lock and must not call back into the log.
+type RotationPolicy func(st RotationState) bool
+
+// WithRotationPolicy adds a policy that triggers rotations, the log still rotates when
+// it exceeds its size limit, see SetSizeLimit
+func WithRotationPolicy(policy RotationPolicy) LogOption {
+	return runtimeOption(func(pl *pLog) { pl.policy = policy })
+}
+
+// ReplayTimePolicy returns a policy that rotates the log once the projected time to replay
+// it exceeds the target, which bounds the time it takes to restart the application better
+// than the size of the log does. The projection uses the rate at which NewLog replayed
+// the log, including decoding and the client's Replay calls, which is only measured if
+// NewLog replayed at least 1000 events, and the policy doesn't trigger until then. It also
+// doesn't trigger before the events output since the snapshot outnumber those of the
+// snapshot, so a snapshot that takes longer than the target to replay doesn't cause a
+// rotation after every event. Stats reports the replay rate as ReplayRate, in events per
+// second, and the projection as ProjectedReplayTime, in seconds.
+func ReplayTimePolicy(target time.Duration) RotationPolicy {
+	return func(st RotationState) bool {
+		return st.ReplayRate > 0 && st.Events > st.SnapshotEvents &&
+			st.ReplayTime() > target
+	}
+}
+
+// rotationState returns the state of the current generation, must be called while holding
+// the lock
+func (pl *pLog) rotationState() RotationState {
+	return RotationState{Gen: pl.gen, Age: pl.now().Sub(pl.genStart),
+		SnapshotBytes: pl.sizeReplay, SnapshotEvents: pl.snapEvents, Bytes: pl.size,
+		Events: pl.liveEvents, ReplayRate: pl.replayRate}
+}
+
+// rotationDue returns true if the log must rotate, must be called while holding the lock
+func (pl *pLog) rotationDue() bool {
+	if !pl.priCaps.CanRotate {
+		return false
+	}
+	if pl.interval > 0 && pl.now().Sub(pl.genStart) > pl.interval {
+		return true
+	}
+	return pl.size > pl.sizeLimit || pl.policy != nil && pl.policy(pl.rotationState())
+}
+
+// startGeneration resets the counters of the current generation
+func (pl *pLog) startGeneration() {
+	pl.genStart = pl.now()
+	pl.genSeq = pl.seq
+	pl.snapEvents, pl.liveEvents = 0, 0
+	pl.snapBytes, pl.throttling = 0, false
+	pl.dups.reset()
+	pl.armAgeCheck()
+}
+
+// measureReplay records the rate at which NewLog replayed events
+func (pl *pLog) measureReplay(events int, elapsed time.Duration) {
+	if events >= minRateEvents && elapsed > 0 {
+		pl.replayRate = float64(events) / elapsed.Seconds()
+	}
+}
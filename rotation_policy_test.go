@@ -0,0 +1,91 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("Rotation policy", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	It("rotates when the policy says so", func() {
+		var states []RotationState
+		policy := func(st RotationState) bool {
+			states = append(states, st)
+			return st.Events >= 3
+		}
+		fd, err := NewFileDest(PT+"/policy", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{events: []interface{}{&logEv1{S: "a"}, &logEv1{S: "b"}}}
+		pl, err := NewLog(fd, rc, log15.Root(), WithRotationPolicy(policy))
+		Ω(err).ShouldNot(HaveOccurred())
+		for i := 0; i < 3; i++ {
+			Ω(pl.Output(&logEv2{A: i})).ShouldNot(HaveOccurred())
+		}
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(2.0))
+		pl.(*pLog).Close()
+
+		Ω(states).Should(HaveLen(3))
+		st := states[2]
+		Ω(st.Gen).Should(Equal(uint64(1)))
+		Ω(st.SnapshotEvents).Should(Equal(2))
+		Ω(st.Events).Should(Equal(3))
+		Ω(st.SnapshotBytes).Should(BeNumerically(">", 0))
+		Ω(st.Bytes).Should(BeNumerically(">", 0))
+		Ω(st.ReplayRate).Should(BeZero())
+		Ω(st.ReplayTime()).Should(BeZero())
+	})
+
+	It("measures the replay rate", func() {
+		fd, err := NewFileDest(PT+"/policy", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{}
+		for i := 0; i < minRateEvents; i++ {
+			rc.events = append(rc.events, &logEv2{A: i})
+		}
+		pl, err := NewLog(fd, rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()["ReplayRate"]).Should(BeZero())
+		pl.(*pLog).Close()
+
+		fd, err = NewFileDest(PT+"/policy", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err = NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		rate := pl.Stats()["ReplayRate"]
+		Ω(rate).Should(BeNumerically(">", 0))
+		Ω(pl.Stats()["ProjectedReplayTime"]).Should(BeNumerically("~", minRateEvents/rate))
+		Ω(pl.Output(&logEv2{A: 1})).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()["ProjectedReplayTime"]).Should(BeNumerically("~",
+			(minRateEvents+1)/rate))
+		pl.(*pLog).Close()
+	})
+
+	It("rotates when the projected replay time exceeds the target", func() {
+		policy := ReplayTimePolicy(30 * time.Second)
+		st := RotationState{SnapshotEvents: 1000, Events: 2000, ReplayRate: 100}
+		Ω(st.ReplayTime()).Should(Equal(30 * time.Second))
+		Ω(policy(st)).Should(BeFalse())
+		st.Events++
+		Ω(policy(st)).Should(BeTrue())
+
+		By("not rotating when the snapshot dominates")
+		st = RotationState{SnapshotEvents: 5000, Events: 4000, ReplayRate: 100}
+		Ω(policy(st)).Should(BeFalse())
+
+		By("not rotating without a replay rate")
+		st = RotationState{Events: 1e6}
+		Ω(policy(st)).Should(BeFalse())
+	})
+})
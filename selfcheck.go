@@ -0,0 +1,140 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Checks performed by SelfCheck, as reported in SelfCheckProblem.Check
+const (
+	CheckLayout   = "layout"   // the set of log files is inconsistent, see PlanRepair
+	CheckFormat   = "format"   // a log file requires a newer version of persist
+	CheckChecksum = "checksum" // a log file no longer matches its recorded checksum
+	CheckDecode   = "decode"   // a log file to replay is truncated, corrupt, or incomplete
+)
+
+// SelfCheckProblem is a problem found by SelfCheck
+type SelfCheckProblem struct {
+	File  string // log file with the problem, empty if it concerns the log set
+	Check string // check that failed, e.g. CheckDecode
+	Error string
+}
+
+// SelfCheckResult is the outcome of SelfCheck, it's meant to be marshaled, e.g. as JSON
+type SelfCheckResult struct {
+	OK       bool               // true if the log set can be opened without repair
+	Replay   []string           // log files a file destination replays, in replay order
+	Events   int                // application events decoded from the replay files
+	Verified int                // log files whose recorded checksum was verified
+	Repairs  []RepairAction     // actions that fix the layout, see PlanRepair and Repair
+	Problems []SelfCheckProblem // problems found, empty if OK
+}
+
+// SelfCheck inspects the log set at basepath in a single pass without modifying it: it
+// checks that the log files form a consistent set, that the files to replay were written
+// in a format this version of persist understands, that log files still match their
+// recorded checksums, see Verifier, and that the files to replay decode completely. It's
+// meant to run before the process that opens the log starts, e.g. in an init container, so
+// it must be linked with the application's event types, see Register. A log set with no
+// log files is OK.
+// An error is returned only if the log set cannot be inspected at all.
+func SelfCheck(basepath string) (*SelfCheckResult, error) {
+	files, err := LogFiles(basepath)
+	if err != nil {
+		return nil, err
+	}
+	res := &SelfCheckResult{}
+	problem := func(file, check string, err error) {
+		res.Problems = append(res.Problems, SelfCheckProblem{File: file, Check: check,
+			Error: err.Error()})
+	}
+
+	// layout
+	res.Repairs, err = PlanRepair(basepath)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range res.Repairs {
+		problem(a.From, CheckLayout, fmt.Errorf("%s, rename to %s", a.Reason, a.To))
+	}
+	if len(files) > 0 {
+		if res.Replay, err = ReplayFiles(basepath); err != nil {
+			problem("", CheckLayout, err)
+		}
+	}
+
+	// checksums of the files that have one recorded
+	for _, f := range files {
+		if _, err := os.Stat(f + checksumExt); err != nil {
+			continue
+		}
+		res.Verified++
+		if err := verifyChecksum(f); err != nil {
+			problem(f, CheckChecksum, err)
+		}
+	}
+
+	// format and decoding of the files to replay
+	var prev *seqDecoder
+	for _, f := range res.Replay {
+		sd, n, err := selfCheckDecode(f, prev)
+		res.Events += n
+		if err != nil {
+			check := CheckDecode
+			if _, ok := err.(formatError); ok {
+				check = CheckFormat
+			}
+			problem(f, check, err)
+			break // the following files cannot be checked against this one
+		}
+		prev = sd
+	}
+
+	res.OK = len(res.Problems) == 0
+	return res, nil
+}
+
+// formatError marks errors caused by a format version this version of persist doesn't
+// support
+type formatError struct{ error }
+
+// selfCheckDecode decodes a log file to the end and checks that it follows prev, which is
+// nil for the first file, and returns its decoder and the number of application events
+func selfCheckDecode(name string, prev *seqDecoder) (*seqDecoder, int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	log := log15.New()
+	log.SetHandler(log15.DiscardHandler())
+
+	sd := withSequence(GobCodec.NewDecoder(f))
+	n, metas := 0, 0
+	for {
+		ev, err := sd.Decode()
+		if err == io.EOF {
+			return sd, n, nil
+		} else if err != nil {
+			return nil, n, fmt.Errorf("cannot decode event %d: %s", n+1, err.Error())
+		}
+		if m, ok := ev.(*GenerationMeta); ok {
+			if err := checkFormat(m, false, log); err != nil {
+				return nil, n, formatError{err}
+			}
+			// a generation restated with a newer format doesn't start a stream, see useFormat
+			if metas++; prev != nil && metas == 1 {
+				if err := checkChain(prev, sd); err != nil {
+					return nil, n, err
+				}
+			}
+		} else if !isInternal(ev) {
+			n++
+		}
+	}
+}
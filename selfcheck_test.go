@@ -0,0 +1,119 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("SelfCheck", func() {
+
+	var files []string
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+
+		// two generations, the checksums get recorded as the log rotates
+		fd, err := NewFileDest(PT+"/sc", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{events: []interface{}{&logEv1{S: "a"}, &logEv1{S: "b"}}}
+		pl, err := NewLog(fd, rc, log15.Root(), RecordSequenceNumbers())
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.SetSizeLimit(10)
+		Ω(pl.Output(&logEv1{S: "c"})).ShouldNot(HaveOccurred())
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(2.0))
+		pl.(*pLog).Close()
+		files, err = LogFiles(PT + "/sc")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files).Should(HaveLen(2))
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	check := func() *SelfCheckResult {
+		res, err := SelfCheck(PT + "/sc")
+		Ω(err).ShouldNot(HaveOccurred())
+		return res
+	}
+
+	It("passes a healthy log set", func() {
+		res := check()
+		Ω(res.Problems).Should(BeEmpty())
+		Ω(res.OK).Should(BeTrue())
+		Ω(res.Replay).Should(Equal(files[1:]))
+		Ω(res.Events).Should(Equal(2))
+		Ω(res.Verified).Should(Equal(2))
+	})
+
+	It("passes an empty log set", func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+		res := check()
+		Ω(res.OK).Should(BeTrue())
+		Ω(res.Replay).Should(BeEmpty())
+	})
+
+	It("reports inconsistent layouts", func() {
+		stray := PT + "/sc-20000101-000000-curr.plog"
+		Ω(ioutil.WriteFile(stray, nil, 0660)).ShouldNot(HaveOccurred())
+		res := check()
+		Ω(res.OK).Should(BeFalse())
+		Ω(res.Repairs).Should(HaveLen(1))
+		Ω(res.Problems).Should(HaveLen(1))
+		Ω(res.Problems[0].File).Should(Equal(stray))
+		Ω(res.Problems[0].Check).Should(Equal(CheckLayout))
+		Ω(res.Events).Should(Equal(2))
+	})
+
+	It("reports checksum mismatches", func() {
+		Ω(ioutil.WriteFile(files[0], []byte("garbage"), 0660)).ShouldNot(HaveOccurred())
+		res := check()
+		Ω(res.OK).Should(BeFalse())
+		Ω(res.Problems).Should(HaveLen(1))
+		Ω(res.Problems[0].File).Should(Equal(files[0]))
+		Ω(res.Problems[0].Check).Should(Equal(CheckChecksum))
+		Ω(res.Problems[0].Error).Should(ContainSubstring("checksum mismatch"))
+	})
+
+	It("reports truncated log files", func() {
+		info, err := os.Stat(files[1])
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(os.Truncate(files[1], info.Size()-3)).ShouldNot(HaveOccurred())
+		res := check()
+		Ω(res.OK).Should(BeFalse())
+		Ω(res.Problems).Should(HaveLen(2))
+		Ω(res.Problems[0].Check).Should(Equal(CheckChecksum))
+		Ω(res.Problems[1].File).Should(Equal(files[1]))
+		Ω(res.Problems[1].Check).Should(Equal(CheckDecode))
+		Ω(res.Events).Should(Equal(1))
+	})
+
+	It("reports log files written in a newer format", func() {
+		f, err := os.Create(files[1])
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(GobCodec.NewEncoder(f).Encode(&GenerationMeta{Gen: 2, Format: FormatVersion + 1})).
+			ShouldNot(HaveOccurred())
+		f.Close()
+		res := check()
+		Ω(res.OK).Should(BeFalse())
+		Ω(res.Problems).Should(HaveLen(2))
+		Ω(res.Problems[0].Check).Should(Equal(CheckChecksum))
+		Ω(res.Problems[1].Check).Should(Equal(CheckFormat))
+		Ω(res.Problems[1].Error).Should(ContainSubstring("newer version of persist"))
+	})
+
+	It("leaves the log set untouched", func() {
+		os.Remove(files[0] + checksumExt)
+		os.Remove(files[1] + checksumExt)
+		res := check()
+		Ω(res.OK).Should(BeTrue())
+		Ω(res.Verified).Should(Equal(0))
+		_, err := os.Stat(files[0] + checksumExt)
+		Ω(os.IsNotExist(err)).Should(BeTrue())
+	})
+})
@@ -0,0 +1,151 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"io"
+)
+
+// SequencedEvent wraps each event written by a log that records sequence numbers, see
+// RecordSequenceNumbers. Decoders strip it, it's never passed to the client.
+type SequencedEvent struct {
+	Seq   uint64 // sequence number, contiguous across generations
+	Event interface{}
+}
+
+func init() {
+	Register(&SequencedEvent{})
+}
+
+// RecordSequenceNumbers makes the log number every event it writes, with numbers that
+// continue from one generation to the next, each generation's metadata recording the number
+// it starts at. Replay then verifies that the numbers within a generation are
+// contiguous and that the generations being replayed follow one another, which detects
+// missing segments of a log, e.g. a chunk lost by a remote destination, as well as logs
+// pieced together from files of different backups. This increases the log format version,
+// see FormatVersion.
+func RecordSequenceNumbers() LogOption {
+	return func(pl *pLog) { pl.sequence = true }
+}
+
+// seqDecoder strips the sequence numbers from the events of a stream and checks that they
+// are contiguous
+type seqDecoder struct {
+	Decoder
+	meta *GenerationMeta // metadata of the stream, nil if it has none
+	next uint64          // sequence number of the next event
+	sync bool            // next is known, false at the start and after a decode error
+	last uint64          // sequence number of the last event returned
+	txn  *TxnBegin       // transaction whose events are being held back, see decodeTxns
+	held []interface{}   // events of the transaction as *SequencedEvent, see decodeTxns
+	done []interface{}   // events of a committed transaction waiting to be delivered
+	// restart returns the decoder of the stream that follows a HandoffMark, nil if the
+	// codec cannot decode it
+	restart func() Decoder
+	handoff *HandoffMark // mark ending the stream decoded so far, nil if records follow it
+}
+
+// withSequence wraps a decoder to check and strip sequence numbers, unless it already does
+func withSequence(dec Decoder) *seqDecoder {
+	if sd, ok := dec.(*seqDecoder); ok {
+		return sd
+	}
+	return &seqDecoder{Decoder: dec}
+}
+
+func (sd *seqDecoder) Decode() (interface{}, error) {
+	for {
+		if len(sd.done) > 0 {
+			se := sd.done[0].(*SequencedEvent)
+			sd.done = sd.done[1:]
+			sd.last = se.Seq
+			return se.Event, nil
+		}
+		ev, err := sd.decode()
+		if err != nil {
+			return ev, err
+		}
+		if f, ok := ev.(*ShardFrame); ok {
+			if err := sd.unframe(f); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if held, err := sd.decodeTxns(ev); err != nil || !held {
+			sd.last = sd.next - 1
+			return ev, err
+		}
+	}
+}
+
+// decode decodes the next entry, stripping its sequence number
+func (sd *seqDecoder) decode() (interface{}, error) {
+	ev, err := sd.Decoder.Decode()
+	if err == io.EOF {
+		return ev, err
+	}
+	sd.handoff = nil
+	if err != nil {
+		// in recovery mode the replay continues past the event, which loses its number
+		sd.sync = false
+		return ev, err
+	}
+	switch e := ev.(type) {
+	case *GenerationMeta:
+		sd.meta = e
+		sd.next = e.Seq
+		sd.sync = e.sequenced()
+	case *SequencedEvent:
+		if sd.sync && e.Seq != sd.next {
+			return nil, fmt.Errorf("sequence gap in generation %d: expected entry %d, "+
+				"found %d", sd.gen(), sd.next, e.Seq)
+		}
+		sd.next = e.Seq + 1
+		sd.sync = true
+		return e.Event, nil
+	case *HandoffMark:
+		if sd.restart == nil {
+			return nil, fmt.Errorf("the records following the handoff in generation %d "+
+				"cannot be decoded with this codec", sd.gen())
+		}
+		sd.Decoder = sd.restart()
+		ev, err := sd.decode()
+		if err == io.EOF {
+			sd.handoff = e
+		}
+		return ev, err
+	case *voidedRecord:
+		// the next record was dropped by OutputCtx, see writeStaged
+		if _, err := sd.Decoder.Decode(); err != nil {
+			sd.sync = false
+			return nil, err
+		}
+		return sd.decode()
+	}
+	return ev, nil
+}
+
+func (sd *seqDecoder) gen() uint64 {
+	if sd.meta == nil {
+		return 0
+	}
+	return sd.meta.Gen
+}
+
+// checkChain verifies that the stream decoded by next follows the one decoded by prev
+func checkChain(prev, next *seqDecoder) error {
+	pm, nm := prev.meta, next.meta
+	if pm == nil || nm == nil || !pm.sequenced() || !nm.sequenced() {
+		return nil // not both sequenced, nothing to check
+	}
+	if nm.Gen != pm.Gen+1 {
+		return fmt.Errorf("generation %d cannot follow generation %d, the logs may come "+
+			"from different backups", nm.Gen, pm.Gen)
+	}
+	if nm.Seq != prev.next {
+		return fmt.Errorf("generation %d ends before entry %d, generation %d starts at "+
+			"entry %d, entries are missing", pm.Gen, prev.next, nm.Gen, nm.Seq)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("Sequence numbers", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	// stream encodes a generation starting at sequence number seq with events numbered
+	// as given
+	stream := func(gen, seq uint64, nums ...uint64) io.ReadCloser {
+		var buf bytes.Buffer
+		enc := GobCodec.NewEncoder(&buf)
+		Ω(enc.Encode(&GenerationMeta{Gen: gen, Format: formatSequenced, Seq: seq})).
+			ShouldNot(HaveOccurred())
+		for _, n := range nums {
+			Ω(enc.Encode(&SequencedEvent{Seq: n, Event: &logEv1{S: "x"}})).
+				ShouldNot(HaveOccurred())
+		}
+		return ioutil.NopCloser(&buf)
+	}
+
+	It("numbers events across generations", func() {
+		fd, err := NewFileDest(PT+"/seq", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{events: []interface{}{&logEv1{S: "a"}}}
+		pl, err := NewLog(fd, rc, log15.Root(), RecordSequenceNumbers())
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.SetSizeLimit(10)
+		Ω(pl.Output(&logEv1{S: "b"})).ShouldNot(HaveOccurred())
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(2.0))
+		pl.(*pLog).Close()
+
+		files, err := LogFiles(PT + "/seq")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files).Should(HaveLen(2))
+		f, err := os.Open(files[1])
+		Ω(err).ShouldNot(HaveOccurred())
+		m, err := ReplayMeta(f, nil)
+		f.Close()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(m.Format).Should(Equal(3))
+		Ω(m.Seq).Should(Equal(uint64(2)))
+
+		fd, err = NewFileDest(PT+"/seq", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc = &recordingClient{}
+		pl, err = NewLog(fd, rc, log15.Root(), RecordSequenceNumbers())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(Equal([]interface{}{&logEv1{S: "a"}}))
+		Ω(pl.(*pLog).seq).Should(Equal(uint64(4)))
+		pl.(*pLog).Close()
+	})
+
+	It("detects gaps within a generation", func() {
+		_, err := ReplayFrom(stream(1, 0, 0, 2), nil, &recordingClient{})
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring(
+			"sequence gap in generation 1: expected entry 1, found 2"))
+	})
+
+	It("detects generations that don't follow one another", func() {
+		pl, _ := newPLog(&recordingClient{}, log15.Root(), nil)
+		Ω(pl.replay([]io.ReadCloser{stream(5, 0, 0, 1), stream(6, 2, 2)})).
+			ShouldNot(HaveOccurred())
+
+		pl, _ = newPLog(&recordingClient{}, log15.Root(), nil)
+		err := pl.replay([]io.ReadCloser{stream(5, 0, 0, 1), stream(9, 2, 2)})
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("generation 9 cannot follow generation 5"))
+
+		pl, _ = newPLog(&recordingClient{}, log15.Root(), nil)
+		err = pl.replay([]io.ReadCloser{stream(5, 0, 0, 1), stream(6, 3, 3)})
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring(
+			"generation 5 ends before entry 2, generation 6 starts at entry 3"))
+	})
+})
@@ -0,0 +1,316 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// SFTPClient is the subset of an SFTP client used by the SFTP destination. All paths are
+// remote paths using forward slashes. A *sftp.Client from github.com/pkg/sftp can be
+// adapted with a few lines of code, the only difference being the returned file types.
+type SFTPClient interface {
+	ReadDir(dir string) ([]os.FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+	OpenFile(name string, flags int) (SFTPFile, error)
+	Rename(oldname, newname string) error
+	Close() error
+}
+
+// SFTPFile is a remote file opened for writing
+type SFTPFile interface {
+	io.WriteCloser
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+}
+
+// SFTPDialer opens a fresh connection to the SFTP server, it is called initially and
+// each time the connection needs to be re-established
+type SFTPDialer func() (SFTPClient, error)
+
+type sftpDest struct {
+	dial           SFTPDialer
+	client         SFTPClient
+	basepath       string
+	replayReaders  []io.ReadCloser
+	output         SFTPFile
+	outputFilename string
+	outputSize     int64  // bytes known to be in the output file, used to resume
+	oldFilename    string // name of previous file (used at end of rotation)
+	snapOK         bool   // true when the initial snapshot is completed
+	retries        int    // number of reconnect attempts before failing an operation
+	retryDelay     time.Duration
+	log            log15.Logger
+}
+
+// NewSFTPDest creates or opens a log set on an SFTP server. The basepath is the remote
+// directory and file name prefix and follows the same rules and naming scheme as for
+// NewFileDest, which means that the log files can be copied to a local disk and replayed
+// using a file destination. If the connection fails while writing, the destination
+// reconnects and resumes writing at the end of the last complete write.
+func NewSFTPDest(dial SFTPDialer, basepath string, create bool,
+	log log15.Logger) (LogDestination, error) {
+
+	if log == nil {
+		log = log15.Root()
+	}
+	log = log.New("basepath", basepath, "dest", "sftp")
+
+	if strings.ContainsAny(basepath, "*?[\\.") {
+		return nil, fmt.Errorf("basepath cannot contain '*', '?', '[', '\\' or '.'")
+	}
+	client, err := dial()
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to SFTP server: %s", err.Error())
+	}
+	sd := &sftpDest{dial: dial, client: client, basepath: basepath, retries: 3,
+		retryDelay: time.Second, log: log}
+
+	m, err := sd.list()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	if len(m) > 0 {
+		names, err := replaySet(basepath, m)
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+		for _, n := range names {
+			r, err := client.Open(n)
+			if err != nil {
+				sd.Close()
+				return nil, fmt.Errorf("error opening %s: %s", n, err.Error())
+			}
+			sd.replayReaders = append(sd.replayReaders, r)
+		}
+		sd.oldFilename = names[len(names)-1]
+		log.Info("Opening existing remote log", "files", names)
+	} else if !create {
+		client.Close()
+		return nil, fmt.Errorf("No existing log file found at %s", basepath)
+	} else {
+		log.Info("No existing remote log found, creating a new one")
+	}
+
+	if err := sd.startNew(len(m) > 0); err != nil {
+		sd.Close()
+		return nil, err
+	}
+	return sd, nil
+}
+
+// list returns the full remote path of all log files in the log set
+func (sd *sftpDest) list() ([]string, error) {
+	dir, prefix := path.Split(sd.basepath)
+	if dir == "" {
+		dir = "."
+	}
+	fis, err := sd.client.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list remote directory %s: %s", dir, err.Error())
+	}
+	var m []string
+	for _, fi := range fis {
+		n := fi.Name()
+		if strings.HasPrefix(n, prefix) && strings.HasSuffix(n, ".plog") {
+			m = append(m, path.Join(dir, n))
+		}
+	}
+	return m, nil
+}
+
+// reconnect drops the current connection and dials a new one
+func (sd *sftpDest) reconnect() error {
+	if sd.output != nil {
+		sd.output.Close()
+		sd.output = nil
+	}
+	sd.client.Close()
+	client, err := sd.dial()
+	if err != nil {
+		return err
+	}
+	sd.client = client
+	return nil
+}
+
+// retry performs an operation and reconnects and retries it if it fails
+func (sd *sftpDest) retry(op string, f func() error) error {
+	err := f()
+	for i := 0; err != nil && i < sd.retries; i++ {
+		sd.log.Warn("SFTP operation failed, reconnecting", "op", op, "err", err)
+		time.Sleep(sd.retryDelay)
+		if err = sd.reconnect(); err == nil {
+			err = f()
+		}
+	}
+	return err
+}
+
+// start a new log file, see fileDest.startNew
+func (sd *sftpDest) startNew(useNewExt bool) error {
+	name := sd.basepath + time.Now().UTC().Format(dateFmt)
+	ext := currExt
+	if useNewExt {
+		ext = newExt
+	}
+
+	err := sd.retry("create", func() error {
+		m, err := sd.list()
+		if err != nil {
+			return err
+		}
+		// find a suffix letter such that no file exists with the resulting prefix
+		for i := '`'; i <= 'z'; i++ {
+			n := name
+			if i != '`' {
+				n += string(i)
+			}
+			taken := false
+			for _, f := range m {
+				taken = taken || strings.HasPrefix(f, n)
+			}
+			if taken {
+				continue
+			}
+			out, err := sd.client.OpenFile(n+ext, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+			if err != nil {
+				return err
+			}
+			sd.output = out
+			sd.outputFilename = n + ext
+			return nil
+		}
+		return fmt.Errorf("Too many log files in the same second")
+	})
+	if err != nil {
+		return fmt.Errorf("Cannot create new log file: %s", err.Error())
+	}
+	sd.log.Info("Starting new remote log file", "file", sd.outputFilename)
+	sd.outputSize = 0
+	sd.snapOK = false
+	return nil
+}
+
+// resume reopens the output file after a reconnect and truncates any partial write
+func (sd *sftpDest) resume() error {
+	out, err := sd.client.OpenFile(sd.outputFilename, os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		return err
+	}
+	fi, err := out.Stat()
+	if err == nil && fi.Size() < sd.outputSize {
+		err = fmt.Errorf("remote file %s lost data: has %d bytes, expected %d",
+			sd.outputFilename, fi.Size(), sd.outputSize)
+	} else if err == nil && fi.Size() > sd.outputSize {
+		err = out.Truncate(sd.outputSize)
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	sd.output = out
+	return nil
+}
+
+func (sd *sftpDest) Write(p []byte) (int, error) {
+	if sd.output == nil {
+		return 0, fmt.Errorf("remote log file %s is not open", sd.outputFilename)
+	}
+	err := sd.retry("write", func() error {
+		if sd.output == nil {
+			if err := sd.resume(); err != nil {
+				return err
+			}
+		}
+		n, err := sd.output.Write(p)
+		if err == nil && n != len(p) {
+			err = io.ErrShortWrite
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	sd.outputSize += int64(len(p))
+	return len(p), nil
+}
+
+func (sd *sftpDest) Capabilities() Capabilities {
+	return Capabilities{CanReplay: true, CanRotate: true}
+}
+
+func (sd *sftpDest) ReplayReaders() []io.ReadCloser {
+	return sd.replayReaders
+}
+
+// StartRotate is called by persist in order to start a new log file.
+func (sd *sftpDest) StartRotate() error {
+	if !sd.snapOK {
+		return fmt.Errorf("Cannot rotate: initial snapshot incomplete")
+	}
+	sd.output.Close()
+	sd.output = nil
+	sd.oldFilename = sd.outputFilename
+	sd.outputFilename = ""
+	return sd.startNew(true)
+}
+
+// EndRotate is called by persist in order to signal the completion of the initial snapshot
+// on the new log file, see fileDest.EndRotate.
+func (sd *sftpDest) EndRotate() error {
+	if sd.snapOK {
+		return internalError(sd.state(), "StartRotate not called")
+	}
+	if sd.oldFilename == "" {
+		if !strings.HasSuffix(sd.outputFilename, currExt) {
+			return internalError(sd.state(), "first log file (%s) should have %s suffix",
+				sd.outputFilename, currExt)
+		}
+		sd.snapOK = true
+		return nil
+	}
+
+	newName, oldName, err := rotatedNames(sd.outputFilename, sd.oldFilename, sd.state())
+	if err != nil {
+		return err
+	}
+	err = sd.retry("rename", func() error {
+		return sd.client.Rename(sd.outputFilename, newName)
+	})
+	if err != nil {
+		return err
+	}
+	sd.outputFilename = newName
+	err = sd.retry("rename", func() error {
+		return sd.client.Rename(sd.oldFilename, oldName)
+	})
+	if err != nil {
+		return err
+	}
+	sd.log.Info("New remote log file now initialized & renamed", "file", newName)
+	sd.oldFilename = ""
+	sd.snapOK = true
+	return nil
+}
+
+func (sd *sftpDest) Close() {
+	for _, rr := range sd.replayReaders {
+		rr.Close()
+	}
+	sd.replayReaders = nil
+	if sd.output != nil {
+		sd.output.Close()
+		sd.output = nil
+	}
+	sd.client.Close()
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// SFTP client used for testing, it operates on the local filesystem and can be told to
+// fail writes half-way through
+type localSFTP struct {
+	failures *int // number of writes that should fail
+}
+
+func (ls localSFTP) ReadDir(dir string) ([]os.FileInfo, error) { return ioutil.ReadDir(dir) }
+func (ls localSFTP) Open(name string) (io.ReadCloser, error)   { return os.Open(name) }
+func (ls localSFTP) Rename(oldname, newname string) error      { return os.Rename(oldname, newname) }
+func (ls localSFTP) Close() error                              { return nil }
+
+func (ls localSFTP) OpenFile(name string, flags int) (SFTPFile, error) {
+	f, err := os.OpenFile(name, flags, 0660)
+	if err != nil {
+		return nil, err
+	}
+	return flakyFile{f, ls.failures}, nil
+}
+
+type flakyFile struct {
+	*os.File
+	failures *int
+}
+
+func (ff flakyFile) Write(p []byte) (int, error) {
+	if *ff.failures > 0 {
+		*ff.failures--
+		n, _ := ff.File.Write(p[:len(p)/2])
+		return n, fmt.Errorf("simulated connection loss")
+	}
+	return ff.File.Write(p)
+}
+
+var _ = Describe("SFTPDest", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	var failures int
+	dial := func() (SFTPClient, error) { return localSFTP{&failures}, nil }
+
+	It("writes a log that a file destination can replay", func() {
+		failures = 0
+		sd, err := NewSFTPDest(dial, PT+"/remote", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(sd.ReplayReaders()).Should(BeNil())
+		Ω(sd.EndRotate()).ShouldNot(HaveOccurred())
+		sd.Write([]byte("Hello World"))
+		sd.Close()
+
+		sd, err = NewSFTPDest(dial, PT+"/remote", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(sd.ReplayReaders()).Should(HaveLen(1))
+		buf, _ := ioutil.ReadAll(sd.ReplayReaders()[0])
+		Ω(string(buf)).Should(Equal("Hello World"))
+		sd.Write([]byte("Hello Again"))
+		Ω(sd.EndRotate()).ShouldNot(HaveOccurred())
+		sd.Close()
+
+		fd, err := NewFileDest(PT+"/remote", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(fd.ReplayReaders()).Should(HaveLen(1))
+		buf, _ = ioutil.ReadAll(fd.ReplayReaders()[0])
+		Ω(string(buf)).Should(Equal("Hello Again"))
+		fd.Close()
+	})
+
+	It("resumes after a failed write", func() {
+		failures = 0
+		sd, err := NewSFTPDest(dial, PT+"/remote", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		sd.(*sftpDest).retryDelay = 0
+		Ω(sd.EndRotate()).ShouldNot(HaveOccurred())
+		sd.Write([]byte("Hello World"))
+		failures = 2
+		n, err := sd.Write([]byte("Hello Again"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(n).Should(Equal(11))
+		sd.Close()
+
+		sd, err = NewSFTPDest(dial, PT+"/remote", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		buf, _ := ioutil.ReadAll(sd.ReplayReaders()[0])
+		Ω(string(buf)).Should(Equal("Hello WorldHello Again"))
+		sd.Close()
+	})
+
+	It("gives up after too many failures", func() {
+		failures = 0
+		sd, err := NewSFTPDest(dial, PT+"/remote", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		sd.(*sftpDest).retryDelay = 0
+		failures = 10
+		_, err = sd.Write([]byte("Hello World"))
+		Ω(err).Should(HaveOccurred())
+		sd.Close()
+	})
+})
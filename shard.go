@@ -0,0 +1,235 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// shardFrameSize is the size of the encoded events above which a shard writer writes them
+// to the log as a frame
+const shardFrameSize = 64 * 1024
+
+// ShardFrame holds snapshot events encoded by a shard writer, see ParallelSnapshot. Each
+// frame is a stream of its own such that frames can be encoded in parallel. Decoders
+// replace it by the events it holds.
+type ShardFrame struct {
+	Shard int    // shard whose writer encoded the events, or rank, see SnapshotOrder
+	Seq   uint64 // sequence number of the first event, see RecordSequenceNumbers
+	Count int    // number of events
+	Data  []byte // events encoded using the log's codec
+}
+
+func init() {
+	Register(&ShardFrame{})
+}
+
+// A ShardWriter outputs the snapshot events of one shard of the client's state, see
+// ParallelSnapshot
+type ShardWriter interface {
+	Output(logEvent interface{}) error
+}
+
+// ParallelSnapshot lets PersistAll output the snapshot of a state divided into n shards in
+// parallel: it calls fn for each shard in a goroutine of its own, passing it a writer that
+// encodes the shard's events without holding the log's lock, and waits for all of them to
+// return. The events of each shard are written to the log in frames, which is where
+// encoding-bound snapshots gain on machines with many cores, while the order of the events
+// of each shard is preserved. As with Output, the events a shard outputs for a resource
+// must be output before the resource is updated again. ParallelSnapshot returns the first
+// error returned by fn. It must be passed the Log that PersistAll received, given any other
+// Log it calls fn for one shard after the other, passing it the Log. Logs with shard frames
+// cannot be replayed by versions of persist that predate them.
+func ParallelSnapshot(log Log, n int, fn func(shard int, w ShardWriter) error) error {
+	var pl *pLog
+	switch l := log.(type) {
+	case snapshotLog:
+		pl = l.pLog
+	case *pLog:
+		if !l.opened {
+			pl = l // the initial snapshot written by NewLog
+		}
+	}
+	if pl == nil || n < 2 {
+		for i := 0; i < n; i++ {
+			if err := fn(i, log); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	pl.Lock()
+	if pl.shards != nil {
+		pl.Unlock()
+		return fmt.Errorf("a parallel snapshot is already in progress")
+	}
+	writers := make([]*shardWriter, n)
+	for i := range writers {
+		writers[i] = &shardWriter{pl: pl, shard: i}
+	}
+	pl.shards = writers
+	pl.Unlock()
+
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i, sw := range writers {
+		wg.Add(1)
+		go func(i int, sw *shardWriter) {
+			defer wg.Done()
+			perr := callSafely("ParallelSnapshot", func() { errs[i] = fn(i, sw) })
+			if perr != nil {
+				errs[i] = perr
+			}
+		}(i, sw)
+	}
+	wg.Wait()
+
+	pl.Lock()
+	err := pl.flushShards()
+	pl.shards = nil
+	pl.Unlock()
+	for _, e := range errs {
+		if e != nil {
+			return e
+		}
+	}
+	return err
+}
+
+// shardWriter encodes the events of a shard into a frame
+type shardWriter struct {
+	pl     *pLog
+	shard  int
+	mu     sync.Mutex    // protects the frame, always acquired after the pl.Lock()
+	buf    bytes.Buffer  // the encoded events
+	enc    Encoder       // encoder of the frame, nil if the frame is empty
+	events []interface{} // events of the frame
+}
+
+func (sw *shardWriter) Output(logEvent interface{}) error {
+	pl := sw.pl
+	pl.Lock()
+	err := pl.checkState()
+	skip := err == nil && pl.skipSnapshot(logEvent)
+	pl.Unlock()
+	if err != nil || skip {
+		return err
+	}
+
+	sw.mu.Lock()
+	if sw.enc == nil {
+		sw.enc = pl.codec.NewEncoder(&sw.buf)
+	}
+	if err = sw.enc.Encode(logEvent); err == nil {
+		sw.events = append(sw.events, logEvent)
+	}
+	full := sw.buf.Len() >= shardFrameSize
+	sw.mu.Unlock()
+	if err == nil && !full {
+		return nil
+	}
+
+	pl.Lock()
+	if err != nil {
+		// the frame cannot be written, as for any event that cannot be encoded
+		pl.fail("encode", err)
+	} else {
+		err = pl.flushShard(sw)
+	}
+	pl.Unlock()
+	pl.throttleSnapshot()
+	return err
+}
+
+// flushShards writes the frames of the shard writers of a parallel snapshot, which must
+// precede any event output after the events of the frames, must be called while holding
+// the pl.Lock()
+func (pl *pLog) flushShards() error {
+	for _, sw := range pl.shards {
+		if err := pl.flushShard(sw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushShard writes the frame of a shard writer, if it holds events, must be called while
+// holding the pl.Lock()
+func (pl *pLog) flushShard(sw *shardWriter) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	n := len(sw.events)
+	if n == 0 {
+		return nil
+	}
+	if err := pl.checkState(); err != nil {
+		return err
+	}
+	if err := pl.useFormat(formatShards); err != nil {
+		return err
+	}
+	for _, ev := range sw.events {
+		if err := pl.useFormat(eventFormat(ev)); err != nil {
+			return err
+		}
+	}
+	pl.dups.reset()
+	f := &ShardFrame{Shard: sw.shard, Seq: pl.seq, Count: n, Data: sw.buf.Bytes()}
+	pl.writePri, pl.writeSec, pl.wroteSec, pl.writeBytes = 0, 0, false, 0
+	if err := pl.encoder.Encode(f); err != nil {
+		return pl.fail("encode", err)
+	}
+	pl.latPrimary.recordDuration(pl.writePri)
+	pl.snapBytes += pl.writeBytes
+	pl.objects += uint64(n)
+	pl.snapEvents += n
+	if pl.sequence {
+		pl.seq += uint64(n)
+	}
+	for i, ev := range sw.events {
+		if pl.secEnc != nil && pl.secSynced {
+			pl.encodeSecondary(ev)
+		}
+		if len(pl.tails) > 0 {
+			pl.pushTails(f.Seq+uint64(i), ev, pl.writeBytes/n)
+		}
+	}
+	sw.buf.Reset()
+	sw.enc, sw.events = nil, nil
+	return nil
+}
+
+// frameDecoder is implemented by the decoders of codecs that can decode shard frames
+type frameDecoder interface {
+	frameDecoder(r io.Reader) Decoder
+}
+
+// unframe decodes the events of a shard frame and queues them for delivery
+func (sd *seqDecoder) unframe(f *ShardFrame) error {
+	fd, ok := sd.Decoder.(frameDecoder)
+	if !ok {
+		return fmt.Errorf("shard frames cannot be decoded with this codec")
+	}
+	if sd.sync && f.Seq != sd.next {
+		return fmt.Errorf("sequence gap in generation %d: expected entry %d, found %d",
+			sd.gen(), sd.next, f.Seq)
+	}
+	dec := fd.frameDecoder(bytes.NewReader(f.Data))
+	for i := 0; i < f.Count; i++ {
+		ev, err := dec.Decode()
+		if err != nil {
+			sd.sync = false
+			return fmt.Errorf("cannot decode event %d of frame of shard %d: %s", i, f.Shard,
+				err.Error())
+		}
+		sd.done = append(sd.done, &SequencedEvent{Seq: f.Seq + uint64(i), Event: ev})
+	}
+	if sd.sync {
+		sd.next = f.Seq + uint64(f.Count)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// shardClient persists its state in shards of keyed events using ParallelSnapshot
+type shardClient struct {
+	shards   [][]interface{}
+	replayed []interface{}
+	during   func(shard int) // called by each shard after outputting its events
+}
+
+func (sc *shardClient) Replay(ev interface{}) error {
+	sc.replayed = append(sc.replayed, ev)
+	return nil
+}
+
+func (sc *shardClient) PersistAll(pl Log) {
+	err := ParallelSnapshot(pl, len(sc.shards), func(shard int, w ShardWriter) error {
+		for _, ev := range sc.shards[shard] {
+			if err := w.Output(ev); err != nil {
+				return err
+			}
+		}
+		if sc.during != nil {
+			sc.during(shard)
+		}
+		return nil
+	})
+	Ω(err).ShouldNot(HaveOccurred())
+}
+
+// shardEvents returns the events of n shards of m events each
+func shardEvents(n, m int) [][]interface{} {
+	shards := make([][]interface{}, n)
+	for s := range shards {
+		for i := 0; i < m; i++ {
+			shards[s] = append(shards[s],
+				&keyEv{K: fmt.Sprintf("%d-%d-%s", s, i, strings.Repeat("x", 50)), V: i})
+		}
+	}
+	return shards
+}
+
+var _ = Describe("ParallelSnapshot", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	open := func(sc *shardClient, create bool) Log {
+		fd, err := NewFileDest(PT+"/shard", create, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, sc, log15.Root(), RecordSequenceNumbers())
+		Ω(err).ShouldNot(HaveOccurred())
+		return pl
+	}
+
+	// frames returns the number of shard frames in the current log file
+	frames := func() int {
+		files, err := LogFiles(PT + "/shard")
+		Ω(err).ShouldNot(HaveOccurred())
+		f, err := os.Open(files[len(files)-1])
+		Ω(err).ShouldNot(HaveOccurred())
+		defer f.Close()
+		dec := gobDecoder{dec: gob.NewDecoder(f)}
+		n := 0
+		for {
+			ev, err := dec.Decode()
+			if err == io.EOF {
+				return n
+			}
+			Ω(err).ShouldNot(HaveOccurred())
+			if _, ok := ev.(*ShardFrame); ok {
+				n++
+			}
+		}
+	}
+
+	It("writes the shards in frames and replays them", func() {
+		sc := &shardClient{shards: shardEvents(4, 3000)}
+		pl := open(sc, true)
+		Ω(frames()).Should(BeNumerically(">", 4))
+		Ω(pl.Output(&keyEv{K: "live"})).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		replayed := &shardClient{}
+		pl = open(replayed, false)
+		Ω(replayed.replayed).Should(HaveLen(4*3000 + 1))
+		// the events of each shard are in order
+		next := make([]int, 4)
+		for _, ev := range replayed.replayed[:4*3000] {
+			var s int
+			fmt.Sscanf(ev.(*keyEv).K, "%d-", &s)
+			Ω(ev).Should(Equal(sc.shards[s][next[s]]))
+			next[s]++
+		}
+		Ω(replayed.replayed[4*3000]).Should(Equal(&keyEv{K: "live"}))
+		pl.(*pLog).Close()
+	})
+
+	It("writes the frames before the events output after them", func() {
+		sc := &shardClient{shards: [][]interface{}{{&keyEv{K: "a", V: 1}}, {}}}
+		pl := open(sc, true)
+		sc.during = func(shard int) {
+			if shard == 0 {
+				Ω(pl.Output(&keyEv{K: "a", V: 2})).ShouldNot(HaveOccurred())
+			}
+		}
+		pl.(*pLog).Lock()
+		pl.(*pLog).rotate()
+		pl.(*pLog).Unlock()
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(2.0))
+		pl.(*pLog).Close()
+
+		replayed := &shardClient{}
+		pl = open(replayed, false)
+		Ω(replayed.replayed).Should(Equal([]interface{}{&keyEv{K: "a", V: 1},
+			&keyEv{K: "a", V: 2}}))
+		pl.(*pLog).Close()
+	})
+
+	It("outputs one shard after the other given another log", func() {
+		pl := open(&shardClient{}, true)
+		var order []int
+		err := ParallelSnapshot(pl, 3, func(shard int, w ShardWriter) error {
+			order = append(order, shard)
+			return w.Output(&keyEv{K: fmt.Sprint(shard)})
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(order).Should(Equal([]int{0, 1, 2}))
+		Ω(frames()).Should(Equal(0))
+		pl.(*pLog).Close()
+	})
+})
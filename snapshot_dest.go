@@ -0,0 +1,24 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+// NewSnapshotOnlyDest wraps a destination such that it only receives the full snapshot
+// written at each rotation and none of the events output between rotations. This suits
+// backup-style destinations, such as object storage, that want periodic full states
+// rather than a continuous stream. Events output while a snapshot is being written are
+// omitted as well, hence each snapshot reflects the state of each resource at the time
+// PersistAll enumerated it. A snapshot-only destination can only be a secondary and it
+// receives its snapshot in a stream of its own, which encodes each event a second time.
+func NewSnapshotOnlyDest(dest LogDestination) LogDestination {
+	return snapshotOnlyDest{dest}
+}
+
+type snapshotOnlyDest struct {
+	LogDestination
+}
+
+func (sd snapshotOnlyDest) Capabilities() Capabilities {
+	caps := DestCapabilities(sd.LogDestination)
+	caps.SnapshotOnly = true
+	return caps
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("SnapshotOnlyDest", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+
+	generation := func(pl Log) func() float64 {
+		return func() float64 { return pl.Stats()["Generation"] }
+	}
+
+	It("receives snapshots but not the events in between", func() {
+		pd, err := NewFileDest(PT+"/primary", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{events: []interface{}{&logEv1{S: "a"}, &logEv1{S: "b"}}}
+		pl, err := NewLog(pd, rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		sd, err := NewFileDest(PT+"/backup", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.SetSecondaryDestination(NewSnapshotOnlyDest(sd))).ShouldNot(HaveOccurred())
+		Eventually(generation(pl)).Should(Equal(2.0))
+		Ω(pl.Output(&logEv1{S: "delta"})).ShouldNot(HaveOccurred())
+
+		By("rotating")
+		Eventually(func() bool {
+			pl.(*pLog).Lock()
+			defer pl.(*pLog).Unlock()
+			return pl.(*pLog).rotating
+		}).Should(BeFalse())
+		pl.SetSizeLimit(10)
+		Ω(pl.Output(&logEv1{S: "another delta"})).ShouldNot(HaveOccurred())
+		Eventually(generation(pl)).Should(Equal(3.0))
+		pl.(*pLog).Close()
+
+		By("replaying each backup generation")
+		files, err := LogFiles(PT + "/backup")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files).Should(HaveLen(2))
+		for _, file := range files {
+			f, err := os.Open(file)
+			Ω(err).ShouldNot(HaveOccurred())
+			brc := &recordingClient{}
+			_, err = ReplayFrom(f, nil, brc)
+			f.Close()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(brc.events).Should(Equal([]interface{}{&logEv1{S: "a"}, &logEv1{S: "b"}}))
+		}
+	})
+
+	It("cannot be the primary destination", func() {
+		fd, err := NewFileDest(PT+"/primary", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer fd.Close()
+		sd := NewSnapshotOnlyDest(fd)
+		Ω(DestCapabilities(sd).SnapshotOnly).Should(BeTrue())
+		Ω(DestCapabilities(sd).CanReplay).Should(BeTrue())
+		pl, err := NewLog(sd, &testLogClient{}, log15.Root())
+		Ω(pl).Should(BeNil())
+		Ω(err).Should(MatchError(ContainSubstring("snapshot-only")))
+	})
+})
@@ -0,0 +1,120 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// WithOverflowSpool keeps a log available after it fails: once the log is in error state,
+// Output appends the events to the spool file at path, which should be on another volume
+// than the log, e.g. a tmpfs, and returns nil, until the file would grow beyond max bytes,
+// from then on Output returns the error of the log. The output that puts the log in error
+// state returns its error, as do the outputs of a log that was closed or handed off. A log
+// in error state never recovers, the application must reopen it, and NewLog, given the same
+// option, replays the events of the spool file after those of the log, includes them in
+// the initial snapshot, and removes the file. This trades ordering for availability: an
+// event whose output failed, and that the application retries, is replayed after the
+// events spooled in the meantime, and the spooled events have no sequence numbers, see
+// RecordSequenceNumbers. Stats reports the number of events spooled as SpooledEvents.
+func WithOverflowSpool(path string, max int64) LogOption {
+	return func(pl *pLog) { pl.spoolPath, pl.spoolMax = path, max }
+}
+
+// overflowSpool is the spool file of a log in error state, see WithOverflowSpool
+type overflowSpool struct {
+	f      *os.File
+	enc    Encoder      // encodes the events into buf
+	buf    bytes.Buffer // the event being spooled
+	size   int64        // bytes written to f
+	events int          // events written to f
+	full   bool         // an event didn't fit, the stream cannot be continued
+}
+
+func (sp *overflowSpool) Write(p []byte) (int, error) { return sp.buf.Write(p) }
+
+// spool appends an event to the spool file, err is the error state of the log, which is
+// returned if the event cannot be spooled, must be called while holding the lock
+func (pl *pLog) spool(logEvent interface{}, err error) error {
+	if pl.spoolPath == "" || pl.errState == nil || err == errClosed || err == errHandedOff {
+		return err
+	}
+	if pl.spooled == nil {
+		f, ferr := os.OpenFile(pl.spoolPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660)
+		if ferr != nil {
+			pl.log.Error("Cannot create overflow spool", "file", pl.spoolPath, "err", ferr)
+			pl.spooled = &overflowSpool{full: true}
+			return err
+		}
+		pl.log.Warn("Spooling events while the log is in error state", "file",
+			pl.spoolPath)
+		pl.spooled = &overflowSpool{f: f}
+		pl.spooled.enc = pl.codec.NewEncoder(pl.spooled)
+	}
+	sp := pl.spooled
+	if sp.full {
+		return err
+	}
+	sp.buf.Reset()
+	if eerr := sp.enc.Encode(logEvent); eerr != nil {
+		// the encoder may have recorded types it didn't write, stop the stream here
+		sp.full = true
+		return fmt.Errorf("cannot spool event: %s", eerr.Error())
+	}
+	if sp.size+int64(sp.buf.Len()) > pl.spoolMax {
+		pl.log.Error("Overflow spool is full", "file", pl.spoolPath, "events", sp.events)
+		sp.full = true
+		return err
+	}
+	n, werr := sp.f.Write(sp.buf.Bytes())
+	sp.size += int64(n)
+	if werr != nil {
+		pl.log.Error("Cannot write overflow spool", "file", pl.spoolPath, "err", werr)
+		sp.full = true
+		return err
+	}
+	sp.events++
+	return nil
+}
+
+// replaySpool replays the events of the spool file left by a log that failed, if any
+func (pl *pLog) replaySpool() error {
+	if pl.spoolPath == "" {
+		return nil
+	}
+	f, err := os.Open(pl.spoolPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("cannot open overflow spool: %s", err.Error())
+	}
+	defer f.Close()
+	count, err := replayStream(pl.codec.NewDecoder(f), pl.client, nil)
+	if err != nil {
+		return fmt.Errorf("overflow spool %s: %s", pl.spoolPath, err.Error())
+	}
+	pl.log.Warn("Replayed events spooled while the log was in error state",
+		"file", pl.spoolPath, "count", count)
+	return nil
+}
+
+// removeSpool removes the spool file once the events it holds are part of a snapshot
+func (pl *pLog) removeSpool() {
+	if pl.spoolPath == "" {
+		return
+	}
+	if err := os.Remove(pl.spoolPath); err != nil && !os.IsNotExist(err) {
+		pl.log.Error("Cannot remove overflow spool", "file", pl.spoolPath, "err", err)
+	}
+}
+
+// closeSpool closes the spool file, must be called while holding the lock
+func (pl *pLog) closeSpool() {
+	if pl.spooled != nil && pl.spooled.f != nil {
+		pl.spooled.f.Close()
+		pl.spooled.f = nil
+		pl.spooled.full = true
+	}
+}
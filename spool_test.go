@@ -0,0 +1,77 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("Overflow spool", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.MkdirAll(PT+"/tmpfs", 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	spoolPath := PT + "/tmpfs/overflow"
+
+	// open opens the log set, through a flaky destination that is returned
+	open := func(rc *recordingClient, opts ...LogOption) (Log, *flakyDest) {
+		fd, err := NewFileDest(PT+"/spooled", len(rc.events) > 0, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		fld := &flakyDest{LogDestination: fd}
+		pl, err := NewLog(fld, rc, log15.Root(), opts...)
+		Ω(err).ShouldNot(HaveOccurred())
+		return pl, fld
+	}
+
+	It("spools the events output in error state and replays them on reopen", func() {
+		a, b, c, d := &logEv1{S: "a"}, &logEv1{S: "b"}, &logEv2{A: 3}, &logEv1{S: "d"}
+		pl, fld := open(&recordingClient{events: []interface{}{a}},
+			WithOverflowSpool(spoolPath, 1<<20))
+		fld.setDown(true)
+		Ω(pl.Output(b)).Should(MatchError(ContainSubstring("destination is down")))
+		Ω(pl.Output(c)).ShouldNot(HaveOccurred())
+		Ω(pl.Output(d)).ShouldNot(HaveOccurred())
+		Ω(pl.HealthCheck()).Should(HaveOccurred())
+		Ω(pl.Stats()["SpooledEvents"]).Should(Equal(2.0))
+		pl.(*pLog).Close()
+		Ω(pl.Output(d)).Should(HaveOccurred())
+
+		rc := &recordingClient{}
+		pl, _ = open(rc, WithOverflowSpool(spoolPath, 1<<20))
+		pl.(*pLog).Close()
+		Ω(rc.events).Should(Equal([]interface{}{a, c, d}))
+		_, err := os.Stat(spoolPath)
+		Ω(os.IsNotExist(err)).Should(BeTrue())
+
+		By("keeping the spooled events in the snapshot")
+		rc = &recordingClient{}
+		pl, _ = open(rc)
+		pl.(*pLog).Close()
+		Ω(rc.events).Should(Equal([]interface{}{a, c, d}))
+	})
+
+	It("fails the outputs once the spool is full", func() {
+		pl, fld := open(&recordingClient{events: []interface{}{&logEv1{S: "a"}}},
+			WithOverflowSpool(spoolPath, 200))
+		fld.setDown(true)
+		Ω(pl.Output(&logEv1{S: "b"})).Should(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "c"})).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: string(make([]byte, 200))})).Should(
+			MatchError(ContainSubstring("destination is down")))
+		Ω(pl.Output(&logEv1{S: "e"})).Should(HaveOccurred())
+		Ω(pl.Stats()["SpooledEvents"]).Should(Equal(1.0))
+		pl.(*pLog).Close()
+
+		rc := &recordingClient{}
+		pl, _ = open(rc, WithOverflowSpool(spoolPath, 200))
+		pl.(*pLog).Close()
+		Ω(rc.events).Should(Equal([]interface{}{&logEv1{S: "a"}, &logEv1{S: "c"}}))
+	})
+})
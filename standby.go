@@ -0,0 +1,83 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"io"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Standby is a client that has been warmed up by replaying a log that another process still
+// owns, see WarmReplay
+type Standby struct {
+	client LogClient
+	log    log15.Logger
+	opts   []LogOption
+	done   map[uint64]int // entries replayed per generation
+}
+
+// WarmReplay replays the logs read from the readers into the client without taking
+// ownership of the log: nothing is written and no snapshot is taken. This allows a new
+// process in a blue/green deployment to build its state while the old process still owns
+// the log, and to attach the standby once the old process is done, which only replays the
+// entries written in the meantime. The readers are typically the files returned by
+// ReplayFiles. Since the last log may still be written to, an incomplete entry at its end
+// is not an error, it's replayed when attaching. The options are used again when attaching.
+func WarmReplay(readers []io.ReadCloser, client LogClient, logger log15.Logger,
+	opts ...LogOption) (*Standby, error) {
+
+	pl, err := newPLog(client, logger, opts)
+	if err != nil {
+		return nil, err
+	}
+	pl.warming = true
+	pl.replayed = make(map[uint64]int)
+	pl.log.Debug("Starting warm replay")
+	if err := pl.replay(readers); err != nil {
+		return nil, err
+	}
+	pl.log.Info("Warm replay done", "generations", len(pl.replayed))
+	return &Standby{client: client, log: logger, opts: opts, done: pl.replayed}, nil
+}
+
+// Attach opens the log with the standby's client as NewLog does, except that the entries
+// replayed by WarmReplay are skipped, so only those written since then reach the client.
+// This fails if the owner has rotated the log so far that the generations replayed by
+// WarmReplay are no longer replayed by the destination, in which case the standby's
+// client must be discarded and warmed again.
+func (s *Standby) Attach(priDest LogDestination) (Log, error) {
+	opts := append(s.opts[:len(s.opts):len(s.opts)], func(pl *pLog) { pl.warm = s.done })
+	return NewLog(priDest, s.client, s.log, opts...)
+}
+
+// skipWarm sets up the replay of a log to skip the entries replayed by a Standby, first
+// is true for the first log to be replayed
+func (pl *pLog) skipWarm(m *GenerationMeta, first bool, rc *resumeClient) error {
+	n, ok := pl.warm[m.Gen]
+	if !ok && first && len(pl.warm) > 0 {
+		return fmt.Errorf("standby is stale: generation %d was not warm replayed", m.Gen)
+	}
+	rc.skip = n
+	return nil
+}
+
+// tailDecoder stops the replay of a log that is still being written to at the first entry
+// that cannot be decoded, which is normally one that is only partially written
+type tailDecoder struct {
+	Decoder
+	err error // error that stopped the replay
+}
+
+func (td *tailDecoder) Decode() (interface{}, error) {
+	if td.err != nil {
+		return nil, io.EOF
+	}
+	ev, err := td.Decoder.Decode()
+	if err != nil && err != io.EOF {
+		td.err = err
+		return nil, io.EOF
+	}
+	return ev, err
+}
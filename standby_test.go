@@ -0,0 +1,101 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("Standby", func() {
+	var owner Log
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+		fd, err := NewFileDest(PT+"/standby", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		owner, err = NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(owner.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		Ω(owner.Output(&logEv1{S: "b"})).ShouldNot(HaveOccurred())
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	// open the files the owner's destination would replay
+	replayReaders := func() []io.ReadCloser {
+		files, err := ReplayFiles(PT + "/standby")
+		Ω(err).ShouldNot(HaveOccurred())
+		var readers []io.ReadCloser
+		for _, file := range files {
+			f, err := os.Open(file)
+			Ω(err).ShouldNot(HaveOccurred())
+			readers = append(readers, f)
+		}
+		return readers
+	}
+
+	It("attaches after replaying only the new entries", func() {
+		rc := &recordingClient{}
+		sb, err := WarmReplay(replayReaders(), rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(Equal([]interface{}{&logEv1{S: "a"}, &logEv1{S: "b"}}))
+		files, _ := LogFiles(PT + "/standby")
+		Ω(files).Should(HaveLen(1))
+
+		Ω(owner.Output(&logEv1{S: "c"})).ShouldNot(HaveOccurred())
+		owner.(*pLog).Close()
+
+		fd, err := NewFileDest(PT+"/standby", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := sb.Attach(fd)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(Equal([]interface{}{&logEv1{S: "a"}, &logEv1{S: "b"},
+			&logEv1{S: "c"}}))
+		Ω(pl.Stats()["Generation"]).Should(Equal(2.0))
+		pl.(*pLog).Close()
+	})
+
+	It("tolerates an entry being written", func() {
+		Ω(owner.Output(&logEv1{S: "c"})).ShouldNot(HaveOccurred())
+		owner.(*pLog).Close()
+		files, _ := LogFiles(PT + "/standby")
+		data, err := ioutil.ReadFile(files[0])
+		Ω(err).ShouldNot(HaveOccurred())
+
+		rc := &recordingClient{}
+		partial := ioutil.NopCloser(bytes.NewReader(data[:len(data)-3]))
+		sb, err := WarmReplay([]io.ReadCloser{partial}, rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(HaveLen(2))
+
+		fd, err := NewFileDest(PT+"/standby", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := sb.Attach(fd)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(HaveLen(3))
+		pl.(*pLog).Close()
+	})
+
+	It("refuses to attach once the owner rotated past the warm replay", func() {
+		sb, err := WarmReplay(replayReaders(), &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		owner.SetSizeLimit(1)
+		Ω(owner.Output(&logEv1{S: "c"})).ShouldNot(HaveOccurred())
+		Eventually(func() float64 { return owner.Stats()["Generation"] }).Should(Equal(2.0))
+		owner.(*pLog).Close()
+
+		fd, err := NewFileDest(PT+"/standby", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = sb.Attach(fd)
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("standby is stale"))
+		fd.Close()
+	})
+})
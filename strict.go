@@ -0,0 +1,53 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+)
+
+// strict is non-zero in strict mode, see Strict
+var strict int32
+
+// Strict turns violations of persist's internal invariants, such as a destination's rotation
+// methods being called out of order, into panics. Normally they are returned as "internal
+// error" errors, which put the log into error state and leave the caller with a log line.
+// The panic carries the state of the destination, which lets test suites catch bugs in the
+// rotation state machine where they happen, e.g., by calling Strict(true) in BeforeSuite.
+// Strict mode applies to all logs of the process and is not meant for production.
+func Strict(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&strict, v)
+}
+
+// internalError returns the error of a violated invariant, or, in strict mode, panics with
+// it and the state, which consists of key-value pairs like log15's context
+func internalError(state []interface{}, format string, args ...interface{}) error {
+	err := fmt.Errorf("internal error: "+format, args...)
+	if atomic.LoadInt32(&strict) == 0 {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.WriteString("persist: " + err.Error())
+	for i := 0; i+1 < len(state); i += 2 {
+		fmt.Fprintf(&buf, " %v=%#v", state[i], state[i+1])
+	}
+	panic(buf.String())
+}
+
+// state describes the file destination for internalError
+func (fd *fileDest) state() []interface{} {
+	return []interface{}{"basepath", fd.basepath, "output", fd.outputFilename,
+		"old", fd.oldFilename, "snap_ok", fd.snapOK}
+}
+
+// state describes the SFTP destination for internalError
+func (sd *sftpDest) state() []interface{} {
+	return []interface{}{"basepath", sd.basepath, "output", sd.outputFilename,
+		"old", sd.oldFilename, "snap_ok", sd.snapOK}
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Strict", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() {
+		Strict(true) // the suite runs in strict mode
+		os.RemoveAll(PT)
+	})
+
+	It("panics with the destination's state on an invariant violation", func() {
+		dest, err := NewFileDest(PT+"/strict", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		defer dest.Close()
+		Ω(dest.EndRotate()).ShouldNot(HaveOccurred())
+
+		var msg interface{}
+		func() {
+			defer func() { msg = recover() }()
+			dest.EndRotate()
+		}()
+		Ω(msg).Should(ContainSubstring("persist: internal error: StartRotate not called"))
+		Ω(msg).Should(ContainSubstring(`basepath="` + PT + `/strict"`))
+		Ω(msg).Should(ContainSubstring("snap_ok=true"))
+
+		By("returning an error when not strict")
+		Strict(false)
+		Ω(dest.EndRotate()).Should(MatchError("internal error: StartRotate not called"))
+	})
+})
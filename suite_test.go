@@ -17,6 +17,7 @@ func TestUCA(t *testing.T) {
 
 	format.UseStringerRepresentation = true
 	RegisterFailHandler(Fail)
+	Strict(true) // catch internal invariant violations where they happen
 
 	RunSpecs(t, "persist")
 }
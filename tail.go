@@ -0,0 +1,310 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// tailLimit is the default number of live events an Iterator can fall behind the log
+const tailLimit = 10000
+
+// An Iterator returns the events of a log in order, see Tail
+type Iterator interface {
+	// Next returns the sequence number of the next event and the event, it blocks until
+	// the event is output. It returns io.EOF once the iterator is closed.
+	Next() (uint64, interface{}, error)
+	// Close stops the iterator, it may be called concurrently with Next, which then
+	// returns io.EOF
+	Close() error
+}
+
+// tailIterator reads the events persisted before it was created from the log files and then
+// the events output since, which the log pushes to it
+type tailIterator struct {
+	pl    *pLog
+	mu    sync.Mutex  // serializes reading the files and closing them
+	done  bool        // the iterator is closed, guarded by mu
+	files []*os.File  // files holding the events before live, in order
+	dec   *seqDecoder // decoder of files[0]
+	want  uint64      // sequence number of the next event
+	live  uint64      // sequence number of the first event pushed by the log
+	queue []tailEvent // events pushed by the log, guarded by its lock
+	err   error       // error returned once the queue is empty, guarded by the log's lock
+
+	// the following are guarded by the log's lock
+	bytes   int    // encoded size of the events in the queue
+	behind  bool   // the log dropped the queue, the iterator must catch up, see catchUp
+	dropped uint64 // sequence number of the first event dropped from the queue
+}
+
+// tailEvent is an event pushed to an iterator
+type tailEvent struct {
+	seq  uint64
+	ev   interface{}
+	size int // encoded size
+}
+
+// WithTailLimits sets how far the iterators returned by Tail may fall behind the log, in
+// events and in bytes of encoded events, a zero limit being unlimited. The default is 10000
+// events. An iterator that falls further behind doesn't hold the log's memory hostage: the
+// log drops the events it holds for it and the iterator reads them from the log files, as
+// it does when it starts, before it switches to live events again. The log logs a warning
+// and Stats report the number of such catch-ups as TailCatchUps.
+func WithTailLimits(events, bytes int) LogOption {
+	return func(pl *pLog) { pl.tailEvents, pl.tailBytes = events, bytes }
+}
+
+// Tail returns an iterator over the events from sequence number fromSeq on, it reads
+// the events already persisted from the log files and then switches to the events output
+// since, which allows in-process consumers such as projections to catch up and then
+// remain current. The events include those of the snapshots written by rotations and
+// exclude the records persist writes for itself. The log must record sequence numbers,
+// see RecordSequenceNumbers, and its primary destination must be a file destination
+// without the directory-per-generation layout. An iterator that falls behind the log reads
+// the events it missed from the log files, see WithTailLimits, it fails if they have been
+// deleted in the meantime, e.g. by RetainUnderUsage. The log must be created by NewLog.
+func Tail(log Log, fromSeq uint64) (Iterator, error) {
+	pl, ok := log.(*pLog)
+	if !ok {
+		return nil, fmt.Errorf("Tail requires a log created by NewLog")
+	}
+	pl.Lock()
+	defer pl.Unlock()
+	if !pl.sequence {
+		return nil, fmt.Errorf("Tail requires RecordSequenceNumbers")
+	}
+	fd, ok := pl.priDest.(*fileDest)
+	if !ok {
+		return nil, fmt.Errorf("Tail requires a file destination")
+	}
+	if fromSeq > pl.seq {
+		return nil, fmt.Errorf("cannot tail from event %d, the next event is %d",
+			fromSeq, pl.seq)
+	}
+	ti := &tailIterator{pl: pl, want: fromSeq, live: pl.seq}
+	if fromSeq < pl.seq {
+		// the files are opened while holding the lock, before a rotation can remove them
+		if err := ti.openFiles(fd); err != nil {
+			ti.closeFiles()
+			return nil, err
+		}
+	}
+	if pl.tailCond == nil {
+		pl.tailCond = sync.NewCond(&pl.Mutex)
+	}
+	pl.tails = append(pl.tails, ti)
+	return ti, nil
+}
+
+// openFiles opens the log files holding the events from ti.want on
+func (ti *tailIterator) openFiles(fd *fileDest) error {
+	names, err := LogFiles(fd.basepath)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		f, err := os.Open(n)
+		if err != nil {
+			return err
+		}
+		m, err := ReplayMeta(f, ti.pl.codec)
+		if err == nil {
+			_, err = f.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("%s: %s", n, err.Error())
+		}
+		if m != nil && m.Seq <= ti.want {
+			// the event is in this file or a later one
+			ti.closeFiles()
+		}
+		ti.files = append(ti.files, f)
+	}
+	if len(ti.files) == 0 {
+		return fmt.Errorf("no log file holds event %d", ti.want)
+	}
+	if m, _ := ReplayMeta(ti.files[0], ti.pl.codec); m != nil && m.Seq > ti.want {
+		return fmt.Errorf("event %d is no longer in the log files, the oldest is %d",
+			ti.want, m.Seq)
+	}
+	if _, err := ti.files[0].Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	ti.dec = withSequence(ti.pl.codec.NewDecoder(ti.files[0]))
+	return nil
+}
+
+func (ti *tailIterator) closeFiles() {
+	for _, f := range ti.files {
+		f.Close()
+	}
+	ti.files = nil
+}
+
+func (ti *tailIterator) Next() (uint64, interface{}, error) {
+	for {
+		ti.mu.Lock()
+		if ti.done {
+			ti.mu.Unlock()
+			return 0, nil, io.EOF
+		}
+		ti.catchUp()
+		if ti.want < ti.live {
+			defer ti.mu.Unlock()
+			return ti.nextPersisted()
+		}
+		ti.mu.Unlock()
+		if seq, ev, ok, err := ti.nextLive(); ok {
+			return seq, ev, err
+		}
+	}
+}
+
+// nextLive returns the next event pushed by the log, ok is false if the iterator fell
+// behind and must catch up first
+func (ti *tailIterator) nextLive() (seq uint64, ev interface{}, ok bool, err error) {
+	pl := ti.pl
+	pl.Lock()
+	defer pl.Unlock()
+	for len(ti.queue) == 0 && ti.err == nil && !ti.behind {
+		pl.tailCond.Wait()
+	}
+	if ti.behind {
+		return 0, nil, false, nil
+	} else if len(ti.queue) == 0 {
+		return 0, nil, true, ti.err
+	}
+	te := ti.queue[0]
+	ti.queue = ti.queue[1:]
+	ti.bytes -= te.size
+	return te.seq, te.ev, true, nil
+}
+
+// catchUp switches an iterator that fell behind the log back to reading the log files,
+// from the first event it hasn't returned up to the events output from now on, must be
+// called while holding ti.mu, the iterator fails if the log files no longer hold them
+func (ti *tailIterator) catchUp() {
+	pl := ti.pl
+	pl.Lock()
+	defer pl.Unlock()
+	if !ti.behind {
+		return
+	}
+	ti.behind = false
+	if ti.want >= ti.live {
+		ti.want = ti.dropped // the iterator was returning live events
+	}
+	ti.live = pl.seq
+	ti.closeFiles()
+	// the files are opened while holding the lock, before a rotation can remove them
+	if err := ti.openFiles(pl.priDest.(*fileDest)); err != nil {
+		ti.closeFiles()
+		ti.want = ti.live // nothing left to read from the files
+		pl.untail(ti, fmt.Errorf("tail fell behind the log and cannot catch up: %s",
+			err.Error()))
+	}
+}
+
+// nextPersisted returns the next event from the log files
+func (ti *tailIterator) nextPersisted() (uint64, interface{}, error) {
+	for len(ti.files) > 0 {
+		ev, err := ti.dec.Decode()
+		if err == io.EOF {
+			ti.files[0].Close()
+			ti.files = ti.files[1:]
+			if len(ti.files) > 0 {
+				ti.dec = withSequence(ti.pl.codec.NewDecoder(ti.files[0]))
+			}
+			continue
+		} else if err != nil {
+			return 0, nil, err
+		}
+		if isInternal(ev) || ti.dec.last < ti.want {
+			continue
+		} else if ti.dec.last > ti.want {
+			return 0, nil, fmt.Errorf("sequence gap in the log files: expected event %d, "+
+				"found %d", ti.want, ti.dec.last)
+		}
+		ti.want++
+		if ti.want == ti.live {
+			ti.closeFiles()
+		}
+		return ti.dec.last, ev, nil
+	}
+	return 0, nil, fmt.Errorf("events %d to %d are missing from the log files", ti.want,
+		ti.live-1)
+}
+
+func (ti *tailIterator) Close() error {
+	ti.mu.Lock()
+	ti.done = true
+	ti.closeFiles()
+	ti.mu.Unlock()
+	pl := ti.pl
+	pl.Lock()
+	defer pl.Unlock()
+	pl.untail(ti, io.EOF)
+	ti.queue = nil
+	return nil
+}
+
+// SequenceRange returns the sequence number of the first event of the snapshot of the
+// current generation, from which Tail can always start, and that of the next event output.
+// The log must record sequence numbers, see RecordSequenceNumbers.
+func SequenceRange(log Log) (first, next uint64, err error) {
+	pl, ok := log.(*pLog)
+	if !ok {
+		return 0, 0, fmt.Errorf("SequenceRange requires a log created by NewLog")
+	}
+	pl.Lock()
+	defer pl.Unlock()
+	if !pl.sequence {
+		return 0, 0, fmt.Errorf("SequenceRange requires RecordSequenceNumbers")
+	}
+	return pl.genSeq, pl.seq, nil
+}
+
+// untail stops pushing events to an iterator, which fails with err once its queue is empty,
+// must be called while holding the pl.Lock()
+func (pl *pLog) untail(ti *tailIterator, err error) {
+	for i, t := range pl.tails {
+		if t == ti {
+			pl.tails = append(pl.tails[:i], pl.tails[i+1:]...)
+			break
+		}
+	}
+	if ti.err == nil {
+		ti.err = err
+	}
+	pl.tailCond.Broadcast()
+}
+
+// pushTails pushes an event whose encoded size is size to the iterators, dropping the
+// queue of those that fell too far behind, see WithTailLimits, must be called while
+// holding the pl.Lock()
+func (pl *pLog) pushTails(seq uint64, logEvent interface{}, size int) {
+	if isInternal(logEvent) {
+		return // like the records read from the log files
+	}
+	for _, ti := range pl.tails {
+		if ti.behind {
+			continue // the iterator reads the event from the log files when it catches up
+		}
+		ti.queue = append(ti.queue, tailEvent{seq: seq, ev: logEvent, size: size})
+		ti.bytes += size
+		if pl.tailEvents > 0 && len(ti.queue) > pl.tailEvents ||
+			pl.tailBytes > 0 && ti.bytes > pl.tailBytes {
+			pl.log.Warn("Tail fell behind the log, it reads the log files again",
+				"from", ti.queue[0].seq, "events", len(ti.queue), "bytes", ti.bytes)
+			ti.behind, ti.dropped = true, ti.queue[0].seq
+			ti.queue, ti.bytes = nil, 0
+			pl.tailCatchUps++
+		}
+	}
+	pl.tailCond.Broadcast()
+}
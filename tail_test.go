@@ -0,0 +1,232 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("Tail", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	newLog := func(opts ...LogOption) Log {
+		fd, err := NewFileDest(PT+"/tail", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{events: []interface{}{&logEv1{S: "a"}}}
+		pl, err := NewLog(fd, rc, log15.Root(), opts...)
+		Ω(err).ShouldNot(HaveOccurred())
+		return pl
+	}
+
+	next := func(it Iterator) (uint64, interface{}) {
+		seq, ev, err := it.Next()
+		Ω(err).ShouldNot(HaveOccurred())
+		return seq, ev
+	}
+
+	It("reads the persisted events and then the live ones", func() {
+		pl := newLog(RecordSequenceNumbers())
+		Ω(pl.Output(&logEv1{S: "b"})).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "c"})).ShouldNot(HaveOccurred())
+		it, err := Tail(pl, 1)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "d"})).ShouldNot(HaveOccurred())
+
+		seq, ev := next(it)
+		Ω(seq).Should(Equal(uint64(1)))
+		Ω(ev).Should(Equal(&logEv1{S: "b"}))
+		seq, ev = next(it)
+		Ω(seq).Should(Equal(uint64(2)))
+		Ω(ev).Should(Equal(&logEv1{S: "c"}))
+		seq, ev = next(it)
+		Ω(seq).Should(Equal(uint64(3)))
+		Ω(ev).Should(Equal(&logEv1{S: "d"}))
+
+		By("waiting for the next event")
+		go pl.Output(&logEv1{S: "e"})
+		seq, ev = next(it)
+		Ω(seq).Should(Equal(uint64(4)))
+		Ω(ev).Should(Equal(&logEv1{S: "e"}))
+		Ω(it.Close()).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+	})
+
+	It("reads across generations", func() {
+		pl := newLog(RecordSequenceNumbers())
+		Ω(pl.Output(&logEv1{S: "b"})).ShouldNot(HaveOccurred())
+		pl.(*pLog).Lock()
+		pl.(*pLog).rotate()
+		pl.(*pLog).Unlock()
+		Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(2.0))
+		Ω(pl.Output(&logEv1{S: "c"})).ShouldNot(HaveOccurred())
+
+		it, err := Tail(pl, 0)
+		Ω(err).ShouldNot(HaveOccurred())
+		var events []interface{}
+		for i := 0; i < 4; i++ {
+			seq, ev := next(it)
+			Ω(seq).Should(Equal(uint64(i)))
+			events = append(events, ev)
+		}
+		// the snapshot of the second generation holds a
+		Ω(events).Should(Equal([]interface{}{&logEv1{S: "a"}, &logEv1{S: "b"},
+			&logEv1{S: "a"}, &logEv1{S: "c"}}))
+		Ω(it.Close()).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+	})
+
+	It("reads the log files with the log's codec", func() {
+		reg := NewTypeRegistry()
+		Ω(reg.Register("test.ev1", &logEv1{})).ShouldNot(HaveOccurred())
+		codecs := map[string]LogOption{
+			"gob":        WithCodec(GobCodec),
+			"registry":   WithTypeRegistry(reg),
+			"json":       WithCodec(JSONCodec(reg)),
+			"compressed": WithCodec(CompressedCodec(GobCodec, flateCompressor{name: "flate"})),
+		}
+		for name, opt := range codecs {
+			By(name)
+			fd, err := NewFileDest(PT+"/"+name, true, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			rc := &recordingClient{events: []interface{}{&logEv1{S: "a"}}}
+			pl, err := NewLog(fd, rc, log15.Root(), RecordSequenceNumbers(), opt)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(pl.Output(&logEv1{S: "b"})).ShouldNot(HaveOccurred())
+			pl.(*pLog).Lock()
+			pl.(*pLog).rotate()
+			pl.(*pLog).Unlock()
+			Eventually(func() float64 { return pl.Stats()["Generation"] }).Should(Equal(2.0))
+			Ω(pl.Output(&logEv1{S: "c"})).ShouldNot(HaveOccurred())
+
+			it, err := Tail(pl, 0)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(pl.Output(&logEv1{S: "d"})).ShouldNot(HaveOccurred())
+			var events []interface{}
+			for i := 0; i < 5; i++ {
+				seq, ev := next(it)
+				Ω(seq).Should(Equal(uint64(i)))
+				events = append(events, ev)
+			}
+			Ω(events).Should(Equal([]interface{}{&logEv1{S: "a"}, &logEv1{S: "b"},
+				&logEv1{S: "a"}, &logEv1{S: "c"}, &logEv1{S: "d"}}))
+			Ω(it.Close()).ShouldNot(HaveOccurred())
+			pl.(*pLog).Close()
+		}
+	})
+
+	It("unblocks Next when the iterator is closed", func() {
+		pl := newLog(RecordSequenceNumbers())
+		it, err := Tail(pl, 1)
+		Ω(err).ShouldNot(HaveOccurred())
+		done := make(chan error)
+		go func() {
+			_, _, err := it.Next()
+			done <- err
+		}()
+		Consistently(done).ShouldNot(Receive())
+		Ω(it.Close()).ShouldNot(HaveOccurred())
+		Eventually(done).Should(Receive(Equal(io.EOF)))
+		pl.(*pLog).Close()
+	})
+
+	It("reads the log files again when the iterator falls behind", func() {
+		pl := newLog(RecordSequenceNumbers(), WithTailLimits(3, 0))
+		it, err := Tail(pl, 1)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv2{A: 1})).ShouldNot(HaveOccurred())
+		seq, ev := next(it)
+		Ω(seq).Should(Equal(uint64(1)))
+		Ω(ev).Should(Equal(&logEv2{A: 1}))
+
+		By("falling behind while returning live events")
+		for i := 2; i <= 6; i++ {
+			Ω(pl.Output(&logEv2{A: i})).ShouldNot(HaveOccurred())
+		}
+		Ω(pl.Stats()["TailCatchUps"]).Should(Equal(1.0))
+		for i := 2; i <= 4; i++ {
+			seq, ev = next(it)
+			Ω(seq).Should(Equal(uint64(i)))
+			Ω(ev).Should(Equal(&logEv2{A: i}))
+		}
+
+		By("falling behind while reading the log files")
+		for i := 7; i <= 11; i++ {
+			Ω(pl.Output(&logEv2{A: i})).ShouldNot(HaveOccurred())
+		}
+		Ω(pl.Stats()["TailCatchUps"]).Should(Equal(2.0))
+		for i := 5; i <= 11; i++ {
+			seq, ev = next(it)
+			Ω(seq).Should(Equal(uint64(i)))
+			Ω(ev).Should(Equal(&logEv2{A: i}))
+		}
+
+		By("switching to live events again")
+		go pl.Output(&logEv2{A: 12})
+		seq, ev = next(it)
+		Ω(seq).Should(Equal(uint64(12)))
+		Ω(ev).Should(Equal(&logEv2{A: 12}))
+		Ω(it.Close()).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+	})
+
+	It("limits the bytes an iterator falls behind", func() {
+		pl := newLog(RecordSequenceNumbers(), WithTailLimits(0, 200))
+		it, err := Tail(pl, 1)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: strings.Repeat("x", 100)})).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()["TailCatchUps"]).Should(Equal(0.0))
+		Ω(pl.Output(&logEv1{S: strings.Repeat("y", 100)})).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()["TailCatchUps"]).Should(Equal(1.0))
+		_, ev := next(it)
+		Ω(ev).Should(Equal(&logEv1{S: strings.Repeat("x", 100)}))
+		_, ev = next(it)
+		Ω(ev).Should(Equal(&logEv1{S: strings.Repeat("y", 100)}))
+		Ω(it.Close()).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+	})
+
+	It("fails an iterator that falls behind events no longer in the log files", func() {
+		pl := newLog(RecordSequenceNumbers(), WithTailLimits(1, 0))
+		it, err := Tail(pl, 1)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv2{A: 1})).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv2{A: 2})).ShouldNot(HaveOccurred())
+		names, err := LogFiles(PT + "/tail")
+		Ω(err).ShouldNot(HaveOccurred())
+		for _, n := range names {
+			Ω(os.Remove(n)).ShouldNot(HaveOccurred())
+		}
+		_, _, err = it.Next()
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("cannot catch up"))
+		Ω(it.Close()).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+	})
+
+	It("requires sequence numbers", func() {
+		pl := newLog()
+		_, err := Tail(pl, 0)
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("requires RecordSequenceNumbers"))
+
+		By("rejecting events that have not been output yet")
+		pl.(*pLog).Close()
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+		pl = newLog(RecordSequenceNumbers())
+		_, err = Tail(pl, 5)
+		Ω(err).Should(HaveOccurred())
+		pl.(*pLog).Close()
+	})
+})
@@ -0,0 +1,37 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import "time"
+
+// WithSnapshotRateLimit limits the rate at which rotations write their snapshot to the
+// primary destination, in bytes per second, such that a rotation doesn't saturate the
+// disk at the expense of the events the application outputs meanwhile. The outputs of
+// PersistAll are delayed, without holding the log's lock, while the snapshot is ahead of
+// the rate, allowing a burst of one second's worth. The initial snapshot written by NewLog
+// is not limited. Stats reports the limit as SnapshotRateLimit, SnapshotThrottled is 1
+// while the rotation in progress is being slowed, and SnapshotThrottleTime is the total
+// time outputs were delayed, in seconds.
+func WithSnapshotRateLimit(bytesPerSecond int) LogOption {
+	return runtimeOption(func(pl *pLog) { pl.snapRate = float64(bytesPerSecond) })
+}
+
+// throttleSnapshot delays the caller while the snapshot being written is ahead of the rate
+// limit, it must be called without holding the lock
+func (pl *pLog) throttleSnapshot() {
+	pl.Lock()
+	if pl.snapRate <= 0 || !pl.rotating || !pl.opened {
+		pl.Unlock()
+		return
+	}
+	allowed := pl.snapRate * (pl.now().Sub(pl.genStart).Seconds() + 1)
+	delay := time.Duration((float64(pl.snapBytes) - allowed) / pl.snapRate * 1e9)
+	if delay > 0 {
+		pl.throttling = true
+		pl.throttled += delay
+	}
+	pl.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
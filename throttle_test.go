@@ -0,0 +1,51 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("Snapshot rate limit", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	It("slows rotations down without delaying other outputs", func() {
+		rc := &recordingClient{}
+		for i := 0; i < 100; i++ {
+			rc.events = append(rc.events, &logEv1{S: strings.Repeat("x", 1000)})
+		}
+		fd, err := NewFileDest(PT+"/throttle", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, rc, log15.Root(), WithSnapshotRateLimit(50*1000))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()["SnapshotThrottleTime"]).Should(BeZero())
+		Ω(pl.Stats()["SnapshotRateLimit"]).Should(Equal(50000.0))
+
+		start := time.Now()
+		pl.(*pLog).Lock()
+		pl.(*pLog).rotate()
+		pl.(*pLog).Unlock()
+		Eventually(func() float64 { return pl.Stats()["SnapshotThrottled"] }).Should(Equal(1.0))
+		outStart := time.Now()
+		Ω(pl.Output(&logEv1{S: "live"})).ShouldNot(HaveOccurred())
+		Ω(time.Since(outStart)).Should(BeNumerically("<", 100*time.Millisecond))
+
+		// the throttle state is cleared when the rotation completes
+		Eventually(func() float64 { return pl.Stats()["SnapshotThrottled"] },
+			5*time.Second).Should(BeZero())
+		Ω(time.Since(start)).Should(BeNumerically(">", 800*time.Millisecond))
+		Ω(pl.Stats()["SnapshotThrottleTime"]).Should(BeNumerically(">", 0.5))
+		pl.(*pLog).Close()
+	})
+})
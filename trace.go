@@ -0,0 +1,117 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TraceEntry is an internal operation of a log recorded by WithTrace
+type TraceEntry struct {
+	Time   time.Time
+	Op     string // write, error, replay, or the kind of an internal event, e.g. recovery
+	Gen    uint64 // generation being written, or replayed for replay entries
+	Bytes  int    // bytes written to the primary destination, or replayed for replay entries
+	Detail string // details, e.g. the error
+}
+
+func (te TraceEntry) String() string {
+	s := fmt.Sprintf("%s gen=%d %s", te.Time.UTC().Format(time.RFC3339Nano), te.Gen, te.Op)
+	if te.Bytes > 0 {
+		s += fmt.Sprintf(" bytes=%d", te.Bytes)
+	}
+	if te.Detail != "" {
+		s += " " + te.Detail
+	}
+	return s
+}
+
+// WithTrace makes a log keep the last n of its internal operations in memory: the writes to
+// the primary destination, the streams replayed, the errors that put the log into error
+// state, and the milestones recorded by RecordInternalEvents, such as rotations, recovery,
+// and the failures of the secondary, whether or not that option is used. The trace helps
+// reconstruct what persist did leading up to an incident, see Trace and TraceHandler.
+func WithTrace(n int) LogOption {
+	return func(pl *pLog) {
+		if n > 0 {
+			pl.traced = &traceRing{entries: make([]TraceEntry, 0, n)}
+		}
+	}
+}
+
+// traceRing holds the most recent entries of a trace
+type traceRing struct {
+	entries []TraceEntry
+	next    int // index of the oldest entry once the ring is full
+}
+
+// trace records an operation if the log is traced, must be called while holding the
+// pl.Lock()
+func (pl *pLog) trace(op string, bytes int, detail string) {
+	tr := pl.traced
+	if tr == nil {
+		return
+	}
+	te := TraceEntry{Time: pl.now(), Op: op, Gen: pl.gen, Bytes: bytes, Detail: detail}
+	if len(tr.entries) < cap(tr.entries) {
+		tr.entries = append(tr.entries, te)
+		return
+	}
+	tr.entries[tr.next] = te
+	tr.next = (tr.next + 1) % len(tr.entries)
+}
+
+// Trace returns the operations recorded by a log created with WithTrace, oldest first. It
+// returns nil for other Logs.
+func Trace(log Log) []TraceEntry {
+	pl, ok := log.(*pLog)
+	if !ok {
+		return nil
+	}
+	pl.Lock()
+	defer pl.Unlock()
+	tr := pl.traced
+	if tr == nil {
+		return nil
+	}
+	return append(append([]TraceEntry(nil), tr.entries[tr.next:]...), tr.entries[:tr.next]...)
+}
+
+// DumpTrace writes the operations recorded by a log created with WithTrace to w, one per
+// line, oldest first
+func DumpTrace(log Log, w io.Writer) error {
+	var b strings.Builder
+	for _, te := range Trace(log) {
+		b.WriteString(te.String())
+		b.WriteByte('\n')
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// TraceHandler returns an HTTP handler that dumps the trace of a log, see DumpTrace, to
+// be mounted on an application's admin endpoint. It responds with 404 if the log isn't
+// traced.
+func TraceHandler(log Log) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if pl, ok := log.(*pLog); !ok || pl.traced == nil {
+			http.Error(w, "log is not traced", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		DumpTrace(log, w)
+	})
+}
+
+// noteDetail formats the attributes of an internal event for the trace
+func noteDetail(attrs []string) string {
+	var parts []string
+	for i := 0; i+1 < len(attrs); i += 2 {
+		parts = append(parts, attrs[i]+"="+attrs[i+1])
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("Trace", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	open := func(create bool, opts ...LogOption) Log {
+		fd, err := NewFileDest(PT+"/trace", create, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root(), opts...)
+		Ω(err).ShouldNot(HaveOccurred())
+		return pl
+	}
+
+	ops := func(pl Log) []string {
+		var ops []string
+		for _, te := range Trace(pl) {
+			ops = append(ops, te.Op)
+		}
+		return ops
+	}
+
+	It("records the operations in order", func() {
+		pl := open(true, WithTrace(100))
+		Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		pl.(*pLog).Lock()
+		pl.(*pLog).rotate()
+		pl.(*pLog).Unlock()
+		// NewLog's snapshot ends with a rotation-end as well
+		Eventually(func() int {
+			n := 0
+			for _, op := range ops(pl) {
+				if op == InternalRotationEnd {
+					n++
+				}
+			}
+			return n
+		}).Should(Equal(2))
+		trace := Trace(pl)
+		Ω(ops(pl)).Should(ContainElement(InternalRotationStart))
+		for i, te := range trace {
+			if te.Op == InternalRotationStart {
+				Ω(trace[i-1].Op).Should(Equal("write"))
+				Ω(trace[i-1].Gen).Should(Equal(uint64(1)))
+				Ω(trace[i+1].Op).Should(Equal("write"))
+				Ω(trace[i+1].Gen).Should(Equal(uint64(2)))
+				Ω(trace[i+1].Bytes).Should(BeNumerically(">", 0))
+			}
+			if i > 0 {
+				Ω(te.Time).ShouldNot(BeTemporally("<", trace[i-1].Time))
+			}
+		}
+		Ω(trace[len(trace)-1].Op).Should(Equal(InternalRotationEnd))
+		pl.(*pLog).Close()
+	})
+
+	It("keeps the last n operations", func() {
+		pl := open(true, WithTrace(3))
+		for _, s := range []string{"a", "b", "c", "d"} {
+			Ω(pl.Output(&logEv1{S: s})).ShouldNot(HaveOccurred())
+		}
+		Ω(ops(pl)).Should(Equal([]string{"write", "write", "write"}))
+		all := Trace(pl)
+		Ω(pl.Output(&logEv1{S: "e"})).ShouldNot(HaveOccurred())
+		Ω(Trace(pl)[:2]).Should(Equal(all[1:]))
+		pl.(*pLog).Close()
+	})
+
+	It("records the replay and errors", func() {
+		pl := open(true)
+		Ω(Trace(pl)).Should(BeNil())
+		Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		files, _ := LogFiles(PT + "/trace")
+		pl = open(false, WithTrace(100))
+		Ω(Trace(pl)[0].Op).Should(Equal("replay"))
+		Ω(Trace(pl)[0].Detail).Should(Equal(files[0] + " entries=1"))
+		pl.(*pLog).Lock()
+		pl.(*pLog).fail("write", os.ErrClosed)
+		pl.(*pLog).Unlock()
+		last := Trace(pl)[len(Trace(pl))-1]
+		Ω(last.Op).Should(Equal("error"))
+		Ω(last.Detail).Should(ContainSubstring(os.ErrClosed.Error()))
+		pl.(*pLog).Close()
+	})
+
+	It("dumps the trace over HTTP", func() {
+		pl := open(true, WithTrace(10))
+		Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		rec := httptest.NewRecorder()
+		TraceHandler(pl).ServeHTTP(rec, httptest.NewRequest("GET", "/trace", nil))
+		Ω(rec.Code).Should(Equal(http.StatusOK))
+		lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+		Ω(lines).Should(HaveLen(len(Trace(pl))))
+		Ω(lines[len(lines)-1]).Should(MatchRegexp(`^\S+ gen=1 write bytes=\d+$`))
+		pl.(*pLog).Close()
+
+		pl = open(false)
+		rec = httptest.NewRecorder()
+		TraceHandler(pl).ServeHTTP(rec, httptest.NewRequest("GET", "/trace", nil))
+		Ω(rec.Code).Should(Equal(http.StatusNotFound))
+		pl.(*pLog).Close()
+	})
+})
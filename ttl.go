@@ -0,0 +1,65 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// An ExpiringClient is a LogClient that tells persist which events of its snapshots have
+// expired, see WithTTL. ShouldPersist is called for each event of a type with a TTL that
+// PersistAll outputs and returns false if the resource it describes was last updated
+// before cutoff, which is the current time minus the TTL of the event's type. It's called
+// while holding the log's lock and must not call back into the log.
+type ExpiringClient interface {
+	LogClient
+	ShouldPersist(logEvent interface{}, cutoff time.Time) bool
+}
+
+// eventTTLs holds the TTL of event types, see WithTTL
+type eventTTLs map[reflect.Type]time.Duration
+
+// WithTTL sets the time-to-live of the types of the example events, which keeps ephemeral
+// state such as sessions or locks from accumulating in the log: the snapshots written by
+// rotations and secondary catch-ups omit the expired events of these types, as determined
+// by the client, which must implement ExpiringClient. Events output using OutputNS are
+// subject to the TTL of the event they wrap. Stats reports the number of events omitted
+// as ExpiredEvents. The client's state isn't affected, so it should drop expired resources
+// as well or they reappear in the log when they're updated.
+func WithTTL(ttl time.Duration, events ...interface{}) LogOption {
+	return func(pl *pLog) {
+		if pl.ttls == nil {
+			pl.ttls = make(eventTTLs)
+		}
+		for _, ev := range events {
+			pl.ttls[reflect.TypeOf(ev)] = ttl
+		}
+	}
+}
+
+// checkTTLs returns an error if TTLs are set but the client cannot tell what has expired
+func (pl *pLog) checkTTLs() error {
+	if _, ok := pl.client.(ExpiringClient); len(pl.ttls) > 0 && !ok {
+		return fmt.Errorf("WithTTL requires a client that implements ShouldPersist")
+	}
+	return nil
+}
+
+// isExpired returns true if a snapshot event has expired, see WithTTL
+func (pl *pLog) isExpired(logEvent interface{}) bool {
+	if len(pl.ttls) == 0 {
+		return false
+	}
+	_, ev := Namespace(logEvent)
+	ttl, ok := pl.ttls[reflect.TypeOf(ev)]
+	if !ok {
+		return false
+	}
+	if pl.client.(ExpiringClient).ShouldPersist(ev, pl.now().Add(-ttl)) {
+		return false
+	}
+	pl.expired++
+	return true
+}
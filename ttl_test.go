@@ -0,0 +1,85 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// ephemeral event type
+type sessionEv struct {
+	ID   string
+	Seen time.Time
+}
+
+func init() {
+	Register(&sessionEv{})
+}
+
+// sessionClient expires sessions that haven't been seen since the cutoff
+type sessionClient struct {
+	recordingClient
+	cutoffs []time.Time
+}
+
+func (sc *sessionClient) ShouldPersist(logEvent interface{}, cutoff time.Time) bool {
+	sc.cutoffs = append(sc.cutoffs, cutoff)
+	return logEvent.(*sessionEv).Seen.After(cutoff)
+}
+
+var _ = Describe("TTL", func() {
+
+	t0 := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	now := func() time.Time { return t0.Add(90 * time.Minute) }
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	It("omits expired events from snapshots", func() {
+		fd, err := NewFileDest(PT+"/ttl", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		sc := &sessionClient{recordingClient: recordingClient{events: []interface{}{
+			&logEv1{S: "kept"},
+			&sessionEv{ID: "old", Seen: t0},
+			&sessionEv{ID: "new", Seen: t0.Add(50 * time.Minute)},
+			&NamespacedEvent{NS: "t", Event: &sessionEv{ID: "old-ns", Seen: t0}},
+		}}}
+		pl, err := NewLog(fd, sc, log15.Root(), WithClock(now),
+			WithTTL(time.Hour, &sessionEv{}))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()["ExpiredEvents"]).Should(Equal(2.0))
+		Ω(sc.cutoffs).Should(HaveLen(3))
+		Ω(sc.cutoffs[0]).Should(Equal(t0.Add(30 * time.Minute)))
+
+		By("outputting expired events outside of snapshots")
+		Ω(pl.Output(&sessionEv{ID: "live", Seen: t0})).ShouldNot(HaveOccurred())
+		Ω(sc.cutoffs).Should(HaveLen(3))
+		pl.(*pLog).Close()
+
+		fd, err = NewFileDest(PT+"/ttl", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{}
+		pl, err = NewLog(fd, rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(rc.events).Should(Equal([]interface{}{&logEv1{S: "kept"},
+			&sessionEv{ID: "new", Seen: t0.Add(50 * time.Minute)},
+			&sessionEv{ID: "live", Seen: t0}}))
+		pl.(*pLog).Close()
+	})
+
+	It("requires a client that implements ShouldPersist", func() {
+		fd, err := NewFileDest(PT+"/ttl", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = NewLog(fd, &recordingClient{}, log15.Root(), WithTTL(time.Hour, &sessionEv{}))
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("requires a client that implements"))
+	})
+})
@@ -0,0 +1,186 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import "fmt"
+
+// A TxnWriter stages the events of a transaction, see Txn
+type TxnWriter interface {
+	// Output stages an event, it's written when the transaction commits
+	Output(logEvent interface{}) error
+}
+
+// TxnBegin starts the events of a transaction in a log, see Txn. Decoders strip it and
+// deliver the events that follow only once they reach the matching TxnCommit.
+type TxnBegin struct {
+	ID uint64 // identifies the transaction within the log
+}
+
+// TxnCommit ends the events of a transaction in a log, see TxnBegin
+type TxnCommit struct {
+	ID uint64
+}
+
+func init() {
+	Register(&TxnBegin{})
+	Register(&TxnCommit{})
+}
+
+// txnWriter holds the events staged by a transaction
+type txnWriter struct {
+	events []interface{}
+}
+
+func (tw *txnWriter) Output(logEvent interface{}) error {
+	tw.events = append(tw.events, logEvent)
+	return nil
+}
+
+// stageTxn calls fn and returns the events it staged
+func stageTxn(fn func(w TxnWriter) error) ([]interface{}, error) {
+	tw := &txnWriter{}
+	if err := fn(tw); err != nil {
+		return nil, err
+	}
+	return tw.events, nil
+}
+
+// Txn outputs the events fn stages using the TxnWriter as one atomic unit: replay delivers
+// all of them or none, even if the process crashes while writing them, and no other event
+// is written between them. If fn returns an error nothing is written and Txn returns the
+// error. The log must be created by NewLog, or be the Log passed to PersistAll. A
+// generation with transactions records format version 6, which versions of persist that
+// predate Txn refuse to replay, see FormatVersion.
+func Txn(log Log, fn func(w TxnWriter) error) error {
+	tl, ok := log.(txnLog)
+	if !ok {
+		return fmt.Errorf("Txn requires a log created by NewLog")
+	}
+	return tl.txn(fn)
+}
+
+// txnLog is implemented by the logs that support transactions, i.e. those created by
+// NewLog and those they pass to PersistAll
+type txnLog interface {
+	txn(fn func(w TxnWriter) error) error
+}
+
+// txn outputs the events staged by fn as one atomic unit
+func (pl *pLog) txn(fn func(w TxnWriter) error) error {
+	events, err := stageTxn(fn)
+	if err != nil {
+		return err
+	}
+	return pl.outputTxn(events, false)
+}
+
+// outputTxn writes the events of a transaction between a TxnBegin and a TxnCommit such
+// that no other event comes between them. A snapshot is only used once complete, so its
+// transactions need no markers, nor do transactions of a single event.
+func (pl *pLog) outputTxn(events []interface{}, snapshot bool) error {
+	pl.Lock()
+	defer pl.Unlock()
+	if err := pl.checkState(); err != nil {
+		return err
+	}
+	if err := pl.flushShards(); err != nil {
+		return err
+	}
+	if !snapshot && pl.opened {
+		if err := pl.flushHeld(nil); err != nil {
+			return err
+		}
+		pl.dups.reset()
+	}
+	// a restated metadata record cannot come between the markers
+	for _, ev := range events {
+		if err := pl.useFormat(eventFormat(ev)); err != nil {
+			return err
+		}
+	}
+	marked := len(events) > 1 && !snapshot && pl.opened
+	if marked {
+		if err := pl.useFormat(formatTxn); err != nil {
+			return err
+		}
+		pl.txns++
+		if err := pl.encodeMarker(&TxnBegin{ID: pl.txns}); err != nil {
+			return err
+		}
+	}
+	for _, ev := range events {
+		if err := pl.encodeEvent(nil, ev, snapshot); err != nil {
+			return err
+		}
+	}
+	if marked {
+		if err := pl.encodeMarker(&TxnCommit{ID: pl.txns}); err != nil {
+			return err
+		}
+	}
+	pl.outputDone()
+	return nil
+}
+
+// encodeMarker encodes a record that delimits events into the primary's stream and the
+// secondary's own stream, must be called while holding the pl.Lock()
+func (pl *pLog) encodeMarker(marker interface{}) error {
+	if err := pl.encoder.Encode(marker); err != nil {
+		return pl.fail("encode", err)
+	}
+	if pl.secEnc != nil && pl.secSynced && !pl.secCaps.SnapshotOnly {
+		if err := pl.secEnc.Encode(marker); err != nil {
+			pl.secondaryError("Write", err)
+		}
+	}
+	return nil
+}
+
+// txn outputs the events of a transaction that's part of the snapshot
+func (sl snapshotLog) txn(fn func(w TxnWriter) error) error {
+	events, err := stageTxn(fn)
+	if err != nil {
+		return err
+	}
+	err = sl.pLog.outputTxn(events, true)
+	sl.pLog.throttleSnapshot()
+	return err
+}
+
+// txn outputs the events of a transaction that's part of the catch-up snapshot
+func (cl catchUpLog) txn(fn func(w TxnWriter) error) error {
+	events, err := stageTxn(fn)
+	if err != nil {
+		return err
+	}
+	for _, ev := range events {
+		if err := cl.Output(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeTxns holds back the events of transactions until their commit, it's called by
+// seqDecoder.Decode for each entry and returns true if the entry is held back. The events
+// of a transaction cut short by the end of the stream are never delivered.
+func (sd *seqDecoder) decodeTxns(ev interface{}) (bool, error) {
+	switch e := ev.(type) {
+	case *TxnBegin:
+		// a transaction without commit can only be followed by the end of the stream,
+		// it's dropped regardless
+		sd.txn, sd.held = e, nil
+	case *TxnCommit:
+		if sd.txn == nil || sd.txn.ID != e.ID {
+			return true, fmt.Errorf("commit of transaction %d without its beginning "+
+				"in generation %d", e.ID, sd.gen())
+		}
+		sd.done, sd.txn, sd.held = sd.held, nil, nil
+	default:
+		if sd.txn == nil {
+			return false, nil
+		}
+		sd.held = append(sd.held, &SequencedEvent{Seq: sd.next - 1, Event: ev})
+	}
+	return true, nil
+}
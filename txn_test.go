@@ -0,0 +1,125 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// poisonDest fails the writes that contain the poison, like a crash in the middle of a
+// transaction
+type poisonDest struct {
+	LogDestination
+	poison string
+}
+
+func (pd *poisonDest) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte(pd.poison)) {
+		return 0, fmt.Errorf("poisoned")
+	}
+	return pd.LogDestination.Write(p)
+}
+
+var _ = Describe("Txn", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	reopen := func() []interface{} {
+		fd, err := NewFileDest(PT+"/txn", false, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{}
+		pl, err := NewLog(fd, rc, log15.Root(), RecordSequenceNumbers())
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+		return rc.events
+	}
+
+	It("replays the events of a transaction", func() {
+		fd, err := NewFileDest(PT+"/txn", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root(), RecordSequenceNumbers())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		err = Txn(pl, func(w TxnWriter) error {
+			w.Output(&logEv1{S: "b"})
+			w.Output(&logEv2{A: 1})
+			return nil
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(Txn(pl, func(w TxnWriter) error { return w.Output(&logEv1{S: "c"}) })).
+			ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "d"})).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+
+		Ω(reopen()).Should(Equal([]interface{}{&logEv1{S: "a"}, &logEv1{S: "b"},
+			&logEv2{A: 1}, &logEv1{S: "c"}, &logEv1{S: "d"}}))
+	})
+
+	It("writes nothing when the transaction fails", func() {
+		fd, err := NewFileDest(PT+"/txn", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		size := pl.Stats()["LogSize"]
+		err = Txn(pl, func(w TxnWriter) error {
+			w.Output(&logEv1{S: "a"})
+			return fmt.Errorf("conflict")
+		})
+		Ω(err).Should(MatchError("conflict"))
+		Ω(pl.Stats()["LogSize"]).Should(Equal(size))
+		pl.(*pLog).Close()
+	})
+
+	It("drops a transaction cut short by a crash", func() {
+		fd, err := NewFileDest(PT+"/txn", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pd := &poisonDest{LogDestination: fd, poison: "crash"}
+		pl, err := NewLog(pd, &recordingClient{}, log15.Root(), RecordSequenceNumbers())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		err = Txn(pl, func(w TxnWriter) error {
+			w.Output(&logEv1{S: "b"})
+			w.Output(&logEv1{S: "crash"})
+			w.Output(&logEv1{S: "c"})
+			return nil
+		})
+		Ω(err).Should(HaveOccurred())
+		pl.(*pLog).Close()
+
+		Ω(reopen()).Should(Equal([]interface{}{&logEv1{S: "a"}}))
+	})
+
+	It("holds back the events of a transaction until it commits", func() {
+		var buf bytes.Buffer
+		enc := GobCodec.NewEncoder(&buf)
+		dec := GobCodec.NewDecoder(&buf)
+		Ω(enc.Encode(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		Ω(enc.Encode(&TxnBegin{ID: 1})).ShouldNot(HaveOccurred())
+		Ω(enc.Encode(&logEv1{S: "b"})).ShouldNot(HaveOccurred())
+		Ω(dec.Decode()).Should(Equal(&logEv1{S: "a"}))
+		_, err := dec.Decode()
+		Ω(err).Should(MatchError("EOF"))
+
+		By("resuming once the rest of the transaction is written")
+		Ω(enc.Encode(&logEv1{S: "c"})).ShouldNot(HaveOccurred())
+		Ω(enc.Encode(&TxnCommit{ID: 1})).ShouldNot(HaveOccurred())
+		Ω(dec.Decode()).Should(Equal(&logEv1{S: "b"}))
+		Ω(dec.Decode()).Should(Equal(&logEv1{S: "c"}))
+
+		By("rejecting a commit without its beginning")
+		Ω(enc.Encode(&TxnCommit{ID: 2})).ShouldNot(HaveOccurred())
+		_, err = dec.Decode()
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("without its beginning"))
+	})
+})
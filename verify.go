@@ -0,0 +1,201 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// checksumExt is the extension of the files holding the checksum of log files, see fileSum
+const checksumExt = ".sha256"
+
+// VerifyHook is called by a Verifier for each corrupt log file it finds
+type VerifyHook func(file string, err error)
+
+// A Verifier periodically verifies the checksums of the log files of a log set in order to
+// detect bit rot before a replay needs the data. A file destination records the checksum of
+// each log file in a .sha256 file next to it as it rotates: the checksum of the snapshot
+// when the file becomes the -curr file that a replay reads, and the checksum of the whole
+// file once it's superseded and becomes an -old file. The events appended to the -curr
+// file after its snapshot are thus only covered once the log rotates again. Files without
+// a recorded checksum, such as the -new file of a rotation in progress, are not verified.
+type Verifier struct {
+	basepath string
+	interval time.Duration
+	hook     VerifyHook
+	log      log15.Logger
+	stop     chan struct{}
+	done     chan struct{}
+	mu       sync.Mutex
+	runs     int
+	files    int // files verified in the last run
+	corrupt  int // corrupt files found in the last run
+}
+
+// NewVerifier returns a verifier for the log set at basepath that runs every interval once
+// started, hook may be nil
+func NewVerifier(basepath string, interval time.Duration, hook VerifyHook,
+	log log15.Logger) *Verifier {
+
+	if log == nil {
+		log = log15.Root()
+	}
+	return &Verifier{basepath: basepath, interval: interval, hook: hook,
+		log: log.New("basepath", basepath, "verifier", true)}
+}
+
+// Start runs the verifier in the background until Stop is called
+func (v *Verifier) Start() {
+	v.stop = make(chan struct{})
+	v.done = make(chan struct{})
+	go func() {
+		defer close(v.done)
+		t := time.NewTicker(v.interval)
+		defer t.Stop()
+		for {
+			if _, err := v.VerifyOnce(); err != nil {
+				v.log.Error("Log verification failed", "err", err)
+			}
+			select {
+			case <-t.C:
+			case <-v.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops a started verifier and waits for it to finish
+func (v *Verifier) Stop() {
+	close(v.stop)
+	<-v.done
+}
+
+// VerifyOnce verifies the log files that have a recorded checksum and returns the number
+// of files checked, it returns an error if any file is corrupt
+func (v *Verifier) VerifyOnce() (int, error) {
+	files, err := LogFiles(v.basepath)
+	if err != nil {
+		return 0, err
+	}
+	checked, corrupt := 0, 0
+	var firstErr error
+	for _, f := range files {
+		if _, err := os.Stat(f + checksumExt); err != nil {
+			continue
+		}
+		checked++
+		if err := verifyChecksum(f); err != nil {
+			corrupt++
+			v.log.Crit("Corrupt log file", "file", f, "err", err)
+			if v.hook != nil {
+				v.hook(f, err)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	v.mu.Lock()
+	v.runs++
+	v.files = checked
+	v.corrupt = corrupt
+	v.mu.Unlock()
+	if firstErr != nil {
+		return checked, fmt.Errorf("%d corrupt log files, first: %s", corrupt,
+			firstErr.Error())
+	}
+	return checked, nil
+}
+
+// Stats returns statistics about the verification as name->value
+func (v *Verifier) Stats() map[string]float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return map[string]float64{
+		"VerifyRuns":         float64(v.runs),
+		"VerifyFiles":        float64(v.files),
+		"VerifyCorruptFiles": float64(v.corrupt),
+	}
+}
+
+// verifyChecksum compares the checksum of a file with the one recorded for it, which
+// covers the number of bytes recorded with it, or the whole file if there is none
+func verifyChecksum(name string) error {
+	recorded, err := ioutil.ReadFile(name + checksumExt)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(recorded))
+	if len(fields) == 0 || len(fields) > 2 {
+		return fmt.Errorf("%s: invalid checksum record", name+checksumExt)
+	}
+	expected, size := fields[0], int64(-1)
+	if len(fields) == 2 {
+		if size, err = strconv.ParseInt(fields[1], 10, 64); err != nil || size < 0 {
+			return fmt.Errorf("%s: invalid checksum record", name+checksumExt)
+		}
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if size >= 0 {
+		r = io.LimitReader(f, size)
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && n < size {
+		return fmt.Errorf("%s: checksum mismatch, the file has %d of the %d bytes recorded",
+			name, n, size)
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); expected != actual {
+		return fmt.Errorf("%s: checksum mismatch, expected %s got %s", name, expected,
+			actual)
+	}
+	return nil
+}
+
+// fileSum is the running checksum of the data a file destination writes to a log file,
+// it's recorded for the verifier as the file rotates, see Verifier
+type fileSum struct {
+	h hash.Hash
+	n int64 // bytes written
+}
+
+func newFileSum() *fileSum {
+	return &fileSum{h: sha256.New()}
+}
+
+func (fs *fileSum) write(p []byte) {
+	fs.h.Write(p)
+	fs.n += int64(len(p))
+}
+
+// record records the checksum of the data written so far to the log file name, through a
+// temporary file such that a verifier never reads a partial record
+func (fs *fileSum) record(name string) error {
+	rec := fmt.Sprintf("%s %d\n", hex.EncodeToString(fs.h.Sum(nil)), fs.n)
+	tmp := name + checksumExt + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(rec), 0660); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name+checksumExt)
+}
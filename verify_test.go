@@ -0,0 +1,112 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("Verifier", func() {
+
+	var files []string
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+
+		// two generations, the checksums get recorded as the log rotates
+		fd, err := NewFileDest(PT+"/v", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		rc := &recordingClient{events: []interface{}{&logEv1{S: "a"}, &logEv1{S: "b"}}}
+		pl, err := NewLog(fd, rc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		pl.SetSizeLimit(10)
+		Ω(pl.Output(&logEv1{S: "c"})).ShouldNot(HaveOccurred())
+		Eventually(func() bool {
+			pl.(*pLog).Lock()
+			defer pl.(*pLog).Unlock()
+			return pl.(*pLog).gen == 2 && !pl.(*pLog).rotating
+		}).Should(BeTrue())
+		pl.(*pLog).Close()
+		files, err = LogFiles(PT + "/v")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(files).Should(HaveLen(2))
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	// corrupt flips a bit of a log file
+	corrupt := func(f string, off int) {
+		data, err := ioutil.ReadFile(f)
+		Ω(err).ShouldNot(HaveOccurred())
+		data[off] ^= 0x10
+		Ω(ioutil.WriteFile(f, data, 0660)).ShouldNot(HaveOccurred())
+	}
+
+	It("detects corrupt files", func() {
+		var found []string
+		v := NewVerifier(PT+"/v", time.Hour, func(file string, err error) {
+			found = append(found, file)
+		}, nil)
+		n, err := v.VerifyOnce()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(n).Should(Equal(2))
+		Ω(files[0]).Should(HaveSuffix(oldExt))
+
+		By("flipping a bit")
+		corrupt(files[0], 3)
+		n, err = v.VerifyOnce()
+		Ω(err).Should(HaveOccurred())
+		Ω(n).Should(Equal(2))
+		Ω(found).Should(Equal([]string{files[0]}))
+		Ω(v.Stats()["VerifyCorruptFiles"]).Should(Equal(1.0))
+		Ω(v.Stats()["VerifyRuns"]).Should(Equal(2.0))
+	})
+
+	It("verifies the snapshot of the current file", func() {
+		v := NewVerifier(PT+"/v", time.Hour, nil, nil)
+		Ω(files[1]).Should(HaveSuffix(currExt))
+
+		By("appending events to the current file")
+		f, err := os.OpenFile(files[1], os.O_WRONLY|os.O_APPEND, 0)
+		Ω(err).ShouldNot(HaveOccurred())
+		_, err = f.Write([]byte("more events"))
+		Ω(err).ShouldNot(HaveOccurred())
+		f.Close()
+		_, err = v.VerifyOnce()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		By("flipping a bit of the snapshot")
+		corrupt(files[1], 3)
+		_, err = v.VerifyOnce()
+		Ω(err).Should(MatchError(ContainSubstring(files[1] + ": checksum mismatch")))
+		Ω(v.Stats()["VerifyCorruptFiles"]).Should(Equal(1.0))
+
+		By("truncating the file")
+		Ω(os.Truncate(files[1], 5)).ShouldNot(HaveOccurred())
+		_, err = v.VerifyOnce()
+		Ω(err).Should(MatchError(ContainSubstring("the file has 5 of the")))
+	})
+
+	It("skips files without a recorded checksum", func() {
+		Ω(os.Remove(files[1] + checksumExt)).ShouldNot(HaveOccurred())
+		corrupt(files[1], 3)
+		n, err := NewVerifier(PT+"/v", time.Hour, nil, nil).VerifyOnce()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(n).Should(Equal(1))
+	})
+
+	It("runs in the background", func() {
+		v := NewVerifier(PT+"/v", time.Millisecond, nil, nil)
+		v.Start()
+		Eventually(func() float64 { return v.Stats()["VerifyRuns"] }).Should(
+			BeNumerically(">=", 2))
+		v.Stop()
+		Ω(v.Stats()["VerifyFiles"]).Should(Equal(2.0))
+	})
+})
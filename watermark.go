@@ -0,0 +1,98 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// spaceCheckInterval is the minimum time between two checks of the free space
+const spaceCheckInterval = 10 * time.Second
+
+// watermark levels of the free space, see FreeSpaceWatermarks
+const (
+	spaceOK       = 0
+	spaceWarning  = 1
+	spaceCritical = 2
+)
+
+// FreeSpaceWatermarks makes a file destination monitor the free space of the filesystem
+// holding the log, checking it at most every 10 seconds while writing. When the free
+// fraction drops below warning, e.g. 0.1 for 10%, a warning is logged and the log's Stats
+// report PrimaryHealthWarning. When it drops below critical the log's HealthCheck returns an
+// error as well, such that the application can shed load before writes start failing,
+// events are still written though. Stats also report PrimaryFreeSpace, the free fraction,
+// and PrimaryFreeSpaceLevel, which is 0 above both watermarks, 1 below warning, and 2 below
+// critical.
+func FreeSpaceWatermarks(warning, critical float64) FileDestOption {
+	if critical > warning {
+		critical = warning
+	}
+	return runtimeFileOption(func(fd *fileDest) {
+		fd.spaceWarn = warning
+		fd.spaceCrit = critical
+		fd.spaceUsage = diskUsage
+	})
+}
+
+// spaceMonitor is implemented by destinations that monitor the free space of their
+// filesystem, see FreeSpaceWatermarks
+type spaceMonitor interface {
+	// freeSpace returns the free fraction found by the last check and its watermark level,
+	// ok is false if the free space isn't monitored
+	freeSpace() (free float64, level int, ok bool)
+	// spaceError describes the watermark level, nil if the free space is above both
+	spaceError() error
+}
+
+func (fd *fileDest) freeSpace() (float64, int, bool) {
+	return fd.spaceFree, fd.spaceLevel, fd.spaceUsage != nil
+}
+
+// checkSpace determines the watermark level of the free space, unless it was checked
+// recently, and logs changes of level
+func (fd *fileDest) checkSpace() {
+	if fd.spaceUsage == nil || time.Since(fd.spaceChecked) < spaceCheckInterval {
+		return
+	}
+	fd.spaceChecked = time.Now()
+	usage, err := fd.spaceUsage(filepath.Dir(fd.basepath))
+	if err != nil {
+		fd.log.Warn("Cannot determine disk usage", "err", err)
+		return
+	}
+	fd.spaceFree = 1 - usage
+	level := spaceOK
+	switch {
+	case fd.spaceFree < fd.spaceCrit:
+		level = spaceCritical
+	case fd.spaceFree < fd.spaceWarn:
+		level = spaceWarning
+	}
+	if level == fd.spaceLevel {
+		return
+	}
+	fd.spaceLevel = level
+	switch level {
+	case spaceCritical:
+		fd.log.Error("Free disk space below critical watermark", "err", fd.spaceError())
+	case spaceWarning:
+		fd.log.Warn("Free disk space below warning watermark", "err", fd.spaceError())
+	default:
+		fd.log.Info("Free disk space back above watermarks", "free", fd.spaceFree)
+	}
+}
+
+func (fd *fileDest) spaceError() error {
+	switch fd.spaceLevel {
+	case spaceCritical:
+		return fmt.Errorf("free disk space is %.1f%%, below the %.1f%% critical watermark",
+			fd.spaceFree*100, fd.spaceCrit*100)
+	case spaceWarning:
+		return fmt.Errorf("free disk space is %.1f%%, below the %.1f%% warning watermark",
+			fd.spaceFree*100, fd.spaceWarn*100)
+	}
+	return nil
+}
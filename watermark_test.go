@@ -0,0 +1,73 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("FreeSpaceWatermarks", func() {
+
+	BeforeEach(func() {
+		os.RemoveAll(PT)
+		os.Mkdir(PT, 0777)
+	})
+	AfterEach(func() { os.RemoveAll(PT) })
+
+	It("reports the watermark levels in Stats and HealthCheck", func() {
+		fd, err := NewFileDest(PT+"/wm", true, nil, FreeSpaceWatermarks(0.2, 0.05))
+		Ω(err).ShouldNot(HaveOccurred())
+		usage := 0.5
+		fd.(*fileDest).spaceUsage = func(string) (float64, error) { return usage, nil }
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		// output an event after the check interval has passed
+		output := func(u float64) {
+			pl.(*pLog).Lock()
+			usage = u
+			fd.(*fileDest).spaceChecked = time.Time{}
+			pl.(*pLog).Unlock()
+			Ω(pl.Output(&logEv1{S: "a"})).ShouldNot(HaveOccurred())
+		}
+
+		Ω(pl.Stats()["PrimaryFreeSpace"]).Should(Equal(0.5))
+		Ω(pl.Stats()["PrimaryFreeSpaceLevel"]).Should(Equal(0.0))
+		Ω(pl.Stats()["PrimaryHealthWarning"]).Should(Equal(0.0))
+
+		output(0.9)
+		Ω(pl.Stats()["PrimaryFreeSpaceLevel"]).Should(Equal(1.0))
+		Ω(pl.Stats()["PrimaryHealthWarning"]).Should(Equal(1.0))
+		Ω(pl.HealthCheck()).ShouldNot(HaveOccurred())
+
+		output(0.97)
+		Ω(pl.Stats()["PrimaryFreeSpaceLevel"]).Should(Equal(2.0))
+		Ω(pl.HealthCheck()).Should(MatchError(ContainSubstring("critical watermark")))
+
+		// the level isn't checked again before the interval has passed
+		pl.(*pLog).Lock()
+		usage = 0.1
+		pl.(*pLog).Unlock()
+		Ω(pl.Output(&logEv1{S: "b"})).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()["PrimaryFreeSpaceLevel"]).Should(Equal(2.0))
+
+		output(0.1)
+		Ω(pl.Stats()["PrimaryFreeSpaceLevel"]).Should(Equal(0.0))
+		Ω(pl.HealthCheck()).ShouldNot(HaveOccurred())
+		pl.(*pLog).Close()
+	})
+
+	It("doesn't report the free space without watermarks", func() {
+		fd, err := NewFileDest(PT+"/wm", true, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+		pl, err := NewLog(fd, &recordingClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(pl.Stats()).ShouldNot(HaveKey("PrimaryFreeSpace"))
+		pl.(*pLog).Close()
+	})
+})
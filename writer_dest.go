@@ -0,0 +1,47 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"fmt"
+	"io"
+)
+
+type writerDest struct {
+	w      io.Writer
+	replay []io.ReadCloser
+}
+
+// NewWriterDest turns any io.Writer, such as a pipe to another process, a net.Conn, or a
+// test buffer, into a log destination. The optional replay readers are returned by
+// ReplayReaders and are replayed in sequence by NewLog. A writer cannot start a fresh
+// stream, so the destination cannot rotate: as primary destination the log never rotates
+// and as secondary it stops receiving events at the first rotation. Close closes the
+// writer if it implements io.Closer.
+func NewWriterDest(w io.Writer, replay []io.ReadCloser) LogDestination {
+	return &writerDest{w: w, replay: replay}
+}
+
+func (wd *writerDest) Write(p []byte) (int, error) { return wd.w.Write(p) }
+
+func (wd *writerDest) ReplayReaders() []io.ReadCloser { return wd.replay }
+
+func (wd *writerDest) Capabilities() Capabilities {
+	return Capabilities{CanReplay: wd.replay != nil}
+}
+
+func (wd *writerDest) StartRotate() error {
+	return fmt.Errorf("writer destination cannot rotate")
+}
+
+func (wd *writerDest) EndRotate() error { return nil }
+
+func (wd *writerDest) Close() {
+	for _, rr := range wd.replay {
+		rr.Close()
+	}
+	wd.replay = nil
+	if c, ok := wd.w.(io.Closer); ok {
+		c.Close()
+	}
+}
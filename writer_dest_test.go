@@ -0,0 +1,35 @@
+// Copyright (c) 2015 RightScale, Inc. - see LICENSE
+
+package persist
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var _ = Describe("WriterDest", func() {
+
+	It("writes to a buffer and replays from it", func() {
+		var buf bytes.Buffer
+		pl, err := NewLog(NewWriterDest(&buf, nil), &testLogClient{}, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		// the log must not rotate even though it's over the size limit
+		pl.SetSizeLimit(10)
+		Ω(pl.Output(&logEv1{S: "extra"})).ShouldNot(HaveOccurred())
+		Ω(pl.(*pLog).rotating).Should(BeFalse())
+		pl.(*pLog).Close()
+
+		rd := NewWriterDest(ioutil.Discard,
+			[]io.ReadCloser{ioutil.NopCloser(bytes.NewReader(buf.Bytes()))})
+		lc := &testLogClient{i: 1}
+		pl, err = NewLog(rd, lc, log15.Root())
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(lc.n).Should(Equal(4))
+		pl.(*pLog).Close()
+	})
+})